@@ -20,7 +20,10 @@ use facilitator::{
         SpecificManifest,
     },
     sample::{generate_ingestion_sample, SampleOutput},
-    task::{AggregationTask, AwsSqsTaskQueue, GcpPubSubTaskQueue, IntakeBatchTask, TaskQueue},
+    task::{
+        read_batches_object, AggregationTask, AwsSqsTaskQueue, Batch, GcpPubSubTaskQueue,
+        IntakeBatchTask, TaskQueue,
+    },
     transport::{
         GCSTransport, LocalFileTransport, S3Transport, SignableTransport, Transport,
         VerifiableAndDecryptableTransport, VerifiableTransport,
@@ -866,6 +869,7 @@ fn aggregate(
     start: &str,
     end: &str,
     batches: Vec<(&str, &str)>,
+    batches_object: Option<&str>,
     sub_matches: &ArgMatches,
 ) -> Result<()> {
     let instance_name = sub_matches.value_of("instance-name").unwrap();
@@ -877,9 +881,16 @@ fn aggregate(
     // shares, so it is simply provided by argument.
     let own_validation_bucket = StoragePath::from_str(sub_matches.value_of("own-input").unwrap())?;
     let own_identity = sub_matches.value_of("own-identity");
-    let own_validation_transport =
+    let mut own_validation_transport =
         transport_for_path(own_validation_bucket, own_identity, sub_matches)?;
 
+    // Aggregations with too many batches to fit into a task queue message
+    // list them in an object in our own validation bucket instead.
+    let listed_batches: Vec<Batch> = match batches_object {
+        Some(key) => read_batches_object(own_validation_transport.as_mut(), key)?,
+        None => Vec::new(),
+    };
+
     // To read our own validation shares, we require our own public keys which
     // we discover in our own specific manifest. If no manifest is provided, use
     // the public portion of the provided batch signing private key.
@@ -976,10 +987,10 @@ fn aggregate(
 
     let mut parsed_batches: Vec<(Uuid, NaiveDateTime)> = Vec::new();
     for raw_batch in batches.iter() {
-        let uuid = Uuid::parse_str(raw_batch.0).context("batch ID is not a UUID")?;
-        let date = NaiveDateTime::parse_from_str(raw_batch.1, DATE_FORMAT)
-            .context("batch date is not in expected format")?;
-        parsed_batches.push((uuid, date));
+        parsed_batches.push(parse_batch(raw_batch.0, raw_batch.1)?);
+    }
+    for batch in listed_batches.iter() {
+        parsed_batches.push(parse_batch(&batch.id, &batch.time)?);
     }
 
     let mut aggregator = BatchAggregator::new(
@@ -997,6 +1008,13 @@ fn aggregate(
     aggregator.generate_sum_part(&parsed_batches)
 }
 
+fn parse_batch(id: &str, time: &str) -> Result<(Uuid, NaiveDateTime)> {
+    let uuid = Uuid::parse_str(id).context("batch ID is not a UUID")?;
+    let date = NaiveDateTime::parse_from_str(time, DATE_FORMAT)
+        .context("batch date is not in expected format")?;
+    Ok((uuid, date))
+}
+
 fn aggregate_subcommand(sub_matches: &ArgMatches) -> Result<(), anyhow::Error> {
     let batch_ids: Vec<&str> = sub_matches
         .values_of("batch-id")
@@ -1019,6 +1037,7 @@ fn aggregate_subcommand(sub_matches: &ArgMatches) -> Result<(), anyhow::Error> {
         sub_matches.value_of("aggregation-start").unwrap(),
         sub_matches.value_of("aggregation-end").unwrap(),
         batch_info,
+        None,
         sub_matches,
     )
 }
@@ -1054,6 +1073,7 @@ fn aggregate_worker(sub_matches: &ArgMatches) -> Result<(), anyhow::Error> {
                 &task_handle.task.aggregation_start,
                 &task_handle.task.aggregation_end,
                 batches,
+                task_handle.task.batches_object.as_deref(),
                 sub_matches,
             );
 
@@ -1,7 +1,8 @@
 mod pubsub;
 mod sqs;
 
-use anyhow::Result;
+use crate::transport::Transport;
+use anyhow::{Context, Result};
 use serde::Deserialize;
 use std::{
     fmt,
@@ -71,8 +72,18 @@ pub struct AggregationTask {
     /// The end of the range of time covered by the aggregation in UTC, with
     /// minute precision, formatted like "2006/01/02/15/04"
     pub aggregation_end: String,
-    // The list of batches aggregated by this task
+    // The list of batches aggregated by this task. workflow-manager leaves it
+    // out of tasks that have a batches object, so that facilitators that don't
+    // know about batches objects fail to parse them rather than aggregating no
+    // batches.
+    #[serde(default)]
     pub batches: Vec<Batch>,
+    /// The key, in our own validation bucket, of an object listing the batches
+    /// aggregated by this task, which workflow-manager writes instead of
+    /// listing them in batches when they don't fit into a task queue message.
+    /// Introduced in task schema version 2.
+    #[serde(default)]
+    pub batches_object: Option<String>,
 }
 
 impl Task for AggregationTask {}
@@ -101,6 +112,13 @@ pub struct Batch {
     pub time: String,
 }
 
+/// Reads the JSON list of batches that workflow-manager wrote to the object
+/// with the provided key, which an AggregationTask names in batches_object.
+pub fn read_batches_object(transport: &mut dyn Transport, key: &str) -> Result<Vec<Batch>> {
+    serde_json::from_reader(transport.get(key)?)
+        .with_context(|| format!("failed to parse batches object {}", key))
+}
+
 /// A TaskHandle wraps a Task along with whatever metadata is needed by a
 /// TaskQueue implementation
 #[derive(Debug)]
@@ -116,3 +134,79 @@ impl<T: Task> Display for TaskHandle<T> {
         write!(f, "ack ID: {}\ntask: {}", self.acknowledgment_id, self.task)
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transport::LocalFileTransport;
+    use std::io::Write;
+
+    #[test]
+    fn deserialize_aggregation_task_with_batches() {
+        let task: AggregationTask = serde_json::from_str(
+            r#"{
+                "aggregation-id": "kittens-seen",
+                "aggregation-start": "2020/10/31/20/00",
+                "aggregation-end": "2020/10/31/21/00",
+                "batches": [{"id": "b8a5579a-f984-460a-a42d-2813cbf57771", "time": "2020/10/31/20/29"}],
+                "version": 1
+            }"#,
+        )
+        .unwrap();
+
+        assert_eq!(
+            task.batches,
+            vec![Batch {
+                id: "b8a5579a-f984-460a-a42d-2813cbf57771".to_owned(),
+                time: "2020/10/31/20/29".to_owned(),
+            }]
+        );
+        assert_eq!(task.batches_object, None);
+    }
+
+    #[test]
+    fn deserialize_aggregation_task_with_batches_object() {
+        let task: AggregationTask = serde_json::from_str(
+            r#"{
+                "aggregation-id": "kittens-seen",
+                "aggregation-start": "2020/10/31/20/00",
+                "aggregation-end": "2020/10/31/21/00",
+                "batches-object": "aggregation-batches/aggregate-kittens-seen.json",
+                "version": 2
+            }"#,
+        )
+        .unwrap();
+
+        assert!(task.batches.is_empty());
+        assert_eq!(
+            task.batches_object.as_deref(),
+            Some("aggregation-batches/aggregate-kittens-seen.json")
+        );
+    }
+
+    #[test]
+    fn read_batches_object_roundtrip() {
+        let tempdir = tempfile::TempDir::new().unwrap();
+        let mut transport = LocalFileTransport::new(tempdir.path().to_path_buf());
+        let key = "aggregation-batches/aggregate-kittens-seen.json";
+
+        transport
+            .put(key)
+            .unwrap()
+            .write_all(
+                br#"[{"id": "b8a5579a-f984-460a-a42d-2813cbf57771", "time": "2020/10/31/20/29"}]"#,
+            )
+            .unwrap();
+
+        let batches = read_batches_object(&mut transport, key).unwrap();
+        assert_eq!(
+            batches,
+            vec![Batch {
+                id: "b8a5579a-f984-460a-a42d-2813cbf57771".to_owned(),
+                time: "2020/10/31/20/29".to_owned(),
+            }]
+        );
+
+        assert!(read_batches_object(&mut transport, "aggregation-batches/missing.json").is_err());
+    }
+}
@@ -3,18 +3,36 @@ package aws
 
 import (
 	"fmt"
+	"os"
+	"sync"
 
 	"github.com/letsencrypt/prio-server/workflow-manager/tokenfetcher"
+	"github.com/letsencrypt/prio-server/workflow-manager/utils"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 )
 
-func webIDP(sess *session.Session, identity string) (*credentials.Credentials, error) {
+const (
+	// These environment variables are set in pods using IAM Roles for Service
+	// Accounts (IRSA) on EKS.
+	// https://docs.aws.amazon.com/eks/latest/userguide/iam-roles-for-service-accounts.html
+	webIdentityTokenFileEnvVar = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	roleARNEnvVar              = "AWS_ROLE_ARN"
+)
+
+// gkeWebIdentityTokenFetcher returns a token fetcher that gets identity tokens
+// for the ambient GCP service account from the GKE metadata service
+func gkeWebIdentityTokenFetcher(audience string) stscreds.TokenFetcher {
+	return tokenfetcher.NewTokenFetcher(audience)
+}
+
+func webIDP(sess *session.Session, identity string, newTokenFetcher func(audience string) stscreds.TokenFetcher) (credentials.Provider, error) {
 	parsed, err := arn.Parse(identity)
 	if err != nil {
 		return nil, err
@@ -23,28 +41,132 @@ func webIDP(sess *session.Session, identity string) (*credentials.Credentials, e
 
 	stsSTS := sts.New(sess)
 	roleSessionName := ""
-	roleProvider := stscreds.NewWebIdentityRoleProviderWithToken(
-		stsSTS, identity, roleSessionName, tokenfetcher.NewTokenFetcher(audience))
+	return stscreds.NewWebIdentityRoleProviderWithToken(
+		stsSTS, identity, roleSessionName, newTokenFetcher(audience)), nil
+}
+
+// credentialsProvider returns a provider of credentials for identity, or nil
+// if the session's default credentials should be used.
+//
+// If the IRSA environment variables are set, the role they name is assumed
+// using the web identity token in the file they name, and if identity is a
+// different role, that role is then assumed using the IRSA role's credentials,
+// passing externalID, if it is not empty. Otherwise, identity is assumed using
+// a web identity token for the ambient GCP service account, obtained from
+// newTokenFetcher.
+//
+// STS doesn't accept an external ID when assuming a role with a web identity
+// token, so it is an error to provide one unless identity is assumed using the
+// IRSA role's credentials.
+func credentialsProvider(
+	sess *session.Session,
+	identity, externalID string,
+	getenv func(string) string,
+	newTokenFetcher func(audience string) stscreds.TokenFetcher,
+) (credentials.Provider, error) {
+	tokenFile, irsaRoleARN := getenv(webIdentityTokenFileEnvVar), getenv(roleARNEnvVar)
+	if tokenFile == "" || irsaRoleARN == "" {
+		if identity == "" {
+			if externalID != "" {
+				return nil, fmt.Errorf("external ID requires an identity")
+			}
+			return nil, nil
+		}
+		if externalID != "" {
+			return nil, fmt.Errorf("external ID for identity %s is only supported when running with IAM Roles for Service Accounts", identity)
+		}
+		return webIDP(sess, identity, newTokenFetcher)
+	}
 
-	return credentials.NewCredentials(roleProvider), nil
+	irsaProvider := stscreds.NewWebIdentityRoleProvider(sts.New(sess), irsaRoleARN, "", tokenFile)
+	if identity == "" || identity == irsaRoleARN {
+		if externalID != "" {
+			return nil, fmt.Errorf("external ID requires an identity other than the IRSA role %s", irsaRoleARN)
+		}
+		return irsaProvider, nil
+	}
+
+	if _, err := arn.Parse(identity); err != nil {
+		return nil, err
+	}
+
+	provider := &stscreds.AssumeRoleProvider{
+		Client:   sts.New(sess, aws.NewConfig().WithCredentials(credentials.NewCredentials(irsaProvider))),
+		RoleARN:  identity,
+		Duration: stscreds.DefaultDuration,
+	}
+	if externalID != "" {
+		provider.ExternalID = aws.String(externalID)
+	}
+
+	return provider, nil
+}
+
+// instanceRegion caches the region reported by the EC2 instance metadata
+// service, which is looked up at most once
+var instanceRegion struct {
+	once   sync.Once
+	region string
+	err    error
+}
+
+// metadataRegion returns the region of the EC2 instance, or EKS node, that
+// workflow-manager runs on, according to the instance metadata service
+func metadataRegion(sess *session.Session) (string, error) {
+	instanceRegion.once.Do(func() {
+		ctx, cancel := utils.ContextWithTimeout()
+		defer cancel()
+		instanceRegion.region, instanceRegion.err = ec2metadata.New(sess).RegionWithContext(ctx)
+	})
+	return instanceRegion.region, instanceRegion.err
+}
+
+// resolveRegion returns region if it isn't empty. Otherwise it falls back to
+// sessionRegion, which the SDK resolves from AWS_REGION, AWS_DEFAULT_REGION or
+// the shared config file, and then to the region getMetadataRegion returns.
+// Returns an error if no region can be resolved from any of those.
+func resolveRegion(region, sessionRegion string, getMetadataRegion func() (string, error)) (string, error) {
+	if region != "" {
+		return region, nil
+	}
+	if sessionRegion != "" {
+		return sessionRegion, nil
+	}
+	region, err := getMetadataRegion()
+	if err != nil || region == "" {
+		return "", fmt.Errorf("no AWS region configured, and none found in AWS_REGION, AWS_DEFAULT_REGION, the shared config file or the EC2 instance metadata (%v)", err)
+	}
+	return region, nil
 }
 
 // ClientConfig returns a (Session, Config) pair suitable for passing to the
-// New() functions for various AWS services. If identity contains a valid role
-// ARN, the config will use a web identity role provider for that role.
-func ClientConfig(region, identity string) (*session.Session, *aws.Config, error) {
-	sess, err := session.NewSession()
+// New() functions for various AWS services. If region is empty, the region is
+// resolved as by resolveRegion. The session honors the shared config and
+// credentials files, as if AWS_SDK_LOAD_CONFIG were set. If identity contains
+// a valid role ARN, the config will use credentials for that role. If
+// externalID is not empty, it is passed to STS when assuming the role, as
+// required by some cross-account trust policies. See credentialsProvider for
+// how the role is assumed.
+func ClientConfig(region, identity, externalID string) (*session.Session, *aws.Config, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
 	if err != nil {
 		return nil, nil, fmt.Errorf("making AWS session: %w", err)
 	}
 
+	region, err = resolveRegion(region, aws.StringValue(sess.Config.Region), func() (string, error) {
+		return metadataRegion(sess)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
 	config := aws.NewConfig().WithRegion(region)
-	if identity != "" {
-		creds, err := webIDP(sess, identity)
-		if err != nil {
-			return nil, nil, err
-		}
-		config = config.WithCredentials(creds)
+	provider, err := credentialsProvider(sess, identity, externalID, os.Getenv, gkeWebIdentityTokenFetcher)
+	if err != nil {
+		return nil, nil, err
+	}
+	if provider != nil {
+		config = config.WithCredentials(credentials.NewCredentials(provider))
 	}
 	return sess, config, nil
 }
@@ -0,0 +1,406 @@
+package aws
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// stsCall records the interesting parts of a request to fakeSTS
+type stsCall struct {
+	action           string
+	roleARN          string
+	webIdentityToken string
+	externalID       string
+	// accessKeyID is the access key ID with which the request was signed, if
+	// any
+	accessKeyID string
+}
+
+// fakeSTS is an STS server that grants every request to assume a role. The
+// access key ID of the returned credentials is the action followed by the
+// role name.
+type fakeSTS struct {
+	lock  sync.Mutex
+	calls []stsCall
+}
+
+func (f *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	call := stsCall{
+		action:           r.Form.Get("Action"),
+		roleARN:          r.Form.Get("RoleArn"),
+		webIdentityToken: r.Form.Get("WebIdentityToken"),
+		externalID:       r.Form.Get("ExternalId"),
+	}
+	if authorization := r.Header.Get("Authorization"); strings.Contains(authorization, "Credential=") {
+		call.accessKeyID = strings.SplitN(strings.SplitN(authorization, "Credential=", 2)[1], "/", 2)[0]
+	}
+
+	f.lock.Lock()
+	f.calls = append(f.calls, call)
+	f.lock.Unlock()
+
+	fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>%[1]s-%[2]s</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </%[1]sResult>
+</%[1]sResponse>`, call.action, roleName(call.roleARN))
+}
+
+// roleName returns the name of the role in the provided role ARN
+func roleName(roleARN string) string {
+	return roleARN[strings.LastIndex(roleARN, "/")+1:]
+}
+
+type staticTokenFetcher string
+
+func (f staticTokenFetcher) FetchToken(credentials.Context) ([]byte, error) {
+	return []byte(f), nil
+}
+
+func TestCredentialsProvider(t *testing.T) {
+	const (
+		irsaRole     = "arn:aws:iam::123456789012:role/irsa-role"
+		identityRole = "arn:aws:iam::210987654321:role/identity-role"
+	)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("irsa-token"), 0644); err != nil {
+		t.Fatalf("failed to write token file: %s", err)
+	}
+	irsaEnv := map[string]string{
+		webIdentityTokenFileEnvVar: tokenFile,
+		roleARNEnvVar:              irsaRole,
+	}
+
+	var testCases = []struct {
+		name                string
+		identity            string
+		externalID          string
+		env                 map[string]string
+		expectDefault       bool
+		expectedCalls       []stsCall
+		expectedAccessKeyID string
+	}{
+		{
+			name:          "no-identity",
+			identity:      "",
+			env:           map[string]string{},
+			expectDefault: true,
+		},
+		{
+			name:     "static-identity",
+			identity: identityRole,
+			env:      map[string]string{},
+			expectedCalls: []stsCall{
+				{action: "AssumeRoleWithWebIdentity", roleARN: identityRole, webIdentityToken: "gke-token"},
+			},
+			expectedAccessKeyID: "AssumeRoleWithWebIdentity-identity-role",
+		},
+		{
+			name:     "irsa-no-identity",
+			identity: "",
+			env:      irsaEnv,
+			expectedCalls: []stsCall{
+				{action: "AssumeRoleWithWebIdentity", roleARN: irsaRole, webIdentityToken: "irsa-token"},
+			},
+			expectedAccessKeyID: "AssumeRoleWithWebIdentity-irsa-role",
+		},
+		{
+			name:     "irsa-same-identity",
+			identity: irsaRole,
+			env:      irsaEnv,
+			expectedCalls: []stsCall{
+				{action: "AssumeRoleWithWebIdentity", roleARN: irsaRole, webIdentityToken: "irsa-token"},
+			},
+			expectedAccessKeyID: "AssumeRoleWithWebIdentity-irsa-role",
+		},
+		{
+			name:     "irsa-chained-identity",
+			identity: identityRole,
+			env:      irsaEnv,
+			expectedCalls: []stsCall{
+				{action: "AssumeRoleWithWebIdentity", roleARN: irsaRole, webIdentityToken: "irsa-token"},
+				{action: "AssumeRole", roleARN: identityRole, accessKeyID: "AssumeRoleWithWebIdentity-irsa-role"},
+			},
+			expectedAccessKeyID: "AssumeRole-identity-role",
+		},
+		{
+			name:       "irsa-chained-identity-external-id",
+			identity:   identityRole,
+			externalID: "external-id",
+			env:        irsaEnv,
+			expectedCalls: []stsCall{
+				{action: "AssumeRoleWithWebIdentity", roleARN: irsaRole, webIdentityToken: "irsa-token"},
+				{action: "AssumeRole", roleARN: identityRole, externalID: "external-id", accessKeyID: "AssumeRoleWithWebIdentity-irsa-role"},
+			},
+			expectedAccessKeyID: "AssumeRole-identity-role",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			sts := &fakeSTS{}
+			server := httptest.NewServer(sts)
+			defer server.Close()
+
+			sess, err := session.NewSession(aws.NewConfig().
+				WithEndpoint(server.URL).
+				WithRegion("us-west-2").
+				WithCredentials(credentials.AnonymousCredentials))
+			if err != nil {
+				t.Fatalf("failed to create session: %s", err)
+			}
+
+			provider, err := credentialsProvider(
+				sess,
+				testCase.identity,
+				testCase.externalID,
+				func(key string) string { return testCase.env[key] },
+				func(string) stscreds.TokenFetcher { return staticTokenFetcher("gke-token") },
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if testCase.expectDefault {
+				if provider != nil {
+					t.Errorf("expected default credentials, got provider %T", provider)
+				}
+				return
+			}
+
+			value, err := provider.Retrieve()
+			if err != nil {
+				t.Fatalf("failed to retrieve credentials: %s", err)
+			}
+			if value.AccessKeyID != testCase.expectedAccessKeyID {
+				t.Errorf("expected access key ID %q, got %q", testCase.expectedAccessKeyID, value.AccessKeyID)
+			}
+			if !reflect.DeepEqual(sts.calls, testCase.expectedCalls) {
+				t.Errorf("expected STS calls %+v, got %+v", testCase.expectedCalls, sts.calls)
+			}
+		})
+	}
+}
+
+func TestCredentialsProviderInvalidIdentity(t *testing.T) {
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatalf("failed to create session: %s", err)
+	}
+
+	for _, env := range []map[string]string{
+		{},
+		{webIdentityTokenFileEnvVar: "/token", roleARNEnvVar: "arn:aws:iam::123456789012:role/irsa-role"},
+	} {
+		if _, err := credentialsProvider(
+			sess,
+			"not-an-arn",
+			"",
+			func(key string) string { return env[key] },
+			func(string) stscreds.TokenFetcher { return staticTokenFetcher("gke-token") },
+		); err == nil {
+			t.Errorf("expected error for invalid identity with environment %v", env)
+		}
+	}
+}
+
+func TestCredentialsProviderUnsupportedExternalID(t *testing.T) {
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatalf("failed to create session: %s", err)
+	}
+	irsaEnv := map[string]string{
+		webIdentityTokenFileEnvVar: "/token",
+		roleARNEnvVar:              "arn:aws:iam::123456789012:role/irsa-role",
+	}
+
+	var testCases = []struct {
+		name     string
+		identity string
+		env      map[string]string
+	}{
+		{name: "no-identity", identity: "", env: map[string]string{}},
+		{name: "static-identity", identity: "arn:aws:iam::210987654321:role/identity-role", env: map[string]string{}},
+		{name: "irsa-no-identity", identity: "", env: irsaEnv},
+		{name: "irsa-same-identity", identity: "arn:aws:iam::123456789012:role/irsa-role", env: irsaEnv},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := credentialsProvider(
+				sess,
+				testCase.identity,
+				"external-id",
+				func(key string) string { return testCase.env[key] },
+				func(string) stscreds.TokenFetcher { return staticTokenFetcher("gke-token") },
+			); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestResolveRegion(t *testing.T) {
+	var testCases = []struct {
+		name           string
+		region         string
+		sessionRegion  string
+		metadataRegion string
+		metadataErr    error
+		expectedRegion string
+		expectErr      bool
+	}{
+		{
+			name:           "configured",
+			region:         "us-west-2",
+			sessionRegion:  "eu-west-1",
+			metadataRegion: "ap-south-1",
+			expectedRegion: "us-west-2",
+		},
+		{
+			name:           "from-session",
+			sessionRegion:  "eu-west-1",
+			metadataRegion: "ap-south-1",
+			expectedRegion: "eu-west-1",
+		},
+		{
+			name:           "from-metadata",
+			metadataRegion: "ap-south-1",
+			expectedRegion: "ap-south-1",
+		},
+		{
+			name:        "metadata-unavailable",
+			metadataErr: fmt.Errorf("EC2 metadata unavailable"),
+			expectErr:   true,
+		},
+		{
+			name:      "metadata-empty",
+			expectErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			region, err := resolveRegion(testCase.region, testCase.sessionRegion, func() (string, error) {
+				return testCase.metadataRegion, testCase.metadataErr
+			})
+			if testCase.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got region %q", region)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if region != testCase.expectedRegion {
+				t.Errorf("expected region %q, got %q", testCase.expectedRegion, region)
+			}
+		})
+	}
+}
+
+// setenv sets the environment variable, or unsets it if value is empty, and
+// returns a function that restores its previous value
+func setenv(t *testing.T, key, value string) func() {
+	t.Helper()
+	previous, wasSet := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	return func() {
+		if wasSet {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestClientConfigDefaultRegion(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(configFile, []byte("[default]\nregion = eu-central-1\n"), 0600); err != nil {
+		t.Fatalf("failed to write shared config file: %s", err)
+	}
+
+	var testCases = []struct {
+		name           string
+		region         string
+		env            map[string]string
+		expectedRegion string
+	}{
+		{
+			name:           "configured",
+			region:         "us-west-2",
+			env:            map[string]string{"AWS_REGION": "eu-west-1"},
+			expectedRegion: "us-west-2",
+		},
+		{
+			name:           "aws-region",
+			env:            map[string]string{"AWS_REGION": "eu-west-1", "AWS_DEFAULT_REGION": "eu-west-2"},
+			expectedRegion: "eu-west-1",
+		},
+		{
+			name:           "aws-default-region",
+			env:            map[string]string{"AWS_DEFAULT_REGION": "eu-west-2"},
+			expectedRegion: "eu-west-2",
+		},
+		{
+			name:           "shared-config-file",
+			env:            map[string]string{"AWS_CONFIG_FILE": configFile},
+			expectedRegion: "eu-central-1",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for _, key := range []string{
+				"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_PROFILE", "AWS_SDK_LOAD_CONFIG",
+				webIdentityTokenFileEnvVar, roleARNEnvVar,
+			} {
+				defer setenv(t, key, testCase.env[key])()
+			}
+			configFile := testCase.env["AWS_CONFIG_FILE"]
+			if configFile == "" {
+				configFile = filepath.Join(dir, "missing")
+			}
+			defer setenv(t, "AWS_CONFIG_FILE", configFile)()
+			defer setenv(t, "AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "missing"))()
+
+			_, config, err := ClientConfig(testCase.region, "", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if region := aws.StringValue(config.Region); region != testCase.expectedRegion {
+				t.Errorf("expected region %q, got %q", testCase.expectedRegion, region)
+			}
+		})
+	}
+}
@@ -2,13 +2,15 @@ package batchpath
 
 import (
 	"fmt"
-	"log"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/letsencrypt/prio-server/workflow-manager/bucket"
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
 	"github.com/letsencrypt/prio-server/workflow-manager/utils"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // BatchPath represents a relative path to a batch
@@ -17,9 +19,16 @@ type BatchPath struct {
 	dateComponents []string
 	ID             string
 	Time           time.Time
-	metadata       bool
-	avro           bool
-	sig            bool
+	// LastModified is when the last of the batch's files was modified, if
+	// the batch was found by ReadyBatchesWithLastModified, and otherwise the
+	// zero time
+	LastModified time.Time
+	// headerFile is the name of the batch's header file, if it was found by
+	// ReadyBatches or ReadyBatchesWithLastModified
+	headerFile string
+	metadata   bool
+	avro       bool
+	sig        bool
 }
 
 // List is a type alias for a slice of BatchPath pointers
@@ -30,9 +39,18 @@ func (bpl List) Len() int {
 	return len(bpl)
 }
 
-// Returns if the ith item in List occurs before the jth item
+// Less returns if the ith item in List occurs before the jth item. Items are
+// ordered by time, then by aggregation ID, then by batch ID, so that a sorted
+// List is in the same order however it was built.
 func (bpl List) Less(i, j int) bool {
-	return bpl[i].Time.Before(bpl[j].Time)
+	a, b := bpl[i], bpl[j]
+	if !a.Time.Equal(b.Time) {
+		return a.Time.Before(b.Time)
+	}
+	if a.AggregationID != b.AggregationID {
+		return a.AggregationID < b.AggregationID
+	}
+	return a.ID < b.ID
 }
 
 // Swap swaps the ith element in List with the jth element
@@ -44,33 +62,40 @@ func (bpl List) Swap(i, j int) {
 func New(batchName string) (*BatchPath, error) {
 	// batchName is like "kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771"
 	pathComponents := strings.Split(batchName, "/")
+	if len(pathComponents) < 2 {
+		return nil, fmt.Errorf("malformed batch name %q. Expected aggregation ID, date and batch ID", batchName)
+	}
 	batchID := pathComponents[len(pathComponents)-1]
 	aggregationID := pathComponents[0]
 	batchDate := pathComponents[1 : len(pathComponents)-1]
 
-	if len(batchDate) != 5 {
-		return nil, fmt.Errorf("malformed date in %q. Expected 5 date components, got %d", batchName, len(batchDate))
+	// The batch time has one component for each part of task.TimestampFormat
+	if expected := strings.Count(task.TimestampFormat(), "/") + 1; len(batchDate) != expected {
+		return nil, fmt.Errorf("malformed date in %q. Expected %d date components, got %d", batchName, expected, len(batchDate))
 	}
 
-	var dateComponents []int
-	for _, c := range batchDate {
-		parsed, err := strconv.ParseInt(c, 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("parsing date component %q in %q: %w", c, batchName, err)
-		}
-		dateComponents = append(dateComponents, int(parsed))
+	batchTime, err := task.ParseTimestamp(strings.Join(batchDate, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("malformed date in %q: %w", batchName, err)
 	}
-	batchTime := time.Date(dateComponents[0], time.Month(dateComponents[1]),
-		dateComponents[2], dateComponents[3], dateComponents[4], 0, 0, time.UTC)
 
 	return &BatchPath{
 		AggregationID:  aggregationID,
 		dateComponents: batchDate,
 		ID:             batchID,
-		Time:           batchTime,
+		Time:           time.Time(batchTime),
 	}, nil
 }
 
+// Equal returns true if other is the same batch as b, meaning it has the same
+// aggregation ID, time and batch ID. Which of the batch's files are present is
+// not compared.
+func (b *BatchPath) Equal(other *BatchPath) bool {
+	return b.AggregationID == other.AggregationID &&
+		b.Time.Equal(other.Time) &&
+		b.ID == other.ID
+}
+
 func (b *BatchPath) String() string {
 	return fmt.Sprintf("{%s %s %s files:%d%d%d}", b.AggregationID, b.dateComponents, b.ID, utils.Index(!b.metadata), utils.Index(!b.avro), utils.Index(!b.sig))
 }
@@ -84,37 +109,76 @@ func (b *BatchPath) DateString() string {
 	return strings.Join(b.dateComponents, "/")
 }
 
+// HeaderFile returns the name of the batch's header file, if the batch was
+// found by ReadyBatches or ReadyBatchesWithLastModified, and otherwise the
+// empty string
+func (b *BatchPath) HeaderFile() string {
+	return b.headerFile
+}
+
 // isComplete returns true if all three files in the batch are present (header,
 // signature and packet file), and false otherwise.
 func (b *BatchPath) isComplete() bool {
 	return b.metadata && b.avro && b.sig
 }
 
-// ReadyBatches gets a List from a list of files and infix
-func ReadyBatches(files []string, infix string) (List, error) {
+// isBookkeeping returns whether the file is one that workflow-manager writes
+// to keep track of tasks, rather than part of a batch
+func isBookkeeping(file string) bool {
+	for _, prefix := range bucket.BookkeepingPrefixes {
+		if strings.HasPrefix(file, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadyBatches gets a List from a list of files and infix. Files whose names
+// can't be parsed as batch paths don't prevent other batches from being
+// returned. Instead, an error is returned for each malformed batch path.
+func ReadyBatches(files []string, infix string) (List, []error) {
+	return ReadyBatchesWithLastModified(files, nil, infix)
+}
+
+// ReadyBatchesWithLastModified is like ReadyBatches, but also sets the
+// LastModified of each batch to the latest of the modification times of its
+// files in lastModified, which maps file names to modification times.
+func ReadyBatchesWithLastModified(files []string, lastModified map[string]time.Time, infix string) (List, []error) {
 	batches := make(map[string]*BatchPath)
-	for _, name := range files {
-		// Ignore task marker objects
-		if strings.HasPrefix(name, "task-markers/") {
+	malformed := make(map[string]struct{})
+	var errs []error
+	for _, file := range files {
+		// Ignore task markers and the other objects written to keep track of
+		// tasks
+		if isBookkeeping(file) {
+			continue
+		}
+		basename := basename(file, infix)
+		if _, ok := malformed[basename]; ok {
 			continue
 		}
-		basename := basename(name, infix)
 		b := batches[basename]
-		var err error
 		if b == nil {
+			var err error
 			b, err = New(basename)
 			if err != nil {
-				return nil, err
+				malformed[basename] = struct{}{}
+				errs = append(errs, err)
+				continue
 			}
 			batches[basename] = b
 		}
-		if strings.HasSuffix(name, fmt.Sprintf(".%s", infix)) {
+		if modified := lastModified[file]; modified.After(b.LastModified) {
+			b.LastModified = modified
+		}
+		if strings.HasSuffix(file, fmt.Sprintf(".%s", infix)) {
 			b.metadata = true
+			b.headerFile = file
 		}
-		if strings.HasSuffix(name, fmt.Sprintf(".%s.avro", infix)) {
+		if strings.HasSuffix(file, fmt.Sprintf(".%s.avro", infix)) {
 			b.avro = true
 		}
-		if strings.HasSuffix(name, fmt.Sprintf(".%s.sig", infix)) {
+		if strings.HasSuffix(file, fmt.Sprintf(".%s.sig", infix)) {
 			b.sig = true
 		}
 	}
@@ -132,7 +196,7 @@ func ReadyBatches(files []string, infix string) (List, error) {
 	}
 	sort.Sort(List(output))
 
-	return output, nil
+	return output, errs
 }
 
 // basename returns s, with any type suffixes stripped off. The type suffixes are determined by
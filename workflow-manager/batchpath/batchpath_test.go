@@ -0,0 +1,283 @@
+package batchpath
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
+)
+
+func TestReadyBatches(t *testing.T) {
+	var testCases = []struct {
+		name            string
+		files           []string
+		infix           string
+		expectedBatches []string
+	}{
+		{
+			name: "complete-batch",
+			files: []string{
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.sig",
+			},
+			infix:           "batch",
+			expectedBatches: []string{"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771"},
+		},
+		{
+			name: "missing-signature",
+			files: []string{
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro",
+			},
+			infix:           "batch",
+			expectedBatches: []string{},
+		},
+		{
+			name: "missing-header",
+			files: []string{
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.validity_0.avro",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.validity_0.sig",
+			},
+			infix:           "validity_0",
+			expectedBatches: []string{},
+		},
+		{
+			name: "one-complete-one-incomplete",
+			files: []string{
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.sig",
+				"kittens-seen/2020/10/31/21/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch",
+				"kittens-seen/2020/10/31/21/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch.avro",
+				"task-markers/intake-kittens-seen-2020-10-31-20-29-b8a5579a-f984-460a-a42d-2813cbf57771",
+			},
+			infix:           "batch",
+			expectedBatches: []string{"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771"},
+		},
+		{
+			name: "bookkeeping-objects",
+			files: []string{
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.sig",
+				"task-markers/intake-kittens-seen-2020-10-31-20-29-b8a5579a-f984-460a-a42d-2813cbf57771",
+				"pending-task-markers/intake-kittens-seen-2020-10-31-20-29-0f0f0f0f-f984-460a-a42d-2813cbf57771",
+				"failed-tasks/intake-kittens-seen-2020-10-31-21-29-1e1e1e1e-f984-460a-a42d-2813cbf57771",
+				"failed-attempts/intake-kittens-seen-2020-10-31-22-29-2d2d2d2d-f984-460a-a42d-2813cbf57771",
+				"scheduled-markers/20201101T040100Z-0a0a0a0a.json",
+				"aggregation-batches/aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00.json",
+			},
+			infix:           "batch",
+			expectedBatches: []string{"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771"},
+		},
+		{
+			name: "same-time",
+			files: []string{
+				"puppies-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch",
+				"puppies-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch.avro",
+				"puppies-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch.sig",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.sig",
+				"kittens-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch",
+				"kittens-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch.avro",
+				"kittens-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch.sig",
+			},
+			infix: "batch",
+			expectedBatches: []string{
+				"kittens-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771",
+				"puppies-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771",
+			},
+		},
+		{
+			name: "other-infix",
+			files: []string{
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.validity_0",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.validity_0.avro",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.validity_1.sig",
+			},
+			infix:           "validity_0",
+			expectedBatches: []string{},
+		},
+		{
+			name: "compressed-files",
+			files: []string{
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.gz",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro.gz",
+				"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.sig.gz",
+			},
+			infix:           "batch",
+			expectedBatches: []string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			batches, errs := ReadyBatches(testCase.files, testCase.infix)
+			if len(errs) != 0 {
+				t.Fatalf("unexpected errors: %q", errs)
+			}
+			if len(batches) != len(testCase.expectedBatches) {
+				t.Fatalf("expected batches %q, got %s", testCase.expectedBatches, batches)
+			}
+			for i, batch := range batches {
+				if batch.path() != testCase.expectedBatches[i] {
+					t.Errorf("expected batch %q, got %q", testCase.expectedBatches[i], batch.path())
+				}
+			}
+		})
+	}
+}
+
+func TestReadyBatchesWithLastModified(t *testing.T) {
+	modified := time.Date(2020, 11, 1, 4, 1, 0, 0, time.UTC)
+	batch := "kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771"
+	files := []string{batch + ".batch", batch + ".batch.avro", batch + ".batch.sig"}
+	lastModified := map[string]time.Time{
+		batch + ".batch":      modified.Add(-time.Minute),
+		batch + ".batch.avro": modified,
+		batch + ".batch.sig":  modified.Add(-2 * time.Minute),
+	}
+
+	batches, errs := ReadyBatchesWithLastModified(files, lastModified, "batch")
+	if len(errs) != 0 || len(batches) != 1 {
+		t.Fatalf("expected one batch, got %v (errors %v)", batches, errs)
+	}
+	if !batches[0].LastModified.Equal(modified) {
+		t.Errorf("expected batch to be last modified at %s, got %s", modified, batches[0].LastModified)
+	}
+
+	batches, _ = ReadyBatches(files, "batch")
+	if len(batches) != 1 || !batches[0].LastModified.IsZero() {
+		t.Errorf("expected batch without modification time, got %v", batches)
+	}
+}
+
+func TestReadyBatchesMalformedPaths(t *testing.T) {
+	files := []string{
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.sig",
+		// Too few date components
+		"kittens-seen/2020/10/31/20/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/20/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch.avro",
+		// Non-numeric date component
+		"kittens-seen/2020/October/31/20/29/1e1e1e1e-f984-460a-a42d-2813cbf57771.batch",
+		"unexpected-object",
+	}
+
+	batches, errs := ReadyBatches(files, "batch")
+	if len(batches) != 1 || batches[0].ID != "b8a5579a-f984-460a-a42d-2813cbf57771" {
+		t.Errorf("expected only the well-formed batch, got %s", batches)
+	}
+	// The files of a malformed batch should only be reported once.
+	if len(errs) != 3 {
+		t.Errorf("expected 3 errors, got %q", errs)
+	}
+}
+
+func TestReadyBatchesHourPrecision(t *testing.T) {
+	if err := task.SetTimestampFormat("2006/01/02/15"); err != nil {
+		t.Fatalf("failed to set timestamp format: %s", err)
+	}
+	defer task.SetTimestampFormat(task.DefaultTimestampFormat)
+
+	batch := "kittens-seen/2020/10/31/20/b8a5579a-f984-460a-a42d-2813cbf57771"
+	files := []string{
+		batch + ".batch", batch + ".batch.avro", batch + ".batch.sig",
+		// Minute precision paths have too many date components
+		"kittens-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch",
+	}
+
+	batches, errs := ReadyBatches(files, "batch")
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error, got %q", errs)
+	}
+	if len(batches) != 1 || batches[0].path() != batch {
+		t.Fatalf("expected batch %s, got %s", batch, batches)
+	}
+	if expected := time.Date(2020, 10, 31, 20, 0, 0, 0, time.UTC); !batches[0].Time.Equal(expected) {
+		t.Errorf("expected batch time %s, got %s", expected, batches[0].Time)
+	}
+}
+
+func TestListSort(t *testing.T) {
+	var sorted List
+	for _, name := range []string{
+		"kittens-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771",
+		"puppies-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771",
+		"ducklings-seen/2020/10/31/20/30/0f0f0f0f-f984-460a-a42d-2813cbf57771",
+		"kittens-seen/2020/10/31/21/29/0f0f0f0f-f984-460a-a42d-2813cbf57771",
+	} {
+		batch, err := New(name)
+		if err != nil {
+			t.Fatalf("failed to parse batch path %s: %s", name, err)
+		}
+		sorted = append(sorted, batch)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		shuffled := append(List{}, sorted...)
+		rnd.Shuffle(len(shuffled), shuffled.Swap)
+		sort.Sort(shuffled)
+		for j := range sorted {
+			if shuffled[j] != sorted[j] {
+				t.Fatalf("expected %s at index %d after sorting, got %s", sorted[j], j, shuffled[j])
+			}
+		}
+	}
+}
+
+func TestBatchPathEqual(t *testing.T) {
+	batch, err := New("kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771")
+	if err != nil {
+		t.Fatalf("failed to parse batch path: %s", err)
+	}
+
+	var testCases = []struct {
+		name     string
+		other    string
+		expected bool
+	}{
+		{
+			name:     "same",
+			other:    "kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771",
+			expected: true,
+		},
+		{
+			name:     "different-aggregation-id",
+			other:    "puppies-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771",
+			expected: false,
+		},
+		{
+			name:     "different-time",
+			other:    "kittens-seen/2020/10/31/20/30/b8a5579a-f984-460a-a42d-2813cbf57771",
+			expected: false,
+		},
+		{
+			name:     "different-id",
+			other:    "kittens-seen/2020/10/31/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771",
+			expected: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			other, err := New(testCase.other)
+			if err != nil {
+				t.Fatalf("failed to parse batch path: %s", err)
+			}
+			// Which files are present doesn't matter
+			other.metadata = true
+			if batch.Equal(other) != testCase.expected || other.Equal(batch) != testCase.expected {
+				t.Errorf("expected Equal to be %t", testCase.expected)
+			}
+		})
+	}
+}
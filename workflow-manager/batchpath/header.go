@@ -0,0 +1,126 @@
+package batchpath
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// avroMagic begins every Avro object container file. Batch headers are
+// written as Avro object container files holding a single record.
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+// avroSyncSize is the size of the sync marker that follows an Avro object
+// container file's metadata and each of its blocks
+const avroSyncSize = 16
+
+// ValidateHeader checks that contents look like a valid batch header: an Avro
+// object container file with a schema and at least one complete block of
+// records. The records themselves aren't decoded, so this only catches
+// headers that are empty, truncated or otherwise corrupt.
+func ValidateHeader(contents []byte) error {
+	if len(contents) == 0 {
+		return fmt.Errorf("header is empty")
+	}
+	if !bytes.HasPrefix(contents, avroMagic) {
+		return fmt.Errorf("header is not an Avro object container file")
+	}
+	reader := avroReader{contents: contents[len(avroMagic):]}
+
+	// The file's metadata is a map from strings to bytes, encoded as a series
+	// of blocks of entries ending with an empty block
+	hasSchema := false
+	for {
+		count, err := reader.long()
+		if err != nil {
+			return fmt.Errorf("malformed header metadata: %w", err)
+		}
+		if count == 0 {
+			break
+		}
+		if count < 0 {
+			// A negative count is followed by the size of the block in bytes
+			count = -count
+			if _, err := reader.long(); err != nil {
+				return fmt.Errorf("malformed header metadata: %w", err)
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			key, err := reader.bytes()
+			if err != nil {
+				return fmt.Errorf("malformed header metadata: %w", err)
+			}
+			if _, err := reader.bytes(); err != nil {
+				return fmt.Errorf("malformed header metadata: %w", err)
+			}
+			if string(key) == "avro.schema" {
+				hasSchema = true
+			}
+		}
+	}
+	if !hasSchema {
+		return fmt.Errorf("header has no Avro schema")
+	}
+	sync, err := reader.fixed(avroSyncSize)
+	if err != nil {
+		return fmt.Errorf("malformed header sync marker: %w", err)
+	}
+
+	records, err := reader.long()
+	if err != nil {
+		return fmt.Errorf("malformed header block: %w", err)
+	}
+	if records <= 0 {
+		return fmt.Errorf("header has no records")
+	}
+	if _, err := reader.bytes(); err != nil {
+		return fmt.Errorf("malformed header block: %w", err)
+	}
+	blockSync, err := reader.fixed(avroSyncSize)
+	if err != nil {
+		return fmt.Errorf("malformed header block: %w", err)
+	}
+	if !bytes.Equal(blockSync, sync) {
+		return fmt.Errorf("header block's sync marker doesn't match the file's")
+	}
+
+	return nil
+}
+
+// avroReader reads values in Avro's binary encoding
+type avroReader struct {
+	contents []byte
+}
+
+// long reads a zig-zag encoded variable length integer, which is how Avro
+// encodes both ints and longs
+func (r *avroReader) long() (int64, error) {
+	value, n := binary.Varint(r.contents)
+	if n <= 0 {
+		return 0, fmt.Errorf("truncated or invalid integer")
+	}
+	r.contents = r.contents[n:]
+	return value, nil
+}
+
+// bytes reads a length-prefixed byte string
+func (r *avroReader) bytes() ([]byte, error) {
+	length, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("negative length %d", length)
+	}
+	return r.fixed(int(length))
+}
+
+// fixed reads size bytes
+func (r *avroReader) fixed(size int) ([]byte, error) {
+	if size > len(r.contents) {
+		return nil, fmt.Errorf("truncated after %d bytes of %d", len(r.contents), size)
+	}
+	value := r.contents[:size]
+	r.contents = r.contents[size:]
+	return value, nil
+}
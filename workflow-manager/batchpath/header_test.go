@@ -0,0 +1,80 @@
+package batchpath
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// avroContainer returns an Avro object container file with the provided
+// metadata keys and one block of records holding data, or, if records is
+// zero, no blocks
+func avroContainer(metadataKeys []string, records int64, data []byte) []byte {
+	var buf bytes.Buffer
+	long := func(value int64) {
+		encoded := make([]byte, binary.MaxVarintLen64)
+		buf.Write(encoded[:binary.PutVarint(encoded, value)])
+	}
+	bytesValue := func(value []byte) {
+		long(int64(len(value)))
+		buf.Write(value)
+	}
+	sync := []byte("0123456789abcdef")
+
+	buf.Write(avroMagic)
+	if len(metadataKeys) > 0 {
+		long(int64(len(metadataKeys)))
+		for _, key := range metadataKeys {
+			bytesValue([]byte(key))
+			bytesValue([]byte(`{"type": "record"}`))
+		}
+	}
+	long(0)
+	buf.Write(sync)
+	if records > 0 {
+		long(records)
+		bytesValue(data)
+		buf.Write(sync)
+	}
+	return buf.Bytes()
+}
+
+func TestValidateHeader(t *testing.T) {
+	valid := avroContainer([]string{"avro.schema", "avro.codec"}, 1, []byte("record"))
+
+	var testCases = []struct {
+		name          string
+		contents      []byte
+		expectedError string
+	}{
+		{name: "valid", contents: valid},
+		{name: "empty", contents: []byte{}, expectedError: "header is empty"},
+		{name: "not-avro", contents: []byte(`{"batch_uuid": "b8a5579a"}`), expectedError: "not an Avro object container file"},
+		{name: "magic-only", contents: avroMagic, expectedError: "malformed header metadata"},
+		{name: "no-schema", contents: avroContainer([]string{"avro.codec"}, 1, []byte("record")), expectedError: "no Avro schema"},
+		{name: "no-records", contents: avroContainer([]string{"avro.schema"}, 0, nil), expectedError: "malformed header block"},
+		{name: "truncated-block", contents: valid[:len(valid)-20], expectedError: "malformed header block"},
+		{name: "truncated-sync", contents: valid[:len(valid)-1], expectedError: "malformed header block"},
+		{
+			name:          "wrong-sync",
+			contents:      append(append([]byte{}, valid[:len(valid)-1]...), 'x'),
+			expectedError: "sync marker doesn't match",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := ValidateHeader(testCase.contents)
+			if testCase.expectedError == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+				t.Errorf("expected error containing %q, got %v", testCase.expectedError, err)
+			}
+		})
+	}
+}
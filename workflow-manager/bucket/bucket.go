@@ -1,154 +1,1097 @@
 package bucket
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	leaws "github.com/letsencrypt/prio-server/workflow-manager/aws"
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
 	"github.com/letsencrypt/prio-server/workflow-manager/utils"
 
 	"cloud.google.com/go/storage"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/api/iterator"
 )
 
-// TaskMarkerWriter allows writing of a task marker to some storage
+// taskMarkerPrefix is the prefix of the keys of task marker objects
+const taskMarkerPrefix = "task-markers/"
+
+// failedTaskPrefix is the prefix of the keys of failed task records
+const failedTaskPrefix = "failed-tasks/"
+
+// pendingTaskMarkerPrefix is the prefix of the keys of pending task markers
+const pendingTaskMarkerPrefix = "pending-task-markers/"
+
+// failedAttemptsPrefix is the prefix of the keys of records of failed attempts
+// to enqueue tasks that will be retried
+const failedAttemptsPrefix = "failed-attempts/"
+
+// scheduledMarkersPrefix is the prefix of the keys of the manifests of the
+// task markers scheduled by each run
+const scheduledMarkersPrefix = "scheduled-markers/"
+
+// aggregationBatchesPrefix is the prefix of the keys of the lists of batches
+// of aggregation tasks too large for the task queue
+const aggregationBatchesPrefix = "aggregation-batches/"
+
+// BookkeepingPrefixes are the prefixes of the keys of all the objects that
+// workflow-manager writes to keep track of tasks, which are not batches and
+// should be skipped when looking for batches in a bucket
+var BookkeepingPrefixes = []string{
+	taskMarkerPrefix,
+	failedTaskPrefix,
+	pendingTaskMarkerPrefix,
+	failedAttemptsPrefix,
+	scheduledMarkersPrefix,
+	aggregationBatchesPrefix,
+}
+
+// objectMetadata is the HTTP metadata with which an object is written. Empty
+// fields are left to the storage service's defaults. Local files have no such
+// metadata, so it is ignored for them.
+type objectMetadata struct {
+	contentType  string
+	cacheControl string
+}
+
+// markerMetadata is the metadata of task markers and pending markers. Tooling
+// may read markers over HTTP, e.g. through a static website or a CDN, where a
+// cached marker would be stale as soon as the marker is deleted.
+var markerMetadata = objectMetadata{contentType: "application/json", cacheControl: "no-store"}
+
+// markerContents is the body of task markers and pending markers, which makes
+// them self-describing and records the task so that it can be replayed.
+// Scheduling only ever lists markers.
+type markerContents struct {
+	Marker string `json:"marker"`
+	// TaskType is the task kind the marker's name begins with, i.e. "intake"
+	// or "aggregate"
+	TaskType  string    `json:"task_type"`
+	CreatedAt time.Time `json:"created_at"`
+	// Task is the task's JSON encoding, as it was enqueued. Markers written
+	// by earlier versions of workflow-manager have none.
+	Task json.RawMessage `json:"task,omitempty"`
+	// Attributes are the task's attributes, which carry what its JSON
+	// encoding doesn't
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// writeMarker writes the marker object with the provided key for the task
+func (b *Bucket) writeMarker(key string, t task.Task) error {
+	encodedTask, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task: %w", err)
+	}
+	contents, err := json.Marshal(markerContents{
+		Marker:     t.Marker(),
+		TaskType:   strings.SplitN(t.Marker(), "-", 2)[0],
+		CreatedAt:  time.Now().UTC(),
+		Task:       encodedTask,
+		Attributes: t.Attributes(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal marker contents: %w", err)
+	}
+	return b.writeObject(key, contents, markerMetadata)
+}
+
+// ReadTaskMarker returns the task recorded in the task marker written for it
+// by WriteTaskMarker or PromoteMarker. Returns an error if the marker records
+// no task, as is the case for markers written by earlier versions of
+// workflow-manager.
+func (b *Bucket) ReadTaskMarker(marker string) (task.Task, error) {
+	body, err := b.readObject(taskMarkerPrefix + marker)
+	if err != nil {
+		return nil, err
+	}
+	var contents markerContents
+	if err := json.Unmarshal(body, &contents); err != nil || len(contents.Task) == 0 {
+		return nil, fmt.Errorf("task marker %s records no task", marker)
+	}
+	return task.Decode(contents.TaskType, contents.Task, contents.Attributes)
+}
+
+// FileInfo describes a file listed by ListFilesWithMetadata or
+// ListPendingMarkers
+type FileInfo struct {
+	// Key is the name of the file, relative to the Bucket's key prefix
+	Key string
+	// LastModified is when the file was last written, according to the
+	// storage service
+	LastModified time.Time
+}
+
+// fileKeys returns the keys of the files
+func fileKeys(files []FileInfo) []string {
+	if files == nil {
+		return nil
+	}
+	keys := make([]string, len(files))
+	for i, file := range files {
+		keys[i] = file.Key
+	}
+	return keys
+}
+
+// TaskMarkerWriter allows writing of a task marker to some storage. Task
+// markers may be written directly, or in two phases: a pending marker is written
+// before a task is enqueued, and then either promoted to a task marker once the
+// task is known to have been enqueued or deleted if enqueuing failed. Markers
+// record the task they were written for, so that it can be replayed.
 type TaskMarkerWriter interface {
-	WriteTaskMarker(marker string) error
+	WriteTaskMarker(t task.Task) error
+	// WritePendingMarker records that the task is about to be enqueued
+	WritePendingMarker(t task.Task) error
+	// PromoteMarker writes the task marker for a task whose pending marker was
+	// written, and then deletes the pending marker
+	PromoteMarker(t task.Task) error
+	// MarkerExists returns whether the task marker for the task with the
+	// provided marker exists, without listing all the markers
+	MarkerExists(marker string) (bool, error)
+	// DeletePendingMarker deletes a pending marker without writing the task
+	// marker. Deleting a pending marker that does not exist is not an error.
+	DeletePendingMarker(marker string) error
+}
+
+// TaskMarkerReader allows reading back the tasks recorded in task markers
+type TaskMarkerReader interface {
+	// ReadTaskMarker returns the task recorded in the task marker
+	ReadTaskMarker(marker string) (task.Task, error)
+}
+
+// TaskMarkerStore allows writing and listing of task markers
+type TaskMarkerStore interface {
+	TaskMarkerWriter
+	// ListTaskMarkers returns the names of all the task markers in the store
+	ListTaskMarkers() ([]string, error)
+}
+
+// FailedTaskWriter allows recording tasks that could not be enqueued
+type FailedTaskWriter interface {
+	// WriteFailedTask writes a record of the failure to enqueue the task with
+	// the provided marker
+	WriteFailedTask(marker string, record []byte) error
+}
+
+// FailedAttemptStore keeps records of the failed attempts to enqueue tasks
+// that are retried on later runs
+type FailedAttemptStore interface {
+	// ReadFailedAttempts returns the record of failed attempts to enqueue the
+	// task with the provided marker
+	ReadFailedAttempts(marker string) ([]byte, error)
+	// WriteFailedAttempts writes the record of failed attempts to enqueue the
+	// task with the provided marker, replacing any previous record
+	WriteFailedAttempts(marker string, record []byte) error
+	// DeleteFailedAttempts deletes the record of failed attempts to enqueue the
+	// task with the provided marker. Deleting a record that does not exist is
+	// not an error.
+	DeleteFailedAttempts(marker string) error
+}
+
+// TaskStateWriter allows writing both task markers and failed task records
+type TaskStateWriter interface {
+	TaskMarkerWriter
+	FailedTaskWriter
+}
+
+// FileReader allows reading the files in a bucket, such as the files of
+// batches
+type FileReader interface {
+	// ReadFile returns the contents of the file with the provided key,
+	// relative to the bucket's key prefix. If the file is larger than maxSize
+	// bytes, an error wrapping ErrFileTooLarge is returned instead.
+	ReadFile(key string, maxSize int64) ([]byte, error)
+}
+
+// ErrFileTooLarge is returned by FileReader.ReadFile for files larger than the
+// maximum size
+var ErrFileTooLarge = errors.New("file too large")
+
+// TaskMarkerDeleter allows deletion of task markers
+type TaskMarkerDeleter interface {
+	DeleteTaskMarker(marker string) error
+}
+
+// AggregationBatchesDeleter allows deletion of the lists of batches written by
+// WriteAggregationBatches
+type AggregationBatchesDeleter interface {
+	DeleteAggregationBatches(marker string) error
+}
+
+// S3Config configures how S3 buckets are accessed, allowing the use of
+// S3-compatible services like MinIO or Ceph RGW. The zero value uses AWS.
+type S3Config struct {
+	// Endpoint is the URL of the S3 API. If empty, the AWS endpoint for the
+	// bucket's region is used.
+	Endpoint string
+	// ForcePathStyle makes requests address buckets in the URL path rather
+	// than in the host name, as most S3-compatible services require
+	ForcePathStyle bool
+	// InsecureSkipVerify disables verification of the endpoint's TLS
+	// certificate. It should only be used against development setups with
+	// self-signed certificates.
+	InsecureSkipVerify bool
+	// AccessKeyID and SecretAccessKey, if set, are static credentials used
+	// instead of the usual AWS credential sources, such as the HMAC keys of
+	// GCS's S3-compatible XML API. Requests are signed with Signature Version
+	// 4, which GCS accepts.
+	AccessKeyID     string
+	SecretAccessKey string
 }
 
+// GCSConfig configures how GCS buckets are accessed. The zero value bills
+// requests to the project that owns each bucket.
+type GCSConfig struct {
+	// BillingProject, if set, is the project billed for requests, which is
+	// required to access requester pays buckets. The identity making requests
+	// must have the serviceusage.services.use permission in the project.
+	BillingProject string
+}
+
+// supportedServices are the URL schemes of the supported storage services
+var supportedServices = []string{"s3", "gs", "file"}
+
 // Bucket represents a general bucket of data
 type Bucket struct {
-	// service is either "s3", or "gs"
+	// service is either "s3", "gs" or "file"
 	service string
-	// bucketName includes the region for S3
+	// bucketName includes the region for S3, and is a path to a local
+	// directory for file
 	bucketName string
-	identity   string
-	dryRun     bool
+	// keyPrefix is prepended to the keys of all objects in S3 and GS, so that
+	// Bucket can be one of many sharing the same storage bucket. It is empty
+	// or ends in "/".
+	keyPrefix string
+	identity  string
+	// externalID is passed to STS when assuming identity, and is only
+	// supported for S3
+	externalID string
+	// s3Config is only used for S3
+	s3Config S3Config
+	// gcsConfig is only used for GS
+	gcsConfig GCSConfig
+	dryRun    bool
 }
 
-// New creates a new Bucket from a URL and identity. If dryRun is true, then any
+// New creates a new Bucket from a URL, identity and external ID. Trailing
+// slashes in the URL are ignored. For S3 and GS, the URL may include a path
+// after the bucket name (e.g. gs://bucket/path), in which case Bucket only
+// contains the objects under that path, and the keys of objects listed,
+// written or deleted are relative to it. s3Config is ignored unless the Bucket is in
+// S3, and gcsConfig is ignored unless it is in GS. If dryRun is true, then any
 // operations with side effects will not actually be performed.
-func New(bucketURL, identity string, dryRun bool) (*Bucket, error) {
+func New(bucketURL, identity, externalID string, s3Config S3Config, gcsConfig GCSConfig, dryRun bool) (*Bucket, error) {
+	parts, err := parseBucketURL(bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	if parts[0] != "s3" && identity != "" {
+		return nil, fmt.Errorf("workflow-manager doesn't support alternate identities (%s) for %s:// Bucket (%q)",
+			identity, parts[0], bucketURL)
+	}
+	if externalID != "" && (parts[0] != "s3" || identity == "") {
+		return nil, fmt.Errorf("an external ID requires an identity and is only supported for s3:// Bucket (%q)", bucketURL)
+	}
+	if (s3Config.AccessKeyID == "") != (s3Config.SecretAccessKey == "") {
+		return nil, fmt.Errorf("S3 static credentials require both an access key ID and a secret access key")
+	}
+	if parts[0] == "s3" && s3Config.AccessKeyID != "" && identity != "" {
+		return nil, fmt.Errorf("S3 static credentials can't be used with an identity (%s) for Bucket (%q)", identity, bucketURL)
+	}
+	if s3Config.Endpoint != "" {
+		endpoint, err := url.Parse(s3Config.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint %q: %w", s3Config.Endpoint, err)
+		}
+		if endpoint.Scheme != "https" && endpoint.Scheme != "http" {
+			return nil, fmt.Errorf("S3 endpoint %q must be an http:// or https:// URL", s3Config.Endpoint)
+		}
+	}
+
+	bucketName, keyPrefix := splitBucketPath(parts[0], parts[1])
+	return &Bucket{
+		service:    parts[0],
+		bucketName: bucketName,
+		keyPrefix:  keyPrefix,
+		identity:   identity,
+		externalID: externalID,
+		s3Config:   s3Config,
+		gcsConfig:  gcsConfig,
+		dryRun:     dryRun,
+	}, nil
+}
+
+// splitBucketPath splits the part of a bucket URL following the scheme into
+// the name of the bucket, which for S3 includes the region, and the prefix of
+// the keys of the objects in the bucket
+func splitBucketPath(service, path string) (string, string) {
+	segments := 1
+	switch service {
+	case "s3":
+		// s3://${region}/${bucket}, where the region may be empty
+		segments = 2
+	case "file":
+		// The whole path is the directory
+		return path, ""
+	}
+
+	parts := strings.SplitN(path, "/", segments+1)
+	if len(parts) <= segments {
+		return path, ""
+	}
+	keyPrefix := strings.Trim(parts[segments], "/")
+	if keyPrefix == "" {
+		return strings.Join(parts[:segments], "/"), ""
+	}
+	return strings.Join(parts[:segments], "/"), keyPrefix + "/"
+}
+
+// relativeKeys returns the keys with the Bucket's key prefix removed
+func (b *Bucket) relativeKeys(keys []string) []string {
+	if b.keyPrefix == "" {
+		return keys
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, b.keyPrefix)
+	}
+	return keys
+}
+
+// ListFiles lists the files contained in Bucket whose names begin with prefix.
+// An empty prefix lists all the files in Bucket.
+func (b *Bucket) ListFiles(prefix string) ([]string, error) {
+	return b.listFiles(prefix)
+}
+
+// ListFilesWithMetadata is like ListFiles, but also returns when each file was
+// last modified. For GS buckets, that is the time the object's metadata was
+// last updated, which for objects that are never updated is when they were
+// written.
+func (b *Bucket) ListFilesWithMetadata(prefix string) ([]FileInfo, error) {
+	return b.listFilesWithMetadata(prefix)
+}
+
+// ListTopLevelPrefixes lists the distinct prefixes of the names of the files in
+// Bucket up to and including the first "/", which for batch buckets are the
+// aggregation IDs followed by "/". Files whose names contain no "/" are
+// omitted.
+func (b *Bucket) ListTopLevelPrefixes() ([]string, error) {
+	switch b.service {
+	case "s3":
+		return b.listTopLevelPrefixesS3()
+	case "gs":
+		return b.listTopLevelPrefixesGS()
+	case "file":
+		return b.listTopLevelPrefixesLocal()
+	default:
+		return nil, fmt.Errorf("invalid storage service %q", b.service)
+	}
+}
+
+// ListFilesSince lists the files contained in Bucket, except for batch files
+// whose batch time is before since, which for S3 and GS buckets are not listed
+// at all. Batch files are expected to be named like
+// "${aggregation ID}/${batch time}/${batch ID}...", with the batch time in
+// task.TimestampFormat, which sorts in order of batch time. Task markers,
+// pending task markers and failed task records are always listed.
+func (b *Bucket) ListFilesSince(since time.Time) ([]string, error) {
+	switch b.service {
+	case "s3":
+		return b.listFilesSinceS3(since)
+	case "gs":
+		return b.listFilesSinceGS(since)
+	case "file":
+		// Local directories can't be listed starting from some file, so list
+		// everything and filter out the old batch files.
+		files, err := b.listFilesLocal("")
+		if err != nil {
+			return nil, err
+		}
+		var output []string
+		for _, file := range fileKeys(files) {
+			if listedSince(file, since) {
+				output = append(output, file)
+			}
+		}
+		return output, nil
+	default:
+		return nil, fmt.Errorf("invalid storage service %q", b.service)
+	}
+}
+
+// listedSince returns true if ListFilesSince(since) lists the file with the
+// provided key, if it exists.
+func listedSince(key string, since time.Time) bool {
+	slash := strings.Index(key, "/")
+	return slash == -1 || key >= startKey(key[:slash+1], since)
+}
+
+// startKey returns the lowest key of the files under the top level prefix
+// that ListFilesSince should list, which is empty for prefixes that don't
+// contain batch files.
+func startKey(prefix string, since time.Time) string {
+	if prefix == taskMarkerPrefix || prefix == failedTaskPrefix || prefix == pendingTaskMarkerPrefix {
+		return ""
+	}
+	return prefix + since.UTC().Format(task.TimestampFormat())
+}
+
+// ListTaskMarkers lists the task markers written to Bucket by WriteTaskMarker,
+// without listing any other files in Bucket.
+func (b *Bucket) ListTaskMarkers() ([]string, error) {
+	files, err := b.listFiles(taskMarkerPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var markers []string
+	for _, file := range files {
+		markers = append(markers, strings.TrimPrefix(file, taskMarkerPrefix))
+	}
+
+	return markers, nil
+}
+
+// Ping checks that Bucket exists and that its contents can be listed with the
+// configured identity, without listing more than a single object.
+func (b *Bucket) Ping() error {
+	switch b.service {
+	case "s3":
+		return b.pingS3()
+	case "gs":
+		return b.pingGS()
+	case "file":
+		return b.pingLocal()
+	default:
+		return fmt.Errorf("invalid storage service %q", b.service)
+	}
+}
+
+// ListFailedTasks lists the markers of the tasks for which WriteFailedTask
+// wrote records to Bucket, without listing any other files in Bucket.
+func (b *Bucket) ListFailedTasks() ([]string, error) {
+	files, err := b.listFiles(failedTaskPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var markers []string
+	for _, file := range files {
+		markers = append(markers, strings.TrimPrefix(file, failedTaskPrefix))
+	}
+
+	return markers, nil
+}
+
+// ListPendingMarkers lists the pending markers written to Bucket by
+// WritePendingMarker that were neither promoted nor deleted, along with when
+// each was written, without listing any other files in Bucket. The Key of each
+// FileInfo is the pending marker.
+func (b *Bucket) ListPendingMarkers() ([]FileInfo, error) {
+	files, err := b.listFilesWithMetadata(pendingTaskMarkerPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range files {
+		files[i].Key = strings.TrimPrefix(files[i].Key, pendingTaskMarkerPrefix)
+	}
+
+	return files, nil
+}
+
+// ListFailedAttempts lists the markers of the tasks for which
+// WriteFailedAttempts wrote records to Bucket, without listing any other files
+// in Bucket.
+func (b *Bucket) ListFailedAttempts() ([]string, error) {
+	files, err := b.listFiles(failedAttemptsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var markers []string
+	for _, file := range files {
+		markers = append(markers, strings.TrimPrefix(file, failedAttemptsPrefix))
+	}
+
+	return markers, nil
+}
+
+// listFiles lists the files in Bucket whose names begin with prefix
+func (b *Bucket) listFiles(prefix string) ([]string, error) {
+	files, err := b.listFilesWithMetadata(prefix)
+	return fileKeys(files), err
+}
+
+// listFilesWithMetadata lists the files in Bucket whose names begin with
+// prefix, along with when they were last modified
+func (b *Bucket) listFilesWithMetadata(prefix string) ([]FileInfo, error) {
+	switch b.service {
+	case "s3":
+		return b.listFilesS3(prefix)
+	case "gs":
+		return b.listFilesGS(prefix)
+	case "file":
+		return b.listFilesLocal(prefix)
+	default:
+		return nil, fmt.Errorf("invalid storage service %q", b.service)
+	}
+}
+
+// WriteTaskMarker writes a marker for a scheduled task, which is an object in
+// the bucket whose key is "task-markers/${marker}". This works as a guard
+// against redundant tasks because both Amazon S3 and Google Cloud Storage offer
+// strong read-after-write consistency.
+//
+// https://aws.amazon.com/s3/consistency/
+// https://cloud.google.com/storage/docs/consistency
+//
+// The marker's body describes it and records the task, as JSON, so that the
+// task can be replayed with ReadTaskMarker. The object is written with
+// "Cache-Control: no-store" so that tooling reading markers over HTTP never
+// sees stale ones.
+func (b *Bucket) WriteTaskMarker(t task.Task) error {
+	return b.writeMarker(taskMarkerPrefix+t.Marker(), t)
+}
+
+// MarkerExists returns whether a task marker was written by WriteTaskMarker
+// or PromoteMarker for the task with the provided marker. It makes a single
+// request, which is cheaper than listing a bucket with many markers to find a
+// few of them.
+func (b *Bucket) MarkerExists(marker string) (bool, error) {
+	key := b.keyPrefix + taskMarkerPrefix + marker
+	switch b.service {
+	case "s3":
+		return b.objectExistsS3(key)
+	case "gs":
+		return b.objectExistsGS(key)
+	case "file":
+		return b.fileExistsLocal(key)
+	default:
+		return false, fmt.Errorf("invalid storage service %q", b.service)
+	}
+}
+
+// WritePendingMarker writes a pending marker for a task that is about to be
+// enqueued, which is an object in the bucket whose key is
+// "pending-task-markers/${marker}". A pending marker that outlives the process
+// that wrote it means that the process stopped without learning whether the
+// task was enqueued.
+func (b *Bucket) WritePendingMarker(t task.Task) error {
+	return b.writeMarker(pendingTaskMarkerPrefix+t.Marker(), t)
+}
+
+// PromoteMarker writes the task marker for a task whose pending marker was
+// previously written by WritePendingMarker, and then deletes the pending
+// marker. If PromoteMarker fails, it is safe to call it again.
+func (b *Bucket) PromoteMarker(t task.Task) error {
+	if err := b.WriteTaskMarker(t); err != nil {
+		return err
+	}
+	return b.DeletePendingMarker(t.Marker())
+}
+
+// DeletePendingMarker deletes a pending marker previously written by
+// WritePendingMarker. Deleting a pending marker that does not exist is not an
+// error.
+func (b *Bucket) DeletePendingMarker(marker string) error {
+	return b.deleteObject(pendingTaskMarkerPrefix + marker)
+}
+
+// WriteFailedTask writes a record of the failure to enqueue a task, which is an
+// object in the bucket whose key is "failed-tasks/${marker}".
+func (b *Bucket) WriteFailedTask(marker string, record []byte) error {
+	return b.writeObject(failedTaskPrefix+marker, record, objectMetadata{})
+}
+
+// ReadFailedAttempts returns the record of failed attempts to enqueue a task
+// previously written by WriteFailedAttempts
+func (b *Bucket) ReadFailedAttempts(marker string) ([]byte, error) {
+	return b.readObject(failedAttemptsPrefix + marker)
+}
+
+// WriteFailedAttempts writes a record of failed attempts to enqueue a task that
+// will be retried, which is an object in the bucket whose key is
+// "failed-attempts/${marker}"
+func (b *Bucket) WriteFailedAttempts(marker string, record []byte) error {
+	return b.writeObject(failedAttemptsPrefix+marker, record, objectMetadata{})
+}
+
+// DeleteFailedAttempts deletes a record previously written by
+// WriteFailedAttempts. Deleting a record that does not exist is not an error.
+func (b *Bucket) DeleteFailedAttempts(marker string) error {
+	return b.deleteObject(failedAttemptsPrefix + marker)
+}
+
+// ResetFailedTask deletes the failed task record and any record of failed
+// attempts for a task, so that the task is scheduled again as if it had never
+// been attempted. Resetting a task without such records is not an error.
+func (b *Bucket) ResetFailedTask(marker string) error {
+	if err := b.deleteObject(failedTaskPrefix + marker); err != nil {
+		return err
+	}
+	return b.DeleteFailedAttempts(marker)
+}
+
+// WriteScheduledMarkers writes the manifest of the task markers scheduled by a
+// run, which is an object in the bucket whose key is
+// "scheduled-markers/${runID}.json".
+func (b *Bucket) WriteScheduledMarkers(runID string, manifest []byte) error {
+	return b.writeObject(scheduledMarkersPrefix+runID+".json", manifest, objectMetadata{contentType: "application/json"})
+}
+
+// WriteAggregationBatches writes the JSON encoding of the batches of the
+// aggregation task with the provided marker, which is an object in the bucket
+// whose key is "aggregation-batches/${marker}.json", and returns that key. The
+// facilitator reads the batches of aggregation tasks whose BatchesObject is set
+// from that object.
+func (b *Bucket) WriteAggregationBatches(marker string, batches []byte) (string, error) {
+	key := aggregationBatchesPrefix + marker + ".json"
+	if err := b.writeObject(key, batches, objectMetadata{contentType: "application/json"}); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// ListAggregationBatches lists the markers of the aggregation tasks whose
+// batches were written to Bucket by WriteAggregationBatches
+func (b *Bucket) ListAggregationBatches() ([]string, error) {
+	files, err := b.listFiles(aggregationBatchesPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var markers []string
+	for _, file := range files {
+		markers = append(markers, strings.TrimSuffix(strings.TrimPrefix(file, aggregationBatchesPrefix), ".json"))
+	}
+
+	return markers, nil
+}
+
+// DeleteAggregationBatches deletes the batches of the aggregation task with the
+// provided marker written by WriteAggregationBatches
+func (b *Bucket) DeleteAggregationBatches(marker string) error {
+	return b.deleteObject(aggregationBatchesPrefix + marker + ".json")
+}
+
+// writeObject writes contents to the object in the bucket with the provided
+// key and metadata
+func (b *Bucket) writeObject(key string, contents []byte, metadata objectMetadata) error {
+	key = b.keyPrefix + key
+	switch b.service {
+	case "s3":
+		return b.writeObjectS3(key, contents, metadata)
+	case "gs":
+		return b.writeObjectGS(key, contents, metadata)
+	case "file":
+		return b.writeFileLocal(key, contents)
+	default:
+		return fmt.Errorf("invalid storage service %q", b.service)
+	}
+}
+
+// ReadFile returns the contents of the file in the bucket with the provided
+// key, unless it is larger than maxSize bytes
+func (b *Bucket) ReadFile(key string, maxSize int64) ([]byte, error) {
+	return b.readObjectLimited(key, maxSize)
+}
+
+// readObject returns the contents of the object in the bucket with the
+// provided key
+func (b *Bucket) readObject(key string) ([]byte, error) {
+	return b.readObjectLimited(key, -1)
+}
+
+// readObjectLimited returns the contents of the object in the bucket with the
+// provided key. If limit is not negative, objects larger than limit bytes are
+// not read in full, and an error wrapping ErrFileTooLarge is returned instead.
+func (b *Bucket) readObjectLimited(key string, limit int64) ([]byte, error) {
+	key = b.keyPrefix + key
+	switch b.service {
+	case "s3":
+		return b.readObjectS3(key, limit)
+	case "gs":
+		return b.readObjectGS(key, limit)
+	case "file":
+		return b.readFileLocal(key, limit)
+	default:
+		return nil, fmt.Errorf("invalid storage service %q", b.service)
+	}
+}
+
+// readAll reads reader to the end, unless limit is not negative and reader
+// holds more than limit bytes, in which case an error wrapping ErrFileTooLarge
+// is returned
+func readAll(reader io.Reader, limit int64) ([]byte, error) {
+	if limit < 0 {
+		return ioutil.ReadAll(reader)
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(contents)) > limit {
+		return nil, fmt.Errorf("more than %d bytes: %w", limit, ErrFileTooLarge)
+	}
+	return contents, nil
+}
+
+// DeleteTaskMarker deletes a marker previously written by WriteTaskMarker.
+// Deleting a marker that does not exist is not an error.
+func (b *Bucket) DeleteTaskMarker(marker string) error {
+	return b.deleteObject(taskMarkerPrefix + marker)
+}
+
+// deleteObject deletes the object in the bucket with the provided key
+func (b *Bucket) deleteObject(key string) error {
+	key = b.keyPrefix + key
+	switch b.service {
+	case "s3":
+		return b.deleteObjectS3(key)
+	case "gs":
+		return b.deleteObjectGS(key)
+	case "file":
+		return b.deleteFileLocal(key)
+	default:
+		return fmt.Errorf("invalid storage service %q", b.service)
+	}
+}
+
+// parseBucketURL splits a bucket URL into the storage service and the bucket
+// name, after removing any trailing slashes
+func parseBucketURL(bucketURL string) ([]string, error) {
+	supported := strings.Join(supportedServices, "://, ") + "://"
 	if bucketURL == "" {
-		return nil, fmt.Errorf("empty Bucket URL")
+		return nil, fmt.Errorf("empty Bucket URL, expected one of %s followed by the bucket name", supported)
+	}
+
+	parts := strings.SplitN(bucketURL, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("no scheme in Bucket URL %q, expected one of %s followed by the bucket name", bucketURL, supported)
+	}
+	if parts[0] == "gcs" {
+		return nil, fmt.Errorf("unsupported scheme in Bucket URL %q, use gs:// for Google Cloud Storage", bucketURL)
+	}
+	supportedService := false
+	for _, service := range supportedServices {
+		if parts[0] == service {
+			supportedService = true
+		}
+	}
+	if !supportedService {
+		return nil, fmt.Errorf("unsupported scheme %q in Bucket URL %q, expected one of %s", parts[0]+"://", bucketURL, supported)
+	}
+
+	name := strings.TrimRight(parts[1], "/")
+	if name == "" && parts[0] == "file" && parts[1] != "" {
+		// The root directory is a valid, if unwise, local bucket
+		name = "/"
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no bucket name in Bucket URL %q", bucketURL)
+	}
+	parts[1] = name
+	if parts[0] == "s3" {
+		if _, _, err := parseS3BucketName(parts[1]); err != nil {
+			return nil, fmt.Errorf("%w, expected s3://${region}/${bucket}, or s3:///${bucket} for the default region", err)
+		}
+	}
+
+	return parts, nil
+}
+
+func parseS3BucketName(bucketName string) (string, string, error) {
+	parts := strings.SplitN(bucketName, "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid S3 Bucket name %q", bucketName)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func (b *Bucket) s3Service(region string) (*s3.S3, error) {
+	sess, config, err := leaws.ClientConfig(region, b.identity, b.externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.s3Config.AccessKeyID != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(
+			b.s3Config.AccessKeyID, b.s3Config.SecretAccessKey, ""))
+	}
+	if b.s3Config.Endpoint != "" {
+		config = config.WithEndpoint(b.s3Config.Endpoint)
+	}
+	if b.s3Config.ForcePathStyle {
+		config = config.WithS3ForcePathStyle(true)
+	}
+	if b.s3Config.InsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		config = config.WithHTTPClient(&http.Client{Transport: transport})
+	}
+
+	return s3.New(sess, config), nil
+}
+
+func (b *Bucket) listFilesS3(prefix string) ([]FileInfo, error) {
+	region, bucket, err := parseS3BucketName(b.bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("listing files in s3://%s as %q", bucket, b.identity)
+
+	svc, err := b.s3Service(region)
+	if err != nil {
+		return nil, err
+	}
+
+	output, _, err := b.listObjectsS3(svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	return output, err
+}
+
+func (b *Bucket) listFilesSinceS3(since time.Time) ([]string, error) {
+	region, bucket, err := parseS3BucketName(b.bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("listing files since %s in s3://%s as %q", since, bucket, b.identity)
+
+	svc, err := b.s3Service(region)
+	if err != nil {
+		return nil, err
+	}
+
+	// List the top level prefixes, which are aggregation IDs, and then list
+	// the files under each one starting after the cutoff.
+	files, prefixes, err := b.listObjectsS3(svc, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Delimiter: aws.String("/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	output := fileKeys(files)
+
+	for _, prefix := range prefixes {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix),
+		}
+		if start := startKey(prefix, since); start != "" {
+			input.StartAfter = aws.String(start)
+		}
+		files, _, err := b.listObjectsS3(svc, input)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, fileKeys(files)...)
+	}
+
+	return output, nil
+}
+
+func (b *Bucket) listTopLevelPrefixesS3() ([]string, error) {
+	region, bucket, err := parseS3BucketName(b.bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("listing top level prefixes in s3://%s as %q", bucket, b.identity)
+
+	svc, err := b.s3Service(region)
+	if err != nil {
+		return nil, err
+	}
+
+	_, prefixes, err := b.listObjectsS3(svc, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Delimiter: aws.String("/"),
+	})
+	return prefixes, err
+}
+
+// listObjectsS3 pages through the results of the provided list request,
+// returning the objects and the common prefixes. The prefix and
+// start key of the request and the returned keys and prefixes are relative to
+// the Bucket's key prefix.
+func (b *Bucket) listObjectsS3(svc *s3.S3, input *s3.ListObjectsV2Input) ([]FileInfo, []string, error) {
+	input.MaxKeys = aws.Int64(1000)
+	input.Prefix = aws.String(b.keyPrefix + aws.StringValue(input.Prefix))
+	if input.StartAfter != nil {
+		input.StartAfter = aws.String(b.keyPrefix + *input.StartAfter)
+	}
+
+	var files []FileInfo
+	var prefixes []string
+	for {
+		resp, err := svc.ListObjectsV2(input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to list items in Bucket %q, %w", b.bucketName, err)
+		}
+		for _, item := range resp.Contents {
+			files = append(files, FileInfo{
+				Key:          strings.TrimPrefix(*item.Key, b.keyPrefix),
+				LastModified: aws.TimeValue(item.LastModified),
+			})
+		}
+		for _, prefix := range resp.CommonPrefixes {
+			prefixes = append(prefixes, *prefix.Prefix)
+		}
+		if !*resp.IsTruncated {
+			break
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+	return files, b.relativeKeys(prefixes), nil
+}
+
+func (b *Bucket) pingS3() error {
+	region, bucket, err := parseS3BucketName(b.bucketName)
+	if err != nil {
+		return err
+	}
+
+	svc, err := b.s3Service(region)
+	if err != nil {
+		return err
+	}
+
+	if _, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		MaxKeys: aws.Int64(1),
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(b.keyPrefix),
+	}); err != nil {
+		return fmt.Errorf("unable to list items in Bucket %q as %q: %w", b.bucketName, b.identity, err)
+	}
+
+	return nil
+}
+
+func (b *Bucket) writeObjectS3(key string, contents []byte, metadata objectMetadata) error {
+	region, bucket, err := parseS3BucketName(b.bucketName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("writing s3://%s/%s as %q", bucket, key, b.identity)
+
+	if b.dryRun {
+		log.Printf("dry run, skipping write")
+		return nil
+	}
+
+	svc, err := b.s3Service(region)
+	if err != nil {
+		return err
 	}
-	if !strings.HasPrefix(bucketURL, "s3://") && !strings.HasPrefix(bucketURL, "gs://") {
-		return nil, fmt.Errorf("invalid Bucket %q with identity %q", bucketURL, identity)
+	input := &s3.PutObjectInput{
+		Body:   aws.ReadSeekCloser(bytes.NewReader(contents)),
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 	}
-	if strings.HasPrefix(bucketURL, "gs://") && identity != "" {
-		return nil, fmt.Errorf("workflow-manager doesn't support alternate identities (%s) for gs:// Bucket (%q)",
-			identity, bucketURL)
+	if metadata.contentType != "" {
+		input.ContentType = aws.String(metadata.contentType)
 	}
-
-	return &Bucket{
-		service:    bucketURL[0:2],
-		bucketName: bucketURL[5:],
-		identity:   identity,
-		dryRun:     dryRun,
-	}, nil
-}
-
-// ListFiles lists the files contained in Bucket
-func (b *Bucket) ListFiles() ([]string, error) {
-	switch b.service {
-	case "s3":
-		return b.listFilesS3()
-	case "gs":
-		return b.listFilesGS()
-	default:
-		return nil, fmt.Errorf("invalid storage service %q", b.service)
+	if metadata.cacheControl != "" {
+		input.CacheControl = aws.String(metadata.cacheControl)
 	}
-}
 
-// WriteTaskMarker writes a marker for a scheduled task, which is an object in
-// the bucket whose key is "task-markers/${marker}". This works as a guard
-// against redundant tasks because both Amazon S3 and Google Cloud Storage offer
-// strong read-after-write consistency.
-//
-// https://aws.amazon.com/s3/consistency/
-// https://cloud.google.com/storage/docs/consistency
-func (b *Bucket) WriteTaskMarker(marker string) error {
-	markerObject := fmt.Sprintf("task-markers/%s", marker)
-	switch b.service {
-	case "s3":
-		return b.writeTaskMarkerS3(markerObject)
-	case "gs":
-		return b.writeTaskMarkerGS(markerObject)
-	default:
-		return fmt.Errorf("invalid storage service %q", b.service)
+	// Deliberately ignore the result, we only care if the write succeeds
+	if _, err := svc.PutObject(input); err != nil {
+		return fmt.Errorf("storage.PutObject: %w", err)
 	}
+
+	return nil
 }
 
-func parseS3BucketName(bucketName string) (string, string, error) {
-	parts := strings.SplitN(bucketName, "/", 2)
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("invalid S3 Bucket name %q", bucketName)
+func (b *Bucket) readObjectS3(key string, limit int64) ([]byte, error) {
+	region, bucket, err := parseS3BucketName(b.bucketName)
+	if err != nil {
+		return nil, err
 	}
 
-	return parts[0], parts[1], nil
-}
+	log.Printf("reading s3://%s/%s as %q", bucket, key, b.identity)
 
-func (b *Bucket) s3Service(region string) (*s3.S3, error) {
-	sess, config, err := leaws.ClientConfig(region, b.identity)
+	svc, err := b.s3Service(region)
 	if err != nil {
 		return nil, err
 	}
+	output, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage.GetObject: %w", err)
+	}
+	defer output.Body.Close()
 
-	return s3.New(sess, config), nil
+	contents, err := readAll(output.Body, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read S3 object: %w", err)
+	}
+
+	return contents, nil
 }
 
-func (b *Bucket) listFilesS3() ([]string, error) {
+func (b *Bucket) objectExistsS3(key string) (bool, error) {
 	region, bucket, err := parseS3BucketName(b.bucketName)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	log.Printf("listing files in s3://%s as %q", bucket, b.identity)
+	log.Debugf("checking for s3://%s/%s as %q", bucket, key, b.identity)
 
 	svc, err := b.s3Service(region)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-
-	var output []string
-	var nextContinuationToken = ""
-	for {
-		input := &s3.ListObjectsV2Input{
-			MaxKeys: aws.Int64(1000),
-			Bucket:  aws.String(bucket),
-		}
-		if nextContinuationToken != "" {
-			input.ContinuationToken = &nextContinuationToken
-		}
-		resp, err := svc.ListObjectsV2(input)
-		if err != nil {
-			return nil, fmt.Errorf("unable to list items in Bucket %q, %w", b.bucketName, err)
-		}
-		for _, item := range resp.Contents {
-			output = append(output, *item.Key)
-		}
-		if !*resp.IsTruncated {
-			break
+	if _, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		var requestFailure awserr.RequestFailure
+		if errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusNotFound {
+			return false, nil
 		}
-		nextContinuationToken = *resp.NextContinuationToken
+		return false, fmt.Errorf("storage.HeadObject: %w", err)
 	}
-	return output, nil
+
+	return true, nil
 }
 
-func (b *Bucket) writeTaskMarkerS3(marker string) error {
+func (b *Bucket) deleteObjectS3(key string) error {
 	region, bucket, err := parseS3BucketName(b.bucketName)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("writing task marker to s3://%s/%s as %q", bucket, marker, b.identity)
+	log.Printf("deleting s3://%s/%s as %q", bucket, key, b.identity)
 
 	if b.dryRun {
-		log.Printf("dry run, skipping marker write")
+		log.Printf("dry run, skipping delete")
 		return nil
 	}
 
@@ -156,17 +1099,13 @@ func (b *Bucket) writeTaskMarkerS3(marker string) error {
 	if err != nil {
 		return err
 	}
-	input := &s3.PutObjectInput{
-		// Doesn't matter what the file contents are, but use the task name just
-		// in case S3 balks at an empty body
-		Body:   aws.ReadSeekCloser(strings.NewReader(marker)),
-		Bucket: aws.String(bucket),
-		Key:    aws.String(marker),
-	}
 
-	// Deliberately ignore the result, we only care if the write succeeds
-	if _, err := svc.PutObject(input); err != nil {
-		return fmt.Errorf("storage.PutObject: %w", err)
+	// S3 DeleteObject succeeds if the object doesn't exist
+	if _, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return fmt.Errorf("storage.DeleteObject: %w", err)
 	}
 
 	return nil
@@ -188,7 +1127,17 @@ func (b *Bucket) gcsClient() (*storage.Client, error) {
 	return client, nil
 }
 
-func (b *Bucket) listFilesGS() ([]string, error) {
+// gcsBucketHandle returns a handle to the Bucket's GCS bucket, with requests
+// billed to the billing project, if any
+func (b *Bucket) gcsBucketHandle(client *storage.Client) *storage.BucketHandle {
+	bkt := client.Bucket(b.bucketName)
+	if b.gcsConfig.BillingProject != "" {
+		bkt = bkt.UserProject(b.gcsConfig.BillingProject)
+	}
+	return bkt
+}
+
+func (b *Bucket) listFilesGS(prefix string) ([]FileInfo, error) {
 	ctx, cancel := utils.ContextWithTimeout()
 	defer cancel()
 
@@ -197,11 +1146,71 @@ func (b *Bucket) listFilesGS() ([]string, error) {
 		return nil, err
 	}
 
-	bkt := client.Bucket(b.bucketName)
-	query := &storage.Query{Prefix: ""}
+	bkt := b.gcsBucketHandle(client)
 
 	log.Printf("looking for ready batches in gs://%s as (ambient service account)", b.bucketName)
-	var output []string
+	output, _, err := b.listObjectsGS(ctx, bkt, &storage.Query{Prefix: prefix})
+	return output, err
+}
+
+func (b *Bucket) listFilesSinceGS(since time.Time) ([]string, error) {
+	ctx, cancel := utils.ContextWithTimeout()
+	defer cancel()
+
+	client, err := b.gcsClient()
+	if err != nil {
+		return nil, err
+	}
+
+	bkt := b.gcsBucketHandle(client)
+
+	log.Printf("looking for ready batches since %s in gs://%s as (ambient service account)", since, b.bucketName)
+
+	// List the top level prefixes, which are aggregation IDs, and then list
+	// the files under each one starting from the cutoff.
+	files, prefixes, err := b.listObjectsGS(ctx, bkt, &storage.Query{Delimiter: "/"})
+	if err != nil {
+		return nil, err
+	}
+	output := fileKeys(files)
+
+	for _, prefix := range prefixes {
+		files, _, err := b.listObjectsGS(ctx, bkt, &storage.Query{
+			Prefix:      prefix,
+			StartOffset: startKey(prefix, since),
+		})
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, fileKeys(files)...)
+	}
+
+	return output, nil
+}
+
+func (b *Bucket) listTopLevelPrefixesGS() ([]string, error) {
+	ctx, cancel := utils.ContextWithTimeout()
+	defer cancel()
+
+	client, err := b.gcsClient()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("listing top level prefixes in gs://%s as (ambient service account)", b.bucketName)
+	_, prefixes, err := b.listObjectsGS(ctx, b.gcsBucketHandle(client), &storage.Query{Delimiter: "/"})
+	return prefixes, err
+}
+
+// listObjectsGS pages through the results of the provided query, returning the
+// objects and the prefixes. The prefix and start offset of the
+// query and the returned names and prefixes are relative to the Bucket's key
+// prefix.
+func (b *Bucket) listObjectsGS(ctx context.Context, bkt *storage.BucketHandle, query *storage.Query) ([]FileInfo, []string, error) {
+	query.Prefix = b.keyPrefix + query.Prefix
+	if query.StartOffset != "" {
+		query.StartOffset = b.keyPrefix + query.StartOffset
+	}
 	it := bkt.Objects(ctx, query)
 
 	// Use the paginated API to list Bucket contents, as otherwise we would only
@@ -213,7 +1222,7 @@ func (b *Bucket) listFilesGS() ([]string, error) {
 		// NextPage will append to the objects slice
 		nextPageToken, err := p.NextPage(&objects)
 		if err != nil {
-			return nil, fmt.Errorf("storage.nextPage: %w", err)
+			return nil, nil, fmt.Errorf("storage.nextPage: %w", err)
 		}
 
 		if nextPageToken == "" {
@@ -222,39 +1231,69 @@ func (b *Bucket) listFilesGS() ([]string, error) {
 		}
 	}
 
+	var files []FileInfo
+	var prefixes []string
 	for _, obj := range objects {
-		output = append(output, obj.Name)
+		// With a delimiter, prefixes are returned as objects with only Prefix
+		// set
+		if obj.Prefix != "" {
+			prefixes = append(prefixes, obj.Prefix)
+			continue
+		}
+		files = append(files, FileInfo{
+			Key:          strings.TrimPrefix(obj.Name, b.keyPrefix),
+			LastModified: obj.Updated,
+		})
 	}
 
-	return output, nil
+	return files, b.relativeKeys(prefixes), nil
 }
 
-func (b *Bucket) writeTaskMarkerGS(marker string) error {
+func (b *Bucket) pingGS() error {
+	ctx, cancel := utils.ContextWithTimeout()
+	defer cancel()
+
 	client, err := b.gcsClient()
 	if err != nil {
 		return err
 	}
 
-	bkt := client.Bucket(b.bucketName)
+	it := b.gcsBucketHandle(client).Objects(ctx, &storage.Query{Prefix: b.keyPrefix})
+	it.PageInfo().MaxSize = 1
+	if _, err := it.Next(); err != nil && err != iterator.Done {
+		return fmt.Errorf("unable to list items in Bucket %q: %w", b.bucketName, err)
+	}
+
+	return nil
+}
+
+func (b *Bucket) writeObjectGS(key string, contents []byte, metadata objectMetadata) error {
+	client, err := b.gcsClient()
+	if err != nil {
+		return err
+	}
 
-	log.Printf("writing task marker to gs://%s/%s as (ambient service account)",
-		b.bucketName, marker)
+	bkt := b.gcsBucketHandle(client)
+
+	log.Printf("writing gs://%s/%s as (ambient service account)", b.bucketName, key)
 
 	if b.dryRun {
-		log.Printf("dry run, skipping marker write")
+		log.Printf("dry run, skipping write")
 		return nil
 	}
 
-	object := bkt.Object(marker)
+	object := bkt.Object(key)
 
 	ctx, cancel := utils.ContextWithTimeout()
 	defer cancel()
 
 	writer := object.NewWriter(ctx)
-	_, err = io.WriteString(writer, marker)
+	writer.ContentType = metadata.contentType
+	writer.CacheControl = metadata.cacheControl
+	_, err = writer.Write(contents)
 	if err != nil {
 		writer.Close()
-		return fmt.Errorf("failed to write marker to GCS: %w", err)
+		return fmt.Errorf("failed to write object to GCS: %w", err)
 	}
 
 	// If writes to GCS fail, we won't find out until we call Close, so we don't
@@ -266,3 +1305,206 @@ func (b *Bucket) writeTaskMarkerGS(marker string) error {
 
 	return nil
 }
+
+func (b *Bucket) readObjectGS(key string, limit int64) ([]byte, error) {
+	client, err := b.gcsClient()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("reading gs://%s/%s as (ambient service account)", b.bucketName, key)
+
+	ctx, cancel := utils.ContextWithTimeout()
+	defer cancel()
+
+	reader, err := b.gcsBucketHandle(client).Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GCS object: %w", err)
+	}
+	defer reader.Close()
+
+	contents, err := readAll(reader, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GCS object: %w", err)
+	}
+
+	return contents, nil
+}
+
+func (b *Bucket) listFilesLocal(prefix string) ([]FileInfo, error) {
+	log.Printf("listing files in file://%s", b.bucketName)
+
+	var output []FileInfo
+	err := filepath.Walk(b.bucketName, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(b.bucketName, path)
+		if err != nil {
+			return err
+		}
+		// Object keys always use '/' as a separator, regardless of platform
+		key := filepath.ToSlash(relativePath)
+		if strings.HasPrefix(key, prefix) {
+			output = append(output, FileInfo{Key: key, LastModified: info.ModTime()})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list files in directory %q: %w", b.bucketName, err)
+	}
+
+	return output, nil
+}
+
+func (b *Bucket) listTopLevelPrefixesLocal() ([]string, error) {
+	log.Printf("listing top level prefixes in file://%s", b.bucketName)
+
+	entries, err := ioutil.ReadDir(b.bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list directory %q: %w", b.bucketName, err)
+	}
+
+	var output []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			output = append(output, entry.Name()+"/")
+		}
+	}
+
+	return output, nil
+}
+
+func (b *Bucket) pingLocal() error {
+	info, err := os.Stat(b.bucketName)
+	if err != nil {
+		return fmt.Errorf("unable to stat directory %q: %w", b.bucketName, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", b.bucketName)
+	}
+
+	return nil
+}
+
+func (b *Bucket) writeFileLocal(key string, contents []byte) error {
+	path := filepath.Join(b.bucketName, filepath.FromSlash(key))
+
+	log.Printf("writing file://%s", path)
+
+	if b.dryRun {
+		log.Printf("dry run, skipping write")
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for file: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Bucket) readFileLocal(key string, limit int64) ([]byte, error) {
+	path := filepath.Join(b.bucketName, filepath.FromSlash(key))
+
+	log.Printf("reading file://%s", path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer file.Close()
+
+	contents, err := readAll(file, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return contents, nil
+}
+
+func (b *Bucket) objectExistsGS(key string) (bool, error) {
+	client, err := b.gcsClient()
+	if err != nil {
+		return false, err
+	}
+
+	log.Debugf("checking for gs://%s/%s as (ambient service account)", b.bucketName, key)
+
+	ctx, cancel := utils.ContextWithTimeout()
+	defer cancel()
+
+	if _, err := b.gcsBucketHandle(client).Object(key).Attrs(ctx); err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get GCS object attributes: %w", err)
+	}
+
+	return true, nil
+}
+
+func (b *Bucket) deleteObjectGS(key string) error {
+	client, err := b.gcsClient()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("deleting gs://%s/%s as (ambient service account)", b.bucketName, key)
+
+	if b.dryRun {
+		log.Printf("dry run, skipping delete")
+		return nil
+	}
+
+	ctx, cancel := utils.ContextWithTimeout()
+	defer cancel()
+
+	err = b.gcsBucketHandle(client).Object(key).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete GCS object: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Bucket) fileExistsLocal(key string) (bool, error) {
+	path := filepath.Join(b.bucketName, filepath.FromSlash(key))
+
+	log.Debugf("checking for file://%s", path)
+
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	return true, nil
+}
+
+func (b *Bucket) deleteFileLocal(key string) error {
+	path := filepath.Join(b.bucketName, filepath.FromSlash(key))
+
+	log.Printf("deleting file://%s", path)
+
+	if b.dryRun {
+		log.Printf("dry run, skipping delete")
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,958 @@
+package bucket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// markerTask is a task that is only a marker, for tests concerned only with
+// markers
+type markerTask string
+
+func (t markerTask) Marker() string {
+	return string(t)
+}
+
+func (t markerTask) Attributes() map[string]string {
+	return nil
+}
+
+func TestLocalBucketTaskMarkers(t *testing.T) {
+	dir := t.TempDir()
+	batchDir := filepath.Join(dir, "kittens-seen", "2020", "10", "31", "20", "29")
+	if err := os.MkdirAll(batchDir, 0755); err != nil {
+		t.Fatalf("failed to create batch directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(batchDir, "b8a5579a-f984-460a-a42d-2813cbf57771.batch"), []byte{}, 0644); err != nil {
+		t.Fatalf("failed to write batch file: %s", err)
+	}
+
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	markers := []string{"intake-kittens-seen-2020-10-31-20-29-b8a5579a", "aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00"}
+	for _, marker := range markers {
+		if err := bucket.WriteTaskMarker(markerTask(marker)); err != nil {
+			t.Fatalf("unexpected error writing marker: %s", err)
+		}
+	}
+
+	listedMarkers, err := bucket.ListTaskMarkers()
+	if err != nil {
+		t.Fatalf("unexpected error listing markers: %s", err)
+	}
+	sort.Strings(markers)
+	sort.Strings(listedMarkers)
+	if !reflect.DeepEqual(markers, listedMarkers) {
+		t.Errorf("expected markers %q, got %q", markers, listedMarkers)
+	}
+
+	files, err := bucket.ListFiles("")
+	if err != nil {
+		t.Fatalf("unexpected error listing files: %s", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("expected batch file and two markers, got %q", files)
+	}
+}
+
+func TestLocalBucketDryRun(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, true)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	if err := bucket.WriteTaskMarker(markerTask("intake-kittens-seen-2020-10-31-20-29-b8a5579a")); err != nil {
+		t.Fatalf("unexpected error writing marker: %s", err)
+	}
+
+	markers, err := bucket.ListTaskMarkers()
+	if err != nil {
+		t.Fatalf("unexpected error listing markers: %s", err)
+	}
+	if len(markers) != 0 {
+		t.Errorf("unexpected markers written in dry run: %q", markers)
+	}
+}
+
+func TestLocalBucketDeleteTaskMarker(t *testing.T) {
+	bucket, err := New("file://"+t.TempDir(), "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	if err := bucket.WriteTaskMarker(markerTask("intake-kittens-seen-2020-10-31-20-29-b8a5579a")); err != nil {
+		t.Fatalf("unexpected error writing marker: %s", err)
+	}
+	if err := bucket.DeleteTaskMarker("intake-kittens-seen-2020-10-31-20-29-b8a5579a"); err != nil {
+		t.Fatalf("unexpected error deleting marker: %s", err)
+	}
+	// Deleting a nonexistent marker should succeed
+	if err := bucket.DeleteTaskMarker("intake-kittens-seen-2020-10-31-20-29-b8a5579a"); err != nil {
+		t.Fatalf("unexpected error deleting nonexistent marker: %s", err)
+	}
+
+	markers, err := bucket.ListTaskMarkers()
+	if err != nil {
+		t.Fatalf("unexpected error listing markers: %s", err)
+	}
+	if len(markers) != 0 {
+		t.Errorf("unexpected markers after deletion: %q", markers)
+	}
+}
+
+func TestLocalBucketMarkerContents(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	aggregationStart := task.Timestamp(time.Date(2020, 10, 31, 16, 0, 0, 0, time.UTC))
+	aggregationEnd := task.Timestamp(time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC))
+	aggregation := task.Aggregation{
+		AggregationID:    "kittens-seen",
+		AggregationStart: aggregationStart,
+		AggregationEnd:   aggregationEnd,
+		Batches:          []task.Batch{{ID: "b8a5579a-f984-460a-a42d-2813cbf57771", Time: aggregationStart}},
+		Version:          task.TaskSchemaVersion,
+		IsFirst:          true,
+		FieldNaming:      task.SnakeCase,
+	}
+	marker := aggregation.Marker()
+	before := time.Now().UTC().Add(-time.Second)
+	if err := bucket.WriteTaskMarker(aggregation); err != nil {
+		t.Fatalf("unexpected error writing marker: %s", err)
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(dir, "task-markers", marker))
+	if err != nil {
+		t.Fatalf("failed to read marker: %s", err)
+	}
+	var contents markerContents
+	if err := json.Unmarshal(body, &contents); err != nil {
+		t.Fatalf("failed to unmarshal marker %q: %s", body, err)
+	}
+	if contents.Marker != marker || contents.TaskType != "aggregate" {
+		t.Errorf("expected marker %q of type aggregate, got %+v", marker, contents)
+	}
+	if contents.CreatedAt.Before(before) || contents.CreatedAt.After(time.Now().UTC()) {
+		t.Errorf("unexpected creation time %s", contents.CreatedAt)
+	}
+
+	replayed, err := bucket.ReadTaskMarker(marker)
+	if err != nil {
+		t.Fatalf("unexpected error reading marker: %s", err)
+	}
+	if !reflect.DeepEqual(replayed, aggregation) {
+		t.Errorf("expected marker to record task %+v, got %+v", aggregation, replayed)
+	}
+
+	// Markers written by earlier versions record no task
+	legacy := "intake-kittens-seen-2020-10-31-20-29-b8a5579a"
+	if err := bucket.writeObject(taskMarkerPrefix+legacy, []byte(taskMarkerPrefix+legacy), objectMetadata{}); err != nil {
+		t.Fatalf("unexpected error writing legacy marker: %s", err)
+	}
+	if _, err := bucket.ReadTaskMarker(legacy); err == nil {
+		t.Errorf("expected error reading marker that records no task")
+	}
+}
+
+func TestLocalBucketMarkerExists(t *testing.T) {
+	bucket, err := New("file://"+t.TempDir(), "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	written := "intake-kittens-seen-2020-10-31-20-29-b8a5579a"
+	pending := "intake-kittens-seen-2020-10-31-20-29-0f0f0f0f"
+	if err := bucket.WriteTaskMarker(markerTask(written)); err != nil {
+		t.Fatalf("unexpected error writing marker: %s", err)
+	}
+	if err := bucket.WritePendingMarker(markerTask(pending)); err != nil {
+		t.Fatalf("unexpected error writing pending marker: %s", err)
+	}
+
+	for marker, expected := range map[string]bool{
+		written: true,
+		// Pending markers aren't task markers
+		pending:                        false,
+		"aggregate-kittens-seen-never": false,
+	} {
+		exists, err := bucket.MarkerExists(marker)
+		if err != nil {
+			t.Fatalf("unexpected error checking for marker %s: %s", marker, err)
+		}
+		if exists != expected {
+			t.Errorf("expected marker %s to exist: %t, got %t", marker, expected, exists)
+		}
+	}
+}
+
+func TestLocalBucketPing(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte{}, 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	var testCases = []struct {
+		name      string
+		path      string
+		expectErr bool
+	}{
+		{name: "directory", path: dir},
+		{name: "missing", path: filepath.Join(dir, "missing"), expectErr: true},
+		{name: "not-directory", path: file, expectErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			bucket, err := New("file://"+testCase.path, "", "", S3Config{}, GCSConfig{}, false)
+			if err != nil {
+				t.Fatalf("unexpected error creating bucket: %s", err)
+			}
+			err = bucket.Ping()
+			if testCase.expectErr && err == nil {
+				t.Errorf("expected error")
+			} else if !testCase.expectErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestLocalBucketFailedTasks(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	marker := "intake-kittens-seen-2020-10-31-20-29-b8a5579a"
+	record := []byte(`{"error":"message too large"}`)
+	if err := bucket.WriteFailedTask(marker, record); err != nil {
+		t.Fatalf("unexpected error writing failed task record: %s", err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "failed-tasks", marker))
+	if err != nil {
+		t.Fatalf("failed to read failed task record: %s", err)
+	}
+	if !reflect.DeepEqual(contents, record) {
+		t.Errorf("expected record %q, got %q", record, contents)
+	}
+
+	failedTasks, err := bucket.ListFailedTasks()
+	if err != nil {
+		t.Fatalf("unexpected error listing failed tasks: %s", err)
+	}
+	if !reflect.DeepEqual(failedTasks, []string{marker}) {
+		t.Errorf("expected failed tasks %q, got %q", []string{marker}, failedTasks)
+	}
+
+	markers, err := bucket.ListTaskMarkers()
+	if err != nil {
+		t.Fatalf("unexpected error listing markers: %s", err)
+	}
+	if len(markers) != 0 {
+		t.Errorf("unexpected task markers %q", markers)
+	}
+}
+
+func TestLocalBucketFailedAttempts(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	marker := "aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00"
+	for _, record := range [][]byte{[]byte(`{"attempts":1}`), []byte(`{"attempts":2}`)} {
+		if err := bucket.WriteFailedAttempts(marker, record); err != nil {
+			t.Fatalf("unexpected error writing failed attempts: %s", err)
+		}
+		contents, err := bucket.ReadFailedAttempts(marker)
+		if err != nil {
+			t.Fatalf("unexpected error reading failed attempts: %s", err)
+		}
+		if !reflect.DeepEqual(contents, record) {
+			t.Errorf("expected record %q, got %q", record, contents)
+		}
+	}
+
+	attempts, err := bucket.ListFailedAttempts()
+	if err != nil {
+		t.Fatalf("unexpected error listing failed attempts: %s", err)
+	}
+	if !reflect.DeepEqual(attempts, []string{marker}) {
+		t.Errorf("expected failed attempts %q, got %q", []string{marker}, attempts)
+	}
+
+	if err := bucket.WriteFailedTask(marker, []byte(`{"error":"message too large"}`)); err != nil {
+		t.Fatalf("unexpected error writing failed task record: %s", err)
+	}
+	if err := bucket.ResetFailedTask(marker); err != nil {
+		t.Fatalf("unexpected error resetting failed task: %s", err)
+	}
+	// Resetting again is not an error
+	if err := bucket.ResetFailedTask(marker); err != nil {
+		t.Fatalf("unexpected error resetting failed task again: %s", err)
+	}
+
+	if attempts, err := bucket.ListFailedAttempts(); err != nil || len(attempts) != 0 {
+		t.Errorf("expected no failed attempts after reset, got %q (error %v)", attempts, err)
+	}
+	if failedTasks, err := bucket.ListFailedTasks(); err != nil || len(failedTasks) != 0 {
+		t.Errorf("expected no failed tasks after reset, got %q (error %v)", failedTasks, err)
+	}
+	if _, err := bucket.ReadFailedAttempts(marker); err == nil {
+		t.Errorf("expected error reading deleted failed attempts")
+	}
+}
+
+func TestLocalBucketScheduledMarkers(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	manifest := []byte(`{"run_id":"20201101T040100Z-0a0a0a0a","markers":[]}`)
+	if err := bucket.WriteScheduledMarkers("20201101T040100Z-0a0a0a0a", manifest); err != nil {
+		t.Fatalf("unexpected error writing manifest: %s", err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "scheduled-markers", "20201101T040100Z-0a0a0a0a.json"))
+	if err != nil {
+		t.Fatalf("failed to read manifest: %s", err)
+	}
+	if !reflect.DeepEqual(contents, manifest) {
+		t.Errorf("expected manifest %q, got %q", manifest, contents)
+	}
+
+	// Manifests aren't mistaken for task markers
+	markers, err := bucket.ListTaskMarkers()
+	if err != nil {
+		t.Fatalf("unexpected error listing markers: %s", err)
+	}
+	if len(markers) != 0 {
+		t.Errorf("unexpected task markers %q", markers)
+	}
+}
+
+func TestLocalBucketAggregationBatches(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	batches := []byte(`[{"id":"b8a5579a-f984-460a-a42d-2813cbf57771","time":"2020/10/31/20/29"}]`)
+	key, err := bucket.WriteAggregationBatches("aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00", batches)
+	if err != nil {
+		t.Fatalf("unexpected error writing batches: %s", err)
+	}
+	if expected := "aggregation-batches/aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00.json"; key != expected {
+		t.Errorf("expected key %q, got %q", expected, key)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, key))
+	if err != nil {
+		t.Fatalf("failed to read batches: %s", err)
+	}
+	if !reflect.DeepEqual(contents, batches) {
+		t.Errorf("expected batches %q, got %q", batches, contents)
+	}
+
+	markers, err := bucket.ListAggregationBatches()
+	if err != nil {
+		t.Fatalf("unexpected error listing batches: %s", err)
+	}
+	if expected := []string{"aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00"}; !reflect.DeepEqual(markers, expected) {
+		t.Errorf("expected markers %q, got %q", expected, markers)
+	}
+
+	if err := bucket.DeleteAggregationBatches(markers[0]); err != nil {
+		t.Fatalf("unexpected error deleting batches: %s", err)
+	}
+	if markers, err := bucket.ListAggregationBatches(); err != nil || len(markers) != 0 {
+		t.Errorf("expected no batches after deletion, got %q (error %v)", markers, err)
+	}
+}
+
+func TestLocalBucketPendingMarkers(t *testing.T) {
+	bucket, err := New("file://"+t.TempDir(), "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	promoted := "intake-kittens-seen-2020-10-31-20-29-b8a5579a"
+	rolledBack := "intake-kittens-seen-2020-10-31-20-29-0f0f0f0f"
+	stale := "aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00"
+	for _, marker := range []string{promoted, rolledBack, stale} {
+		if err := bucket.WritePendingMarker(markerTask(marker)); err != nil {
+			t.Fatalf("unexpected error writing pending marker: %s", err)
+		}
+	}
+	if err := bucket.PromoteMarker(markerTask(promoted)); err != nil {
+		t.Fatalf("unexpected error promoting marker: %s", err)
+	}
+	// Promoting again, as when retrying a promotion that failed, should succeed
+	if err := bucket.PromoteMarker(markerTask(promoted)); err != nil {
+		t.Fatalf("unexpected error promoting marker again: %s", err)
+	}
+	if err := bucket.DeletePendingMarker(rolledBack); err != nil {
+		t.Fatalf("unexpected error deleting pending marker: %s", err)
+	}
+
+	pendingMarkers, err := bucket.ListPendingMarkers()
+	if err != nil {
+		t.Fatalf("unexpected error listing pending markers: %s", err)
+	}
+	if keys := fileKeys(pendingMarkers); !reflect.DeepEqual(keys, []string{stale}) {
+		t.Errorf("expected pending markers %q, got %q", []string{stale}, keys)
+	} else if pendingMarkers[0].LastModified.IsZero() {
+		t.Errorf("expected time pending marker %s was written", stale)
+	}
+
+	markers, err := bucket.ListTaskMarkers()
+	if err != nil {
+		t.Fatalf("unexpected error listing markers: %s", err)
+	}
+	if !reflect.DeepEqual(markers, []string{promoted}) {
+		t.Errorf("expected markers %q, got %q", []string{promoted}, markers)
+	}
+}
+
+func TestLocalBucketListFilesSince(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	files := []string{
+		"kittens-seen/2020/10/30/23/59/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/11/01/00/00/1e1e1e1e-f984-460a-a42d-2813cbf57771.batch",
+		"puppies-seen/2019/01/01/00/00/2d2d2d2d-f984-460a-a42d-2813cbf57771.batch",
+		"task-markers/intake-kittens-seen-2020-10-30-23-59-0f0f0f0f-f984-460a-a42d-2813cbf57771",
+		"failed-tasks/intake-puppies-seen-2019-01-01-00-00-2d2d2d2d-f984-460a-a42d-2813cbf57771",
+		"pending-task-markers/intake-puppies-seen-2019-01-01-00-00-2d2d2d2d-f984-460a-a42d-2813cbf57771",
+		"unexpected-object",
+	}
+	for _, file := range files {
+		if err := bucket.writeObject(file, []byte(file), objectMetadata{}); err != nil {
+			t.Fatalf("failed to write %s: %s", file, err)
+		}
+	}
+
+	since := time.Date(2020, 10, 31, 20, 29, 0, 0, time.UTC)
+	listed, err := bucket.ListFilesSince(since)
+	if err != nil {
+		t.Fatalf("unexpected error listing files: %s", err)
+	}
+
+	expected := []string{
+		"failed-tasks/intake-puppies-seen-2019-01-01-00-00-2d2d2d2d-f984-460a-a42d-2813cbf57771",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/11/01/00/00/1e1e1e1e-f984-460a-a42d-2813cbf57771.batch",
+		"pending-task-markers/intake-puppies-seen-2019-01-01-00-00-2d2d2d2d-f984-460a-a42d-2813cbf57771",
+		"task-markers/intake-kittens-seen-2020-10-30-23-59-0f0f0f0f-f984-460a-a42d-2813cbf57771",
+		"unexpected-object",
+	}
+	sort.Strings(listed)
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("expected files %q, got %q", expected, listed)
+	}
+}
+
+func TestLocalBucketListByPrefix(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	files := []string{
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/21/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch",
+		"puppies-seen/2020/10/31/20/29/1e1e1e1e-f984-460a-a42d-2813cbf57771.batch",
+		"unexpected-object",
+	}
+	for _, file := range files {
+		if err := bucket.writeObject(file, []byte(file), objectMetadata{}); err != nil {
+			t.Fatalf("failed to write %s: %s", file, err)
+		}
+	}
+
+	prefixes, err := bucket.ListTopLevelPrefixes()
+	if err != nil {
+		t.Fatalf("unexpected error listing prefixes: %s", err)
+	}
+	sort.Strings(prefixes)
+	if expected := []string{"kittens-seen/", "puppies-seen/"}; !reflect.DeepEqual(prefixes, expected) {
+		t.Errorf("expected prefixes %q, got %q", expected, prefixes)
+	}
+
+	listed, err := bucket.ListFiles("kittens-seen/2020/10/31/20/")
+	if err != nil {
+		t.Fatalf("unexpected error listing files: %s", err)
+	}
+	if expected := files[:1]; !reflect.DeepEqual(listed, expected) {
+		t.Errorf("expected files %q, got %q", expected, listed)
+	}
+}
+
+// useStaticAWSCredentials makes AWS clients created during the test use static
+// credentials rather than whatever the environment provides
+func useStaticAWSCredentials(t *testing.T) {
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           "access-key",
+		"AWS_SECRET_ACCESS_KEY":       "secret-key",
+		"AWS_SDK_LOAD_CONFIG":         "",
+		"AWS_CONFIG_FILE":             filepath.Join(t.TempDir(), "config"),
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(t.TempDir(), "credentials"),
+	} {
+		key := key
+		previous, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, previous)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+func TestLocalBucketListFilesWithMetadata(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	modified := time.Date(2020, 11, 1, 4, 1, 0, 0, time.UTC)
+	files := []string{
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/21/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch",
+	}
+	for i, file := range files {
+		if err := bucket.writeObject(file, []byte(file), objectMetadata{}); err != nil {
+			t.Fatalf("failed to write %s: %s", file, err)
+		}
+		fileModified := modified.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(file)), fileModified, fileModified); err != nil {
+			t.Fatalf("failed to set modification time of %s: %s", file, err)
+		}
+	}
+
+	listed, err := bucket.ListFilesWithMetadata("kittens-seen/")
+	if err != nil {
+		t.Fatalf("unexpected error listing files: %s", err)
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Key < listed[j].Key })
+	if len(listed) != len(files) {
+		t.Fatalf("expected %d files, got %+v", len(files), listed)
+	}
+	for i, file := range files {
+		if listed[i].Key != file {
+			t.Errorf("expected file %q, got %q", file, listed[i].Key)
+		}
+		if expected := modified.Add(time.Duration(i) * time.Hour); !listed[i].LastModified.Equal(expected) {
+			t.Errorf("expected %s to be last modified at %s, got %s", file, expected, listed[i].LastModified)
+		}
+	}
+}
+
+func TestLocalBucketReadFile(t *testing.T) {
+	bucket, err := New("file://"+t.TempDir(), "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+	file := "kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch"
+	if err := bucket.writeObject(file, []byte("header"), objectMetadata{}); err != nil {
+		t.Fatalf("failed to write %s: %s", file, err)
+	}
+
+	var testCases = []struct {
+		name             string
+		key              string
+		maxSize          int64
+		expectedContents string
+		expectedTooLarge bool
+		expectedError    bool
+	}{
+		{name: "larger-limit", key: file, maxSize: 100, expectedContents: "header"},
+		{name: "exact-limit", key: file, maxSize: 6, expectedContents: "header"},
+		{name: "too-large", key: file, maxSize: 5, expectedTooLarge: true, expectedError: true},
+		{name: "missing", key: file + ".avro", maxSize: 100, expectedError: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			contents, err := bucket.ReadFile(testCase.key, testCase.maxSize)
+			if testCase.expectedError {
+				if err == nil {
+					t.Fatalf("expected error, got contents %q", contents)
+				}
+				if errors.Is(err, ErrFileTooLarge) != testCase.expectedTooLarge {
+					t.Errorf("expected ErrFileTooLarge %t, got %s", testCase.expectedTooLarge, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(contents) != testCase.expectedContents {
+				t.Errorf("expected contents %q, got %q", testCase.expectedContents, contents)
+			}
+		})
+	}
+}
+
+func TestS3CompatibleEndpoint(t *testing.T) {
+	useStaticAWSCredentials(t)
+
+	var requestPaths []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPaths = append(requestPaths, r.URL.Path)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <Name>kittens</Name>
+  <IsTruncated>false</IsTruncated>
+  <Contents><Key>kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch</Key></Contents>
+</ListBucketResult>`)
+	}))
+	defer server.Close()
+
+	var testCases = []struct {
+		name      string
+		s3Config  S3Config
+		expectErr bool
+	}{
+		{
+			name:      "tls-verified",
+			s3Config:  S3Config{Endpoint: server.URL, ForcePathStyle: true},
+			expectErr: true,
+		},
+		{
+			name:     "tls-not-verified",
+			s3Config: S3Config{Endpoint: server.URL, ForcePathStyle: true, InsecureSkipVerify: true},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			requestPaths = nil
+			bucket, err := New("s3://us-east-1/kittens", "", "", testCase.s3Config, GCSConfig{}, false)
+			if err != nil {
+				t.Fatalf("unexpected error creating bucket: %s", err)
+			}
+
+			files, err := bucket.ListFiles("")
+			if testCase.expectErr {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error listing files: %s", err)
+			}
+			expected := []string{"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch"}
+			if !reflect.DeepEqual(files, expected) {
+				t.Errorf("expected files %q, got %q", expected, files)
+			}
+			if !reflect.DeepEqual(requestPaths, []string{"/kittens"}) {
+				t.Errorf("expected path style request for /kittens, got %q", requestPaths)
+			}
+		})
+	}
+}
+
+func TestInvalidS3Endpoint(t *testing.T) {
+	for _, endpoint := range []string{"minio.example:9000", "ftp://minio.example", "http://[::1"} {
+		if _, err := New("s3://us-east-1/kittens", "", "", S3Config{Endpoint: endpoint}, GCSConfig{}, false); err == nil {
+			t.Errorf("expected error for endpoint %q", endpoint)
+		}
+	}
+}
+
+func TestNewBucketURL(t *testing.T) {
+	var testCases = []struct {
+		name               string
+		bucketURL          string
+		expectedService    string
+		expectedBucketName string
+		expectedKeyPrefix  string
+		expectErr          bool
+	}{
+		{name: "gs", bucketURL: "gs://kittens", expectedService: "gs", expectedBucketName: "kittens"},
+		{name: "gs-trailing-slash", bucketURL: "gs://kittens/", expectedService: "gs", expectedBucketName: "kittens"},
+		{name: "s3", bucketURL: "s3://us-west-2/kittens", expectedService: "s3", expectedBucketName: "us-west-2/kittens"},
+		{name: "s3-trailing-slashes", bucketURL: "s3://us-west-2/kittens//", expectedService: "s3", expectedBucketName: "us-west-2/kittens"},
+		{name: "gs-path", bucketURL: "gs://shared/locality-a/", expectedService: "gs", expectedBucketName: "shared", expectedKeyPrefix: "locality-a/"},
+		{name: "gs-nested-path", bucketURL: "gs://shared/us/locality-a", expectedService: "gs", expectedBucketName: "shared", expectedKeyPrefix: "us/locality-a/"},
+		{name: "s3-path", bucketURL: "s3://us-west-2/shared/locality-a/", expectedService: "s3", expectedBucketName: "us-west-2/shared", expectedKeyPrefix: "locality-a/"},
+		{name: "file", bucketURL: "file:///tmp/kittens/", expectedService: "file", expectedBucketName: "/tmp/kittens"},
+		{name: "file-relative", bucketURL: "file://kittens/", expectedService: "file", expectedBucketName: "kittens"},
+		{name: "file-root", bucketURL: "file:///", expectedService: "file", expectedBucketName: "/"},
+		{name: "empty", bucketURL: "", expectErr: true},
+		{name: "no-scheme", bucketURL: "kittens", expectErr: true},
+		{name: "gcs-scheme", bucketURL: "gcs://kittens", expectErr: true},
+		{name: "unknown-scheme", bucketURL: "azure://kittens", expectErr: true},
+		{name: "no-bucket-name", bucketURL: "gs://", expectErr: true},
+		{name: "only-slashes", bucketURL: "gs:///", expectErr: true},
+		{name: "s3-no-region", bucketURL: "s3://kittens", expectErr: true},
+		{name: "s3-default-region", bucketURL: "s3:///kittens", expectedService: "s3", expectedBucketName: "/kittens"},
+		{name: "s3-default-region-path", bucketURL: "s3:///shared/locality-a", expectedService: "s3", expectedBucketName: "/shared", expectedKeyPrefix: "locality-a/"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			bucket, err := New(testCase.bucketURL, "", "", S3Config{}, GCSConfig{}, false)
+			if testCase.expectErr {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if bucket.service != testCase.expectedService ||
+				bucket.bucketName != testCase.expectedBucketName ||
+				bucket.keyPrefix != testCase.expectedKeyPrefix {
+				t.Errorf("expected service %q, bucket name %q and key prefix %q, got %q, %q and %q",
+					testCase.expectedService, testCase.expectedBucketName, testCase.expectedKeyPrefix,
+					bucket.service, bucket.bucketName, bucket.keyPrefix)
+			}
+		})
+	}
+}
+
+func TestS3StaticCredentials(t *testing.T) {
+	// The environment's credentials must not be used
+	useStaticAWSCredentials(t)
+
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <Name>peer-validations</Name>
+  <IsTruncated>false</IsTruncated>
+</ListBucketResult>`)
+	}))
+	defer server.Close()
+
+	s3Config := S3Config{
+		Endpoint:        server.URL,
+		ForcePathStyle:  true,
+		AccessKeyID:     "GOOG1EXAMPLE",
+		SecretAccessKey: "hmac-secret",
+	}
+	bucket, err := New("s3://auto/peer-validations", "", "", s3Config, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+	if _, err := bucket.ListTaskMarkers(); err != nil {
+		t.Fatalf("unexpected error listing markers: %s", err)
+	}
+	if expected := "AWS4-HMAC-SHA256 Credential=GOOG1EXAMPLE/"; !strings.HasPrefix(authorization, expected) {
+		t.Errorf("expected authorization beginning %q, got %q", expected, authorization)
+	}
+
+	for _, invalid := range []struct {
+		identity string
+		s3Config S3Config
+	}{
+		{s3Config: S3Config{AccessKeyID: "GOOG1EXAMPLE"}},
+		{s3Config: S3Config{SecretAccessKey: "hmac-secret"}},
+		{identity: "arn:aws:iam::12345678:role/validator", s3Config: s3Config},
+	} {
+		if _, err := New("s3://auto/peer-validations", invalid.identity, "", invalid.s3Config, GCSConfig{}, false); err == nil {
+			t.Errorf("expected error creating bucket with identity %q and %+v", invalid.identity, invalid.s3Config)
+		}
+	}
+}
+
+func TestGCSBillingProject(t *testing.T) {
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("failed to create storage client: %s", err)
+	}
+
+	var testCases = []struct {
+		name           string
+		billingProject string
+		expected       *storage.BucketHandle
+	}{
+		{name: "owner-pays", expected: client.Bucket("kittens")},
+		{name: "requester-pays", billingProject: "prio", expected: client.Bucket("kittens").UserProject("prio")},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			bucket, err := New("gs://kittens/locality-a", "", "", S3Config{}, GCSConfig{BillingProject: testCase.billingProject}, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if handle := bucket.gcsBucketHandle(client); !reflect.DeepEqual(handle, testCase.expected) {
+				t.Errorf("expected bucket handle %+v, got %+v", testCase.expected, handle)
+			}
+		})
+	}
+}
+
+func TestS3KeyPrefix(t *testing.T) {
+	useStaticAWSCredentials(t)
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.URL.Query().Get("prefix"))
+		if r.Method != http.MethodGet {
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <Name>shared</Name>
+  <IsTruncated>false</IsTruncated>
+  <Contents><Key>locality-a/task-markers/intake-kittens-seen-2020-10-31-20-29-b8a5579a</Key></Contents>
+</ListBucketResult>`)
+	}))
+	defer server.Close()
+
+	bucket, err := New("s3://us-east-1/shared/locality-a/", "", "", S3Config{Endpoint: server.URL, ForcePathStyle: true}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	if err := bucket.WriteTaskMarker(markerTask("intake-kittens-seen-2020-10-31-20-29-b8a5579a")); err != nil {
+		t.Fatalf("unexpected error writing marker: %s", err)
+	}
+	markers, err := bucket.ListTaskMarkers()
+	if err != nil {
+		t.Fatalf("unexpected error listing markers: %s", err)
+	}
+	if expected := []string{"intake-kittens-seen-2020-10-31-20-29-b8a5579a"}; !reflect.DeepEqual(markers, expected) {
+		t.Errorf("expected markers %q, got %q", expected, markers)
+	}
+
+	expectedRequests := []string{
+		"PUT /shared/locality-a/task-markers/intake-kittens-seen-2020-10-31-20-29-b8a5579a ",
+		"GET /shared locality-a/task-markers/",
+	}
+	if !reflect.DeepEqual(requests, expectedRequests) {
+		t.Errorf("expected requests %q, got %q", expectedRequests, requests)
+	}
+}
+
+func TestS3MarkerMetadata(t *testing.T) {
+	useStaticAWSCredentials(t)
+
+	headers := map[string]http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers[r.URL.Path] = r.Header
+	}))
+	defer server.Close()
+
+	bucket, err := New("s3://us-east-1/markers", "", "", S3Config{Endpoint: server.URL, ForcePathStyle: true}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	marker := "intake-kittens-seen-2020-10-31-20-29-b8a5579a"
+	if err := bucket.WriteTaskMarker(markerTask(marker)); err != nil {
+		t.Fatalf("unexpected error writing marker: %s", err)
+	}
+	if err := bucket.WritePendingMarker(markerTask(marker)); err != nil {
+		t.Fatalf("unexpected error writing pending marker: %s", err)
+	}
+
+	for _, path := range []string{"/markers/task-markers/" + marker, "/markers/pending-task-markers/" + marker} {
+		header, ok := headers[path]
+		if !ok {
+			t.Errorf("expected a request for %s, got %v", path, headers)
+			continue
+		}
+		if contentType := header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("expected %s to have content type application/json, got %q", path, contentType)
+		}
+		if cacheControl := header.Get("Cache-Control"); cacheControl != "no-store" {
+			t.Errorf("expected %s to have cache control no-store, got %q", path, cacheControl)
+		}
+	}
+}
+
+func TestS3MarkerExists(t *testing.T) {
+	useStaticAWSCredentials(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/markers/task-markers/written":
+		case "/markers/task-markers/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	bucket, err := New("s3://us-east-1/markers", "", "", S3Config{Endpoint: server.URL, ForcePathStyle: true}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	var testCases = []struct {
+		marker      string
+		expected    bool
+		expectError bool
+	}{
+		{marker: "written", expected: true},
+		{marker: "missing", expected: false},
+		{marker: "broken", expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.marker, func(t *testing.T) {
+			exists, err := bucket.MarkerExists(testCase.marker)
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected error checking for marker")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error checking for marker: %s", err)
+			}
+			if exists != testCase.expected {
+				t.Errorf("expected marker to exist: %t, got %t", testCase.expected, exists)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package bucket
+
+import (
+	"time"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ListingCache caches the listing of a Bucket, so that repeated listings only
+// list the batch files whose batch time is recent enough that they might have
+// been written since the previous listing. Task markers, failed task records
+// and any other files outside of aggregation ID prefixes are listed every time,
+// so their deletion is always noticed.
+type ListingCache struct {
+	bucket *Bucket
+	clock  utils.Clock
+	// since is the time before which batch files are never listed, or the zero
+	// time to list all batch files
+	since time.Time
+	// lookback is how long before the previous listing batch files are listed
+	// again. Batch files written more than lookback after their batch time
+	// may be missed.
+	lookback time.Duration
+	// files is the result of the previous listing
+	files []string
+	// listedAt is the time of the previous listing, or the zero time if the
+	// bucket has not been listed yet
+	listedAt time.Time
+}
+
+// NewListingCache creates a ListingCache for the bucket. Batch files whose
+// batch time is before since are never listed, unless since is the zero time.
+// Batch files whose batch time is more than lookback before the previous
+// listing are not listed again.
+func NewListingCache(bucket *Bucket, clock utils.Clock, since time.Time, lookback time.Duration) *ListingCache {
+	return &ListingCache{
+		bucket:   bucket,
+		clock:    clock,
+		since:    since,
+		lookback: lookback,
+	}
+}
+
+// List returns the names of the files in the bucket, as ListFiles or
+// ListFilesSince would. Deletions of batch files whose batch time is more than
+// lookback before the previous listing are not noticed.
+func (c *ListingCache) List() ([]string, error) {
+	now := c.clock.Now()
+
+	if c.listedAt.IsZero() {
+		var files []string
+		var err error
+		if c.since.IsZero() {
+			files, err = c.bucket.ListFiles("")
+		} else {
+			files, err = c.bucket.ListFilesSince(c.since)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.files = files
+		c.listedAt = now
+		return files, nil
+	}
+
+	cutoff := c.listedAt.Add(-c.lookback)
+	if cutoff.Before(c.since) {
+		cutoff = c.since
+	}
+	recentFiles, err := c.bucket.ListFilesSince(cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the cached batch files from before the cutoff, which were not
+	// listed again, and take everything else from the new listing.
+	files := []string{}
+	cached := 0
+	for _, file := range c.files {
+		if !listedSince(file, cutoff) {
+			files = append(files, file)
+			cached++
+		}
+	}
+	files = append(files, recentFiles...)
+
+	log.Printf("listed %d files since %s in %s, reused %d cached files", len(recentFiles), cutoff, c.bucket.bucketName, cached)
+
+	c.files = files
+	c.listedAt = now
+	return files, nil
+}
@@ -0,0 +1,62 @@
+package bucket
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/utils"
+)
+
+func TestListingCache(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := New("file://"+dir, "", "", S3Config{}, GCSConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	oldBatch := "kittens-seen/2020/10/29/20/29/0f0f0f0f-f984-460a-a42d-2813cbf57771.batch"
+	recentBatch := "kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch"
+	newBatch := "kittens-seen/2020/10/31/22/29/1e1e1e1e-f984-460a-a42d-2813cbf57771.batch"
+	marker := "task-markers/intake-kittens-seen-2020-10-29-20-29-0f0f0f0f-f984-460a-a42d-2813cbf57771"
+	for _, file := range []string{oldBatch, recentBatch, marker} {
+		if err := bucket.writeObject(file, []byte(file), objectMetadata{}); err != nil {
+			t.Fatalf("failed to write %s: %s", file, err)
+		}
+	}
+
+	firstListing := time.Date(2020, 10, 31, 21, 0, 0, 0, time.UTC)
+	cache := NewListingCache(bucket, utils.ClockWithFixedNow(firstListing), time.Time{}, 24*time.Hour)
+	files, err := cache.List()
+	if err != nil {
+		t.Fatalf("unexpected error listing files: %s", err)
+	}
+	sort.Strings(files)
+	if expected := []string{oldBatch, recentBatch, marker}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected files %q, got %q", expected, files)
+	}
+
+	// Deleting the old batch file isn't noticed, since it is not listed
+	// again, but deleting the marker and the recent batch file is.
+	for _, file := range []string{oldBatch, recentBatch, marker} {
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(file))); err != nil {
+			t.Fatalf("failed to delete %s: %s", file, err)
+		}
+	}
+	if err := bucket.writeObject(newBatch, []byte(newBatch), objectMetadata{}); err != nil {
+		t.Fatalf("failed to write %s: %s", newBatch, err)
+	}
+
+	cache.clock = utils.ClockWithFixedNow(firstListing.Add(time.Hour))
+	files, err = cache.List()
+	if err != nil {
+		t.Fatalf("unexpected error listing files: %s", err)
+	}
+	sort.Strings(files)
+	if expected := []string{oldBatch, newBatch}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected files %q, got %q", expected, files)
+	}
+}
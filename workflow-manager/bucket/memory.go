@@ -0,0 +1,131 @@
+package bucket
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
+)
+
+// MemoryTaskMarkerWriter implements TaskStateWriter by recording task markers,
+// pending markers and failed task records in memory, so that tests can observe
+// what was written and simulate failures to write task markers. It is safe for
+// concurrent use.
+type MemoryTaskMarkerWriter struct {
+	lock           sync.Mutex
+	markers        []string
+	pendingMarkers []string
+	failedTasks    []string
+	// failures is the number of task marker writes that should fail before
+	// writes succeed again
+	failures int
+}
+
+// NewMemoryTaskMarkerWriter creates an empty MemoryTaskMarkerWriter
+func NewMemoryTaskMarkerWriter() *MemoryTaskMarkerWriter {
+	return &MemoryTaskMarkerWriter{}
+}
+
+// FailNextWrites makes the next n writes of task markers, whether by
+// WriteTaskMarker or PromoteMarker, fail. Writes of pending markers and failed
+// task records are unaffected.
+func (w *MemoryTaskMarkerWriter) FailNextWrites(n int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.failures = n
+}
+
+func (w *MemoryTaskMarkerWriter) WriteTaskMarker(t task.Task) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writeTaskMarker(t.Marker())
+}
+
+// writeTaskMarker records the task marker, unless it should fail. w.lock must
+// be held.
+func (w *MemoryTaskMarkerWriter) writeTaskMarker(marker string) error {
+	if w.failures > 0 {
+		w.failures--
+		return fmt.Errorf("failed to write task marker %s", marker)
+	}
+	w.markers = append(w.markers, marker)
+	return nil
+}
+
+func (w *MemoryTaskMarkerWriter) MarkerExists(marker string) (bool, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, written := range w.markers {
+		if written == marker {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (w *MemoryTaskMarkerWriter) WritePendingMarker(t task.Task) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.pendingMarkers = append(w.pendingMarkers, t.Marker())
+	return nil
+}
+
+func (w *MemoryTaskMarkerWriter) PromoteMarker(t task.Task) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.writeTaskMarker(t.Marker()); err != nil {
+		return err
+	}
+	w.deletePendingMarker(t.Marker())
+	return nil
+}
+
+func (w *MemoryTaskMarkerWriter) DeletePendingMarker(marker string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.deletePendingMarker(marker)
+	return nil
+}
+
+// deletePendingMarker forgets the pending marker, if it was written. w.lock
+// must be held.
+func (w *MemoryTaskMarkerWriter) deletePendingMarker(marker string) {
+	pendingMarkers := []string{}
+	for _, pendingMarker := range w.pendingMarkers {
+		if pendingMarker != marker {
+			pendingMarkers = append(pendingMarkers, pendingMarker)
+		}
+	}
+	w.pendingMarkers = pendingMarkers
+}
+
+func (w *MemoryTaskMarkerWriter) WriteFailedTask(marker string, record []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.failedTasks = append(w.failedTasks, marker)
+	return nil
+}
+
+// WrittenMarkers returns the task markers written so far, in the order they
+// were written
+func (w *MemoryTaskMarkerWriter) WrittenMarkers() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.markers...)
+}
+
+// PendingMarkers returns the pending markers that were written and neither
+// promoted nor deleted
+func (w *MemoryTaskMarkerWriter) PendingMarkers() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.pendingMarkers...)
+}
+
+// FailedTasks returns the markers of the tasks for which failed task records
+// were written so far, in the order they were written
+func (w *MemoryTaskMarkerWriter) FailedTasks() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.failedTasks...)
+}
@@ -0,0 +1,42 @@
+package bucket
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMemoryTaskMarkerWriter(t *testing.T) {
+	writer := NewMemoryTaskMarkerWriter()
+	writer.FailNextWrites(2)
+
+	for _, marker := range []string{"marker-1", "marker-2", "marker-3"} {
+		if err := writer.WritePendingMarker(markerTask(marker)); err != nil {
+			t.Fatalf("unexpected error writing pending marker %s: %s", marker, err)
+		}
+	}
+	if err := writer.WriteTaskMarker(markerTask("marker-0")); err == nil {
+		t.Errorf("expected first task marker write to fail")
+	}
+	if err := writer.PromoteMarker(markerTask("marker-1")); err == nil {
+		t.Errorf("expected second task marker write to fail")
+	}
+	if err := writer.PromoteMarker(markerTask("marker-2")); err != nil {
+		t.Errorf("unexpected error promoting marker: %s", err)
+	}
+	if err := writer.DeletePendingMarker("marker-3"); err != nil {
+		t.Errorf("unexpected error deleting pending marker: %s", err)
+	}
+	if err := writer.WriteFailedTask("marker-3", []byte("{}")); err != nil {
+		t.Errorf("unexpected error writing failed task record: %s", err)
+	}
+
+	if markers := writer.WrittenMarkers(); !reflect.DeepEqual(markers, []string{"marker-2"}) {
+		t.Errorf("unexpected written markers %q", markers)
+	}
+	if pendingMarkers := writer.PendingMarkers(); !reflect.DeepEqual(pendingMarkers, []string{"marker-1"}) {
+		t.Errorf("unexpected pending markers %q", pendingMarkers)
+	}
+	if failedTasks := writer.FailedTasks(); !reflect.DeepEqual(failedTasks, []string{"marker-3"}) {
+		t.Errorf("unexpected failed tasks %q", failedTasks)
+	}
+}
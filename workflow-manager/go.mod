@@ -3,13 +3,25 @@ module github.com/letsencrypt/prio-server/workflow-manager
 go 1.15
 
 require (
-	cloud.google.com/go/pubsub v1.3.1
+	cloud.google.com/go v0.66.0
+	cloud.google.com/go/pubsub v1.6.1
 	cloud.google.com/go/storage v1.12.0
+	github.com/Shopify/sarama v1.27.2
+	github.com/alicebob/miniredis/v2 v2.14.1
 	github.com/aws/aws-sdk-go v1.35.16
+	github.com/go-redis/redis/v8 v8.3.4
 	github.com/prometheus/client_golang v1.8.0
+	github.com/sirupsen/logrus v1.7.0
+	go.opentelemetry.io/otel v0.13.0
+	go.opentelemetry.io/otel/exporters/otlp v0.13.0
+	go.opentelemetry.io/otel/sdk v0.13.0
 	golang.org/x/net v0.0.0-20201027133719-8eef5233e2a1 // indirect
 	golang.org/x/text v0.3.4 // indirect
 	google.golang.org/api v0.33.0
+	google.golang.org/genproto v0.0.0-20200921151605-7abf4a1a14d5
+	google.golang.org/grpc v1.32.0
+	google.golang.org/protobuf v1.25.0
+	gopkg.in/yaml.v2 v2.3.0
 	k8s.io/api v0.19.3
 	k8s.io/apimachinery v0.19.3
 	k8s.io/client-go v0.19.3
@@ -2,33 +2,72 @@
 package kubernetes
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/letsencrypt/prio-server/workflow-manager/utils"
 
+	log "github.com/sirupsen/logrus"
 	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// DefaultJobListPageSize is the number of jobs requested at a time by ListJobs
+const DefaultJobListPageSize = 1000
+
+// maxJobListRestarts is how many times ListJobs restarts a listing whose
+// continue token expired before giving up
+const maxJobListRestarts = 3
+
+// DefaultMaxAttempts is the number of times a Kubernetes API call is made
+// before giving up, if it keeps failing with transient errors
+const DefaultMaxAttempts = 5
+
+// initialBackoff and maxBackoff bound the delay between attempts at an API
+// call. The delay doubles after each failed attempt, unless the API server
+// asks us to wait for some other amount of time.
+const (
+	initialBackoff = 1 * time.Second
+	maxBackoff     = 30 * time.Second
+)
+
 type Client struct {
-	client    *kubernetes.Clientset
+	client    kubernetes.Interface
 	namespace string
-	dryRun    bool
+	// labelSelector restricts the jobs listed by ListJobs. If empty, all the
+	// jobs in the namespace are listed.
+	labelSelector string
+	// pageSize is the number of jobs requested in each call to the jobs list
+	// API
+	pageSize int64
+	// maxAttempts is the number of times an API call that fails with
+	// transient errors is made before giving up
+	maxAttempts int
+	// sleep is time.Sleep, except in tests
+	sleep  func(time.Duration)
+	dryRun bool
 }
 
-// Client returns a Clientset that uses the credentials that an instance running
-// in the k8s cluster gets automatically, via automount_service_account_token in
-// the Terraform config, or the credentials in the provided kube config file, if
-// it is not empty. If dryRun is true, then any destructive API calls will be
-// made with DryRun: All.
-func NewClient(namespace string, kubeconfigPath string, dryRun bool) (*Client, error) {
-	// BuildConfigFromFlags falls back to rest.InClusterConfig if kubeconfigPath
-	// is empty
-	// https://godoc.org/k8s.io/client-go/tools/clientcmd#BuildConfigFromFlags
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+// Client returns a Clientset that uses the credentials in the provided kube
+// config file, if it is not empty. Otherwise, it uses the credentials that an
+// instance running in the k8s cluster gets automatically, via
+// automount_service_account_token in the Terraform config, or when not running
+// in a cluster, the kube config file from $KUBECONFIG or ~/.kube/config. Only
+// jobs whose labels match labelSelector (e.g. "app=workflow-manager") are
+// listed, unless it is empty, and they are listed pageSize at a time. API calls
+// that fail with transient errors are made up to maxAttempts times, with
+// exponential backoff. If dryRun is true, then any destructive API calls will
+// be made with DryRun: All.
+func NewClient(namespace, kubeconfigPath, labelSelector string, pageSize int64, maxAttempts int, dryRun bool) (*Client, error) {
+	config, err := clusterConfig(kubeconfigPath)
 	if err != nil {
 		return nil, fmt.Errorf("cluster config: %w", err)
 	}
@@ -38,29 +77,135 @@ func NewClient(namespace string, kubeconfigPath string, dryRun bool) (*Client, e
 		return nil, fmt.Errorf("clientset: %w", err)
 	}
 
+	return newClientForClientset(client, namespace, labelSelector, pageSize, maxAttempts, dryRun)
+}
+
+// clusterConfig returns the config for the kube config file at kubeconfigPath,
+// if it is not empty, or else for the service account of the pod we are running
+// in, or else if we aren't running in a cluster, for the default kube config
+// file. It logs which of these it picked.
+func clusterConfig(kubeconfigPath string) (*rest.Config, error) {
+	if kubeconfigPath != "" {
+		log.Infof("authenticating to Kubernetes with kube config file %s", kubeconfigPath)
+		return clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	}
+
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		log.Info("authenticating to Kubernetes with in-cluster service account")
+		return config, nil
+	}
+	if !errors.Is(err, rest.ErrNotInCluster) {
+		// We seem to be running in a cluster, but the service account token
+		// isn't mounted or is unreadable. Falling back to some kube config
+		// file would only obscure that.
+		return nil, fmt.Errorf("in-cluster config: %w", err)
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	log.Infof("not running in a Kubernetes cluster, authenticating to Kubernetes with default kube config file %s",
+		loadingRules.GetDefaultFilename())
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+func newClientForClientset(client kubernetes.Interface, namespace, labelSelector string, pageSize int64, maxAttempts int, dryRun bool) (*Client, error) {
+	if _, err := labels.Parse(labelSelector); err != nil {
+		return nil, fmt.Errorf("job label selector %q: %w", labelSelector, err)
+	}
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("job list page size must be positive, got %d", pageSize)
+	}
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("max attempts must be at least 1, got %d", maxAttempts)
+	}
+
 	return &Client{
-		client:    client,
-		namespace: namespace,
-		dryRun:    dryRun,
+		client:        client,
+		namespace:     namespace,
+		labelSelector: labelSelector,
+		pageSize:      pageSize,
+		maxAttempts:   maxAttempts,
+		sleep:         time.Sleep,
+		dryRun:        dryRun,
 	}, nil
 }
 
-// ListJobs returns a map of Kubernetes jobs in the specified namespace, where
-// the key is the name of the job and the value is the job structure, or an
-// error on failure.
+// isRetryable returns true if err, returned from a Kubernetes API call, is
+// likely to be transient, as when the API server is overloaded or restarting
+// during a control plane upgrade
+func isRetryable(err error) bool {
+	return apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		utilnet.IsConnectionReset(err)
+}
+
+// withRetries calls f until it succeeds, fails with an error that isn't
+// retryable, or has been called c.maxAttempts times. Between attempts, it waits
+// for as long as the API server asked, or else for an exponentially increasing
+// delay.
+func (c *Client) withRetries(description string, f func() error) error {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !isRetryable(err) || attempt >= c.maxAttempts {
+			return err
+		}
+
+		delay := backoff
+		if seconds, ok := apierrors.SuggestsClientDelay(err); ok {
+			delay = time.Duration(seconds) * time.Second
+		}
+		log.Warnf("attempt %d of %d to %s failed, retrying in %s: %s", attempt, c.maxAttempts, description, delay, err)
+		c.sleep(delay)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// ListJobs returns a map of Kubernetes jobs in the specified namespace that
+// match the label selector, where the key is the name of the job and the value
+// is the job structure, or an error on failure.
 func (c *Client) ListJobs() (map[string]batchv1.Job, error) {
+	for restarts := 0; ; restarts++ {
+		jobs, err := c.listJobs()
+		// The continue token of a paginated listing expires after a few
+		// minutes, or sooner if the resource version it refers to is
+		// compacted, in which case the API server responds with 410 Gone and
+		// we have to start over.
+		if (apierrors.IsResourceExpired(err) || apierrors.IsGone(err)) && restarts < maxJobListRestarts {
+			log.Warnf("listing of jobs expired, restarting it: %s", err)
+			continue
+		}
+		return jobs, err
+	}
+}
+
+// listJobs lists the jobs one page at a time, following continue tokens
+func (c *Client) listJobs() (map[string]batchv1.Job, error) {
 	jobs := map[string]batchv1.Job{}
 
-	// The jobs list API is paginated. We request 1000 entries at a time. If
-	// there are more entries, the response will contain a continue token to
+	// The jobs list API is paginated. We request c.pageSize entries at a time.
+	// If there are more entries, the response will contain a continue token to
 	// provide on subsequent requests.
 	continueToken := ""
 	for {
-		ctx, cancel := utils.ContextWithTimeout()
-		defer cancel()
-		jobsList, err := c.client.BatchV1().Jobs(c.namespace).List(ctx, metav1.ListOptions{
-			Limit:    1000,
-			Continue: continueToken,
+		var jobsList *batchv1.JobList
+		err := c.withRetries("list jobs", func() error {
+			ctx, cancel := utils.ContextWithTimeout()
+			defer cancel()
+			var err error
+			jobsList, err = c.client.BatchV1().Jobs(c.namespace).List(ctx, metav1.ListOptions{
+				LabelSelector: c.labelSelector,
+				Limit:         c.pageSize,
+				Continue:      continueToken,
+			})
+			return err
 		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to list jobs in namespace: %w", err)
@@ -0,0 +1,360 @@
+package kubernetes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakePagingClientset returns a fake clientset whose jobs list API returns
+// the provided pages of jobs in turn, filtered by label selector. The fake
+// clientset doesn't pass continue tokens to reactors, so pages are served in
+// order, starting over after the last one. If expiredCalls contains the number
+// of a call (counting from zero), that call fails with 410 Gone and the next
+// one starts over. The number of calls made is counted in calls.
+func fakePagingClientset(pages [][]batchv1.Job, expiredCalls map[int]bool, calls *int) *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	nextPage := 0
+	clientset.PrependReactor("list", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		call := *calls
+		*calls++
+		if expiredCalls[call] {
+			nextPage = 0
+			return true, nil, apierrors.NewResourceExpired("continue token expired")
+		}
+
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Labels
+		list := &batchv1.JobList{}
+		for _, job := range pages[nextPage] {
+			if selector.Matches(labels.Set(job.Labels)) {
+				list.Items = append(list.Items, job)
+			}
+		}
+
+		nextPage++
+		if nextPage < len(pages) {
+			list.Continue = fmt.Sprintf("page-%d", nextPage)
+		} else {
+			nextPage = 0
+		}
+
+		return true, list, nil
+	})
+	return clientset
+}
+
+func job(name string, jobLabels map[string]string) batchv1.Job {
+	return batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: jobLabels}}
+}
+
+func TestListJobs(t *testing.T) {
+	facilitator := map[string]string{"app": "facilitator"}
+	other := map[string]string{"app": "other"}
+	pages := [][]batchv1.Job{
+		{job("i-kittens-seen-1", facilitator), job("unrelated-1", other)},
+		{job("i-kittens-seen-2", facilitator), job("unrelated-2", nil)},
+		{job("a-kittens-seen-1", facilitator)},
+	}
+
+	var testCases = []struct {
+		name          string
+		labelSelector string
+		expiredCalls  map[int]bool
+		expectedJobs  []string
+		expectedCalls int
+		expectError   bool
+	}{
+		{
+			name:          "all-pages",
+			expectedJobs:  []string{"a-kittens-seen-1", "i-kittens-seen-1", "i-kittens-seen-2", "unrelated-1", "unrelated-2"},
+			expectedCalls: 3,
+		},
+		{
+			name:          "label-selector",
+			labelSelector: "app=facilitator",
+			expectedJobs:  []string{"a-kittens-seen-1", "i-kittens-seen-1", "i-kittens-seen-2"},
+			expectedCalls: 3,
+		},
+		{
+			name:          "continue-token-expired",
+			expiredCalls:  map[int]bool{1: true},
+			expectedJobs:  []string{"a-kittens-seen-1", "i-kittens-seen-1", "i-kittens-seen-2", "unrelated-1", "unrelated-2"},
+			expectedCalls: 5,
+		},
+		{
+			name:          "continue-token-keeps-expiring",
+			expiredCalls:  map[int]bool{1: true, 3: true, 5: true, 7: true},
+			expectedCalls: 8,
+			expectError:   true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			calls := 0
+			client, err := newClientForClientset(
+				fakePagingClientset(pages, testCase.expiredCalls, &calls),
+				"default", testCase.labelSelector, 2, DefaultMaxAttempts, false,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error creating client: %s", err)
+			}
+
+			jobs, err := client.ListJobs()
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected error listing jobs")
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error listing jobs: %s", err)
+			}
+
+			jobNames := []string{}
+			for name := range jobs {
+				jobNames = append(jobNames, name)
+			}
+			sort.Strings(jobNames)
+			if !testCase.expectError && !reflect.DeepEqual(jobNames, testCase.expectedJobs) {
+				t.Errorf("expected jobs %q, got %q", testCase.expectedJobs, jobNames)
+			}
+			if calls != testCase.expectedCalls {
+				t.Errorf("expected %d list calls, got %d", testCase.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestListJobsRetries(t *testing.T) {
+	jobsResource := schema.GroupResource{Group: "batch", Resource: "jobs"}
+	connectionReset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+	var testCases = []struct {
+		name           string
+		maxAttempts    int
+		errs           []error
+		expectedSleeps []time.Duration
+		expectError    bool
+	}{
+		{
+			name:           "too-many-requests",
+			maxAttempts:    DefaultMaxAttempts,
+			errs:           []error{apierrors.NewTooManyRequests("slow down", 7)},
+			expectedSleeps: []time.Duration{7 * time.Second},
+		},
+		{
+			name:        "server-errors",
+			maxAttempts: DefaultMaxAttempts,
+			errs: []error{
+				apierrors.NewInternalError(fmt.Errorf("etcd unavailable")),
+				apierrors.NewServiceUnavailable("upgrading"),
+				connectionReset,
+			},
+			expectedSleeps: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:        "gives-up",
+			maxAttempts: 3,
+			errs: []error{
+				apierrors.NewServiceUnavailable("upgrading"),
+				apierrors.NewServiceUnavailable("upgrading"),
+				apierrors.NewServiceUnavailable("upgrading"),
+			},
+			expectedSleeps: []time.Duration{1 * time.Second, 2 * time.Second},
+			expectError:    true,
+		},
+		{
+			name:           "forbidden",
+			maxAttempts:    DefaultMaxAttempts,
+			errs:           []error{apierrors.NewForbidden(jobsResource, "", fmt.Errorf("no RBAC"))},
+			expectedSleeps: []time.Duration{},
+			expectError:    true,
+		},
+		{
+			name:           "not-found",
+			maxAttempts:    DefaultMaxAttempts,
+			errs:           []error{apierrors.NewNotFound(jobsResource, "")},
+			expectedSleeps: []time.Duration{},
+			expectError:    true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// The jobs list API fails with each of the errors in turn, and
+			// then succeeds
+			clientset := fake.NewSimpleClientset()
+			errs := testCase.errs
+			clientset.PrependReactor("list", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if len(errs) > 0 {
+					err := errs[0]
+					errs = errs[1:]
+					return true, nil, err
+				}
+				return true, &batchv1.JobList{Items: []batchv1.Job{job("i-kittens-seen-1", nil)}}, nil
+			})
+
+			client, err := newClientForClientset(clientset, "default", "", DefaultJobListPageSize, testCase.maxAttempts, false)
+			if err != nil {
+				t.Fatalf("unexpected error creating client: %s", err)
+			}
+			sleeps := []time.Duration{}
+			client.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+			jobs, err := client.ListJobs()
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected error listing jobs")
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error listing jobs: %s", err)
+			} else if _, ok := jobs["i-kittens-seen-1"]; !ok || len(jobs) != 1 {
+				t.Errorf("unexpected jobs %v", jobs)
+			}
+
+			if !reflect.DeepEqual(sleeps, testCase.expectedSleeps) {
+				t.Errorf("expected sleeps %v, got %v", testCase.expectedSleeps, sleeps)
+			}
+		})
+	}
+}
+
+func TestNewClientInvalidOptions(t *testing.T) {
+	if _, err := newClientForClientset(fake.NewSimpleClientset(), "default", "app in (", DefaultJobListPageSize, DefaultMaxAttempts, false); err == nil {
+		t.Errorf("expected error for invalid label selector")
+	}
+	if _, err := newClientForClientset(fake.NewSimpleClientset(), "default", "", 0, DefaultMaxAttempts, false); err == nil {
+		t.Errorf("expected error for zero page size")
+	}
+	if _, err := newClientForClientset(fake.NewSimpleClientset(), "default", "", DefaultJobListPageSize, 0, false); err == nil {
+		t.Errorf("expected error for zero max attempts")
+	}
+}
+
+// setEnv sets the provided environment variables for the duration of the test.
+// An empty value unsets the variable.
+func setEnv(t *testing.T, env map[string]string) {
+	for key, value := range env {
+		key := key
+		previous, ok := os.LookupEnv(key)
+		if value == "" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, value)
+		}
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, previous)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+// writeKubeconfig writes a kube config file for a cluster at server and
+// returns its path
+func writeKubeconfig(t *testing.T, server string) string {
+	path := filepath.Join(t.TempDir(), "config")
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: cluster
+  cluster:
+    server: %s
+contexts:
+- name: context
+  context:
+    cluster: cluster
+    user: user
+current-context: context
+users:
+- name: user
+  user:
+    token: token
+`, server)
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("failed to write kube config: %s", err)
+	}
+	return path
+}
+
+func TestClusterConfig(t *testing.T) {
+	explicitKubeconfig := writeKubeconfig(t, "https://explicit.example:6443")
+	defaultKubeconfig := writeKubeconfig(t, "https://default.example:6443")
+
+	var testCases = []struct {
+		name           string
+		kubeconfigPath string
+		inCluster      bool
+		expectedHost   string
+		expectError    bool
+	}{
+		{
+			name:           "explicit-kubeconfig",
+			kubeconfigPath: explicitKubeconfig,
+			inCluster:      true,
+			expectedHost:   "https://explicit.example:6443",
+		},
+		{
+			name:         "out-of-cluster",
+			expectedHost: "https://default.example:6443",
+		},
+		{
+			// The service account token isn't mounted in the test environment
+			name:        "in-cluster-without-token",
+			inCluster:   true,
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			env := map[string]string{
+				"KUBECONFIG":              defaultKubeconfig,
+				"KUBERNETES_SERVICE_HOST": "",
+				"KUBERNETES_SERVICE_PORT": "",
+			}
+			if testCase.inCluster {
+				env["KUBERNETES_SERVICE_HOST"] = "10.0.0.1"
+				env["KUBERNETES_SERVICE_PORT"] = "443"
+			}
+			setEnv(t, env)
+
+			if testCase.expectError {
+				if _, err := os.Stat("/var/run/secrets/kubernetes.io/serviceaccount/token"); err == nil {
+					t.Skip("running in a cluster with a service account token")
+				}
+			}
+
+			config, err := clusterConfig(testCase.kubeconfigPath)
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected error getting cluster config")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error getting cluster config: %s", err)
+			}
+			if config.Host != testCase.expectedHost {
+				t.Errorf("expected host %q, got %q", testCase.expectedHost, config.Host)
+			}
+		})
+	}
+}
@@ -7,24 +7,44 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/letsencrypt/prio-server/workflow-manager/batchpath"
 	"github.com/letsencrypt/prio-server/workflow-manager/bucket"
 	wfkubernetes "github.com/letsencrypt/prio-server/workflow-manager/kubernetes"
 	"github.com/letsencrypt/prio-server/workflow-manager/monitor"
+	"github.com/letsencrypt/prio-server/workflow-manager/retry"
 	"github.com/letsencrypt/prio-server/workflow-manager/task"
+	"github.com/letsencrypt/prio-server/workflow-manager/tracing"
 	"github.com/letsencrypt/prio-server/workflow-manager/utils"
 
+	"cloud.google.com/go/pubsub"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/label"
+	"gopkg.in/yaml.v2"
 	batchv1 "k8s.io/api/batch/v1"
 )
 
@@ -32,306 +52,3551 @@ import (
 var BuildInfo string
 
 var k8sNS = flag.String("k8s-namespace", "", "Kubernetes namespace")
+var configFile = flag.String("config", "", "Path to a YAML or JSON file whose keys are the names of other flags, from which flags not set on the command line are taken")
 var isFirst = flag.Bool("is-first", false, "Whether this set of servers is \"first\", aka PHA servers")
+var ownValidationInfix = flag.String("own-validation-infix", "", "The infix between the batch ID and the extensions in the names of our own validation files, e.g. \"validity_0\" in \"<batch ID>.validity_0.avro\". Defaults to \"validity_0\" with --is-first and \"validity_1\" without.")
+var peerValidationInfix = flag.String("peer-validation-infix", "", "The infix between the batch ID and the extensions in the names of the peer's validation files, for peers that name them differently. Defaults to \"validity_1\" with --is-first and \"validity_0\" without. Must differ from --own-validation-infix.")
 var maxAge = flag.String("intake-max-age", "1h", "Max age (in Go duration format) for intake batches to be worth processing.")
-var ingestorInput = flag.String("ingestor-input", "", "Bucket for input from ingestor (s3:// or gs://) (Required)")
-var ingestorIdentity = flag.String("ingestor-identity", "", "Identity to use with ingestor bucket (Required for S3)")
+var intakeFutureTolerance = flag.String("intake-future-tolerance", "24h", "How far in the future (in Go duration format) an intake batch's time may be, to tolerate skew between our clock and the ingestor's. Batches further in the future are skipped.")
+var ingestorInput = stringListFlag("ingestor-input", "Bucket for input from ingestor (s3:// or gs://) (Required). May be repeated or contain a comma-separated list to read batches from several buckets.")
+var ingestorIdentity = positionalListFlag("ingestor-identity", "Identity to use with ingestor bucket (Required for S3). With several ingestor buckets, give one identity per bucket, in the same order, leaving empty those that need none.")
+var ingestorExternalID = positionalListFlag("ingestor-external-id", "External ID to provide when assuming --ingestor-identity, if its trust policy requires one (Only supported for S3). With several ingestor buckets, give one per bucket, in the same order, leaving empty those that need none.")
 var ownValidationInput = flag.String("own-validation-input", "", "Bucket for input of validation batches from self (s3:// or gs://) (required)")
 var ownValidationIdentity = flag.String("own-validation-identity", "", "Identity to use with own validation bucket (Required for S3)")
+var ownValidationExternalID = flag.String("own-validation-external-id", "", "External ID to provide when assuming --own-validation-identity, if its trust policy requires one (Only supported for S3)")
 var peerValidationInput = flag.String("peer-validation-input", "", "Bucket for input of validation batches from peer (s3:// or gs://) (required)")
 var peerValidationIdentity = flag.String("peer-validation-identity", "", "Identity to use with peer validation bucket (Required for S3)")
+var peerValidationExternalID = flag.String("peer-validation-external-id", "", "External ID to provide when assuming --peer-validation-identity, if its trust policy requires one (Only supported for S3)")
+var taskMarkerBucketURL = flag.String("task-marker-bucket", "", "Bucket to which task markers should be written (s3://, gs:// or file://). If unset, task markers are written to the own validation bucket.")
+var taskMarkerBucketIdentity = flag.String("task-marker-bucket-identity", "", "Identity to use with task marker bucket (Required for S3)")
+var outputScheduledMarkers = flag.String("output-scheduled-markers", "", "If set, after each run write a manifest of the markers of the tasks it scheduled, named by a run ID, under scheduled-markers/ in this bucket (s3://, gs:// or file://), for reconciliation tooling")
+var outputScheduledMarkersIdentity = flag.String("output-scheduled-markers-identity", "", "Identity to use with --output-scheduled-markers bucket (Required for S3)")
+var ingestorS3 = s3BucketFlags("ingestor", "--ingestor-input buckets")
+var ownValidationS3 = s3BucketFlags("own-validation", "--own-validation-input")
+var peerValidationS3 = s3BucketFlags("peer-validation", "--peer-validation-input")
+var taskMarkerBucketS3 = s3BucketFlags("task-marker-bucket", "--task-marker-bucket")
+var outputScheduledMarkersS3 = s3BucketFlags("output-scheduled-markers", "--output-scheduled-markers")
+var s3ForcePathStyle = flag.Bool("s3-force-path-style", false, "If set, address s3:// buckets with an S3-compatible endpoint in the request path rather than the host name, as most S3-compatible services require")
+var s3InsecureSkipVerify = flag.Bool("s3-insecure-skip-verify", false, "If set, don't verify the TLS certificates of S3-compatible endpoints. Only use this with self-signed development setups.")
+var gcsBillingProject = flag.String("gcs-billing-project", "", "If set, the project billed for requests to gs:// buckets, which allows reading requester pays buckets. Requests to other buckets are unaffected.")
+var taskMarkerMaxAge = flag.String("task-marker-max-age", "", "If set, task markers older than this (in Go duration format) are deleted at the end of each run. Must be greater than --intake-max-age and --aggregation-period plus --grace-period.")
+var intakeBackfill = flag.Bool("intake-backfill", false, "If set, schedule intake tasks for all batches whose time is between --intake-backfill-start (inclusive) and --intake-backfill-end (exclusive), regardless of --intake-max-age.")
+var intakeBackfillStart = flag.String("intake-backfill-start", "", "Start (in RFC3339 format) of the window over which to backfill intake tasks. See --intake-backfill.")
+var intakeBackfillEnd = flag.String("intake-backfill-end", "", "End (in RFC3339 format) of the window over which to backfill intake tasks. See --intake-backfill.")
+var timePathFormat = flag.String("time-path-format", task.DefaultTimestampFormat, "The Go time layout of batch times in batch paths and of timestamps in tasks, which must match what the ingestors and facilitators use: \"2006/01/02/15/04\", with minute precision, as facilitator/lib.rs expects, or \"2006/01/02/15\", with hour precision. Timestamps in task markers and job names use the same layout with \"-\" for \"/\". With hour precision, --aggregation-period must be a whole number of hours.")
 var aggregationPeriod = flag.String("aggregation-period", "3h", "How much time each aggregation covers")
 var gracePeriod = flag.String("grace-period", "1h", "Wait this amount of time after the end of an aggregation timeslice to run the aggregation")
+var gracePeriodOverrides = stringListFlag("grace-period-override", "Grace period to use instead of --grace-period for one aggregation ID, in the form AGGREGATION_ID=DURATION (e.g. com.example.EN=2h). May be repeated or contain a comma-separated list to override several aggregation IDs.")
+var backfillStart = flag.String("backfill-start", "", "If set along with --backfill-end, schedule aggregations for every aggregation period between the two times (in RFC3339 format) instead of only the most recent one.")
+var backfillEnd = flag.String("backfill-end", "", "End (in RFC3339 format) of the window over which to backfill aggregations. See --backfill-start.")
+var since = flag.String("since", "", "If set, ignore batches whose time is before this time (in RFC3339 format). For S3 and GS buckets, older batches are not even listed.")
+var intakeTimeSource = flag.String("intake-time-source", "path", "Where the time by which intake batches are judged too old or too far in the future comes from: \"path\", the batch time in the batch's object names, or \"metadata\", when the batch's objects were last modified according to the storage service, for ingestors whose object names don't reflect when batches were written. With \"metadata\", ingestor buckets are listed in full every run. Tasks and aggregations always use the batch time in the object names.")
+var pruneIntakeListing = flag.Bool("prune-intake-listing", false, "If set, list only the hourly prefixes of the ingestor bucket that may contain batches eligible for intake, rather than the whole bucket. Requires batch object names to begin with \"${aggregation ID}/YYYY/MM/DD/HH/\".")
+var pollInterval = flag.String("poll-interval", "", "If set, run continuously, listing buckets and scheduling tasks at this interval (in Go duration format), until receiving SIGTERM or SIGINT. If unset, run once and exit.")
+var cacheDisabled = flag.Bool("cache-disabled", false, "If set, list the whole of each bucket every cycle with --poll-interval, rather than only the batches written since the previous cycle.")
+var listingCacheLookback = flag.String("listing-cache-lookback", "24h", "With --poll-interval, list again batches whose time is no more than this long (in Go duration format) before the previous cycle. Batches written later than this after their batch time are missed.")
+var maxBatchesPerAggregation = flag.Int("max-batches-per-aggregation", 0, "If set, don't schedule aggregation tasks over more than this many batches, and log an error instead, to guard against upstream bugs producing tasks too big for the task queue or the facilitator. Zero means no limit.")
+var maxEnqueueAttempts = flag.Int("max-enqueue-attempts", 1, "How many runs may attempt to enqueue a task that fails to enqueue before a failed task record is written for it, after which it is skipped until an operator resets it. Retries are spaced out with exponential backoff. The default of 1 records tasks as failed after their first failure.")
+var enqueueRetryBackoff = flag.String("enqueue-retry-backoff", "1h", "With --max-enqueue-attempts greater than 1, how long (in Go duration format) to wait after a task's first failed attempt before retrying it. The wait doubles with each further failed attempt.")
+var resetFailedTasks = stringListFlag("reset-failed-tasks", "Markers of tasks whose failed task records and records of failed attempts should be deleted at startup, so that they are scheduled again. May be repeated or contain a comma-separated list.")
+var checkTaskMarkers = flag.Bool("check-task-markers", false, "If set, instead of listing every task marker in --task-marker-bucket, check whether each task that may be scheduled has a marker, with one request per task. This is cheaper for buckets with very many markers. Requires --task-marker-bucket and is incompatible with --task-marker-max-age, which needs the listing. --report-only still lists the markers.")
+var markerCheckConcurrency = flag.Int("marker-check-concurrency", 16, "With --check-task-markers, how many task markers may be checked at once")
+var markerCheckTimeout = flag.String("marker-check-timeout", "5m", "With --check-task-markers, how long (in Go duration format) checking the markers of the tasks that may be scheduled may take in each run, after which the run fails without scheduling them")
+var replayMarkers = stringListFlag("replay-markers", "Markers of tasks to enqueue again, from the task bodies recorded in their task markers, after which workflow-manager exits without scheduling any other tasks. Markers are neither written nor deleted. May be repeated or contain a comma-separated list.")
+var maxConsecutiveEnqueueFailures = flag.Int("max-consecutive-enqueue-failures", 10, "If this many enqueues in a row fail, assume the task queue is unavailable, stop enqueuing tasks for the rest of the run and exit with an error. Zero means never stop.")
+var validateBatchHeaders = flag.Bool("validate-batch-headers", false, "If set, read the header file of each intake batch that may be scheduled from its ingestor bucket, and skip batches whose header is empty, larger than --batch-header-max-size or not a well-formed Avro object container file. Headers are read --enqueue-concurrency at a time. Batches whose headers can't be read are scheduled anyway.")
+var batchHeaderMaxSize = flag.Int("batch-header-max-size", 1<<20, "With --validate-batch-headers, the largest size in bytes of a valid batch header")
+var enqueueConcurrency = flag.Int("enqueue-concurrency", 1, "Number of intake tasks whose pending markers may be written and which may be enqueued at once. Which tasks to schedule is still decided oldest batch first, but with more than one, tasks may reach the task queue out of order.")
+var operationTimeout = flag.String("operation-timeout", utils.DefaultOperationTimeout.String(), "How long (in Go duration format) a single network operation, such as publishing a task, pinging a task queue or listing a page of a bucket, may take before it is abandoned")
+var startupJitter = flag.String("startup-jitter", "0s", "Before doing any work, sleep for a random duration between zero and this (in Go duration format), to spread out the load of many workflow-managers started at the same time.")
+var now = flag.String("now", "", "If set, schedule tasks as if the current time were this time (in RFC3339 format), to reproduce past scheduling decisions. Use with --dry-run unless you mean to schedule tasks.")
+var reportOnly = flag.Bool("report-only", false, "If set, print a summary of the work that is ready to be scheduled and exit, without enqueuing any tasks or writing anything. Task queue flags are not required.")
+var intakeOnly = flag.Bool("intake-only", false, "If set, schedule only intake tasks and skip aggregation entirely. Useful to tell whether a problem lies in intake scheduling or in matching own and peer validations.")
+var selfTestPublish = flag.Bool("selftest-publish", false, "With the selftest subcommand, publish a sentinel task, whose task_type attribute is \"selftest\", to each task queue instead of only pinging it. Only use this if the task queues' consumers drop such tasks.")
+var continueOnPartialFailure = flag.Bool("continue-on-partial-failure", false, "If set, a peer validation bucket that can't be reached or listed doesn't fail the run. Intake tasks are still scheduled, and aggregation is skipped until the bucket can be listed again.")
+var aggregateOnly = flag.Bool("aggregate-only", false, "If set, schedule only aggregation tasks and skip intake entirely. Useful to tell whether a problem lies in intake scheduling or in matching own and peer validations.")
 var pushGateway = flag.String("push-gateway", "", "Set this to the gateway to use with prometheus. If left empty, workflow-manager will not use prometheus.")
 var kubeconfigPath = flag.String("kube-config-path", "", "Path to the kubeconfig file to be used to authenticate to Kubernetes API")
+var jobListPageSize = flag.Int64("job-list-page-size", wfkubernetes.DefaultJobListPageSize, "Number of Kubernetes jobs to request at a time when listing jobs. Lower this if listing jobs times out.")
+var k8sMaxAttempts = flag.Int("k8s-max-attempts", wfkubernetes.DefaultMaxAttempts, "Number of times to make a Kubernetes API call that fails with transient errors (e.g. 429, 500 or 503) before giving up")
+var jobLabelSelector = flag.String("job-label-selector", "", "If set, only consider Kubernetes jobs whose labels match this selector (e.g. \"app=workflow-manager\") when looking for jobs created for tasks. If unset, all jobs in --k8s-namespace are considered.")
+var validateConfigOnly = flag.Bool("validate-config", false, "If set, check that the flags are valid, without contacting any bucket, task queue or other service, and exit with a nonzero status describing the first problem if they are not.")
 var dryRun = flag.Bool("dry-run", false, "If set, no operations with side effects will be done.")
+var onlyAggregationIDs = stringListFlag("only-aggregation-id", "If set, only schedule tasks for batches with this aggregation ID. May be repeated or contain a comma-separated list to allow several aggregation IDs.")
+var excludeAggregationIDs = stringListFlag("exclude-aggregation-id", "If set, don't schedule tasks for batches with this aggregation ID, even if allowed by --only-aggregation-id. May be repeated or contain a comma-separated list to exclude several aggregation IDs.")
+var aggregationIDIncludeRegex = flag.String("aggregation-id-include-regex", "", "If set, only schedule tasks for batches whose aggregation IDs match this regular expression, or are allowed by --only-aggregation-id. The expression is unanchored, so use ^ and $ to match whole aggregation IDs.")
+var aggregationIDExcludeRegex = flag.String("aggregation-id-exclude-regex", "", "If set, don't schedule tasks for batches whose aggregation IDs match this regular expression, even if they are otherwise allowed. The expression is unanchored, so use ^ and $ to match whole aggregation IDs.")
 var taskQueueKind = flag.String("task-queue-kind", "", "Which task queue kind to use.")
+var intakeTaskQueueKind = flag.String("intake-task-queue-kind", "", "If set, the task queue kind to use for intake tasks instead of --task-queue-kind")
+var aggregateTaskQueueKind = flag.String("aggregate-task-queue-kind", "", "If set, the task queue kind to use for aggregate tasks instead of --task-queue-kind")
 var intakeTasksTopic = flag.String("intake-tasks-topic", "", "Name of the topic to which intake-batch tasks should be published")
 var aggregateTasksTopic = flag.String("aggregate-tasks-topic", "", "Name of the topic to which aggregate tasks should be published")
+var topicPrefix = flag.String("topic-prefix", "", "If set, prepended to the names of --intake-tasks-topic and --aggregate-tasks-topic, and so of the subscriptions created by --gcp-pubsub-create-topics, e.g. to namespace the topics of many localities in one project. For aws-sns, it is prepended to the topic name at the end of the ARN.")
+var logFormat = flag.String("log-format", "text", "Format of log output, either \"text\" or \"json\"")
+var logLevel = flag.String("log-level", "info", "Minimum level of messages to log (e.g., debug, info, warning, error)")
+var otlpEndpoint = flag.String("otlp-endpoint", "", "Address (host:port) of an OTLP collector to which trace spans should be exported. If left empty, workflow-manager will not export traces.")
+var otlpInsecure = flag.Bool("otlp-insecure", false, "If set, connect to the OTLP collector without TLS.")
+var taskSchemaVersion = flag.Int("task-schema-version", task.TaskSchemaVersion, "Schema version of the JSON encoding of tasks to emit. During a rolling upgrade of facilitators, set this to the version understood by the oldest facilitator. Version 0 omits the version field.")
+var taskFieldNaming = flag.String("task-field-naming", string(task.KebabCase), "Style of the keys in the JSON encoding of tasks, either \"kebab-case\" (e.g. \"aggregation-id\") or \"snake-case\" (e.g. \"aggregation_id\"). Only facilitators that expect snake_case keys need \"snake-case\".")
+var metricsAggregationIDLabel = flag.Bool("metrics-aggregation-id-label", true, "Whether to label started job metrics with the aggregation ID. Disable if the number of aggregation IDs is large.")
 
 // Arguments for gcp-pubsub task queue
 var gcpPubSubCreatePubSubTopics = flag.Bool("gcp-pubsub-create-topics", false, "Whether to create the GCP PubSub topics used for intake and aggregation tasks.")
+var gcpPubSubAckDeadline = flag.String("gcp-pubsub-ack-deadline", "", "With --gcp-pubsub-create-topics, how long (in Go duration format, between 10s and 600s) facilitators have to acknowledge a task before PubSub redelivers it. If unset, 10m is used.")
+var gcpPubSubRetentionDuration = flag.String("gcp-pubsub-retention-duration", "", "With --gcp-pubsub-create-topics, how long (in Go duration format, between 10m and 168h) PubSub retains unacknowledged tasks. If unset, PubSub's default of 7 days is used.")
+var gcpPubSubDeadLetterTopic = flag.String("gcp-pubsub-dead-letter-topic", "", "With --gcp-pubsub-create-topics, the ID of a topic to which PubSub forwards tasks that could not be delivered after --gcp-pubsub-max-delivery-attempts. The topic and a subscription with the same ID are created if they don't exist. If unset, tasks are never dead-lettered.")
+var gcpPubSubMaxDeliveryAttempts = flag.Int("gcp-pubsub-max-delivery-attempts", 0, "With --gcp-pubsub-dead-letter-topic, the number of delivery attempts (between 5 and 100) after which PubSub dead-letters a task. If unset, PubSub's default of 5 is used.")
 var gcpPubSubProjectID = flag.String("gcp-project-id", "", "Name of the GCP project ID being used for PubSub..")
+var gcpPubSubPublishCountThreshold = flag.Int("gcp-pubsub-publish-count-threshold", 0, "Publish a batch of tasks to GCP PubSub once it contains this many tasks. If unset, the PubSub client's default is used.")
+var gcpPubSubPublishByteThreshold = flag.Int("gcp-pubsub-publish-byte-threshold", 0, "Publish a batch of tasks to GCP PubSub once it reaches this size in bytes. If unset, the PubSub client's default is used.")
+var gcpPubSubPublishDelayThreshold = flag.String("gcp-pubsub-publish-delay-threshold", "", "Publish a non-empty batch of tasks to GCP PubSub after this delay (in Go duration format). If unset, the PubSub client's default is used.")
+var gcpPubSubPublishBufferedByteLimit = flag.Int("gcp-pubsub-publish-buffered-byte-limit", 0, "Maximum size in bytes of tasks buffered in memory awaiting publication to GCP PubSub. Tasks enqueued beyond this limit fail. If unset, the PubSub client's default is used.")
+var gcpPubSubOrdering = flag.Bool("gcp-pubsub-ordering", false, "If set, publish tasks to GCP PubSub with their aggregation ID as the ordering key, so that each aggregation ID's tasks are delivered in order to subscriptions with message ordering enabled, which --gcp-pubsub-create-topics does. Ordering reduces publish throughput.")
+var gcpPubSubMaxMessageSize = flag.Int("gcp-pubsub-max-message-size", task.DefaultGCPPubSubMaxMessageSize, "Maximum size in bytes of a task published to GCP PubSub. Larger aggregation tasks refer to their batches in an object in the own validation bucket instead of listing them.")
+
+// Arguments for gcp-cloudtasks task queue. The queue IDs are provided in
+// --intake-tasks-topic and --aggregate-tasks-topic, and the project in
+// --gcp-project-id.
+var gcpCloudTasksLocation = flag.String("gcp-cloudtasks-location", "", "GCP location (e.g., us-west1) of the Cloud Tasks queues")
+var gcpCloudTasksTargetURL = flag.String("gcp-cloudtasks-target-url", "", "URL to which Cloud Tasks should deliver tasks")
+var gcpCloudTasksServiceAccount = flag.String("gcp-cloudtasks-service-account", "", "Email of the GCP service account whose OIDC token Cloud Tasks should present when delivering tasks. If unset, no token is presented.")
+var gcpCloudTasksIntakeDelay = flag.String("intake-delay", "0s", "Defer delivery of intake tasks until the batch is at least this old (in Go duration format). Only supported with task-queue-kind=gcp-cloudtasks.")
+var gcpCloudTasksMaxTaskSize = flag.Int("gcp-cloudtasks-max-task-size", task.DefaultGCPCloudTasksMaxSize, "Maximum size in bytes of a task created in Cloud Tasks. Larger aggregation tasks refer to their batches in an object in the own validation bucket instead of listing them.")
 
 // Arguments for aws-sns task queue
-var awsSNSRegion = flag.String("aws-sns-region", "", "AWS region in which to publish to SNS topic")
+var awsSNSRegion = flag.String("aws-sns-region", "", "AWS region in which to publish to SNS topic. If unset, the region is taken from AWS_REGION, AWS_DEFAULT_REGION, the shared AWS config file or the EC2 instance metadata.")
 var awsSNSIdentity = flag.String("aws-sns-identity", "", "AWS IAM ARN of the role to be assumed to publish to SNS topics")
+var awsSNSMaxMessageSize = flag.Int("aws-sns-max-message-size", task.DefaultAWSSNSMaxMessageSize, "Maximum size in bytes of a task published to SNS. Larger aggregation tasks refer to their batches in an object in the own validation bucket instead of listing them.")
+
+// Arguments for kafka task queue. The topics are provided in
+// --intake-tasks-topic and --aggregate-tasks-topic.
+var kafkaBrokers = flag.String("kafka-brokers", "", "Comma-separated addresses (host:port) of Kafka brokers through which to connect to the cluster")
+var kafkaMaxMessageSize = flag.Int("kafka-max-message-size", task.DefaultKafkaMaxMessageSize, "Maximum size in bytes of a task produced to Kafka. Larger aggregation tasks refer to their batches in an object in the own validation bucket instead of listing them. Must not exceed the topic's max.message.bytes.")
+
+// Arguments for redis task queue. The streams are provided in
+// --intake-tasks-topic and --aggregate-tasks-topic.
+var redisAddr = flag.String("redis-addr", "", "Address (host:port) of the Redis server on which to add tasks to streams")
+var redisUsername = flag.String("redis-username", "", "Redis ACL user to authenticate as. If unset, the password in --redis-password-file, if any, authenticates the default user.")
+var redisPasswordFile = flag.String("redis-password-file", "", "Path to a file containing the password with which to authenticate to Redis. If unset, no authentication is done.")
+var redisTLS = flag.Bool("redis-tls", false, "If set, connect to Redis with TLS.")
+var redisMaxLen = flag.Int64("redis-max-len", 100000, "Approximate number of tasks beyond which the oldest tasks are trimmed from each Redis stream, to bound its memory use. If 0, streams are never trimmed.")
 
 // Define flags and arguments for other task queue implementations here.
 // Argument names should be prefixed with the corresponding value of
 // task-queue-kind to avoid conflicts.
 
 // monitoring things
+// The started jobs counters are labeled by aggregation ID. Each distinct
+// aggregation ID creates a new time series, so we recommend disabling the label
+// with --metrics-aggregation-id-label=false for deployments with more than ~100
+// aggregation IDs.
 var (
-	intakesStarted      monitor.CounterMonitor = &monitor.NoopCounter{}
-	aggregationsStarted monitor.CounterMonitor = &monitor.NoopCounter{}
+	intakesStarted        monitor.CounterVecMonitor = &monitor.NoopCounterVec{}
+	aggregationsStarted   monitor.CounterVecMonitor = &monitor.NoopCounterVec{}
+	malformedBatchPaths   monitor.CounterMonitor    = &monitor.NoopCounter{}
+	jobNameCollisions     monitor.CounterMonitor    = &monitor.NoopCounter{}
+	tasksDeadLettered     monitor.CounterVecMonitor = &monitor.NoopCounterVec{}
+	mismatchedValidations monitor.CounterMonitor    = &monitor.NoopCounter{}
+	markerWriteFailures   monitor.CounterMonitor    = &monitor.NoopCounter{}
+	intakeBatchesTooOld   monitor.GaugeMonitor      = &monitor.NoopGauge{}
+	intakeBatchesInFuture monitor.GaugeMonitor      = &monitor.NoopGauge{}
+	stalePendingMarkers   monitor.CounterMonitor    = &monitor.NoopCounter{}
+	intakeBatchAge        monitor.HistogramMonitor  = &monitor.NoopHistogram{}
+	aggregationLag        monitor.HistogramMonitor  = &monitor.NoopHistogram{}
+	aggregationBegin      monitor.GaugeMonitor      = &monitor.NoopGauge{}
+	aggregationEnd        monitor.GaugeMonitor      = &monitor.NoopGauge{}
+	orphanOwnValidations  monitor.GaugeMonitor      = &monitor.NoopGauge{}
+	orphanPeerValidations monitor.GaugeMonitor      = &monitor.NoopGauge{}
+	aggregationsTooLarge  monitor.CounterVecMonitor = &monitor.NoopCounterVec{}
+	enqueueFailures       monitor.CounterVecMonitor = &monitor.NoopCounterVec{}
+	aggregationsSkipped   monitor.CounterMonitor    = &monitor.NoopCounter{}
+	invalidBatchHeaders   monitor.CounterMonitor    = &monitor.NoopCounter{}
+	runDuration           monitor.HistogramMonitor  = &monitor.NoopHistogram{}
 )
 
+// lastSuccess holds the time of the most recent successful run. Rather than
+// being registered with the default registry, it is only pushed after a run
+// that succeeded, so that a failed run doesn't overwrite the time pushed by an
+// earlier, successful run.
+var lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "workflow_manager_last_success_timestamp",
+	Help: "The time, in Unix seconds, at which the most recent successful run finished",
+})
+
+// latencyBuckets are the buckets, in seconds, of the histograms of how long
+// after their batch time or aggregation interval tasks are scheduled. They
+// double from 1 second to about 9 hours.
+var latencyBuckets = prometheus.ExponentialBuckets(1, 2, 16)
+
 func main() {
-	log.Printf("starting %s version %s. Args: %s", os.Args[0], BuildInfo, os.Args[1:])
-	flag.Parse()
+	// `workflow-manager selftest [flags]` checks the configured dependencies
+	// instead of scheduling tasks
+	args := os.Args[1:]
+	selfTest := len(args) > 0 && args[0] == "selftest"
+	if selfTest {
+		args = args[1:]
+	}
+	// flag.CommandLine exits on errors
+	flag.CommandLine.Parse(args)
+	// Flags on the command line take precedence over environment variables,
+	// which take precedence over the config file
+	flagSources := map[string]string{}
+	flag.Visit(func(f *flag.Flag) { flagSources[f.Name] = "command line" })
+	if err := applyEnvironment(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if _, ok := flagSources[f.Name]; !ok {
+			flagSources[f.Name] = fmt.Sprintf("environment (%s)", flagEnvironmentVariable(f.Name))
+		}
+	})
+	if *configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, *configFile); err != nil {
+			log.Fatalf("--config: %s", err)
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if _, ok := flagSources[f.Name]; !ok {
+				flagSources[f.Name] = "config file"
+			}
+		})
+	}
+
+	if err := configureLogging(*logFormat, *logLevel); err != nil {
+		log.Fatalf("--log-format, --log-level: %s", err)
+	}
+
+	parsed, err := validateConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logStartup(parsed)
+	sourceFields := log.Fields{}
+	for name, source := range flagSources {
+		sourceFields[name] = source
+	}
+	log.WithFields(sourceFields).Info("flags not at their defaults were set from these sources")
+	if *validateConfigOnly {
+		log.Print("configuration is valid")
+		return
+	}
+	if selfTest && (*reportOnly || *dryRun) {
+		log.Fatal("selftest can't be combined with --report-only or --dry-run, since it writes a task marker")
+	}
+	utils.OperationTimeout = parsed.operationTimeout
+	if err := task.SetTimestampFormat(*timePathFormat); err != nil {
+		log.Fatalf("--time-path-format: %s", err)
+	}
 
 	if *pushGateway != "" {
-		push.New(*pushGateway, "workflow-manager").Gatherer(prometheus.DefaultGatherer).Push()
-		intakesStarted = promauto.NewCounter(prometheus.CounterOpts{
+		intakesStarted = monitor.NewPrometheusCounterVec(prometheus.CounterOpts{
 			Name: "intake_jobs_started",
 			Help: "The number of intake-batch jobs successfully started",
-		})
+		}, "aggregation_id")
 
-		aggregationsStarted = promauto.NewCounter(prometheus.CounterOpts{
+		aggregationsStarted = monitor.NewPrometheusCounterVec(prometheus.CounterOpts{
 			Name: "aggregation_jobs_started",
 			Help: "The number of aggregate jobs successfully started",
+		}, "aggregation_id")
+
+		malformedBatchPaths = promauto.NewCounter(prometheus.CounterOpts{
+			Name: "malformed_batch_paths",
+			Help: "The number of objects in batch buckets whose names could not be parsed",
 		})
-	}
 
-	ownValidationBucket, err := bucket.New(*ownValidationInput, *ownValidationIdentity, *dryRun)
-	if err != nil {
-		log.Fatalf("--own-validation-input: %s", err)
+		jobNameCollisions = promauto.NewCounter(prometheus.CounterOpts{
+			Name: "job_name_collision",
+			Help: "The number of tasks whose job name matched an existing job created for a different task",
+		})
+
+		tasksDeadLettered = monitor.NewPrometheusCounterVec(prometheus.CounterOpts{
+			Name: "dead_lettered_tasks",
+			Help: "The number of tasks that failed to be enqueued and were recorded in the failed tasks prefix",
+		}, "aggregation_id")
+
+		mismatchedValidations = promauto.NewCounter(prometheus.CounterOpts{
+			Name: "mismatched_validation_batches",
+			Help: "The number of peer validations whose batch ID matched an own validation with a different aggregation ID or batch time",
+		})
+
+		markerWriteFailures = promauto.NewCounter(prometheus.CounterOpts{
+			Name: "task_marker_write_failures",
+			Help: "The number of tasks that were enqueued but whose task marker could not be written on the first attempt",
+		})
+
+		intakeBatchesTooOld = promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "intake_batches_too_old",
+			Help: "The number of intake batches skipped by the most recent run because their time was more than --intake-max-age in the past",
+		})
+
+		intakeBatchesInFuture = promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "intake_batches_too_far_in_future",
+			Help: "The number of intake batches skipped by the most recent run because their time was more than --intake-future-tolerance in the future",
+		})
+
+		stalePendingMarkers = promauto.NewCounter(prometheus.CounterOpts{
+			Name: "stale_pending_task_markers",
+			Help: "The number of tasks whose pending marker was left behind by an earlier run that stopped before learning whether the task was enqueued",
+		})
+
+		intakeBatchAge = promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "intake_batch_age_seconds",
+			Help:    "How long after their batch time intake tasks were scheduled",
+			Buckets: latencyBuckets,
+		})
+
+		aggregationLag = promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "aggregation_lag_seconds",
+			Help:    "How long after the end of their aggregation interval aggregation tasks were scheduled",
+			Buckets: latencyBuckets,
+		})
+
+		aggregationBegin = promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "aggregation_interval_begin_seconds",
+			Help: "The start, in Unix seconds, of the most recent aggregation interval whose grace period has elapsed",
+		})
+
+		aggregationEnd = promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "aggregation_interval_end_seconds",
+			Help: "The end, in Unix seconds, of the most recent aggregation interval whose grace period has elapsed",
+		})
+
+		orphanOwnValidations = promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "orphan_own_validations",
+			Help: "The number of own validations in the aggregation intervals being scheduled for which no peer validation with the same batch ID exists",
+		})
+
+		orphanPeerValidations = promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "orphan_peer_validations",
+			Help: "The number of peer validations in the aggregation intervals being scheduled for which no own validation with the same batch ID exists",
+		})
+
+		aggregationsTooLarge = monitor.NewPrometheusCounterVec(prometheus.CounterOpts{
+			Name: "aggregations_too_large",
+			Help: "The number of aggregation tasks not scheduled because they had more than --max-batches-per-aggregation batches",
+		}, "aggregation_id")
+
+		enqueueFailures = monitor.NewPrometheusCounterVec(prometheus.CounterOpts{
+			Name: "task_enqueue_failures_total",
+			Help: "The number of tasks that failed to enqueue, by task queue kind and class of error",
+		}, "backend", "error_class")
+
+		aggregationsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+			Name: "aggregation_scheduling_skipped",
+			Help: "The number of runs that scheduled no aggregation tasks because the peer validation bucket could not be listed, with --continue-on-partial-failure",
+		})
+
+		invalidBatchHeaders = promauto.NewCounter(prometheus.CounterOpts{
+			Name: "intake_batches_invalid_header",
+			Help: "The number of intake batches skipped because their header file was invalid, with --validate-batch-headers",
+		})
+
+		runDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "workflow_manager_run_duration_seconds",
+			Help:    "How long each run of workflow-manager took to schedule tasks",
+			Buckets: latencyBuckets,
+		})
 	}
-	peerValidationBucket, err := bucket.New(*peerValidationInput, *peerValidationIdentity, *dryRun)
+
+	shutdownTracing, err := tracing.Init(*otlpEndpoint, *otlpInsecure)
 	if err != nil {
-		log.Fatalf("--peer-validation-input: %s", err)
+		log.Fatalf("--otlp-endpoint: %s", err)
 	}
-	intakeBucket, err := bucket.New(*ingestorInput, *ingestorIdentity, *dryRun)
-	if err != nil {
-		log.Fatalf("--ingestor-input: %s", err)
+
+	// ctx is canceled if we receive SIGTERM or SIGINT, which stops us from
+	// scheduling any further tasks. Publishes to the task queue that are
+	// already in flight aren't canceled, but are left to finish or time out,
+	// and we wait for the task enqueuers to drain so that markers get written
+	// for the tasks that were published. A second signal exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("received signal %s, draining task enqueuers before exiting", sig)
+		cancel()
+		sig = <-signals
+		log.Fatalf("received second signal %s, exiting immediately", sig)
+	}()
+
+	if *s3InsecureSkipVerify {
+		log.Warn("--s3-insecure-skip-verify is set, so TLS certificates of S3 endpoints will not be verified")
 	}
 
-	maxAgeParsed, err := time.ParseDuration(*maxAge)
-	if err != nil {
-		log.Fatalf("--max-age: %s", err)
+	clock := utils.DefaultClock()
+	if parsed.now != nil {
+		log.Warnf("using fixed time %s as the current time instead of the real time %s", *parsed.now, time.Now())
+		if !*dryRun {
+			log.Warn("--now is set without --dry-run, so tasks will be scheduled")
+		}
+		clock = utils.ClockWithFixedNow(*parsed.now)
 	}
 
-	gracePeriodParsed, err := time.ParseDuration(*gracePeriod)
-	if err != nil {
-		log.Fatalf("--grace-period: %s", err)
+	// In polling mode, each batch bucket's listing is cached across cycles
+	intakeCaches := make([]*bucket.ListingCache, len(parsed.intakeBuckets))
+	var ownValidationCache, peerValidationCache *bucket.ListingCache
+	if parsed.pollInterval != 0 && !*cacheDisabled {
+		for i, intakeBucket := range parsed.intakeBuckets {
+			intakeCaches[i] = bucket.NewListingCache(intakeBucket, utils.DefaultClock(), parsed.since, parsed.listingCacheLookback)
+		}
+		ownValidationCache = bucket.NewListingCache(parsed.ownValidationBucket, utils.DefaultClock(), parsed.since, parsed.listingCacheLookback)
+		peerValidationCache = bucket.NewListingCache(parsed.peerValidationBucket, utils.DefaultClock(), parsed.since, parsed.listingCacheLookback)
 	}
 
-	aggregationPeriodParsed, err := time.ParseDuration(*aggregationPeriod)
-	if err != nil {
-		log.Fatalf("--aggregation-time-slice: %s", err)
+	// listBuckets lists the batch buckets and the task marker bucket, and
+	// returns the listings along with the configuration for scheduling tasks
+	// based on them.
+	listBuckets := func(ctx context.Context) (*bucketListings, error) {
+		listings := bucketListings{
+			config: scheduleTasksConfig{
+				isFirst:                  *isFirst,
+				ownValidationInfix:       parsed.ownValidationInfix,
+				peerValidationInfix:      parsed.peerValidationInfix,
+				clock:                    clock,
+				taskMarkerBucket:         parsed.taskMarkerBucket,
+				maxAge:                   parsed.maxAge,
+				intakeFutureTolerance:    parsed.intakeFutureTolerance,
+				taskSchemaVersion:        *taskSchemaVersion,
+				taskFieldNaming:          parsed.taskFieldNaming,
+				aggregationPeriod:        parsed.aggregationPeriod,
+				gracePeriod:              parsed.gracePeriod,
+				gracePeriodOverrides:     parsed.gracePeriodOverrides,
+				aggregationBackfill:      parsed.aggregationBackfill,
+				intakeBackfill:           parsed.intakeBackfill,
+				enqueueConcurrency:       *enqueueConcurrency,
+				maxEnqueueFailures:       *maxConsecutiveEnqueueFailures,
+				maxEnqueueAttempts:       *maxEnqueueAttempts,
+				enqueueRetryBackoff:      parsed.enqueueRetryBackoff,
+				failedAttemptStore:       parsed.taskMarkerBucket,
+				maxBatchesPerAggregation: *maxBatchesPerAggregation,
+				aggregationIDs:           parsed.aggregationIDs,
+				skipIntake:               *aggregateOnly,
+				skipAggregation:          *intakeOnly,
+				checkTaskMarkers:         *checkTaskMarkers && !*reportOnly,
+				markerCheckConcurrency:   *markerCheckConcurrency,
+				markerCheckTimeout:       parsed.markerCheckTimeout,
+				batchHeaderMaxSize:       int64(*batchHeaderMaxSize),
+			},
+		}
+		if *validateBatchHeaders {
+			for _, intakeBucket := range parsed.intakeBuckets {
+				listings.config.intakeHeaderReaders = append(listings.config.intakeHeaderReaders, intakeBucket)
+			}
+		}
+
+		for i, intakeBucket := range parsed.intakeBuckets {
+			name := "ingestor"
+			if i > 0 {
+				name = fmt.Sprintf("ingestor-%d", i+1)
+			}
+			var files []string
+			var err error
+			if *intakeTimeSource == intakeTimeFromMetadata {
+				if listings.config.intakeLastModified == nil {
+					listings.config.intakeLastModified = map[string]time.Time{}
+				}
+				files, err = listFilesWithMetadata(ctx, name, intakeBucket, listings.config.intakeLastModified)
+			} else if *pruneIntakeListing {
+				window := intakeWindow(clock, parsed.maxAge, parsed.intakeFutureTolerance, parsed.intakeBackfill)
+				if window.begin.Before(parsed.since) {
+					window.begin = parsed.since
+				}
+				files, err = listFilesInWindow(ctx, name, intakeBucket, window)
+			} else {
+				files, err = listFiles(ctx, name, intakeBucket, intakeCaches[i], parsed.since)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				listings.config.intakeFiles = files
+			} else {
+				listings.config.additionalIntakeFiles = append(listings.config.additionalIntakeFiles, files)
+			}
+		}
+
+		var err error
+
+		listings.config.ownValidationFiles, err = listFiles(ctx, "own-validation", parsed.ownValidationBucket, ownValidationCache, parsed.since)
+		if err != nil {
+			return nil, err
+		}
+
+		listings.config.peerValidationFiles, err = listFiles(ctx, "peer-validation", parsed.peerValidationBucket, peerValidationCache, parsed.since)
+		if err != nil {
+			// The peer validations are only needed for aggregation, so intake
+			// can go ahead without them
+			if !*continueOnPartialFailure || *reportOnly {
+				return nil, err
+			}
+			log.Warnf("failed to list peer validation bucket, skipping aggregation this run: %s", err)
+			listings.config.peerValidationFiles = nil
+			listings.config.peerValidationUnavailable = true
+		}
+
+		// Unless a dedicated task marker bucket is configured, task markers
+		// are written to the own validation bucket, and we find them in the
+		// listing of its contents.
+		listings.markersInTaskMarkerBucket = taskMarkersInFiles(listings.config.ownValidationFiles)
+		// Pending markers are listed on their own, wherever they are written,
+		// since only those old enough to be stale are reconciled
+		pendingMarkers, err := parsed.taskMarkerBucket.ListPendingMarkers()
+		if err != nil {
+			return nil, err
+		}
+		listings.config.pendingMarkersLastModified = map[string]time.Time{}
+		for _, pendingMarker := range pendingMarkers {
+			listings.config.pendingMarkers = append(listings.config.pendingMarkers, pendingMarker.Key)
+			listings.config.pendingMarkersLastModified[pendingMarker.Key] = pendingMarker.LastModified
+		}
+		if parsed.taskMarkerBucket != parsed.ownValidationBucket {
+			// Markers are instead checked one by one as they are needed
+			if !listings.config.checkTaskMarkers {
+				listings.config.taskMarkers, err = listTaskMarkers(ctx, parsed.taskMarkerBucket)
+				if err != nil {
+					return nil, err
+				}
+			}
+			listings.config.failedTasks, err = parsed.taskMarkerBucket.ListFailedTasks()
+			if err != nil {
+				return nil, err
+			}
+			// Tasks are only retried with more than one attempt, so there is
+			// nothing to list otherwise
+			if *maxEnqueueAttempts > 1 {
+				listings.config.failedAttempts, err = parsed.taskMarkerBucket.ListFailedAttempts()
+				if err != nil {
+					return nil, err
+				}
+			}
+			listings.markersInTaskMarkerBucket = listings.config.taskMarkers
+		}
+
+		return &listings, nil
 	}
 
-	if *taskQueueKind == "" || *intakeTasksTopic == "" || *aggregateTasksTopic == "" {
-		log.Fatalf("--task-queue-kind, --intake-tasks-topic and --aggregate-tasks-topic are required")
+	var bucketDependencies []dependency
+	for i, intakeBucket := range parsed.intakeBuckets {
+		bucketDependencies = append(bucketDependencies, dependency{
+			fmt.Sprintf("--ingestor-input %s", redactURL((*ingestorInput)[i])),
+			intakeBucket.Ping,
+		})
+	}
+	peerValidationPing := parsed.peerValidationBucket.Ping
+	if *continueOnPartialFailure && !*reportOnly && !selfTest {
+		peerValidationPing = func() error {
+			if err := parsed.peerValidationBucket.Ping(); err != nil {
+				log.Warnf("--peer-validation-input is unreachable, aggregation will be skipped until it can be listed: %s", err)
+			}
+			return nil
+		}
+	}
+	bucketDependencies = append(bucketDependencies,
+		dependency{"--own-validation-input", parsed.ownValidationBucket.Ping},
+		dependency{"--peer-validation-input", peerValidationPing},
+		dependency{"--task-marker-bucket", parsed.taskMarkerBucket.Ping},
+	)
+	if parsed.scheduledMarkersBucket != nil {
+		bucketDependencies = append(bucketDependencies,
+			dependency{"--output-scheduled-markers", parsed.scheduledMarkersBucket.Ping},
+		)
 	}
 
-	var intakeTaskEnqueuer task.Enqueuer
-	var aggregationTaskEnqueuer task.Enqueuer
+	if *reportOnly {
+		for _, dependency := range bucketDependencies {
+			if err := dependency.ping(); err != nil {
+				log.Fatalf("%s is unreachable: %s", dependency.name, err)
+			}
+		}
 
-	switch *taskQueueKind {
-	case "gcp-pubsub":
-		if *gcpPubSubProjectID == "" {
-			log.Fatal("--gcp-project-id is required for task-queue-kind=gcp-pubsub")
+		listings, err := listBuckets(ctx)
+		if err != nil {
+			log.Fatal(err)
 		}
+		pendingWorkFor(ctx, listings.config).write(os.Stdout)
+		shutdownTracing()
+		return
+	}
 
-		if *gcpPubSubCreatePubSubTopics {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	if parsed.startupJitter > 0 && !selfTest {
+		delay := jitterDelay(parsed.startupJitter, rnd)
+		log.Printf("sleeping %s before starting", delay)
+		select {
+		case <-ctx.Done():
+			log.Fatalf("interrupted before starting: %s", ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+
+	if *gcpPubSubCreatePubSubTopics {
+		for _, queue := range []struct {
+			kind, topic string
+		}{
+			{parsed.intakeTaskQueueKind, parsed.intakeEnqueuerConfig.Topic},
+			{parsed.aggregationTaskQueueKind, parsed.aggregationEnqueuerConfig.Topic},
+		} {
+			if queue.kind != "gcp-pubsub" {
+				continue
+			}
 			if err := task.CreatePubSubTopic(
 				*gcpPubSubProjectID,
-				*intakeTasksTopic,
+				queue.topic,
+				parsed.gcpPubSubSubscriptionConfig,
 			); err != nil {
 				log.Fatalf("creating pubsub topic: %s", err)
 			}
-			if err := task.CreatePubSubTopic(
-				*gcpPubSubProjectID,
-				*aggregateTasksTopic,
+		}
+	}
+
+	intakeConfig := parsed.intakeEnqueuerConfig
+	aggregationConfig := parsed.aggregationEnqueuerConfig
+	// The facilitator reads the batches of aggregation tasks too large for
+	// the task queue from its own validation bucket
+	aggregationConfig.BatchesWriter = parsed.ownValidationBucket
+	if *redisPasswordFile != "" {
+		password, err := ioutil.ReadFile(*redisPasswordFile)
+		if err != nil {
+			log.Fatalf("--redis-password-file: %s", err)
+		}
+		intakeConfig.Redis.Password = strings.TrimRight(string(password), "\r\n")
+		aggregationConfig.Redis.Password = intakeConfig.Redis.Password
+	}
+
+	intakeTaskEnqueuer, err := task.NewEnqueuer(parsed.intakeTaskQueueKind, intakeConfig)
+	if err != nil {
+		log.Fatalf("--intake-tasks-topic: %s", err)
+	}
+	intakeTaskEnqueuer = &failureCountingEnqueuer{Enqueuer: intakeTaskEnqueuer, backend: parsed.intakeTaskQueueKind}
+	aggregationTaskEnqueuer, err := task.NewEnqueuer(parsed.aggregationTaskQueueKind, aggregationConfig)
+	if err != nil {
+		log.Fatalf("--aggregate-tasks-topic: %s", err)
+	}
+	aggregationTaskEnqueuer = &failureCountingEnqueuer{Enqueuer: aggregationTaskEnqueuer, backend: parsed.aggregationTaskQueueKind}
+
+	if selfTest {
+		selfTestTask := task.SelfTest{ID: newRunID(time.Now(), rnd)}
+		checks := append(bucketDependencies, dependency{
+			"--task-marker-bucket write and read task marker",
+			func() error { return checkMarkerRoundTrip(parsed.taskMarkerBucket, selfTestTask) },
+		})
+		for _, queue := range []struct {
+			name     string
+			enqueuer task.Enqueuer
+		}{
+			{"--intake-tasks-topic", intakeTaskEnqueuer},
+			{"--aggregate-tasks-topic", aggregationTaskEnqueuer},
+		} {
+			enqueuer := queue.enqueuer
+			if *selfTestPublish {
+				checks = append(checks, dependency{
+					queue.name + " publish sentinel task",
+					func() error { return publishSelfTest(ctx, enqueuer, selfTestTask) },
+				})
+			} else {
+				checks = append(checks, dependency{queue.name, func() error { return enqueuer.Ping(ctx) }})
+			}
+		}
+
+		failed := runSelfTest(os.Stdout, checks)
+		intakeTaskEnqueuer.Stop()
+		aggregationTaskEnqueuer.Stop()
+		shutdownTracing()
+		if failed > 0 {
+			log.Fatalf("%d of %d selftest checks failed", failed, len(checks))
+		}
+		log.Print("all selftest checks passed")
+		return
+	}
+
+	// Check that we can reach all our dependencies before doing any real work,
+	// so that a misconfiguration is reported clearly and up front.
+	for _, dependency := range append(bucketDependencies,
+		dependency{"--intake-tasks-topic", func() error { return intakeTaskEnqueuer.Ping(ctx) }},
+		dependency{"--aggregate-tasks-topic", func() error { return aggregationTaskEnqueuer.Ping(ctx) }},
+	) {
+		if err := dependency.ping(); err != nil {
+			log.Fatalf("%s is unreachable: %s", dependency.name, err)
+		}
+	}
+
+	for _, marker := range *resetFailedTasks {
+		log.WithField("marker", marker).Info("resetting failed task")
+		if err := parsed.taskMarkerBucket.ResetFailedTask(marker); err != nil {
+			log.Fatalf("--reset-failed-tasks: %s", err)
+		}
+	}
+
+	if len(*replayMarkers) > 0 {
+		err := replayTasks(ctx, parsed.taskMarkerBucket, *replayMarkers, intakeTaskEnqueuer, aggregationTaskEnqueuer)
+		intakeTaskEnqueuer.Stop()
+		aggregationTaskEnqueuer.Stop()
+		shutdownTracing()
+		if err != nil {
+			log.Fatalf("--replay-markers: %s", err)
+		}
+		log.Print("done")
+		return
+	}
+
+	kubernetesClient, err := wfkubernetes.NewClient(*k8sNS, *kubeconfigPath, *jobLabelSelector, *jobListPageSize, *k8sMaxAttempts, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// runCycle lists the buckets and existing jobs, schedules tasks and cleans
+	// up old task markers.
+	runCycle := func(ctx context.Context) (err error) {
+		started := time.Now()
+		ctx, span := tracing.Tracer().Start(ctx, "workflow-manager")
+		defer func() { tracing.EndWithError(span, err) }()
+
+		// Get a listing of all jobs in the namespace so the finished ones can
+		// be reaped later on, and to avoid scheduling redudant work.
+		existingJobs, err := kubernetesClient.ListJobs()
+		if err != nil {
+			return err
+		}
+
+		listings, err := listBuckets(ctx)
+		if err != nil {
+			return err
+		}
+
+		config := listings.config
+		config.existingJobs = existingJobs
+		config.intakeTaskEnqueuer = intakeTaskEnqueuer
+		config.aggregationTaskEnqueuer = aggregationTaskEnqueuer
+		if parsed.scheduledMarkersBucket != nil {
+			config.scheduledMarkers = &scheduledMarkers{}
+		}
+		summary, err := scheduleTasks(ctx, config)
+		if config.scheduledMarkers != nil {
+			// Write the manifest even if scheduling failed part way, since the
+			// tasks enqueued before the failure were still scheduled.
+			manifest := scheduledMarkersManifest{
+				RunID:    newRunID(started, rnd),
+				Started:  started,
+				Finished: time.Now(),
+				Markers:  config.scheduledMarkers.list(),
+			}
+			if writeErr := writeScheduledMarkers(parsed.scheduledMarkersBucket, manifest); writeErr != nil && err == nil {
+				err = writeErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+		summary.report(*dryRun)
+
+		if *taskMarkerMaxAge != "" && ctx.Err() == nil {
+			if _, err := cleanUpTaskMarkers(
+				clock,
+				listings.markersInTaskMarkerBucket,
+				parsed.taskMarkerMaxAge,
+				parsed.taskMarkerBucket,
 			); err != nil {
-				log.Fatalf("creating pubsub topic: %s", err)
+				return fmt.Errorf("failed to clean up task markers: %w", err)
+			}
+			// Lists of the batches of aggregation tasks too large for the
+			// task queue are only needed while their tasks may still run
+			aggregationBatches, err := parsed.ownValidationBucket.ListAggregationBatches()
+			if err != nil {
+				return fmt.Errorf("failed to list aggregation batches: %w", err)
+			}
+			if _, err := cleanUpAggregationBatches(
+				clock,
+				aggregationBatches,
+				parsed.taskMarkerMaxAge,
+				parsed.ownValidationBucket,
+			); err != nil {
+				return fmt.Errorf("failed to clean up aggregation batches: %w", err)
 			}
 		}
 
-		intakeTaskEnqueuer, err = task.NewGCPPubSubEnqueuer(
-			*gcpPubSubProjectID,
-			*intakeTasksTopic,
-			*dryRun,
-		)
+		return nil
+	}
+
+	if parsed.pollInterval == 0 {
+		started := time.Now()
+		err = runCycle(ctx)
+		intakeTaskEnqueuer.Stop()
+		aggregationTaskEnqueuer.Stop()
+		if pushErr := pushRunMetrics(*pushGateway, started, time.Now(), err == nil && ctx.Err() == nil); pushErr != nil {
+			log.Warnf("failed to push metrics: %s", pushErr)
+		}
+		shutdownTracing()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		aggregationTaskEnqueuer, err = task.NewGCPPubSubEnqueuer(
-			*gcpPubSubProjectID,
-			*aggregateTasksTopic,
-			*dryRun,
-		)
-		if err != nil {
-			log.Fatal(err)
-		}
-	case "aws-sns":
-		if *awsSNSRegion == "" {
-			log.Fatal("--aws-sns-region is required for task-queue-kind=aws-sns")
+		if ctx.Err() != nil {
+			log.Fatalf("interrupted before all tasks were scheduled: %s", ctx.Err())
+		}
+
+		log.Print("done")
+		return
+	}
+
+	// In polling mode, errors are logged rather than fatal, so that a
+	// transient failure doesn't stop scheduling. The enqueuers are reused
+	// across cycles.
+	for {
+		started := time.Now()
+		err := runCycle(ctx)
+		if err != nil {
+			log.Errorf("failed to schedule tasks: %s", err)
+		}
+		if pushErr := pushRunMetrics(*pushGateway, started, time.Now(), err == nil && ctx.Err() == nil); pushErr != nil {
+			log.Warnf("failed to push metrics: %s", pushErr)
+		}
+		log.Printf("waiting %s until next cycle", parsed.pollInterval)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(parsed.pollInterval):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	intakeTaskEnqueuer.Stop()
+	aggregationTaskEnqueuer.Stop()
+	shutdownTracing()
+	log.Print("done")
+}
+
+// logStartup logs a single structured record describing this build of
+// workflow-manager and its configuration, for auditing. Credentials in bucket
+// URLs and identities are redacted.
+func logStartup(parsed *parsedFlags) {
+	log.WithFields(startupFields(parsed)).Info("starting workflow-manager")
+}
+
+// startupFields returns the fields of the startup record
+func startupFields(parsed *parsedFlags) log.Fields {
+	return log.Fields{
+		"build_info":                           BuildInfo,
+		"is_first":                             *isFirst,
+		"validate_batch_headers":               *validateBatchHeaders,
+		"own_validation_infix":                 parsed.ownValidationInfix,
+		"peer_validation_infix":                parsed.peerValidationInfix,
+		"dry_run":                              *dryRun,
+		"report_only":                          *reportOnly,
+		"replay_markers":                       *replayMarkers,
+		"intake_only":                          *intakeOnly,
+		"aggregate_only":                       *aggregateOnly,
+		"topic_prefix":                         *topicPrefix,
+		"continue_on_partial_failure":          *continueOnPartialFailure,
+		"intake_time_source":                   *intakeTimeSource,
+		"task_queue_kind":                      *taskQueueKind,
+		"intake_task_queue_kind":               parsed.intakeTaskQueueKind,
+		"aggregation_task_queue_kind":          parsed.aggregationTaskQueueKind,
+		"ingestor_input":                       redactList(*ingestorInput, redactURL),
+		"own_validation_input":                 redactURL(*ownValidationInput),
+		"peer_validation_input":                redactURL(*peerValidationInput),
+		"task_marker_bucket":                   redactURL(*taskMarkerBucketURL),
+		"output_scheduled_markers":             redactURL(*outputScheduledMarkers),
+		"ingestor_s3_endpoint":                 redactURL(*ingestorS3.endpoint),
+		"own_validation_s3_endpoint":           redactURL(*ownValidationS3.endpoint),
+		"peer_validation_s3_endpoint":          redactURL(*peerValidationS3.endpoint),
+		"task_marker_bucket_s3_endpoint":       redactURL(*taskMarkerBucketS3.endpoint),
+		"output_scheduled_markers_s3_endpoint": redactURL(*outputScheduledMarkersS3.endpoint),
+		"ingestor_identity":                    redactList(*ingestorIdentity, redactSecret),
+		"own_validation_identity":              redactSecret(*ownValidationIdentity),
+		"peer_validation_identity":             redactSecret(*peerValidationIdentity),
+		"task_marker_bucket_identity":          redactSecret(*taskMarkerBucketIdentity),
+		"output_scheduled_markers_identity":    redactSecret(*outputScheduledMarkersIdentity),
+		"aws_sns_identity":                     redactSecret(*awsSNSIdentity),
+		"intake_max_age":                       parsed.maxAge.String(),
+		"intake_future_tolerance":              parsed.intakeFutureTolerance.String(),
+		"aggregation_period":                   parsed.aggregationPeriod.String(),
+		"time_path_format":                     *timePathFormat,
+		"grace_period":                         parsed.gracePeriod.String(),
+		"poll_interval":                        parsed.pollInterval.String(),
+		"listing_cache_lookback":               parsed.listingCacheLookback.String(),
+		"task_marker_max_age":                  parsed.taskMarkerMaxAge.String(),
+		"check_task_markers":                   *checkTaskMarkers,
+		"marker_check_concurrency":             *markerCheckConcurrency,
+		"marker_check_timeout":                 parsed.markerCheckTimeout.String(),
+		"enqueue_retry_backoff":                parsed.enqueueRetryBackoff.String(),
+		"startup_jitter":                       parsed.startupJitter.String(),
+		"operation_timeout":                    parsed.operationTimeout.String(),
+	}
+}
+
+// redactedValue replaces secrets in the startup record
+const redactedValue = "REDACTED"
+
+// redactURL returns the URL with any user info and query, which may hold
+// credentials, redacted. URLs that can't be parsed are redacted entirely.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactedValue
+	}
+	if u.User != nil {
+		u.User = url.User(redactedValue)
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redactedValue
+	}
+	return u.String()
+}
+
+// redactSecret returns whether the value, such as an identity ARN, is set
+// without revealing it
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// redactList redacts each of the values and joins them with commas
+func redactList(values []string, redact func(string) string) string {
+	redacted := make([]string, len(values))
+	for i, value := range values {
+		redacted[i] = redact(value)
+	}
+	return strings.Join(redacted, ",")
+}
+
+// jitterDelay returns a random duration in [0, max]
+func jitterDelay(max time.Duration, rnd *rand.Rand) time.Duration {
+	return time.Duration(rnd.Int63n(int64(max) + 1))
+}
+
+// configureLogging sets the format and minimum level of the standard logger
+func configureLogging(format, level string) error {
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	parsedLevel, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(parsedLevel)
+
+	return nil
+}
+
+// gcpPubSubSubscriptionConfig returns the configuration of the subscriptions
+// created with --gcp-pubsub-create-topics, based on the command line flags
+func gcpPubSubSubscriptionConfig() (task.PubSubSubscriptionConfig, error) {
+	config := task.DefaultPubSubSubscriptionConfig
+	if *gcpPubSubAckDeadline != "" {
+		ackDeadline, err := time.ParseDuration(*gcpPubSubAckDeadline)
+		if err != nil {
+			return config, fmt.Errorf("--gcp-pubsub-ack-deadline: %w", err)
+		}
+		if ackDeadline < 10*time.Second || ackDeadline > 600*time.Second {
+			return config, fmt.Errorf("--gcp-pubsub-ack-deadline must be between 10s and 600s")
+		}
+		config.AckDeadline = ackDeadline
+	}
+	if *gcpPubSubRetentionDuration != "" {
+		retentionDuration, err := time.ParseDuration(*gcpPubSubRetentionDuration)
+		if err != nil {
+			return config, fmt.Errorf("--gcp-pubsub-retention-duration: %w", err)
+		}
+		if retentionDuration < 10*time.Minute || retentionDuration > 7*24*time.Hour {
+			return config, fmt.Errorf("--gcp-pubsub-retention-duration must be between 10m and 168h")
+		}
+		config.RetentionDuration = retentionDuration
+	}
+	if *gcpPubSubMaxDeliveryAttempts != 0 {
+		if *gcpPubSubDeadLetterTopic == "" {
+			return config, fmt.Errorf("--gcp-pubsub-max-delivery-attempts requires --gcp-pubsub-dead-letter-topic")
+		}
+		if *gcpPubSubMaxDeliveryAttempts < 5 || *gcpPubSubMaxDeliveryAttempts > 100 {
+			return config, fmt.Errorf("--gcp-pubsub-max-delivery-attempts must be between 5 and 100")
+		}
+	}
+	config.DeadLetterTopicID = *gcpPubSubDeadLetterTopic
+	config.MaxDeliveryAttempts = *gcpPubSubMaxDeliveryAttempts
+	config.EnableMessageOrdering = *gcpPubSubOrdering
+	return config, nil
+}
+
+// gcpPubSubPublishSettings returns the PubSub client's default publish
+// settings, overridden by any --gcp-pubsub-publish- flags that were set.
+func gcpPubSubPublishSettings() (pubsub.PublishSettings, error) {
+	settings := pubsub.DefaultPublishSettings
+	if *gcpPubSubPublishCountThreshold != 0 {
+		settings.CountThreshold = *gcpPubSubPublishCountThreshold
+	}
+	if *gcpPubSubPublishByteThreshold != 0 {
+		settings.ByteThreshold = *gcpPubSubPublishByteThreshold
+	}
+	if *gcpPubSubPublishDelayThreshold != "" {
+		delayThreshold, err := time.ParseDuration(*gcpPubSubPublishDelayThreshold)
+		if err != nil {
+			return settings, fmt.Errorf("--gcp-pubsub-publish-delay-threshold: %w", err)
+		}
+		settings.DelayThreshold = delayThreshold
+	}
+	if *gcpPubSubPublishBufferedByteLimit != 0 {
+		settings.BufferedByteLimit = *gcpPubSubPublishBufferedByteLimit
+	}
+	return settings, nil
+}
+
+// listFiles lists the files in the provided bucket inside a tracing span,
+// omitting batches from before since unless it is the zero time. If cache is
+// not nil, the listing is done through it. name identifies the bucket in the
+// span.
+func listFiles(ctx context.Context, name string, b *bucket.Bucket, cache *bucket.ListingCache, since time.Time) ([]string, error) {
+	_, span := tracing.Tracer().Start(ctx, "ListFiles", trace.WithAttributes(label.String("bucket", name)))
+	var files []string
+	var err error
+	if cache != nil {
+		files, err = cache.List()
+	} else if since.IsZero() {
+		files, err = b.ListFiles("")
+	} else {
+		files, err = b.ListFilesSince(since)
+	}
+	tracing.EndWithError(span, err)
+	return files, err
+}
+
+// listFilesWithMetadata lists all the files in the provided bucket inside a
+// tracing span, and records when each was last modified in lastModified. A file
+// already in lastModified, from another bucket, keeps the later of the two
+// times. name identifies the bucket in the span.
+func listFilesWithMetadata(ctx context.Context, name string, b *bucket.Bucket, lastModified map[string]time.Time) ([]string, error) {
+	_, span := tracing.Tracer().Start(ctx, "ListFiles", trace.WithAttributes(label.String("bucket", name)))
+	infos, err := b.ListFilesWithMetadata("")
+	tracing.EndWithError(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(infos))
+	for _, info := range infos {
+		files = append(files, info.Key)
+		if info.LastModified.After(lastModified[info.Key]) {
+			lastModified[info.Key] = info.LastModified
+		}
+	}
+	return files, nil
+}
+
+// listFilesInWindow lists the files in the provided bucket inside a tracing
+// span, listing only the prefixes of batches whose time is in the window, for
+// each aggregation ID in the bucket. name identifies the bucket in the span.
+func listFilesInWindow(ctx context.Context, name string, b *bucket.Bucket, window interval) ([]string, error) {
+	_, span := tracing.Tracer().Start(ctx, "ListFiles", trace.WithAttributes(label.String("bucket", name)))
+	files, err := func() ([]string, error) {
+		aggregationIDPrefixes, err := b.ListTopLevelPrefixes()
+		if err != nil {
+			return nil, err
+		}
+
+		var files []string
+		for _, aggregationIDPrefix := range aggregationIDPrefixes {
+			for _, prefix := range hourPrefixes(aggregationIDPrefix, window) {
+				prefixFiles, err := b.ListFiles(prefix)
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, prefixFiles...)
+			}
+		}
+		return files, nil
+	}()
+	tracing.EndWithError(span, err)
+	return files, err
+}
+
+// hourPrefixes returns the prefixes of the names of batch files under
+// aggregationIDPrefix whose batch time is within the window, one for each hour
+// that the window overlaps.
+func hourPrefixes(aggregationIDPrefix string, window interval) []string {
+	var prefixes []string
+	for hour := window.begin.UTC().Truncate(time.Hour); hour.Before(window.end); hour = hour.Add(time.Hour) {
+		prefixes = append(prefixes, aggregationIDPrefix+hour.Format("2006/01/02/15/"))
+	}
+	return prefixes
+}
+
+// intakeWindow returns the window of batch times for which intake tasks are
+// scheduled, which is the backfill window if there is one. Batches up to
+// futureTolerance in the future are tolerated in case of clock skew.
+func intakeWindow(clock utils.Clock, maxAge, futureTolerance time.Duration, backfill *interval) interval {
+	if backfill != nil {
+		return *backfill
+	}
+	return interval{
+		begin: clock.Now().Add(-maxAge),
+		end:   clock.Now().Add(futureTolerance),
+	}
+}
+
+// countOutsideInterval returns the numbers of the provided batches whose time,
+// according to batchTime, is before the beginning of the interval, and at or
+// after its end
+func countOutsideInterval(batches batchpath.List, inter interval, batchTime func(*batchpath.BatchPath) time.Time) (before int, after int) {
+	for _, batch := range batches {
+		if t := batchTime(batch); t.Before(inter.begin) {
+			before++
+		} else if !t.Before(inter.end) {
+			after++
+		}
+	}
+	return before, after
+}
+
+// listTaskMarkers lists the task markers in the provided bucket inside a
+// tracing span
+func listTaskMarkers(ctx context.Context, store bucket.TaskMarkerStore) ([]string, error) {
+	_, span := tracing.Tracer().Start(ctx, "ListTaskMarkers")
+	markers, err := store.ListTaskMarkers()
+	tracing.EndWithError(span, err)
+	return markers, err
+}
+
+// readyBatches calls batchpath.ReadyBatchesWithLastModified inside a tracing
+// span. lastModified may be nil if the files' modification times are unknown.
+// Malformed batch paths are logged and counted, but don't stop us from
+// scheduling tasks for the well-formed ones.
+func readyBatches(ctx context.Context, files []string, lastModified map[string]time.Time, infix string) batchpath.List {
+	_, span := tracing.Tracer().Start(ctx, "ReadyBatches", trace.WithAttributes(label.String("infix", infix)))
+	defer span.End()
+	batches, errs := batchpath.ReadyBatchesWithLastModified(files, lastModified, infix)
+	for _, err := range errs {
+		log.WithField("infix", infix).Warnf("ignoring malformed batch path: %s", err)
+		span.RecordError(ctx, err)
+		malformedBatchPaths.Inc()
+	}
+	return batches
+}
+
+// readyIntakeBatches returns the ready batches in all the ingestor buckets. A
+// batch ready in more than one bucket is returned once, from the first bucket
+// in which it is ready. Batches are only considered ready if all their files
+// are in the same bucket.
+func readyIntakeBatches(ctx context.Context, config scheduleTasksConfig) batchpath.List {
+	batches, _ := readyIntakeBatchesBySource(ctx, config)
+	return batches
+}
+
+// readyIntakeBatchesBySource is like readyIntakeBatches, but also returns the
+// index of the ingestor bucket in which each batch was found, zero being the
+// bucket listed in intakeFiles and i the one listed in additionalIntakeFiles[i-1]
+func readyIntakeBatchesBySource(ctx context.Context, config scheduleTasksConfig) (batchpath.List, map[*batchpath.BatchPath]int) {
+	batches := readyBatches(ctx, config.intakeFiles, config.intakeLastModified, "batch")
+	sources := map[*batchpath.BatchPath]int{}
+	for _, batch := range batches {
+		sources[batch] = 0
+	}
+	if len(config.additionalIntakeFiles) == 0 {
+		return batches, sources
+	}
+
+	seen := map[string]bool{}
+	for _, batch := range batches {
+		seen[batch.ID] = true
+	}
+	duplicates := 0
+	for i, files := range config.additionalIntakeFiles {
+		for _, batch := range readyBatches(ctx, files, config.intakeLastModified, "batch") {
+			if seen[batch.ID] {
+				duplicates++
+				continue
+			}
+			seen[batch.ID] = true
+			batches = append(batches, batch)
+			sources[batch] = i + 1
+		}
+	}
+	if duplicates > 0 {
+		log.Printf("ignoring %d batches found in more than one ingestor bucket", duplicates)
+	}
+	sort.Sort(batches)
+	return batches, sources
+}
+
+// withValidHeaders returns batches less those whose header files are invalid,
+// which are logged, counted in summary and skipped. Only the headers of
+// batches without task markers or failed task records are read, from the
+// ingestor bucket given by sources, concurrency at a time. Batches whose
+// headers can't be read are kept, since the failure may well be transient.
+func withValidHeaders(
+	ctx context.Context,
+	config scheduleTasksConfig,
+	batches batchpath.List,
+	sources map[*batchpath.BatchPath]int,
+	taskMarkers map[string]struct{},
+	failedTasks map[string]struct{},
+	summary *runSummary,
+) batchpath.List {
+	concurrency := config.enqueueConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	invalid := make([]bool, len(batches))
+	var waitGroup sync.WaitGroup
+	semaphore := make(chan struct{}, concurrency)
+	for i, batch := range batches {
+		marker := task.IntakeBatch{
+			AggregationID: batch.AggregationID,
+			BatchID:       batch.ID,
+			Date:          task.Timestamp(batch.Time),
+		}.Marker()
+		if _, ok := taskMarkers[marker]; ok {
+			continue
+		}
+		if _, ok := failedTasks[marker]; ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		semaphore <- struct{}{}
+		waitGroup.Add(1)
+		go func(i int, batch *batchpath.BatchPath) {
+			defer waitGroup.Done()
+			defer func() { <-semaphore }()
+			logger := log.WithFields(log.Fields{"batch": batch, "header": batch.HeaderFile()})
+			contents, err := config.intakeHeaderReaders[sources[batch]].ReadFile(batch.HeaderFile(), config.batchHeaderMaxSize)
+			if err == nil {
+				err = batchpath.ValidateHeader(contents)
+			} else if !errors.Is(err, bucket.ErrFileTooLarge) {
+				logger.Warnf("failed to read batch header, scheduling batch without validating it: %s", err)
+				return
+			}
+			if err != nil {
+				logger.Errorf("skipping batch with invalid header: %s", err)
+				invalid[i] = true
+			}
+		}(i, batch)
+	}
+	waitGroup.Wait()
+
+	valid := batchpath.List{}
+	for i, batch := range batches {
+		if invalid[i] {
+			summary.intakeBatchesInvalidHeader++
+			invalidBatchHeaders.Inc()
+			continue
+		}
+		valid = append(valid, batch)
+	}
+	return valid
+}
+
+// aggregationIDFilter selects the batches to schedule tasks for by their
+// aggregation IDs. If there are any inclusions, literal or regular
+// expressions, only aggregation IDs matching at least one are selected.
+// Exclusions take precedence over inclusions. The zero value selects all
+// batches.
+type aggregationIDFilter struct {
+	// only are aggregation IDs included
+	only map[string]bool
+	// exclude are aggregation IDs never selected
+	exclude map[string]bool
+	// includeRegexp, if not nil, matches aggregation IDs included
+	includeRegexp *regexp.Regexp
+	// excludeRegexp, if not nil, matches aggregation IDs never selected
+	excludeRegexp *regexp.Regexp
+}
+
+// newAggregationIDFilter returns an aggregationIDFilter with the provided
+// literal aggregation IDs and regular expressions, which are ignored if empty.
+// It returns an error naming the flag if a regular expression is invalid.
+func newAggregationIDFilter(only, exclude []string, includeRegex, excludeRegex string) (aggregationIDFilter, error) {
+	filter := aggregationIDFilter{only: map[string]bool{}, exclude: map[string]bool{}}
+	for _, aggregationID := range only {
+		filter.only[aggregationID] = true
+	}
+	for _, aggregationID := range exclude {
+		filter.exclude[aggregationID] = true
+	}
+
+	var err error
+	if includeRegex != "" {
+		filter.includeRegexp, err = regexp.Compile(includeRegex)
+		if err != nil {
+			return aggregationIDFilter{}, fmt.Errorf("--aggregation-id-include-regex: %w", err)
+		}
+	}
+	if excludeRegex != "" {
+		filter.excludeRegexp, err = regexp.Compile(excludeRegex)
+		if err != nil {
+			return aggregationIDFilter{}, fmt.Errorf("--aggregation-id-exclude-regex: %w", err)
+		}
+	}
+	return filter, nil
+}
+
+// selects returns whether the filter selects the aggregation ID
+func (f aggregationIDFilter) selects(aggregationID string) bool {
+	if f.exclude[aggregationID] || (f.excludeRegexp != nil && f.excludeRegexp.MatchString(aggregationID)) {
+		return false
+	}
+	if len(f.only) == 0 && f.includeRegexp == nil {
+		return true
+	}
+	return f.only[aggregationID] || (f.includeRegexp != nil && f.includeRegexp.MatchString(aggregationID))
+}
+
+// apply returns the batches whose aggregation IDs the filter selects, logging
+// how many of the batches with the provided infix were filtered out
+func (f aggregationIDFilter) apply(batches batchpath.List, infix string) batchpath.List {
+	if len(f.only) == 0 && len(f.exclude) == 0 && f.includeRegexp == nil && f.excludeRegexp == nil {
+		return batches
+	}
+	var output batchpath.List
+	for _, batch := range batches {
+		if f.selects(batch.AggregationID) {
+			output = append(output, batch)
+		}
+	}
+	if filtered := len(batches) - len(output); filtered > 0 {
+		log.WithField("infix", infix).Infof("filtered out %d of %d batches by aggregation ID", filtered, len(batches))
+	}
+	return output
+}
+
+type scheduleTasksConfig struct {
+	isFirst bool
+	// ownValidationInfix and peerValidationInfix are the infixes of the names
+	// of own and peer validation files
+	ownValidationInfix, peerValidationInfix              string
+	clock                                                utils.Clock
+	intakeFiles, ownValidationFiles, peerValidationFiles []string
+	// additionalIntakeFiles are the listings of any ingestor buckets after
+	// the first, whose listing is intakeFiles
+	additionalIntakeFiles                       [][]string
+	existingJobs                                map[string]batchv1.Job
+	intakeTaskEnqueuer, aggregationTaskEnqueuer task.Enqueuer
+	// intakeFutureTolerance is how far in the future an intake batch's time
+	// may be without being skipped, unless intakeBackfill is set
+	intakeFutureTolerance time.Duration
+	// taskSchemaVersion is the schema version of the tasks to enqueue
+	taskSchemaVersion int
+	// taskFieldNaming is the style of the keys in the JSON encoding of the
+	// tasks to enqueue
+	taskFieldNaming task.FieldNaming
+	// taskMarkers are markers listed from a dedicated task marker bucket, if
+	// any, and are considered along with any markers in ownValidationFiles.
+	taskMarkers []string
+	// checkTaskMarkers, if set, means that the dedicated task marker bucket
+	// wasn't listed, so taskMarkers is empty, and instead whether each task
+	// that may be scheduled has a marker is checked with
+	// TaskMarkerWriter.MarkerExists, markerCheckConcurrency at a time, taking
+	// at most markerCheckTimeout in all for each kind of task
+	checkTaskMarkers       bool
+	markerCheckConcurrency int
+	markerCheckTimeout     time.Duration
+	// failedTasks are the markers of tasks with failed task records in a
+	// dedicated task marker bucket, if any, and are considered along with any
+	// failed task records in ownValidationFiles.
+	failedTasks []string
+	// intakeLastModified, if not nil, maps the names of the files in the
+	// ingestor buckets to when they were last modified, and intake batches
+	// are judged by those times instead of the times in their names
+	intakeLastModified map[string]time.Time
+	// failedAttempts are the markers of tasks with records of failed attempts
+	// to enqueue them in the dedicated task marker bucket, if any, and are
+	// considered along with any such records in ownValidationFiles.
+	failedAttempts []string
+	// pendingMarkers are the pending markers found in the task marker bucket,
+	// which were left behind by an earlier run, or written by a run still in
+	// progress
+	pendingMarkers []string
+	// pendingMarkersLastModified, if not nil, maps pending markers to when they
+	// were written. Pending markers whose times are unknown are taken for
+	// stale.
+	pendingMarkersLastModified map[string]time.Time
+	// taskMarkerBucket is where task markers and failed task records are
+	// written
+	taskMarkerBucket                       bucket.TaskStateWriter
+	maxAge, aggregationPeriod, gracePeriod time.Duration
+	// gracePeriodOverrides maps aggregation IDs to the grace periods to use for
+	// them instead of gracePeriod
+	gracePeriodOverrides map[string]time.Duration
+	// aggregationBackfill, if not nil, is a window over which aggregations
+	// should be scheduled for every aggregation period, instead of only the
+	// most recent one.
+	aggregationBackfill *interval
+	// intakeBackfill, if not nil, is a window within which intake tasks should
+	// be scheduled for all batches, regardless of maxAge.
+	intakeBackfill *interval
+	// enqueueConcurrency is how many intake tasks may be written and enqueued
+	// at once. Values less than one mean one.
+	enqueueConcurrency int
+	// maxEnqueueFailures is the number of consecutive failed enqueues to
+	// either task queue after which scheduleTasks stops enqueuing tasks and
+	// fails. Zero means no limit.
+	maxEnqueueFailures int
+	// maxEnqueueAttempts is the number of runs that may fail to enqueue a task
+	// before a failed task record is written for it. Values less than one mean
+	// one.
+	maxEnqueueAttempts int
+	// enqueueRetryBackoff is how long to wait after a task first fails to
+	// enqueue before retrying it, doubling with each further failure
+	enqueueRetryBackoff time.Duration
+	// failedAttemptStore is where records of failed attempts are written. It
+	// is only used if maxEnqueueAttempts is greater than one.
+	failedAttemptStore bucket.FailedAttemptStore
+	// maxBatchesPerAggregation is the most batches an aggregation task may
+	// have. Larger aggregations are skipped. Zero means no limit.
+	maxBatchesPerAggregation int
+	// aggregationIDs selects the batches, both intake and validation, for
+	// which tasks are scheduled
+	aggregationIDs aggregationIDFilter
+	// scheduledMarkers, if not nil, records the markers of the tasks that
+	// scheduleTasks successfully enqueues
+	scheduledMarkers *scheduledMarkers
+	// skipIntake, if set, makes scheduleTasks schedule no intake tasks
+	skipIntake bool
+	// skipAggregation, if set, makes scheduleTasks schedule no aggregation
+	// tasks
+	skipAggregation bool
+	// peerValidationUnavailable is set if the peer validation bucket could
+	// not be listed, in which case scheduleTasks schedules no aggregation
+	// tasks either
+	peerValidationUnavailable bool
+	// intakeHeaderReaders, if not nil, are the ingestor buckets, in the same
+	// order as their listings in intakeFiles and additionalIntakeFiles, from
+	// which the headers of intake batches that may be scheduled are read, so
+	// that batches with invalid headers are skipped
+	intakeHeaderReaders []bucket.FileReader
+	// batchHeaderMaxSize is the largest size in bytes of a valid batch
+	// header
+	batchHeaderMaxSize int64
+}
+
+// intakeTime returns the time by which the age of an intake batch is judged,
+// which is when its files were last modified if those times are known, and
+// otherwise the batch time in its name
+func (c scheduleTasksConfig) intakeTime(batch *batchpath.BatchPath) time.Time {
+	if c.intakeLastModified != nil && !batch.LastModified.IsZero() {
+		return batch.LastModified
+	}
+	return batch.Time
+}
+
+// gracePeriodFor returns the grace period that applies to aggregations of the
+// aggregation ID
+func (c scheduleTasksConfig) gracePeriodFor(aggregationID string) time.Duration {
+	if gracePeriod, ok := c.gracePeriodOverrides[aggregationID]; ok {
+		return gracePeriod
+	}
+	return c.gracePeriod
+}
+
+// bucketListings holds the listings of the buckets made at the start of a cycle
+type bucketListings struct {
+	// config holds the listings of the batch buckets and the task marker
+	// bucket, and the rest of the configuration that doesn't change between
+	// cycles
+	config scheduleTasksConfig
+	// markersInTaskMarkerBucket is the names of the task markers in the bucket
+	// to which they are written
+	markersInTaskMarkerBucket []string
+}
+
+// waitingEnqueuer wraps a task.Enqueuer so that the completions of the tasks
+// enqueued through it can be waited for without stopping the underlying
+// enqueuer, which can then be reused.
+type waitingEnqueuer struct {
+	task.Enqueuer
+	pending sync.WaitGroup
+}
+
+func (e *waitingEnqueuer) Enqueue(ctx context.Context, task task.Task, completion func(error)) {
+	e.pending.Add(1)
+	e.Enqueuer.Enqueue(ctx, task, func(err error) {
+		defer e.pending.Done()
+		completion(err)
+	})
+}
+
+// Wait blocks until the completions of all tasks passed to Enqueue() have
+// returned.
+func (e *waitingEnqueuer) Wait() {
+	e.pending.Wait()
+}
+
+// errTaskQueueUnavailable is returned by scheduleTasks when it stopped
+// enqueuing tasks after too many consecutive failures
+var errTaskQueueUnavailable = errors.New("task queue appears unavailable, aborted enqueues")
+
+// circuitBreakingEnqueuer wraps a task.Enqueuer so that once maxFailures
+// enqueues in a row have failed, it calls trip and fails any further tasks
+// without attempting to enqueue them. Failures of enqueues whose context was
+// canceled are not counted.
+type circuitBreakingEnqueuer struct {
+	task.Enqueuer
+	maxFailures int
+	trip        func()
+
+	lock                sync.Mutex
+	consecutiveFailures int
+	tripped             bool
+}
+
+func newCircuitBreakingEnqueuer(enqueuer task.Enqueuer, maxFailures int, trip func()) *circuitBreakingEnqueuer {
+	return &circuitBreakingEnqueuer{Enqueuer: enqueuer, maxFailures: maxFailures, trip: trip}
+}
+
+func (e *circuitBreakingEnqueuer) Enqueue(ctx context.Context, task task.Task, completion func(error)) {
+	if e.isTripped() {
+		completion(errTaskQueueUnavailable)
+		return
+	}
+	e.Enqueuer.Enqueue(ctx, task, func(err error) {
+		e.record(ctx, err)
+		completion(err)
+	})
+}
+
+// record updates the count of consecutive failures with the outcome of an
+// enqueue, tripping the breaker if there have been too many
+func (e *circuitBreakingEnqueuer) record(ctx context.Context, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err == nil {
+		e.consecutiveFailures = 0
+		return
+	}
+	if errors.Is(ctx.Err(), context.Canceled) || e.maxFailures == 0 {
+		return
+	}
+	e.consecutiveFailures++
+	if e.consecutiveFailures >= e.maxFailures && !e.tripped {
+		e.tripped = true
+		log.Errorf("%d consecutive enqueues failed, %s", e.consecutiveFailures, errTaskQueueUnavailable)
+		e.trip()
+	}
+}
+
+func (e *circuitBreakingEnqueuer) isTripped() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.tripped
+}
+
+// failureCountingEnqueuer wraps a task.Enqueuer, counting the enqueues that
+// fail in enqueueFailures, labeled by the kind of task queue and the class of
+// the error. Failures of enqueues whose context was canceled are not counted,
+// since they are caused by workflow-manager shutting down rather than by the
+// task queue.
+type failureCountingEnqueuer struct {
+	task.Enqueuer
+	backend string
+}
+
+func (e *failureCountingEnqueuer) Enqueue(ctx context.Context, t task.Task, completion func(error)) {
+	e.Enqueuer.Enqueue(ctx, t, func(err error) {
+		if err != nil && !errors.Is(ctx.Err(), context.Canceled) {
+			enqueueFailures.WithLabelValues(e.backend, task.ClassifyEnqueueError(err)).Inc()
+		}
+		completion(err)
+	})
+}
+
+// scheduledMarkers records the markers of the tasks successfully enqueued
+// through the enqueuers it wraps. It is safe for concurrent use.
+type scheduledMarkers struct {
+	lock    sync.Mutex
+	markers []string
+}
+
+// wrap returns an enqueuer that records in m the markers of the tasks that
+// enqueuer successfully enqueues. If m is nil, enqueuer is returned unchanged.
+func (m *scheduledMarkers) wrap(enqueuer task.Enqueuer) task.Enqueuer {
+	if m == nil {
+		return enqueuer
+	}
+	return &recordingEnqueuer{Enqueuer: enqueuer, scheduled: m}
+}
+
+func (m *scheduledMarkers) add(marker string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.markers = append(m.markers, marker)
+}
+
+// list returns the markers recorded so far, sorted
+func (m *scheduledMarkers) list() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	markers := append([]string{}, m.markers...)
+	sort.Strings(markers)
+	return markers
+}
+
+// recordingEnqueuer wraps a task.Enqueuer, recording the markers of the tasks
+// it successfully enqueues
+type recordingEnqueuer struct {
+	task.Enqueuer
+	scheduled *scheduledMarkers
+}
+
+func (e *recordingEnqueuer) Enqueue(ctx context.Context, task task.Task, completion func(error)) {
+	marker := task.Marker()
+	e.Enqueuer.Enqueue(ctx, task, func(err error) {
+		if err == nil {
+			e.scheduled.add(marker)
+		}
+		completion(err)
+	})
+}
+
+// scheduledMarkersManifest lists the markers of the tasks that one run
+// scheduled, so that reconciliation tooling can compare the run's decisions
+// with what reached the task queues and the task marker bucket. Times are
+// wall clock times, even with --now.
+type scheduledMarkersManifest struct {
+	RunID    string    `json:"run_id"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Markers  []string  `json:"markers"`
+}
+
+// newRunID returns an identifier for a run that started at the provided time.
+// IDs sort in order of start time, and the random suffix tells apart runs of
+// several workflow-managers that started in the same second.
+func newRunID(started time.Time, rnd *rand.Rand) string {
+	return fmt.Sprintf("%s-%08x", started.UTC().Format("20060102T150405Z"), rnd.Uint32())
+}
+
+// writeScheduledMarkers writes the manifest to the bucket, under a key derived
+// from its run ID
+func writeScheduledMarkers(b *bucket.Bucket, manifest scheduledMarkersManifest) error {
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest of scheduled markers: %w", err)
+	}
+	if err := b.WriteScheduledMarkers(manifest.RunID, encoded); err != nil {
+		return fmt.Errorf("failed to write manifest of scheduled markers: %w", err)
+	}
+	log.Printf("wrote manifest of %d scheduled markers for run %s", len(manifest.Markers), manifest.RunID)
+	return nil
+}
+
+// Values of --intake-time-source
+const (
+	intakeTimeFromPath     = "path"
+	intakeTimeFromMetadata = "metadata"
+)
+
+// parsedFlags holds the values of the flags that need parsing, and the buckets
+// they describe, once validateConfig has checked them
+type parsedFlags struct {
+	ownValidationBucket, peerValidationBucket, taskMarkerBucket *bucket.Bucket
+	// scheduledMarkersBucket, if not nil, is where manifests of the markers
+	// scheduled by each run are written
+	scheduledMarkersBucket *bucket.Bucket
+	// intakeBuckets are the ingestor buckets, in the order they were given
+	intakeBuckets                       []*bucket.Bucket
+	maxAge, intakeFutureTolerance       time.Duration
+	taskFieldNaming                     task.FieldNaming
+	aggregationPeriod, gracePeriod      time.Duration
+	gracePeriodOverrides                map[string]time.Duration
+	aggregationBackfill, intakeBackfill *interval
+	since                               time.Time
+	pollInterval                        time.Duration
+	// now, if not nil, is the time to use as the current time
+	now                  *time.Time
+	listingCacheLookback time.Duration
+	taskMarkerMaxAge     time.Duration
+	markerCheckTimeout   time.Duration
+	enqueueRetryBackoff  time.Duration
+	startupJitter        time.Duration
+	operationTimeout     time.Duration
+	// ownValidationInfix and peerValidationInfix are the infixes of the names
+	// of own and peer validation files
+	ownValidationInfix, peerValidationInfix string
+	aggregationIDs                          aggregationIDFilter
+	gcpPubSubSubscriptionConfig             task.PubSubSubscriptionConfig
+	gcpPubSubPublishSettings                pubsub.PublishSettings
+	gcpCloudTasksIntakeDelay                time.Duration
+	// intakeTaskQueueKind and aggregationTaskQueueKind are the kinds of the
+	// task queues, and intakeEnqueuerConfig and aggregationEnqueuerConfig their
+	// configurations, less the Redis password, which is read from a file
+	intakeTaskQueueKind, aggregationTaskQueueKind   string
+	intakeEnqueuerConfig, aggregationEnqueuerConfig task.EnqueuerConfig
+}
+
+// validateConfig parses and checks the flags, without contacting any bucket,
+// task queue or other service, and returns the first problem found, naming the
+// flags involved.
+func validateConfig() (*parsedFlags, error) {
+	var parsed parsedFlags
+	var err error
+
+	ingestorS3Config, err := ingestorS3.config()
+	if err != nil {
+		return nil, err
+	}
+	ownValidationS3Config, err := ownValidationS3.config()
+	if err != nil {
+		return nil, err
+	}
+	peerValidationS3Config, err := peerValidationS3.config()
+	if err != nil {
+		return nil, err
+	}
+	taskMarkerBucketS3Config, err := taskMarkerBucketS3.config()
+	if err != nil {
+		return nil, err
+	}
+	outputScheduledMarkersS3Config, err := outputScheduledMarkersS3.config()
+	if err != nil {
+		return nil, err
+	}
+	gcsConfig := bucket.GCSConfig{BillingProject: *gcsBillingProject}
+	parsed.ownValidationBucket, err = bucket.New(*ownValidationInput, *ownValidationIdentity, *ownValidationExternalID, ownValidationS3Config, gcsConfig, *dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("--own-validation-input: %w", err)
+	}
+	parsed.peerValidationBucket, err = bucket.New(*peerValidationInput, *peerValidationIdentity, *peerValidationExternalID, peerValidationS3Config, gcsConfig, *dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("--peer-validation-input: %w", err)
+	}
+	parsed.intakeBuckets, err = newIntakeBuckets(*ingestorInput, *ingestorIdentity, *ingestorExternalID, ingestorS3Config, gcsConfig, *dryRun)
+	if err != nil {
+		return nil, err
+	}
+	parsed.taskMarkerBucket = parsed.ownValidationBucket
+	if *taskMarkerBucketURL != "" {
+		parsed.taskMarkerBucket, err = bucket.New(*taskMarkerBucketURL, *taskMarkerBucketIdentity, "", taskMarkerBucketS3Config, gcsConfig, *dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("--task-marker-bucket: %w", err)
+		}
+	}
+	if *outputScheduledMarkers != "" {
+		parsed.scheduledMarkersBucket, err = bucket.New(*outputScheduledMarkers, *outputScheduledMarkersIdentity, "", outputScheduledMarkersS3Config, gcsConfig, *dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("--output-scheduled-markers: %w", err)
+		}
+	}
+
+	parsed.maxAge, err = time.ParseDuration(*maxAge)
+	if err != nil {
+		return nil, fmt.Errorf("--intake-max-age: %w", err)
+	}
+
+	parsed.intakeFutureTolerance, err = time.ParseDuration(*intakeFutureTolerance)
+	if err != nil {
+		return nil, fmt.Errorf("--intake-future-tolerance: %w", err)
+	}
+	if parsed.intakeFutureTolerance < 0 {
+		return nil, fmt.Errorf("--intake-future-tolerance: must not be negative")
+	}
+
+	if *taskSchemaVersion < 0 || *taskSchemaVersion > task.TaskSchemaVersion {
+		return nil, fmt.Errorf("--task-schema-version: must be between 0 and %d", task.TaskSchemaVersion)
+	}
+
+	parsed.taskFieldNaming, err = task.ParseFieldNaming(*taskFieldNaming)
+	if err != nil {
+		return nil, fmt.Errorf("--task-field-naming: %w", err)
+	}
+
+	parsed.gracePeriod, err = time.ParseDuration(*gracePeriod)
+	if err != nil {
+		return nil, fmt.Errorf("--grace-period: %w", err)
+	}
+
+	parsed.gracePeriodOverrides, err = parseGracePeriodOverrides(*gracePeriodOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("--grace-period-override: %w", err)
+	}
+
+	parsed.aggregationPeriod, err = time.ParseDuration(*aggregationPeriod)
+	if err != nil {
+		return nil, fmt.Errorf("--aggregation-period: %w", err)
+	}
+	if err := validateAggregationPeriod(parsed.aggregationPeriod); err != nil {
+		return nil, fmt.Errorf("--aggregation-period: %w", err)
+	}
+
+	timestampPrecision, err := task.CheckTimestampFormat(*timePathFormat)
+	if err != nil {
+		return nil, fmt.Errorf("--time-path-format: %w", err)
+	}
+	// Aggregation intervals must begin and end on times that task timestamps
+	// can represent, or consecutive intervals would get the same markers
+	if parsed.aggregationPeriod%timestampPrecision != 0 {
+		return nil, fmt.Errorf("--aggregation-period %s must be a multiple of %s, the precision of --time-path-format %q", parsed.aggregationPeriod, timestampPrecision, *timePathFormat)
+	}
+
+	if *backfillStart != "" || *backfillEnd != "" {
+		parsed.aggregationBackfill, err = parseBackfillWindow(*backfillStart, *backfillEnd)
+		if err != nil {
+			return nil, fmt.Errorf("--backfill-start, --backfill-end: %w", err)
+		}
+	}
+
+	if *intakeBackfill {
+		parsed.intakeBackfill, err = parseBackfillWindow(*intakeBackfillStart, *intakeBackfillEnd)
+		if err != nil {
+			return nil, fmt.Errorf("--intake-backfill-start, --intake-backfill-end: %w", err)
+		}
+	} else if *intakeBackfillStart != "" || *intakeBackfillEnd != "" {
+		return nil, fmt.Errorf("--intake-backfill-start and --intake-backfill-end require --intake-backfill")
+	}
+
+	if *since != "" {
+		parsed.since, err = time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return nil, fmt.Errorf("--since: %w", err)
+		}
+		// Batches from before --since aren't listed, so they can't be
+		// backfilled.
+		if parsed.aggregationBackfill != nil && parsed.aggregationBackfill.begin.Before(parsed.since) {
+			return nil, fmt.Errorf("--since must not be after --backfill-start")
+		}
+		if parsed.intakeBackfill != nil && parsed.intakeBackfill.begin.Before(parsed.since) {
+			return nil, fmt.Errorf("--since must not be after --intake-backfill-start")
+		}
+	}
+
+	if *pollInterval != "" {
+		parsed.pollInterval, err = time.ParseDuration(*pollInterval)
+		if err != nil {
+			return nil, fmt.Errorf("--poll-interval: %w", err)
+		}
+		if parsed.pollInterval <= 0 {
+			return nil, fmt.Errorf("--poll-interval must be positive")
+		}
+	}
+
+	if *now != "" {
+		nowParsed, err := time.Parse(time.RFC3339, *now)
+		if err != nil {
+			return nil, fmt.Errorf("--now: %w", err)
+		}
+		if parsed.pollInterval != 0 {
+			return nil, fmt.Errorf("--now is incompatible with --poll-interval")
+		}
+		parsed.now = &nowParsed
+	}
+
+	parsed.listingCacheLookback, err = time.ParseDuration(*listingCacheLookback)
+	if err != nil {
+		return nil, fmt.Errorf("--listing-cache-lookback: %w", err)
+	}
+
+	parsed.operationTimeout, err = time.ParseDuration(*operationTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("--operation-timeout: %w", err)
+	}
+	if parsed.operationTimeout <= 0 {
+		return nil, fmt.Errorf("--operation-timeout must be positive")
+	}
+
+	if *batchHeaderMaxSize <= 0 {
+		return nil, fmt.Errorf("--batch-header-max-size must be positive")
+	}
+
+	parsed.ownValidationInfix, parsed.peerValidationInfix = *ownValidationInfix, *peerValidationInfix
+	if parsed.ownValidationInfix == "" {
+		parsed.ownValidationInfix = defaultValidationInfix(*isFirst)
+	}
+	if parsed.peerValidationInfix == "" {
+		parsed.peerValidationInfix = defaultValidationInfix(!*isFirst)
+	}
+	for _, infix := range []struct{ flag, value string }{
+		{"--own-validation-infix", parsed.ownValidationInfix},
+		{"--peer-validation-infix", parsed.peerValidationInfix},
+	} {
+		if strings.Contains(infix.value, "/") {
+			return nil, fmt.Errorf("%s: %q must not contain \"/\"", infix.flag, infix.value)
+		}
+	}
+	if parsed.ownValidationInfix == parsed.peerValidationInfix {
+		return nil, fmt.Errorf("--own-validation-infix and --peer-validation-infix must differ, but both are %q", parsed.ownValidationInfix)
+	}
+
+	parsed.markerCheckTimeout, err = time.ParseDuration(*markerCheckTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("--marker-check-timeout: %w", err)
+	}
+	if parsed.markerCheckTimeout <= 0 {
+		return nil, fmt.Errorf("--marker-check-timeout must be positive")
+	}
+	if *markerCheckConcurrency < 1 {
+		return nil, fmt.Errorf("--marker-check-concurrency must be at least 1")
+	}
+	if *checkTaskMarkers {
+		if *taskMarkerBucketURL == "" {
+			return nil, fmt.Errorf("--check-task-markers requires --task-marker-bucket, since markers in the own validation bucket are found in its listing anyway")
+		}
+		if *taskMarkerMaxAge != "" {
+			return nil, fmt.Errorf("--check-task-markers is incompatible with --task-marker-max-age, which needs a listing of all the task markers")
+		}
+	}
+
+	if *taskMarkerMaxAge != "" {
+		parsed.taskMarkerMaxAge, err = time.ParseDuration(*taskMarkerMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("--task-marker-max-age: %w", err)
+		}
+		// Markers must outlive the window in which we might schedule the
+		// corresponding task, or we would schedule it again.
+		longestGracePeriod := parsed.gracePeriod
+		for _, override := range parsed.gracePeriodOverrides {
+			if override > longestGracePeriod {
+				longestGracePeriod = override
+			}
+		}
+		if parsed.taskMarkerMaxAge <= parsed.maxAge ||
+			parsed.taskMarkerMaxAge <= parsed.aggregationPeriod+longestGracePeriod {
+			return nil, fmt.Errorf("--task-marker-max-age must be greater than --intake-max-age and --aggregation-period plus the longest grace period")
+		}
+	}
+
+	parsed.aggregationIDs, err = newAggregationIDFilter(
+		*onlyAggregationIDs,
+		*excludeAggregationIDs,
+		*aggregationIDIncludeRegex,
+		*aggregationIDExcludeRegex,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if *intakeOnly && *aggregateOnly {
+		return nil, fmt.Errorf("--intake-only and --aggregate-only are mutually exclusive")
+	}
+	if *reportOnly && len(*replayMarkers) > 0 {
+		return nil, fmt.Errorf("--replay-markers is incompatible with --report-only")
+	}
+
+	// Task queue flags aren't needed to report pending work
+	if *reportOnly {
+		return &parsed, nil
+	}
+
+	// Each task queue's kind flag is the one naming its kind, for errors
+	intakeKindFlag, aggregationKindFlag := "--task-queue-kind", "--task-queue-kind"
+	parsed.intakeTaskQueueKind = *taskQueueKind
+	if *intakeTaskQueueKind != "" {
+		intakeKindFlag = "--intake-task-queue-kind"
+		parsed.intakeTaskQueueKind = *intakeTaskQueueKind
+	}
+	parsed.aggregationTaskQueueKind = *taskQueueKind
+	if *aggregateTaskQueueKind != "" {
+		aggregationKindFlag = "--aggregate-task-queue-kind"
+		parsed.aggregationTaskQueueKind = *aggregateTaskQueueKind
+	}
+	if parsed.intakeTaskQueueKind == "" || parsed.aggregationTaskQueueKind == "" {
+		return nil, fmt.Errorf("--task-queue-kind is required unless --intake-task-queue-kind and --aggregate-task-queue-kind are both set")
+	}
+	if parsed.intakeTaskQueueKind != "memory" && *intakeTasksTopic == "" {
+		return nil, fmt.Errorf("--intake-tasks-topic is required for %s=%s", intakeKindFlag, parsed.intakeTaskQueueKind)
+	}
+	if parsed.aggregationTaskQueueKind != "memory" && *aggregateTasksTopic == "" {
+		return nil, fmt.Errorf("--aggregate-tasks-topic is required for %s=%s", aggregationKindFlag, parsed.aggregationTaskQueueKind)
+	}
+	intakeTopic, err := task.PrefixTopic(parsed.intakeTaskQueueKind, *topicPrefix, *intakeTasksTopic)
+	if err != nil {
+		return nil, fmt.Errorf("--topic-prefix: %w", err)
+	}
+	aggregationTopic, err := task.PrefixTopic(parsed.aggregationTaskQueueKind, *topicPrefix, *aggregateTasksTopic)
+	if err != nil {
+		return nil, fmt.Errorf("--topic-prefix: %w", err)
+	}
+
+	parsed.startupJitter, err = time.ParseDuration(*startupJitter)
+	if err != nil {
+		return nil, fmt.Errorf("--startup-jitter: %w", err)
+	}
+	if parsed.startupJitter < 0 {
+		return nil, fmt.Errorf("--startup-jitter must not be negative")
+	}
+
+	if *enqueueConcurrency < 1 {
+		return nil, fmt.Errorf("--enqueue-concurrency must be at least 1")
+	}
+	if *maxBatchesPerAggregation < 0 {
+		return nil, fmt.Errorf("--max-batches-per-aggregation must not be negative")
+	}
+	if *maxConsecutiveEnqueueFailures < 0 {
+		return nil, fmt.Errorf("--max-consecutive-enqueue-failures must not be negative")
+	}
+	switch *intakeTimeSource {
+	case intakeTimeFromPath:
+	case intakeTimeFromMetadata:
+		if *pruneIntakeListing {
+			return nil, fmt.Errorf("--intake-time-source=%s is incompatible with --prune-intake-listing, which relies on batch times in object names", intakeTimeFromMetadata)
+		}
+	default:
+		return nil, fmt.Errorf("--intake-time-source must be %q or %q", intakeTimeFromPath, intakeTimeFromMetadata)
+	}
+	if *maxEnqueueAttempts < 1 {
+		return nil, fmt.Errorf("--max-enqueue-attempts must be at least 1")
+	}
+	parsed.enqueueRetryBackoff, err = time.ParseDuration(*enqueueRetryBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("--enqueue-retry-backoff: %w", err)
+	}
+	if parsed.enqueueRetryBackoff <= 0 {
+		return nil, fmt.Errorf("--enqueue-retry-backoff must be positive")
+	}
+	for _, marker := range *resetFailedTasks {
+		if marker == "" || strings.Contains(marker, "/") {
+			return nil, fmt.Errorf("--reset-failed-tasks: invalid task marker %q", marker)
+		}
+	}
+	for _, marker := range *replayMarkers {
+		if marker == "" || strings.Contains(marker, "/") {
+			return nil, fmt.Errorf("--replay-markers: invalid task marker %q", marker)
+		}
+	}
+	if *enqueueConcurrency > 1 && *gcpPubSubOrdering && parsed.intakeTaskQueueKind == "gcp-pubsub" {
+		return nil, fmt.Errorf("--enqueue-concurrency greater than 1 is incompatible with --gcp-pubsub-ordering")
+	}
+
+	// Only the flags of the kinds in use are parsed, so that, e.g., a stale
+	// PubSub flag doesn't break a deployment that has moved to another kind
+	if parsed.intakeTaskQueueKind == "gcp-pubsub" || parsed.aggregationTaskQueueKind == "gcp-pubsub" {
+		if *gcpPubSubCreatePubSubTopics {
+			parsed.gcpPubSubSubscriptionConfig, err = gcpPubSubSubscriptionConfig()
+			if err != nil {
+				return nil, err
+			}
+		}
+		parsed.gcpPubSubPublishSettings, err = gcpPubSubPublishSettings()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Only intake tasks are delayed
+	if parsed.intakeTaskQueueKind == "gcp-cloudtasks" {
+		parsed.gcpCloudTasksIntakeDelay, err = time.ParseDuration(*gcpCloudTasksIntakeDelay)
+		if err != nil {
+			return nil, fmt.Errorf("--intake-delay: %w", err)
+		}
+	}
+
+	parsed.intakeEnqueuerConfig = enqueuerConfig(&parsed, intakeTopic)
+	parsed.intakeEnqueuerConfig.GCPCloudTasksDelay = parsed.gcpCloudTasksIntakeDelay
+	if err := task.ValidateEnqueuerConfig(parsed.intakeTaskQueueKind, parsed.intakeEnqueuerConfig); err != nil {
+		return nil, enqueuerConfigError(err, intakeKindFlag, parsed.intakeTaskQueueKind, "--intake-tasks-topic")
+	}
+	parsed.aggregationEnqueuerConfig = enqueuerConfig(&parsed, aggregationTopic)
+	if err := task.ValidateEnqueuerConfig(parsed.aggregationTaskQueueKind, parsed.aggregationEnqueuerConfig); err != nil {
+		return nil, enqueuerConfigError(err, aggregationKindFlag, parsed.aggregationTaskQueueKind, "--aggregate-tasks-topic")
+	}
+
+	return &parsed, nil
+}
+
+// enqueuerConfigFlags maps the fields of task.EnqueuerConfig to the flags they
+// are taken from, except for Topic, which depends on the task queue
+var enqueuerConfigFlags = map[string]string{
+	"GCPProjectID":           "--gcp-project-id",
+	"GCPCloudTasksLocation":  "--gcp-cloudtasks-location",
+	"GCPCloudTasksTargetURL": "--gcp-cloudtasks-target-url",
+	"GCPCloudTasksDelay":     "--intake-delay",
+	"KafkaBrokers":           "--kafka-brokers",
+	"RedisAddr":              "--redis-addr",
+	"Redis.MaxLen":           "--redis-max-len",
+}
+
+// enqueuerConfigError rewrites an error from task.ValidateEnqueuerConfig in
+// terms of flags rather than task.EnqueuerConfig fields, e.g.
+// "--gcp-project-id is required for --task-queue-kind=gcp-pubsub". kindFlag
+// and kind are the flag setting the kind of task queue and its value, and
+// topicFlag the flag setting the queue's topic.
+func enqueuerConfigError(err error, kindFlag, kind, topicFlag string) error {
+	var configErr *task.ConfigError
+	if !errors.As(err, &configErr) {
+		return fmt.Errorf("%s=%s: %w", kindFlag, kind, err)
+	}
+
+	flags := make([]string, len(configErr.Fields))
+	for i, field := range configErr.Fields {
+		switch flag, ok := enqueuerConfigFlags[field]; {
+		case field == "Topic":
+			flags[i] = topicFlag
+		case ok:
+			flags[i] = flag
+		default:
+			flags[i] = field
+		}
+	}
+	names := flags[len(flags)-1]
+	if len(flags) > 1 {
+		names = strings.Join(flags[:len(flags)-1], ", ") + " and " + names
+	}
+
+	if configErr.Problem != "" {
+		return fmt.Errorf("%s %s", names, configErr.Problem)
+	}
+	verb := "is"
+	if len(flags) > 1 {
+		verb = "are"
+	}
+	return fmt.Errorf("%s %s required for %s=%s", names, verb, kindFlag, kind)
+}
+
+// newIntakeBuckets creates the ingestor buckets, each with the identity and
+// external ID in the same position as its URL
+func newIntakeBuckets(urls, identities, externalIDs []string, s3Config bucket.S3Config, gcsConfig bucket.GCSConfig, dryRun bool) ([]*bucket.Bucket, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("--ingestor-input is required")
+	}
+	if len(identities) != 0 && len(identities) != len(urls) {
+		return nil, fmt.Errorf("--ingestor-identity must be given once per --ingestor-input, got %d identities for %d buckets", len(identities), len(urls))
+	}
+	if len(externalIDs) != 0 && len(externalIDs) != len(urls) {
+		return nil, fmt.Errorf("--ingestor-external-id must be given once per --ingestor-input, got %d external IDs for %d buckets", len(externalIDs), len(urls))
+	}
+
+	intakeBuckets := make([]*bucket.Bucket, len(urls))
+	for i, bucketURL := range urls {
+		var identity, externalID string
+		if len(identities) != 0 {
+			identity = identities[i]
+		}
+		if len(externalIDs) != 0 {
+			externalID = externalIDs[i]
+		}
+		intakeBucket, err := bucket.New(bucketURL, identity, externalID, s3Config, gcsConfig, dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("--ingestor-input: %w", err)
+		}
+		intakeBuckets[i] = intakeBucket
+	}
+	return intakeBuckets, nil
+}
+
+// s3Flags are the flags configuring how one bucket, or the ingestor buckets,
+// are reached when they are s3:// buckets.
+type s3Flags struct {
+	prefix              string
+	endpoint            *string
+	accessKeyID         *string
+	secretAccessKeyFile *string
+}
+
+// s3BucketFlags defines the S3 endpoint and static credential flags, named
+// after prefix, of the bucket described by bucketFlag.
+func s3BucketFlags(prefix, bucketFlag string) s3Flags {
+	return s3Flags{
+		prefix:              prefix,
+		endpoint:            flag.String(prefix+"-s3-endpoint", "", fmt.Sprintf("If set, access %s through the S3-compatible API at this URL (e.g. MinIO, Ceph RGW or GCS) instead of AWS", bucketFlag)),
+		accessKeyID:         flag.String(prefix+"-s3-access-key-id", "", fmt.Sprintf("If set, the access key ID of static credentials, such as GCS HMAC keys, to use for %s instead of the usual AWS credential sources. Requires --%s-s3-secret-access-key-file.", bucketFlag, prefix)),
+		secretAccessKeyFile: flag.String(prefix+"-s3-secret-access-key-file", "", fmt.Sprintf("Path to a file containing the secret access key that goes with --%s-s3-access-key-id", prefix)),
+	}
+}
+
+// config returns the S3 configuration given by the flags, reading the secret
+// access key from its file.
+func (f s3Flags) config() (bucket.S3Config, error) {
+	config := bucket.S3Config{
+		Endpoint:    *f.endpoint,
+		AccessKeyID: *f.accessKeyID,
+	}
+	if config.Endpoint != "" {
+		config.ForcePathStyle = *s3ForcePathStyle
+		config.InsecureSkipVerify = *s3InsecureSkipVerify
+	}
+	if *f.secretAccessKeyFile != "" {
+		secret, err := ioutil.ReadFile(*f.secretAccessKeyFile)
+		if err != nil {
+			return bucket.S3Config{}, fmt.Errorf("--%s-s3-secret-access-key-file: %w", f.prefix, err)
+		}
+		config.SecretAccessKey = strings.TrimRight(string(secret), "\r\n")
+	}
+	if (config.AccessKeyID == "") != (config.SecretAccessKey == "") {
+		return bucket.S3Config{}, fmt.Errorf("--%[1]s-s3-access-key-id and --%[1]s-s3-secret-access-key-file must be provided together", f.prefix)
+	}
+	return config, nil
+}
+
+// enqueuerConfig returns the configuration, taken from the flags, of the task
+// queue with the provided topic. The Redis password, which is read from a
+// file, and the Cloud Tasks delay, which only applies to intake tasks, are
+// left unset.
+func enqueuerConfig(parsed *parsedFlags, topic string) task.EnqueuerConfig {
+	var brokers []string
+	if *kafkaBrokers != "" {
+		brokers = strings.Split(*kafkaBrokers, ",")
+	}
+
+	return task.EnqueuerConfig{
+		Topic:                       topic,
+		DryRun:                      *dryRun,
+		GCPProjectID:                *gcpPubSubProjectID,
+		GCPPubSubPublishSettings:    parsed.gcpPubSubPublishSettings,
+		GCPPubSubOrdering:           *gcpPubSubOrdering,
+		GCPPubSubMaxMessageSize:     *gcpPubSubMaxMessageSize,
+		GCPCloudTasksLocation:       *gcpCloudTasksLocation,
+		GCPCloudTasksTargetURL:      *gcpCloudTasksTargetURL,
+		GCPCloudTasksServiceAccount: *gcpCloudTasksServiceAccount,
+		GCPCloudTasksMaxTaskSize:    *gcpCloudTasksMaxTaskSize,
+		AWSSNSRegion:                *awsSNSRegion,
+		AWSSNSIdentity:              *awsSNSIdentity,
+		AWSSNSMaxMessageSize:        *awsSNSMaxMessageSize,
+		KafkaBrokers:                brokers,
+		KafkaMaxMessageSize:         *kafkaMaxMessageSize,
+		RedisAddr:                   *redisAddr,
+		Redis: task.RedisStreamsConfig{
+			Username: *redisUsername,
+			TLS:      *redisTLS,
+			MaxLen:   *redisMaxLen,
+		},
+	}
+}
+
+// applyConfigFile sets the flags in flagSet from the YAML or JSON file at path,
+// whose keys are flag names, except for the flags that were already set, e.g.
+// on the command line, which take precedence. Lists of values are joined with
+// commas.
+func applyConfigFile(flagSet *flag.FlagSet, path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// JSON is a subset of YAML, so the YAML parser handles both
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(contents, &values); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	alreadySet := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) { alreadySet[f.Name] = true })
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "config" {
+			return fmt.Errorf("%s: config files can't set config", path)
+		}
+		if flagSet.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag %q", path, name)
+		}
+		if alreadySet[name] {
+			continue
+		}
+		value, err := configValueString(values[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+		if err := flagSet.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+
+	return nil
+}
+
+// flagEnvironmentVariable returns the name of the environment variable from
+// which the named flag is taken, e.g. WFM_INGESTOR_INPUT for ingestor-input
+func flagEnvironmentVariable(name string) string {
+	return "WFM_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvironment sets each flag in flagSet that was not already set, e.g. on
+// the command line, from its environment variable, if that is set, as looked up
+// by lookupEnv.
+func applyEnvironment(flagSet *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	alreadySet := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) { alreadySet[f.Name] = true })
+
+	var err error
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if err != nil || alreadySet[f.Name] {
+			return
+		}
+		variable := flagEnvironmentVariable(f.Name)
+		value, ok := lookupEnv(variable)
+		if !ok {
+			return
+		}
+		if setErr := flagSet.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", variable, setErr)
+		}
+	})
+	return err
+}
+
+// parseGracePeriodOverrides parses AGGREGATION_ID=DURATION pairs into a map from
+// aggregation ID to grace period
+func parseGracePeriodOverrides(overrides []string) (map[string]time.Duration, error) {
+	gracePeriods := map[string]time.Duration{}
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not of the form AGGREGATION_ID=DURATION", override)
+		}
+		if _, ok := gracePeriods[parts[0]]; ok {
+			return nil, fmt.Errorf("aggregation ID %s overridden more than once", parts[0])
+		}
+		gracePeriod, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("aggregation ID %s: %w", parts[0], err)
+		}
+		gracePeriods[parts[0]] = gracePeriod
+	}
+	return gracePeriods, nil
+}
+
+// stringList is a flag.Value holding a list of strings, which may be provided
+// by repeating the flag, by separating them with commas, or both
+type stringList []string
+
+// stringListFlag defines a stringList flag with the provided name and usage
+func stringListFlag(name, usage string) *stringList {
+	var list stringList
+	flag.Var(&list, name, usage)
+	return &list
+}
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			*l = append(*l, element)
+		}
+	}
+	return nil
+}
+
+// positionalList is like stringList, but its elements correspond by position
+// to those of another list flag, so empty elements are kept as placeholders
+type positionalList []string
+
+// positionalListFlag defines a positionalList flag with the provided name and
+// usage
+func positionalListFlag(name, usage string) *positionalList {
+	var list positionalList
+	flag.Var(&list, name, usage)
+	return &list
+}
+
+func (l *positionalList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *positionalList) Set(value string) error {
+	for _, element := range strings.Split(value, ",") {
+		*l = append(*l, strings.TrimSpace(element))
+	}
+	return nil
+}
+
+// configValueString returns the value from a config file in the form it would
+// take on the command line
+func configValueString(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string, bool, int, int64:
+		return fmt.Sprint(value), nil
+	case float64:
+		// Numbers written with a fraction or exponent, e.g. 1000000.0, are
+		// decoded as float64, and fmt.Sprint would format them as "1e+06",
+		// which integer flags reject
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case []interface{}:
+		elements := make([]string, len(value))
+		for i, element := range value {
+			elementString, err := configValueString(element)
+			if err != nil {
+				return "", err
+			}
+			elements[i] = elementString
+		}
+		return strings.Join(elements, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// markerWriteMaxTries and markerWriteTimeBetweenTries control how hard
+// scheduleTasks tries to write task markers that failed to be written after
+// their tasks were enqueued.
+const (
+	markerWriteMaxTries         = 5
+	markerWriteTimeBetweenTries = 2 * time.Second
+)
+
+// failedMarkerWrites collects the tasks that were successfully enqueued but
+// whose pending markers could not be promoted. Without a marker, the next run
+// would take the task for one whose enqueuing was interrupted, so the
+// promotions are retried once all the completions have returned. It is safe
+// for concurrent use.
+type failedMarkerWrites struct {
+	mutex sync.Mutex
+	tasks []task.Task
+}
+
+func (f *failedMarkerWrites) add(t task.Task) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.tasks = append(f.tasks, t)
+	markerWriteFailures.Inc()
+}
+
+// retry attempts to promote each of the collected markers up to maxTries
+// times, waiting timeBetweenTries between attempts. It returns an error if any
+// marker still could not be promoted.
+func (f *failedMarkerWrites) retry(writer bucket.TaskMarkerWriter, maxTries int, timeBetweenTries time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	unwritten := []string{}
+	for _, t := range f.tasks {
+		t, marker := t, t.Marker()
+		r := retry.Retry{
+			Identifier:       fmt.Sprintf("promote task marker %s", marker),
+			Retryable:        func() error { return writer.PromoteMarker(t) },
+			ShouldRequeue:    func(err error) bool { return true },
+			MaxTries:         maxTries,
+			TimeBetweenTries: timeBetweenTries,
+		}
+		if err := r.Start(); err != nil {
+			log.WithField("marker", marker).Errorf("giving up on promoting task marker: %s", err)
+			unwritten = append(unwritten, marker)
+			continue
+		}
+		log.WithField("marker", marker).Info("promoted task marker on retry")
+	}
+	f.tasks = nil
+
+	if len(unwritten) > 0 {
+		return fmt.Errorf("failed to write markers of %d enqueued tasks: %q", len(unwritten), unwritten)
+	}
+	return nil
+}
+
+// runSummary counts what scheduleTasks did, or in a dry run, would have done
+type runSummary struct {
+	intakeTasksScheduled int
+	// intakeBatchesTooOld counts batches before the intake window, or outside
+	// the backfill window if there is one
+	intakeBatchesTooOld int
+	// intakeBatchesInFuture counts batches after the intake window
+	intakeBatchesInFuture int
+	// intakeBatchesInvalidHeader counts batches skipped because their header
+	// file was invalid
+	intakeBatchesInvalidHeader  int
+	intakeTasksExisting         int
+	intakeTasksPreviouslyFailed int
+	// intakeTasksBackingOff and aggregationTasksBackingOff count tasks
+	// skipped because they failed to enqueue recently and will be retried
+	intakeTasksBackingOff      int
+	aggregationTasksScheduled  int
+	aggregationTasksExisting   int
+	aggregationTasksBackingOff int
+	// aggregationTasksPreviouslyFailed counts aggregation tasks skipped because
+	// of failed task records
+	aggregationTasksPreviouslyFailed int
+	// aggregationTasksTooLarge counts aggregation tasks skipped because they
+	// had too many batches
+	aggregationTasksTooLarge int
+	// orphanOwnValidations and orphanPeerValidations count own validations
+	// in the aggregation intervals that have no peer validation, and vice
+	// versa
+	orphanOwnValidations, orphanPeerValidations int
+}
+
+// report logs the summary on a single line, with the counts as fields
+func (s runSummary) report(dryRun bool) {
+	log.WithFields(log.Fields{
+		"dry_run":                             dryRun,
+		"intake_tasks_scheduled":              s.intakeTasksScheduled,
+		"intake_batches_too_old":              s.intakeBatchesTooOld,
+		"intake_batches_in_future":            s.intakeBatchesInFuture,
+		"intake_batches_invalid_header":       s.intakeBatchesInvalidHeader,
+		"intake_tasks_existing":               s.intakeTasksExisting,
+		"intake_tasks_previously_failed":      s.intakeTasksPreviouslyFailed,
+		"intake_tasks_backing_off":            s.intakeTasksBackingOff,
+		"aggregation_tasks_scheduled":         s.aggregationTasksScheduled,
+		"aggregation_tasks_existing":          s.aggregationTasksExisting,
+		"aggregation_tasks_previously_failed": s.aggregationTasksPreviouslyFailed,
+		"aggregation_tasks_backing_off":       s.aggregationTasksBackingOff,
+		"aggregation_tasks_too_large":         s.aggregationTasksTooLarge,
+		"orphan_own_validations":              s.orphanOwnValidations,
+		"orphan_peer_validations":             s.orphanPeerValidations,
+	}).Info("run summary")
+}
+
+// scheduleTasks evaluates bucket contents and kubernetes cluster state to
+// schedule new tasks or delete old jobs, and returns a summary of the tasks it
+// scheduled and skipped. scheduleTasks waits for the
+// completions of the tasks it enqueues before returning, even if it returns an
+// error, so any tasks that were already enqueued will have been published and
+// had their markers written. Marker promotions that fail are retried after all
+// the completions have returned. The task enqueuers are not stopped, so they may be
+// reused.
+func scheduleTasks(ctx context.Context, config scheduleTasksConfig) (summary runSummary, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "scheduleTasks")
+	defer func() { tracing.EndWithError(span, err) }()
+
+	// Deferred before the waits below so that it runs after them, once no more
+	// completions can add to failedMarkers
+	failedMarkers := &failedMarkerWrites{}
+	defer func() {
+		retryErr := failedMarkers.retry(config.taskMarkerBucket, markerWriteMaxTries, markerWriteTimeBetweenTries)
+		if retryErr != nil && err == nil {
+			err = retryErr
+		}
+	}()
+
+	// If either task queue seems to be down, cancel ctx, which stops us from
+	// scheduling further tasks as if we were shutting down, and fail once
+	// the completions have returned. As when shutting down, enqueues already
+	// started run in their own contexts, so they are left to finish.
+	ctx, stopScheduling := context.WithCancel(ctx)
+	defer stopScheduling()
+	intakeBreaker := newCircuitBreakingEnqueuer(config.intakeTaskEnqueuer, config.maxEnqueueFailures, stopScheduling)
+	aggregationBreaker := newCircuitBreakingEnqueuer(config.aggregationTaskEnqueuer, config.maxEnqueueFailures, stopScheduling)
+	defer func() {
+		if (intakeBreaker.isTripped() || aggregationBreaker.isTripped()) && err == nil {
+			err = errTaskQueueUnavailable
+		}
+	}()
+
+	// Ensure that markers have been written for all the tasks we enqueue
+	// before the next listing of the buckets, or before the process exits
+	intakeTaskEnqueuer := &waitingEnqueuer{Enqueuer: config.scheduledMarkers.wrap(intakeBreaker)}
+	defer intakeTaskEnqueuer.Wait()
+	aggregationTaskEnqueuer := &waitingEnqueuer{Enqueuer: config.scheduledMarkers.wrap(aggregationBreaker)}
+	defer aggregationTaskEnqueuer.Wait()
+
+	taskMarkers, failedTasks := taskStateSets(config)
+	// A pending marker whose task marker exists was promoted, and isn't stale
+	if err := addCheckedTaskMarkers(ctx, config, config.pendingMarkers, taskMarkers); err != nil {
+		return summary, err
+	}
+	if err := reconcilePendingMarkers(config.clock, config.pendingMarkers, config.pendingMarkersLastModified, taskMarkers, failedTasks, config.taskMarkerBucket); err != nil {
+		return summary, fmt.Errorf("failed to reconcile pending task markers: %w", err)
+	}
+	retries := &enqueueRetries{
+		clock:       config.clock,
+		maxAttempts: config.maxEnqueueAttempts,
+		backoff:     config.enqueueRetryBackoff,
+		attempted:   failedAttemptSet(config),
+		store:       config.failedAttemptStore,
+	}
+
+	if config.skipIntake {
+		log.Warn("not scheduling intake tasks, as --aggregate-only is set")
+	} else if err := scheduleIntakeTasks(ctx, config, taskMarkers, failedTasks, retries, failedMarkers, intakeTaskEnqueuer, &summary); err != nil {
+		return summary, fmt.Errorf("failed to schedule intake tasks: %w", err)
+	}
+
+	if config.skipAggregation {
+		log.Warn("not scheduling aggregation tasks, as --intake-only is set")
+	} else if config.peerValidationUnavailable {
+		log.Warn("not scheduling aggregation tasks, as the peer validation bucket could not be listed")
+		aggregationsSkipped.Inc()
+	} else if err := scheduleAggregationTasks(ctx, config, taskMarkers, failedTasks, retries, failedMarkers, aggregationTaskEnqueuer, &summary); err != nil {
+		return summary, err
+	}
+
+	return summary, nil
+}
+
+// scheduleIntakeTasks schedules intake tasks for the ready intake batches in
+// the intake window, adding what it scheduled and skipped to summary
+func scheduleIntakeTasks(
+	ctx context.Context,
+	config scheduleTasksConfig,
+	taskMarkers map[string]struct{},
+	failedTasks map[string]struct{},
+	retries *enqueueRetries,
+	failedMarkers *failedMarkerWrites,
+	enqueuer task.Enqueuer,
+	summary *runSummary,
+) error {
+	ready, sources := readyIntakeBatchesBySource(ctx, config)
+	intakeBatches := config.aggregationIDs.apply(ready, "batch")
+	intakeAgeLimit := config.maxAge
+	window := intakeWindow(config.clock, config.maxAge, config.intakeFutureTolerance, config.intakeBackfill)
+	currentIntakeBatches := withinInterval(intakeBatches, window, config.intakeTime)
+	summary.intakeBatchesTooOld, summary.intakeBatchesInFuture = countOutsideInterval(intakeBatches, window, config.intakeTime)
+	if config.intakeBackfill != nil {
+		// Backfilled batches may be arbitrarily old, so don't apply an age
+		// limit to them.
+		intakeAgeLimit = 0
+		log.Printf("backfilling intake tasks for %d batches in window %s, skipping %d batches before it and %d after it",
+			len(currentIntakeBatches), *config.intakeBackfill, summary.intakeBatchesTooOld, summary.intakeBatchesInFuture)
+	} else {
+		// The same batches fall outside the window run after run, so the
+		// gauges hold the current numbers rather than counting them again
+		log.Printf("skipping %d batches as too old", summary.intakeBatchesTooOld)
+		intakeBatchesTooOld.Set(float64(summary.intakeBatchesTooOld))
+		// Batches from too far in the future most likely mean that the
+		// ingestor's clock is skewed, which operators should know about
+		if summary.intakeBatchesInFuture > 0 {
+			log.Warnf("skipping %d batches more than %s in the future", summary.intakeBatchesInFuture, config.intakeFutureTolerance)
+		}
+		intakeBatchesInFuture.Set(float64(summary.intakeBatchesInFuture))
+	}
+
+	candidates := make([]string, 0, len(currentIntakeBatches))
+	for _, batch := range currentIntakeBatches {
+		intakeTask := task.IntakeBatch{
+			AggregationID: batch.AggregationID,
+			BatchID:       batch.ID,
+			Date:          task.Timestamp(batch.Time),
+		}
+		candidates = append(candidates, intakeTask.Marker())
+	}
+	if err := addCheckedTaskMarkers(ctx, config, candidates, taskMarkers); err != nil {
+		return err
+	}
+	if config.intakeHeaderReaders != nil {
+		currentIntakeBatches = withValidHeaders(ctx, config, currentIntakeBatches, sources, taskMarkers, failedTasks, summary)
+	}
+
+	return enqueueIntakeTasks(
+		ctx,
+		config.clock,
+		config.isFirst,
+		config.taskSchemaVersion,
+		config.taskFieldNaming,
+		currentIntakeBatches,
+		intakeAgeLimit,
+		config.intakeTime,
+		taskMarkers,
+		failedTasks,
+		retries,
+		config.existingJobs,
+		config.taskMarkerBucket,
+		failedMarkers,
+		enqueuer,
+		config.enqueueConcurrency,
+		summary,
+	)
+}
+
+// scheduleAggregationTasks schedules aggregation tasks for the batches for
+// which both own and peer validations are ready, in each aggregation interval,
+// adding what it scheduled and skipped to summary
+func scheduleAggregationTasks(
+	ctx context.Context,
+	config scheduleTasksConfig,
+	taskMarkers map[string]struct{},
+	failedTasks map[string]struct{},
+	retries *enqueueRetries,
+	failedMarkers *failedMarkerWrites,
+	enqueuer task.Enqueuer,
+	summary *runSummary,
+) error {
+	aggregationBatches, unpairedOwnValidations, unpairedPeerValidations := aggregatableBatches(ctx, config)
+
+	// Expose the interval we are targeting, even when backfilling, so that
+	// dashboards can show how far it trails the current time
+	current := aggregationInterval(config.clock, config.aggregationPeriod, config.gracePeriod)
+	aggregationBegin.Set(float64(current.begin.Unix()))
+	aggregationEnd.Set(float64(current.end.Unix()))
+
+	summary.orphanOwnValidations = reportOrphanValidations(config, unpairedOwnValidations, "own", "peer", orphanOwnValidations)
+	summary.orphanPeerValidations = reportOrphanValidations(config, unpairedPeerValidations, "peer", "own", orphanPeerValidations)
+	intervals, batchesByInterval := assignToAggregationIntervals(config, aggregationBatches)
+	if config.aggregationBackfill != nil {
+		log.Printf("backfilling aggregations over %d intervals in window %s",
+			len(intervals), *config.aggregationBackfill)
+	}
+	aggregationMaps := make([]aggregationMap, len(intervals))
+	var candidates []string
+	for i, inter := range intervals {
+		aggregationMaps[i] = groupByAggregationID(batchesByInterval[i])
+		for aggregationID := range aggregationMaps[i] {
+			aggregationTask := task.Aggregation{
+				AggregationID:    aggregationID,
+				AggregationStart: task.Timestamp(inter.begin),
+				AggregationEnd:   task.Timestamp(inter.end),
+			}
+			candidates = append(candidates, aggregationTask.Marker())
+		}
+	}
+	if err := addCheckedTaskMarkers(ctx, config, candidates, taskMarkers); err != nil {
+		return err
+	}
+
+	for i, interval := range intervals {
+		if ctx.Err() != nil {
+			log.Warnf("not scheduling aggregation tasks for any more intervals: %s", ctx.Err())
+			break
+		}
+
+		log.WithField("interval", interval.String()).Info("looking for batches to aggregate")
+		err := enqueueAggregationTasks(
+			ctx,
+			config.clock,
+			config.isFirst,
+			config.taskSchemaVersion,
+			config.taskFieldNaming,
+			aggregationMaps[i],
+			interval,
+			config.maxBatchesPerAggregation,
+			taskMarkers,
+			failedTasks,
+			retries,
+			config.existingJobs,
+			config.taskMarkerBucket,
+			failedMarkers,
+			enqueuer,
+			summary,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to schedule aggregation tasks for interval %s: %w", interval, err)
+		}
+	}
+
+	return nil
+}
+
+// taskStateSets returns sets of the markers of the tasks that were already
+// scheduled and of the tasks that previously failed to be enqueued
+func taskStateSets(config scheduleTasksConfig) (map[string]struct{}, map[string]struct{}) {
+	// Make a set of the tasks for which we have marker objects for efficient
+	// lookup later. Markers might be found in the own validation bucket even if
+	// a dedicated task marker bucket is in use, if they were written before the
+	// dedicated bucket was configured.
+	taskMarkers := map[string]struct{}{}
+	for _, marker := range taskMarkersInFiles(config.ownValidationFiles) {
+		taskMarkers[marker] = struct{}{}
+	}
+	for _, marker := range config.taskMarkers {
+		taskMarkers[marker] = struct{}{}
+	}
+
+	// Tasks that previously failed to be enqueued are not retried until an
+	// operator deletes their failed task records.
+	failedTasks := map[string]struct{}{}
+	for _, marker := range failedTasksInFiles(config.ownValidationFiles) {
+		failedTasks[marker] = struct{}{}
+	}
+	for _, marker := range config.failedTasks {
+		failedTasks[marker] = struct{}{}
+	}
+
+	return taskMarkers, failedTasks
+}
+
+// addCheckedTaskMarkers adds those of the provided markers whose task markers
+// exist to taskMarkers, if config.checkTaskMarkers is set. Otherwise, the task
+// markers were listed, and taskMarkers is already complete. Markers already
+// in taskMarkers aren't checked again.
+func addCheckedTaskMarkers(ctx context.Context, config scheduleTasksConfig, markers []string, taskMarkers map[string]struct{}) error {
+	if !config.checkTaskMarkers {
+		return nil
+	}
+	var unknown []string
+	for _, marker := range markers {
+		if _, ok := taskMarkers[marker]; !ok {
+			unknown = append(unknown, marker)
+		}
+	}
+
+	start := time.Now()
+	existing, err := findTaskMarkers(ctx, config.taskMarkerBucket, unknown, config.markerCheckConcurrency, config.markerCheckTimeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("checked %d task markers in %s, %d exist", len(unknown), time.Since(start), len(existing))
+	for _, marker := range existing {
+		taskMarkers[marker] = struct{}{}
+	}
+	return nil
+}
+
+// findTaskMarkers returns those of the provided markers whose task markers
+// exist, checking up to concurrency markers at once. It fails if any check
+// fails, or if the checks take longer than timeout in all, since scheduling
+// tasks without knowing whether they were already scheduled could schedule
+// them twice.
+func findTaskMarkers(ctx context.Context, writer bucket.TaskMarkerWriter, markers []string, concurrency int, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type check struct {
+		marker string
+		exists bool
+		err    error
+	}
+	// Buffered so that checks still running when we give up don't block
+	checks := make(chan check, len(markers))
+	semaphore := make(chan struct{}, concurrency)
+	go func() {
+		for _, marker := range markers {
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(marker string) {
+				defer func() { <-semaphore }()
+				exists, err := writer.MarkerExists(marker)
+				checks <- check{marker: marker, exists: exists, err: err}
+			}(marker)
+		}
+	}()
+
+	var existing []string
+	for range markers {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to check task markers: %w", ctx.Err())
+		case check := <-checks:
+			if check.err != nil {
+				return nil, fmt.Errorf("failed to check task marker %s: %w", check.marker, check.err)
+			}
+			if check.exists {
+				existing = append(existing, check.marker)
+			}
+		}
+	}
+	return existing, nil
+}
+
+// failedAttemptSet returns the set of the markers of tasks that failed to
+// enqueue on earlier runs and will be retried
+func failedAttemptSet(config scheduleTasksConfig) map[string]struct{} {
+	failedAttempts := map[string]struct{}{}
+	for _, marker := range failedAttemptsInFiles(config.ownValidationFiles) {
+		failedAttempts[marker] = struct{}{}
+	}
+	for _, marker := range config.failedAttempts {
+		failedAttempts[marker] = struct{}{}
+	}
+	return failedAttempts
+}
+
+// pendingMarkerStaleMargin is how much longer than the operation timeout a
+// pending marker must have existed before it is taken for stale, allowing for
+// the time taken to write it and to start the enqueue, and for clock skew
+// between workflow-manager and the storage service
+const pendingMarkerStaleMargin = time.Minute
+
+// reconcilePendingMarkers resolves the pending markers left behind by an
+// earlier run that stopped between writing a pending marker and promoting or
+// deleting it, or that kept a pending marker because it couldn't tell whether
+// the task was enqueued. If the task marker or failed task record was written,
+// only the pending marker's deletion was interrupted. Otherwise, there's no
+// telling whether the task was enqueued, so rather than risk either losing the
+// task or scheduling it twice, a failed task record is written for it and
+// added to failedTasks, leaving the decision to retry it to an operator.
+//
+// A pending marker written less than the operation timeout, plus a margin, ago,
+// judging by lastModified, may belong to an enqueue still in flight in another
+// run, so it is left alone. Its task is added to taskMarkers instead, so that
+// it isn't scheduled again in the meantime.
+func reconcilePendingMarkers(
+	clock utils.Clock,
+	pendingMarkers []string,
+	lastModified map[string]time.Time,
+	taskMarkers map[string]struct{},
+	failedTasks map[string]struct{},
+	taskMarkerBucket bucket.TaskStateWriter,
+) error {
+	for _, marker := range pendingMarkers {
+		_, scheduled := taskMarkers[marker]
+		_, failed := failedTasks[marker]
+		if !scheduled && !failed {
+			if written, ok := lastModified[marker]; ok && clock.Now().Sub(written) <= utils.OperationTimeout+pendingMarkerStaleMargin {
+				log.WithField("marker", marker).Info("found recent pending marker for task that may still be being enqueued, not scheduling it")
+				taskMarkers[marker] = struct{}{}
+				continue
+			}
+			log.WithField("marker", marker).Warn("found stale pending marker for task that may or may not have been enqueued, recording it as failed")
+			record, err := json.Marshal(struct {
+				Error string `json:"error"`
+			}{
+				Error: "workflow-manager stopped before learning whether the task was enqueued",
+			})
+			if err != nil {
+				return fmt.Errorf("marshaling failed task record: %w", err)
+			}
+			if err := taskMarkerBucket.WriteFailedTask(marker, record); err != nil {
+				return err
+			}
+			failedTasks[marker] = struct{}{}
+			stalePendingMarkers.Inc()
+		}
+
+		if err := taskMarkerBucket.DeletePendingMarker(marker); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// defaultValidationInfix returns the infix of the names of the validation files
+// written by the "first" servers if first is true, and by the others otherwise
+func defaultValidationInfix(first bool) string {
+	return fmt.Sprintf("validity_%d", utils.Index(first))
+}
+
+// aggregatableBatches returns the batches for which both own and peer
+// validations are ready, the own validations for which there is no peer
+// validation with the same batch ID, and the peer validations for which there
+// is no own validation with the same batch ID
+func aggregatableBatches(ctx context.Context, config scheduleTasksConfig) (batchpath.List, batchpath.List, batchpath.List) {
+	ownValidityInfix, peerValidityInfix := config.ownValidationInfix, config.peerValidationInfix
+	ownValidationBatches := config.aggregationIDs.apply(readyBatches(ctx, config.ownValidationFiles, nil, ownValidityInfix), ownValidityInfix)
+
+	log.Printf("found %d own validations", len(ownValidationBatches))
+
+	peerValidationBatches := config.aggregationIDs.apply(readyBatches(ctx, config.peerValidationFiles, nil, peerValidityInfix), peerValidityInfix)
+
+	log.Printf("found %d peer validations", len(peerValidationBatches))
+
+	// Take the intersection of the sets of own validations and peer validations
+	// to get the list of batches we can aggregate.
+	// Go doesn't have sets, so we index own validations by batch ID, because
+	// batchPath is not a valid map key type, and using a *batchPath wouldn't
+	// give us the lookup semantics we want. A peer validation only pairs with
+	// an own validation that also agrees on aggregation ID and batch time: a
+	// batch ID that appears with different aggregation IDs or times on either
+	// side means something upstream is broken, and aggregating the pair would
+	// produce garbage, so we skip it and complain loudly.
+	ownValidationsByID := map[string][]*batchpath.BatchPath{}
+	for _, ownValidationBatch := range ownValidationBatches {
+		ownValidationsByID[ownValidationBatch.ID] = append(ownValidationsByID[ownValidationBatch.ID], ownValidationBatch)
+	}
+	aggregationBatches := batchpath.List{}
+	unpairedPeerValidations := batchpath.List{}
+	peerValidationIDs := map[string]bool{}
+	for _, peerValidationBatch := range peerValidationBatches {
+		peerValidationIDs[peerValidationBatch.ID] = true
+		ownValidations, ok := ownValidationsByID[peerValidationBatch.ID]
+		if !ok {
+			unpairedPeerValidations = append(unpairedPeerValidations, peerValidationBatch)
+			continue
+		}
+
+		paired := false
+		for _, ownValidationBatch := range ownValidations {
+			if ownValidationBatch.Equal(peerValidationBatch) {
+				paired = true
+				break
+			}
+		}
+		if !paired {
+			log.WithFields(log.Fields{
+				"batch-id":            peerValidationBatch.ID,
+				"peer-aggregation-id": peerValidationBatch.AggregationID,
+				"peer-batch-time":     peerValidationBatch.Time.String(),
+				"own-aggregation-id":  ownValidations[0].AggregationID,
+				"own-batch-time":      ownValidations[0].Time.String(),
+			}).Error("own and peer validations of batch disagree on aggregation ID or time, not aggregating it")
+			mismatchedValidations.Inc()
+			continue
+		}
+
+		aggregationBatches = append(aggregationBatches, peerValidationBatch)
+	}
+
+	unpairedOwnValidations := batchpath.List{}
+	for _, ownValidationBatch := range ownValidationBatches {
+		if !peerValidationIDs[ownValidationBatch.ID] {
+			unpairedOwnValidations = append(unpairedOwnValidations, ownValidationBatch)
+		}
+	}
+
+	return aggregationBatches, unpairedOwnValidations, unpairedPeerValidations
+}
+
+// reportOrphanValidations logs the unpaired validations, from the side named by
+// `side`, that fall in the aggregation intervals being scheduled, sets the
+// gauge to their number and returns it. `other` names the side whose validations are
+// missing. Validations outside the intervals are ignored: more recent ones may
+// yet be paired, and older ones were already reported by earlier runs. Since
+// the intervals being scheduled are those whose grace period has elapsed, an
+// orphan most likely means that the other side's pipeline is lagging or
+// broken, and the batch will never be aggregated.
+func reportOrphanValidations(config scheduleTasksConfig, unpairedValidations batchpath.List, side, other string, gauge monitor.GaugeMonitor) int {
+	orphans := 0
+	intervals, batchesByInterval := assignToAggregationIntervals(config, unpairedValidations)
+	for i, batches := range batchesByInterval {
+		for _, batch := range batches {
+			log.WithFields(log.Fields{
+				"aggregation-id": batch.AggregationID,
+				"batch-id":       batch.ID,
+				"batch-time":     batch.Time.String(),
+				"interval":       intervals[i].String(),
+			}).Warnf("%s validation has no %s validation, it will not be aggregated", side, other)
+			orphans++
+		}
+	}
+	gauge.Set(float64(orphans))
+	return orphans
+}
+
+// aggregationIntervals returns the intervals for which aggregation tasks should
+// be scheduled for aggregation IDs with the provided grace period, which are the
+// intervals overlapping the backfill window if there is one, or the most
+// recent interval whose grace period has elapsed
+func aggregationIntervals(config scheduleTasksConfig, gracePeriod time.Duration) []interval {
+	if config.aggregationBackfill == nil {
+		return []interval{aggregationInterval(config.clock, config.aggregationPeriod, gracePeriod)}
+	}
+
+	return backfillIntervals(
+		config.clock,
+		*config.aggregationBackfill,
+		config.aggregationPeriod,
+		gracePeriod,
+	)
+}
+
+// assignToAggregationIntervals returns the intervals for which aggregation
+// tasks should be scheduled, in chronological order, and the batches to
+// aggregate in each of them. Each batch is assigned among the intervals
+// computed with the grace period of its aggregation ID, so aggregation IDs
+// with shorter grace periods may have batches in more recent intervals than
+// others. The intervals computed with the default grace period are always
+// returned, even if they have no batches.
+func assignToAggregationIntervals(config scheduleTasksConfig, batches batchpath.List) ([]interval, []batchpath.List) {
+	batchesByGracePeriod := map[time.Duration]batchpath.List{config.gracePeriod: nil}
+	for _, batch := range batches {
+		gracePeriod := config.gracePeriodFor(batch.AggregationID)
+		batchesByGracePeriod[gracePeriod] = append(batchesByGracePeriod[gracePeriod], batch)
+	}
+
+	var intervals []interval
+	var batchesByInterval []batchpath.List
+	for gracePeriod, batches := range batchesByGracePeriod {
+		gracePeriodIntervals := aggregationIntervals(config, gracePeriod)
+		for i, assigned := range assignToIntervals(batches, gracePeriodIntervals) {
+			// Grace periods that differ by less than the aggregation period may
+			// yield the same intervals, whose batches are merged
+			index := -1
+			for j, inter := range intervals {
+				if inter.begin.Equal(gracePeriodIntervals[i].begin) {
+					index = j
+					break
+				}
+			}
+			if index == -1 {
+				intervals = append(intervals, gracePeriodIntervals[i])
+				batchesByInterval = append(batchesByInterval, nil)
+				index = len(intervals) - 1
+			}
+			batchesByInterval[index] = append(batchesByInterval[index], assigned...)
+		}
+	}
+	for _, batches := range batchesByInterval {
+		sort.Sort(batches)
+	}
+
+	order := make([]int, len(intervals))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return intervals[order[i]].begin.Before(intervals[order[j]].begin)
+	})
+	sortedIntervals := make([]interval, len(intervals))
+	sortedBatches := make([]batchpath.List, len(intervals))
+	for i, index := range order {
+		sortedIntervals[i] = intervals[index]
+		sortedBatches[i] = batchesByInterval[index]
+	}
+	return sortedIntervals, sortedBatches
+}
+
+// pendingWork summarizes the work that is ready to be scheduled
+type pendingWork struct {
+	// intakeBatches is the number of batches with all their files in the
+	// ingestor bucket
+	intakeBatches int
+	// intakeBatchesTooOld is the number of intake batches before the intake
+	// window, which is the backfill window if there is one
+	intakeBatchesTooOld int
+	// intakeBatchesInFuture is the number of intake batches after the intake
+	// window
+	intakeBatchesInFuture int
+	// intakeTasksScheduled is the number of intake batches within the window
+	// whose tasks have markers
+	intakeTasksScheduled int
+	// intakeTasksFailed is the number of intake batches within the window
+	// whose tasks have failed task records
+	intakeTasksFailed int
+	// intakeTasksPending is the number of intake batches within the window
+	// whose tasks have neither
+	intakeTasksPending int
+	// aggregatableBatches is the number of batches with both own and peer
+	// validations
+	aggregatableBatches int
+	// orphanOwnValidations and orphanPeerValidations are the numbers of own
+	// validations in the aggregation intervals without peer validations, and
+	// vice versa
+	orphanOwnValidations, orphanPeerValidations int
+	// intervals describes the aggregation intervals that would be scheduled
+	intervals []pendingAggregations
+}
+
+// pendingAggregations summarizes the aggregations in one interval
+type pendingAggregations struct {
+	interval interval
+	// batches is the number of aggregatable batches in the interval
+	batches int
+	// tasksScheduled, tasksFailed and tasksPending are the numbers of
+	// aggregation IDs whose aggregation task in the interval has a marker, has
+	// a failed task record and has neither, respectively
+	tasksScheduled, tasksFailed, tasksPending int
+}
+
+// pendingWorkFor computes what scheduleTasks would schedule with the provided
+// configuration, without scheduling anything. Existing jobs are not
+// considered.
+func pendingWorkFor(ctx context.Context, config scheduleTasksConfig) pendingWork {
+	var work pendingWork
+	taskMarkers, failedTasks := taskStateSets(config)
+
+	// countTask counts the task in the appropriate one of the provided counts
+	countTask := func(marker string, scheduled, failed, pending *int) {
+		if _, ok := taskMarkers[marker]; ok {
+			*scheduled++
+		} else if _, ok := failedTasks[marker]; ok {
+			*failed++
+		} else {
+			*pending++
+		}
+	}
+
+	intakeBatches := config.aggregationIDs.apply(readyIntakeBatches(ctx, config), "batch")
+	window := intakeWindow(config.clock, config.maxAge, config.intakeFutureTolerance, config.intakeBackfill)
+	currentIntakeBatches := withinInterval(intakeBatches, window, config.intakeTime)
+	work.intakeBatches = len(intakeBatches)
+	work.intakeBatchesTooOld, work.intakeBatchesInFuture = countOutsideInterval(intakeBatches, window, config.intakeTime)
+	for _, batch := range currentIntakeBatches {
+		intakeTask := task.IntakeBatch{
+			AggregationID: batch.AggregationID,
+			BatchID:       batch.ID,
+			Date:          task.Timestamp(batch.Time),
+		}
+		countTask(intakeTask.Marker(), &work.intakeTasksScheduled, &work.intakeTasksFailed, &work.intakeTasksPending)
+	}
+
+	aggregationBatches, unpairedOwnValidations, unpairedPeerValidations := aggregatableBatches(ctx, config)
+	work.aggregatableBatches = len(aggregationBatches)
+	work.orphanOwnValidations = reportOrphanValidations(config, unpairedOwnValidations, "own", "peer", orphanOwnValidations)
+	work.orphanPeerValidations = reportOrphanValidations(config, unpairedPeerValidations, "peer", "own", orphanPeerValidations)
+	intervals, batchesByInterval := assignToAggregationIntervals(config, aggregationBatches)
+	for i, inter := range intervals {
+		aggregations := pendingAggregations{interval: inter}
+		batchesByID := groupByAggregationID(batchesByInterval[i])
+		for _, aggregationID := range batchesByID.sortedAggregationIDs() {
+			aggregations.batches += len(batchesByID[aggregationID])
+			aggregationTask := task.Aggregation{
+				AggregationID:    aggregationID,
+				AggregationStart: task.Timestamp(inter.begin),
+				AggregationEnd:   task.Timestamp(inter.end),
+			}
+			countTask(aggregationTask.Marker(), &aggregations.tasksScheduled, &aggregations.tasksFailed, &aggregations.tasksPending)
 		}
+		work.intervals = append(work.intervals, aggregations)
+	}
 
-		intakeTaskEnqueuer, err = task.NewAWSSNSEnqueuer(
-			*awsSNSRegion,
-			*awsSNSIdentity,
-			*intakeTasksTopic,
-			*dryRun,
-		)
-		if err != nil {
-			log.Fatal(err)
+	return work
+}
+
+// write prints the summary of pending work
+func (w pendingWork) write(out io.Writer) {
+	fmt.Fprintf(out, "intake batches ready: %d\n", w.intakeBatches)
+	fmt.Fprintf(out, "intake batches skipped as too old: %d\n", w.intakeBatchesTooOld)
+	fmt.Fprintf(out, "intake batches skipped as too far in the future: %d\n", w.intakeBatchesInFuture)
+	fmt.Fprintf(out, "intake tasks already scheduled: %d\n", w.intakeTasksScheduled)
+	fmt.Fprintf(out, "intake tasks previously failed: %d\n", w.intakeTasksFailed)
+	fmt.Fprintf(out, "intake tasks pending: %d\n", w.intakeTasksPending)
+	fmt.Fprintf(out, "aggregatable batches (own and peer validations ready): %d\n", w.aggregatableBatches)
+	fmt.Fprintf(out, "orphan own validations (no peer validation): %d\n", w.orphanOwnValidations)
+	fmt.Fprintf(out, "orphan peer validations (no own validation): %d\n", w.orphanPeerValidations)
+	for _, aggregations := range w.intervals {
+		fmt.Fprintf(out, "aggregation interval %s: %d batches, %d tasks already scheduled, %d previously failed, %d pending\n",
+			aggregations.interval, aggregations.batches, aggregations.tasksScheduled, aggregations.tasksFailed, aggregations.tasksPending)
+	}
+}
+
+// taskMarkersInFiles returns the names of the task markers among the provided
+// object keys
+func taskMarkersInFiles(files []string) []string {
+	return keysWithPrefix(files, "task-markers/")
+}
+
+// failedTasksInFiles returns the markers of the tasks with failed task records
+// among the provided object keys
+func failedTasksInFiles(files []string) []string {
+	return keysWithPrefix(files, "failed-tasks/")
+}
+
+// failedAttemptsInFiles returns the markers of the tasks with records of failed
+// attempts among the provided object keys
+func failedAttemptsInFiles(files []string) []string {
+	return keysWithPrefix(files, "failed-attempts/")
+}
+
+// keysWithPrefix returns those of the provided object keys that begin with
+// prefix, with the prefix removed
+func keysWithPrefix(files []string, prefix string) []string {
+	var keys []string
+	for _, object := range files {
+		if !strings.HasPrefix(object, prefix) {
+			continue
 		}
+		keys = append(keys, strings.TrimPrefix(object, prefix))
+	}
+	return keys
+}
 
-		aggregationTaskEnqueuer, err = task.NewAWSSNSEnqueuer(
-			*awsSNSRegion,
-			*awsSNSIdentity,
-			*aggregateTasksTopic,
-			*dryRun,
-		)
-		if err != nil {
-			log.Fatal(err)
+// replayTasks enqueues again each of the tasks recorded in the provided task
+// markers, to the intake or aggregation task queue according to the kind of
+// task. No markers are written or deleted, since the tasks were already
+// scheduled. All the markers are attempted even if some fail.
+func replayTasks(
+	ctx context.Context,
+	reader bucket.TaskMarkerReader,
+	markers []string,
+	intakeTaskEnqueuer task.Enqueuer,
+	aggregationTaskEnqueuer task.Enqueuer,
+) error {
+	var failed []string
+	for _, marker := range markers {
+		logger := log.WithField("marker", marker)
+		if err := replayMarker(ctx, reader, marker, intakeTaskEnqueuer, aggregationTaskEnqueuer); err != nil {
+			logger.Errorf("failed to replay task: %s", err)
+			failed = append(failed, marker)
+			continue
 		}
-	// To implement a new task queue kind, add a case here. You should
-	// initialize intakeTaskEnqueuer and aggregationTaskEnqueuer.
-	default:
-		log.Fatalf("unknown task queue kind %s", *taskQueueKind)
+		logger.Info("replayed task")
 	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to replay %d tasks: %q", len(failed), failed)
+	}
+	return nil
+}
 
-	kubernetesClient, err := wfkubernetes.NewClient(*k8sNS, *kubeconfigPath, *dryRun)
+// replayMarker reads the task recorded in the task marker and enqueues it,
+// waiting until it is enqueued
+func replayMarker(
+	ctx context.Context,
+	reader bucket.TaskMarkerReader,
+	marker string,
+	intakeTaskEnqueuer task.Enqueuer,
+	aggregationTaskEnqueuer task.Enqueuer,
+) error {
+	replayed, err := reader.ReadTaskMarker(marker)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	enqueuer := intakeTaskEnqueuer
+	if _, ok := replayed.(task.Aggregation); ok {
+		enqueuer = aggregationTaskEnqueuer
 	}
 
-	// Get a listing of all jobs in the namespace so the finished ones can be
-	// reaped later on, and to avoid scheduling redudant work.
-	existingJobs, err := kubernetesClient.ListJobs()
-	if err != nil {
-		log.Fatal(err)
+	enqueued := make(chan error, 1)
+	enqueuer.Enqueue(ctx, replayed, func(err error) { enqueued <- err })
+	if err := <-enqueued; err != nil {
+		return fmt.Errorf("failed to enqueue task: %w", err)
 	}
+	return nil
+}
 
-	intakeFiles, err := intakeBucket.ListFiles()
-	if err != nil {
-		log.Fatal(err)
+// dependency is something workflow-manager depends on, such as a bucket or a
+// task queue, along with how to check that it is reachable
+type dependency struct {
+	name string
+	ping func() error
+}
+
+// runSelfTest makes each check in turn, writing whether it passed to out, and
+// returns the number of checks that failed
+func runSelfTest(out io.Writer, checks []dependency) int {
+	failed := 0
+	for _, check := range checks {
+		if err := check.ping(); err != nil {
+			fmt.Fprintf(out, "FAIL %s: %s\n", check.name, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(out, "PASS %s\n", check.name)
 	}
+	return failed
+}
 
-	ownValidationFiles, err := ownValidationBucket.ListFiles()
-	if err != nil {
-		log.Fatal(err)
+// checkMarkerRoundTrip writes a task marker for the selftest task to the
+// bucket, reads the task back from it and deletes it again
+func checkMarkerRoundTrip(b *bucket.Bucket, selfTest task.SelfTest) (err error) {
+	if err := b.WriteTaskMarker(selfTest); err != nil {
+		return fmt.Errorf("failed to write task marker: %w", err)
 	}
+	defer func() {
+		if deleteErr := b.DeleteTaskMarker(selfTest.Marker()); deleteErr != nil && err == nil {
+			err = fmt.Errorf("failed to delete task marker: %w", deleteErr)
+		}
+	}()
 
-	peerValidationFiles, err := peerValidationBucket.ListFiles()
+	read, err := b.ReadTaskMarker(selfTest.Marker())
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to read task marker: %w", err)
+	}
+	if read != selfTest {
+		return fmt.Errorf("read task %+v from task marker, expected %+v", read, selfTest)
 	}
+	return nil
+}
+
+// publishSelfTest enqueues the selftest task and waits until it is enqueued
+func publishSelfTest(ctx context.Context, enqueuer task.Enqueuer, selfTest task.SelfTest) error {
+	enqueued := make(chan error, 1)
+	enqueuer.Enqueue(ctx, selfTest, func(err error) { enqueued <- err })
+	return <-enqueued
+}
 
-	scheduleTasks(scheduleTasksConfig{
-		isFirst:                 *isFirst,
-		clock:                   utils.DefaultClock(),
-		intakeFiles:             intakeFiles,
-		ownValidationFiles:      ownValidationFiles,
-		peerValidationFiles:     peerValidationFiles,
-		existingJobs:            existingJobs,
-		intakeTaskEnqueuer:      intakeTaskEnqueuer,
-		aggregationTaskEnqueuer: aggregationTaskEnqueuer,
-		ownValidationBucket:     ownValidationBucket,
-		maxAge:                  maxAgeParsed,
-		aggregationPeriod:       aggregationPeriodParsed,
-		gracePeriod:             gracePeriodParsed,
+// deadLetterTask writes a failed task record for a task that could not be
+// enqueued, containing the task and the error, so that operators can inspect
+// it and so that the task is not retried on every run.
+func deadLetterTask(writer bucket.FailedTaskWriter, failedTask task.Task, enqueueErr error) error {
+	record, err := json.Marshal(struct {
+		Task  task.Task `json:"task"`
+		Error string    `json:"error"`
+	}{
+		Task:  failedTask,
+		Error: enqueueErr.Error(),
 	})
+	if err != nil {
+		return fmt.Errorf("marshaling failed task record: %w", err)
+	}
 
-	log.Print("done")
+	return writer.WriteFailedTask(failedTask.Marker(), record)
 }
 
-type scheduleTasksConfig struct {
-	isFirst                                              bool
-	clock                                                utils.Clock
-	intakeFiles, ownValidationFiles, peerValidationFiles []string
-	existingJobs                                         map[string]batchv1.Job
-	intakeTaskEnqueuer, aggregationTaskEnqueuer          task.Enqueuer
-	ownValidationBucket                                  bucket.TaskMarkerWriter
-	maxAge, aggregationPeriod, gracePeriod               time.Duration
+// maxEnqueueRetryBackoff caps the wait between attempts to enqueue a task, so
+// that the doubling can't overflow
+const maxEnqueueRetryBackoff = 7 * 24 * time.Hour
+
+// failedAttempts is the record of the failed attempts to enqueue a task that
+// will be retried
+type failedAttempts struct {
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+	Error       string    `json:"error"`
 }
 
-// scheduleTasks evaluates bucket contents and kubernetes cluster state to
-// schedule new tasks or delete old jobs
-func scheduleTasks(config scheduleTasksConfig) {
-	intakeBatches, err := batchpath.ReadyBatches(config.intakeFiles, "batch")
+// enqueueRetries decides when tasks that failed to enqueue on earlier runs are
+// retried, and records the outcome of each attempt to enqueue them. A task is
+// retried with exponential backoff until it has failed maxAttempts times, when
+// it is dead lettered, which makes later runs skip it until an operator resets
+// it.
+type enqueueRetries struct {
+	clock       utils.Clock
+	maxAttempts int
+	backoff     time.Duration
+	// attempted are the markers of tasks with records of failed attempts
+	attempted map[string]struct{}
+	store     bucket.FailedAttemptStore
+}
+
+// previousAttempts returns the record of the earlier failed attempts to enqueue
+// the task with the marker, which is the zero value if there were none, and
+// whether the task is due to be attempted again
+func (r *enqueueRetries) previousAttempts(marker string) (failedAttempts, bool, error) {
+	var previous failedAttempts
+	if _, ok := r.attempted[marker]; !ok {
+		return previous, true, nil
+	}
+	record, err := r.store.ReadFailedAttempts(marker)
 	if err != nil {
-		log.Fatal(err)
+		return previous, false, err
 	}
+	if err := json.Unmarshal(record, &previous); err != nil {
+		return previous, false, fmt.Errorf("failed to decode record of failed attempts: %w", err)
+	}
+	return previous, !r.clock.Now().Before(r.retryAfter(previous)), nil
+}
 
-	// Make a set of the tasks for which we have marker objects for efficient
-	// lookup later.
-	taskMarkers := map[string]struct{}{}
-	for _, object := range config.ownValidationFiles {
-		if !strings.HasPrefix(object, "task-markers/") {
-			continue
-		}
-		taskMarkers[strings.TrimPrefix(object, "task-markers/")] = struct{}{}
+// retryAfter returns the time before which a task with the provided failed
+// attempts should not be attempted again
+func (r *enqueueRetries) retryAfter(previous failedAttempts) time.Time {
+	if previous.Attempts == 0 {
+		return time.Time{}
+	}
+	backoff := r.backoff
+	for i := 1; i < previous.Attempts && backoff < maxEnqueueRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxEnqueueRetryBackoff {
+		backoff = maxEnqueueRetryBackoff
 	}
+	return previous.LastAttempt.Add(backoff)
+}
 
-	currentIntakeBatches := withinInterval(intakeBatches, interval{
-		begin: config.clock.Now().Add(-config.maxAge),
-		end:   config.clock.Now().Add(24 * time.Hour),
-	})
-	log.Printf("skipping %d batches as too old", len(intakeBatches)-len(currentIntakeBatches))
+// failed handles a task that failed to enqueue for some reason other than
+// shutting down. Unless the task has now failed maxAttempts times, it records
+// the failed attempt so that a later run retries the task. Otherwise, it dead
+// letters the task and forgets its failed attempts, so that deleting the
+// failed task record is enough to reset the task.
+func (r *enqueueRetries) failed(
+	failedTask task.Task,
+	aggregationID string,
+	previous failedAttempts,
+	enqueueErr error,
+	failedTaskWriter bucket.FailedTaskWriter,
+	logger *log.Entry,
+) {
+	attempts := failedAttempts{
+		Attempts:    previous.Attempts + 1,
+		LastAttempt: r.clock.Now(),
+		Error:       enqueueErr.Error(),
+	}
+	if attempts.Attempts < r.maxAttempts {
+		record, err := json.Marshal(attempts)
+		if err == nil {
+			err = r.store.WriteFailedAttempts(failedTask.Marker(), record)
+		}
+		if err != nil {
+			logger.Errorf("failed to write record of failed attempts: %s", err)
+			return
+		}
+		logger.Warnf("task failed to enqueue %d of %d times, will retry after %s",
+			attempts.Attempts, r.maxAttempts, r.retryAfter(attempts))
+		return
+	}
 
-	err = enqueueIntakeTasks(
-		config.clock,
-		currentIntakeBatches,
-		config.maxAge,
-		taskMarkers,
-		config.existingJobs,
-		config.ownValidationBucket,
-		config.intakeTaskEnqueuer,
-	)
-	if err != nil {
-		log.Fatal(err)
+	if err := deadLetterTask(failedTaskWriter, failedTask, enqueueErr); err != nil {
+		logger.Errorf("failed to write failed task record: %s", err)
+		return
 	}
+	if attempts.Attempts > 1 {
+		logger.Errorf("task failed to enqueue %d times, giving up on it until it is reset", attempts.Attempts)
+	}
+	tasksDeadLettered.WithLabelValues(aggregationIDLabel(aggregationID)).Inc()
+	r.forget(failedTask.Marker(), previous, logger)
+}
 
-	ownValidityInfix := fmt.Sprintf("validity_%d", utils.Index(config.isFirst))
-	ownValidationBatches, err := batchpath.ReadyBatches(config.ownValidationFiles, ownValidityInfix)
-	if err != nil {
-		log.Fatal(err)
+// forget deletes the record of the earlier failed attempts to enqueue the task
+// with the marker, if there were any
+func (r *enqueueRetries) forget(marker string, previous failedAttempts, logger *log.Entry) {
+	if previous.Attempts == 0 {
+		return
 	}
+	if err := r.store.DeleteFailedAttempts(marker); err != nil {
+		logger.Errorf("failed to delete record of failed attempts: %s", err)
+	}
+}
 
-	log.Printf("found %d own validations", len(ownValidationBatches))
+// cleanUpTaskMarkers deletes those of the provided task markers that are older
+// than maxAge, judging by the time embedded in the marker, and returns the
+// number of markers deleted. Markers whose time can't be determined are left
+// alone.
+func cleanUpTaskMarkers(
+	clock utils.Clock,
+	markers []string,
+	maxAge time.Duration,
+	deleter bucket.TaskMarkerDeleter,
+) (int, error) {
+	return cleanUpByMarkerTime(clock, markers, maxAge, "task marker", deleter.DeleteTaskMarker)
+}
 
-	peerValidityInfix := fmt.Sprintf("validity_%d", utils.Index(!config.isFirst))
-	peerValidationBatches, err := batchpath.ReadyBatches(config.peerValidationFiles, peerValidityInfix)
-	if err != nil {
-		log.Fatal(err)
-	}
+// cleanUpAggregationBatches deletes the lists of batches of those of the
+// provided aggregation tasks that are older than maxAge, judging by the time
+// embedded in their markers, like cleanUpTaskMarkers, and returns the number of
+// lists deleted
+func cleanUpAggregationBatches(
+	clock utils.Clock,
+	markers []string,
+	maxAge time.Duration,
+	deleter bucket.AggregationBatchesDeleter,
+) (int, error) {
+	return cleanUpByMarkerTime(clock, markers, maxAge, "aggregation batches list", deleter.DeleteAggregationBatches)
+}
 
-	log.Printf("found %d peer validations", len(peerValidationBatches))
+// cleanUpByMarkerTime calls deleteMarker with those of the provided task markers
+// that are older than maxAge, judging by the time embedded in the marker, and
+// returns the number of markers deleted. what describes what is deleted.
+func cleanUpByMarkerTime(
+	clock utils.Clock,
+	markers []string,
+	maxAge time.Duration,
+	what string,
+	deleteMarker func(marker string) error,
+) (int, error) {
+	deleted := 0
+	unparseable := 0
+	for _, marker := range markers {
+		markerTime, err := task.ParseMarkerTime(marker)
+		if err != nil {
+			log.Printf("not cleaning up %s: %s", what, err)
+			unparseable++
+			continue
+		}
 
-	// Take the intersection of the sets of own validations and peer validations
-	// to get the list of batches we can aggregate.
-	// Go doesn't have sets, so we have to use a map[string]bool. We use the
-	// batch ID as the key to the set, because batchPath is not a valid map key
-	// type, and using a *batchPath wouldn't give us the lookup semantics we
-	// want.
-	ownValidationsSet := map[string]bool{}
-	for _, ownValidationBatch := range ownValidationBatches {
-		ownValidationsSet[ownValidationBatch.ID] = true
-	}
-	aggregationBatches := batchpath.List{}
-	for _, peerValidationBatch := range peerValidationBatches {
-		if _, ok := ownValidationsSet[peerValidationBatch.ID]; ok {
-			aggregationBatches = append(aggregationBatches, peerValidationBatch)
+		if clock.Now().Sub(markerTime) <= maxAge {
+			continue
 		}
-	}
 
-	interval := aggregationInterval(config.clock, config.aggregationPeriod, config.gracePeriod)
-	log.Printf("looking for batches to aggregate in interval %s", interval)
-	aggregationBatches = withinInterval(aggregationBatches, interval)
-	aggregationMap := groupByAggregationID(aggregationBatches)
-	err = enqueueAggregationTasks(
-		aggregationMap,
-		interval,
-		taskMarkers,
-		config.existingJobs,
-		config.ownValidationBucket,
-		config.aggregationTaskEnqueuer,
-	)
-	if err != nil {
-		log.Fatal(err)
+		if err := deleteMarker(marker); err != nil {
+			return deleted, err
+		}
+		deleted++
 	}
 
-	// Ensure both task enqueuers have completed their asynchronous work before
-	// allowing the process to exit
-	config.intakeTaskEnqueuer.Stop()
-	config.aggregationTaskEnqueuer.Stop()
+	log.Printf("cleaned up %d %ss older than %s. Skipped %d %ss with unparseable times.",
+		deleted, what, maxAge, unparseable, what)
+
+	return deleted, nil
+}
+
+// jobCollides returns true if the provided job, which has the name we would
+// have given a task, was created for a different task, judging by the
+// arguments that older versions of workflow-manager passed to facilitator.
+// expectedArgs maps flags to the values they would have for our task. A flag
+// missing from the job's arguments is not considered a mismatch, so that we
+// err on the side of assuming the job was created for our task.
+func jobCollides(job batchv1.Job, expectedArgs map[string]string) bool {
+	for _, container := range job.Spec.Template.Spec.Containers {
+		args := append(append([]string{}, container.Command...), container.Args...)
+		for i, arg := range args {
+			for flag, expected := range expectedArgs {
+				value := ""
+				if arg == flag && i+1 < len(args) {
+					value = args[i+1]
+				} else if strings.HasPrefix(arg, flag+"=") {
+					value = strings.TrimPrefix(arg, flag+"=")
+				} else {
+					continue
+				}
+				if value != expected {
+					return true
+				}
+			}
+		}
+	}
+	return false
 }
 
 // interval represents a half-open interval of time.
@@ -345,33 +3610,79 @@ func (inter interval) String() string {
 	return fmt.Sprintf("%s to %s", fmtTime(inter.begin), fmtTime(inter.end))
 }
 
-// fmtTime returns the input time in the same style expected by facilitator/lib.rs,
-// currently "%Y/%m/%d/%H/%M"
+// fmtTime returns the input time in the same style as the timestamps in tasks,
+// which is by default that expected by facilitator/lib.rs, "%Y/%m/%d/%H/%M"
 func fmtTime(t time.Time) string {
-	return t.Format("2006/01/02/15/04")
+	return t.Format(task.TimestampFormat())
 }
 
-// jobNameForBatchPath generates a name for the Kubernetes job that will intake
-// the provided batch. The name will incorporate the aggregation ID, batch UUID
-// and batch timestamp while being a legal Kubernetes job name.
+// intakeJobNameForBatchPath generates a name for the Kubernetes job that will
+// intake the provided batch. The name will incorporate the aggregation ID, a
+// hash of the batch path and batch timestamp while being a legal Kubernetes
+// job name.
 func intakeJobNameForBatchPath(path *batchpath.BatchPath) string {
 	// Kubernetes job names must be valid DNS identifiers, which means they are
 	// limited to 63 characters in length and also what characters they may
 	// contain. Intake job names are like:
-	// i-<aggregation name fragment>-<batch UUID fragment>-<batch timestamp>
+	// i-<aggregation name fragment>-<batch path hash>-<batch timestamp>
 	// The batch timestamp is 16 characters, and the 'i' and '-'es take up
-	// another 4, leaving 43. We take the '-'es out of the UUID and use half of
-	// it, hoping that this plus the date will provide enough entropy to avoid
-	// collisions. Half a UUID is 16 characters, leaving 27 for the aggregation
-	// ID fragment.
+	// another 4, leaving 43. We hash the whole batch path with SHA-256 and use
+	// the first 16 characters of its base32 encoding, for 80 bits of entropy,
+	// which makes collisions between distinct batches vanishingly unlikely
+	// even if their aggregation IDs share a long prefix. That leaves 27
+	// characters for the aggregation ID fragment.
 	// For example, we might get:
-	// i-com-apple-EN-verylongnameth-0f0f0f0f0f0f0f0f-2006-01-02-15-04
+	// i-com-apple-en-verylongnameth-ovt3lz5xjbkwn6dq-2006-01-02-15-04
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s", path.AggregationID, fmtTime(path.Time), path.ID)))
+	return fmt.Sprintf("i-%s-%s-%s",
+		aggregationJobNameFragment(path.AggregationID, 27),
+		strings.ToLower(base32.StdEncoding.EncodeToString(hash[:]))[:16],
+		strings.ReplaceAll(fmtTime(path.Time), "/", "-"))
+}
+
+// legacyIntakeJobNameForBatchPath generates the name that older versions of
+// workflow-manager gave to the Kubernetes job that intakes the provided batch,
+// which used half of the batch UUID where intakeJobNameForBatchPath uses a
+// hash of the batch path. We use it to recognize jobs created by those
+// versions.
+func legacyIntakeJobNameForBatchPath(path *batchpath.BatchPath) string {
 	return fmt.Sprintf("i-%s-%s-%s",
 		aggregationJobNameFragment(path.AggregationID, 27),
 		strings.ReplaceAll(path.ID, "-", "")[:16],
 		strings.ReplaceAll(fmtTime(path.Time), "/", "-"))
 }
 
+// aggregationJobName generates a name for the Kubernetes job that will run the
+// aggregation for the provided aggregation ID over the interval beginning at
+// intervalStart, while being a legal Kubernetes job name.
+func aggregationJobName(aggregationID string, intervalStart time.Time) string {
+	// Aggregation job names are like:
+	// a-<aggregation name fragment>-<interval start timestamp>
+	// The timestamp is 16 characters, and the 'a' and '-'es take up another
+	// 3, so a 30 character aggregation name fragment keeps us well within the
+	// 63 character limit.
+	// For example, we might get:
+	// a-com-apple-en-verylongnamethatgets-2006-01-02-15-04
+	return fmt.Sprintf("a-%s-%s",
+		aggregationJobNameFragment(aggregationID, 30),
+		strings.ReplaceAll(fmtTime(intervalStart), "/", "-"))
+}
+
+// jobNameRegexp matches a DNS label as defined in RFC 1123, which is what
+// Kubernetes requires job names to be
+var jobNameRegexp = regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
+
+// validateJobName returns an error if name is not a legal Kubernetes job name
+func validateJobName(name string) error {
+	if len(name) > 63 {
+		return fmt.Errorf("job name %q is longer than 63 characters", name)
+	}
+	if !jobNameRegexp.MatchString(name) {
+		return fmt.Errorf("job name %q is not a valid DNS label", name)
+	}
+	return nil
+}
+
 // aggregationJobNameFragment generates a job name-safe string from an
 // aggregationID.
 // Remove characters that aren't valid in DNS names, and also restrict
@@ -396,20 +3707,105 @@ func aggregationInterval(clock utils.Clock, aggregationPeriod, gracePeriod time.
 	return output
 }
 
-// withinInterval returns the subset of `batchPath`s that are within the given interval.
-func withinInterval(batches batchpath.List, inter interval) batchpath.List {
+// parseBackfillWindow parses the RFC3339 start and end of an aggregation
+// backfill window, both of which must be provided.
+func parseBackfillWindow(start, end string) (*interval, error) {
+	if start == "" || end == "" {
+		return nil, fmt.Errorf("both the start and end of the backfill window are required")
+	}
+	var window interval
+	var err error
+	window.begin, err = time.Parse(time.RFC3339, start)
+	if err != nil {
+		return nil, fmt.Errorf("parsing backfill start: %w", err)
+	}
+	window.end, err = time.Parse(time.RFC3339, end)
+	if err != nil {
+		return nil, fmt.Errorf("parsing backfill end: %w", err)
+	}
+	if !window.begin.Before(window.end) {
+		return nil, fmt.Errorf("backfill start %s is not before backfill end %s", start, end)
+	}
+	return &window, nil
+}
+
+// backfillIntervals returns every interval aligned on multiples of
+// `aggregationPeriod` that overlaps the backfill window, oldest first. Intervals
+// later than the one aggregationInterval would currently choose are omitted,
+// since they may not have all their batches yet.
+func backfillIntervals(clock utils.Clock, window interval, aggregationPeriod, gracePeriod time.Duration) []interval {
+	latest := aggregationInterval(clock, aggregationPeriod, gracePeriod)
+	var output []interval
+	for begin := window.begin.Truncate(aggregationPeriod); begin.Before(window.end); begin = begin.Add(aggregationPeriod) {
+		inter := interval{begin: begin, end: begin.Add(aggregationPeriod)}
+		if inter.end.After(latest.end) {
+			log.Printf("not backfilling interval %s or later as its grace period has not yet elapsed", inter)
+			break
+		}
+		output = append(output, inter)
+	}
+	return output
+}
+
+// validateAggregationPeriod checks that aggregation intervals computed with the
+// provided period will line up with day boundaries. aggregationInterval aligns
+// intervals on multiples of the period relative to the zero time, so a period
+// that neither evenly divides nor is a multiple of 24 hours yields intervals
+// that start at a different time of day each day.
+func validateAggregationPeriod(aggregationPeriod time.Duration) error {
+	day := 24 * time.Hour
+	if aggregationPeriod <= 0 {
+		return fmt.Errorf("aggregation period must be positive, got %s", aggregationPeriod)
+	}
+	if day%aggregationPeriod != 0 && aggregationPeriod%day != 0 {
+		return fmt.Errorf("aggregation period %s must evenly divide or be a multiple of 24h", aggregationPeriod)
+	}
+	return nil
+}
+
+// withinInterval returns the subset of `batchPath`s whose time, according to
+// batchTime, is within the given interval.
+func withinInterval(batches batchpath.List, inter interval, batchTime func(*batchpath.BatchPath) time.Time) batchpath.List {
 	var output batchpath.List
 	for _, bp := range batches {
 		// We use Before twice rather than Before and after, because Before is <,
 		// and After is >, but we are processing a half-open interval so we need
 		// >= and <.
-		if !bp.Time.Before(inter.begin) && bp.Time.Before(inter.end) {
+		if t := batchTime(bp); !t.Before(inter.begin) && t.Before(inter.end) {
 			output = append(output, bp)
 		}
 	}
 	return output
 }
 
+// assignToIntervals returns, for each of the intervals, the batches to aggregate
+// in it. Each batch is assigned to at most one interval, the first that
+// contains its time, so that no two aggregation tasks scheduled in a run share
+// a batch, even if the intervals overlap. Intervals are half-open, so a batch
+// exactly on the boundary between two adjacent intervals belongs to the later
+// one.
+func assignToIntervals(batches batchpath.List, intervals []interval) []batchpath.List {
+	output := make([]batchpath.List, len(intervals))
+	for _, bp := range batches {
+		for i, inter := range intervals {
+			if !bp.Time.Before(inter.begin) && bp.Time.Before(inter.end) {
+				output[i] = append(output[i], bp)
+				break
+			}
+		}
+	}
+	return output
+}
+
+// aggregationIDLabel returns the value that should be used for the
+// aggregation_id label on metrics, which is empty if the label is disabled.
+func aggregationIDLabel(aggregationID string) string {
+	if !*metricsAggregationIDLabel {
+		return ""
+	}
+	return aggregationID
+}
+
 type aggregationMap map[string]batchpath.List
 
 func groupByAggregationID(batches batchpath.List) aggregationMap {
@@ -420,13 +3816,34 @@ func groupByAggregationID(batches batchpath.List) aggregationMap {
 	return output
 }
 
+// sortedAggregationIDs returns the aggregation IDs in the map in lexical
+// order, so that tasks are scheduled and logged in the same order each run.
+func (m aggregationMap) sortedAggregationIDs() []string {
+	aggregationIDs := make([]string, 0, len(m))
+	for aggregationID := range m {
+		aggregationIDs = append(aggregationIDs, aggregationID)
+	}
+	sort.Strings(aggregationIDs)
+	return aggregationIDs
+}
+
 func enqueueAggregationTasks(
+	ctx context.Context,
+	clock utils.Clock,
+	isFirst bool,
+	taskSchemaVersion int,
+	taskFieldNaming task.FieldNaming,
 	batchesByID aggregationMap,
 	inter interval,
+	maxBatches int,
 	taskMarkers map[string]struct{},
+	failedTasks map[string]struct{},
+	retries *enqueueRetries,
 	existingJobs map[string]batchv1.Job,
-	ownValidationBucket bucket.TaskMarkerWriter,
+	taskMarkerBucket bucket.TaskStateWriter,
+	failedMarkers *failedMarkerWrites,
 	enqueuer task.Enqueuer,
+	summary *runSummary,
 ) error {
 	if len(batchesByID) == 0 {
 		log.Printf("no batches to aggregate")
@@ -434,9 +3851,18 @@ func enqueueAggregationTasks(
 	}
 
 	skippedDueToMarker := 0
+	skippedDueToFailure := 0
+	skippedDueToSize := 0
+	skippedDueToBackoff := 0
 	scheduled := 0
 
-	for _, readyBatches := range batchesByID {
+	for _, id := range batchesByID.sortedAggregationIDs() {
+		readyBatches := batchesByID[id]
+		if ctx.Err() != nil {
+			log.Warnf("not scheduling any more aggregation tasks: %s", ctx.Err())
+			break
+		}
+
 		aggregationID := readyBatches[0].AggregationID
 		batches := []task.Batch{}
 
@@ -459,71 +3885,239 @@ func enqueueAggregationTasks(
 			AggregationStart: task.Timestamp(inter.begin),
 			AggregationEnd:   task.Timestamp(inter.end),
 			Batches:          batches,
+			Version:          taskSchemaVersion,
+			IsFirst:          isFirst,
+			FieldNaming:      taskFieldNaming,
+		}
+
+		taskName := aggregationJobName(aggregationID, inter.begin)
+		if err := validateJobName(taskName); err != nil {
+			return err
 		}
+		logger := log.WithFields(log.Fields{
+			"aggregation_id": aggregationID,
+			"marker":         aggregationTask.Marker(),
+			"task_name":      taskName,
+		})
 
 		if _, ok := taskMarkers[aggregationTask.Marker()]; ok {
+			logger.Debug("skipping aggregation task with existing task marker")
 			skippedDueToMarker++
 			continue
 		}
 
-		taskName := fmt.Sprintf(
-			"a-%s-%s",
-			aggregationJobNameFragment(aggregationID, 30),
-			strings.ReplaceAll(fmtTime(inter.begin), "/", "-"),
-		)
-		if _, ok := existingJobs[taskName]; ok {
+		if _, ok := failedTasks[aggregationTask.Marker()]; ok {
+			logger.Warn("skipping aggregation task with failed task record")
+			skippedDueToFailure++
+			continue
+		}
+
+		// An aggregation this big most likely means something upstream is
+		// broken, and the task could be too big for the task queue or the
+		// facilitator, so it isn't scheduled until someone investigates.
+		// Splitting it wouldn't help, as the facilitator expects a single
+		// aggregation per aggregation ID and interval.
+		if maxBatches > 0 && batchCount > maxBatches {
+			logger.WithField("batch_count", batchCount).Errorf(
+				"aggregation task has %d batches, more than the maximum of %d, not scheduling it", batchCount, maxBatches)
+			aggregationsTooLarge.WithLabelValues(aggregationIDLabel(aggregationID)).Inc()
+			skippedDueToSize++
+			continue
+		}
+
+		previous, due, err := retries.previousAttempts(aggregationTask.Marker())
+		if err != nil {
+			logger.Errorf("skipping aggregation task whose earlier failed attempts can't be read: %s", err)
+			skippedDueToFailure++
+			continue
+		}
+		if !due {
+			logger.Infof("skipping aggregation task that failed to enqueue %d times until %s", previous.Attempts, retries.retryAfter(previous))
+			skippedDueToBackoff++
+			continue
+		}
+
+		if job, ok := existingJobs[taskName]; ok && jobCollides(job, map[string]string{
+			"--aggregation-id": aggregationID,
+		}) {
+			logger.Warn("existing job with this aggregation task's name was created for a different task")
+			jobNameCollisions.Inc()
+		} else if ok {
+			logger.Debug("skipping aggregation task with existing job")
 			skippedDueToMarker++
 			// If we made it here, a Kubernetes job for this aggregation
 			// existed, but we did not find a marker for the task. The job was
 			// most likely created by an older workflow-manager, so write out a
 			// marker for this task, which makes it safe to reap the job when it
 			// finishes.
-			if err := ownValidationBucket.WriteTaskMarker(aggregationTask.Marker()); err != nil {
+			if err := taskMarkerBucket.WriteTaskMarker(aggregationTask); err != nil {
 				return err
 			}
 			continue
 		}
 
-		log.Printf("scheduling aggregation task %s (interval %s) for aggregation ID %s over %d batches",
-			taskName, inter, aggregationID, batchCount)
+		// Write a pending marker before enqueuing, so that if we stop before
+		// learning whether the task was enqueued, the next run can tell
+		if err := taskMarkerBucket.WritePendingMarker(aggregationTask); err != nil {
+			return fmt.Errorf("failed to write pending aggregation task marker: %w", err)
+		}
+
+		logger.Infof("scheduling aggregation task (interval %s) over %d batches", inter, batchCount)
 		scheduled++
-		enqueuer.Enqueue(aggregationTask, func(err error) {
+		aggregationLag.Observe(clock.Now().Sub(inter.end).Seconds())
+		// Shutting down only stops us from scheduling more tasks. Enqueues
+		// already started are left to finish, as abandoning one would leave us
+		// not knowing whether the task was enqueued.
+		enqueueCtx, cancel := utils.ContextWithTimeoutDetachedFrom(ctx)
+		enqueueCtx, span := tracing.Tracer().Start(enqueueCtx, "Enqueue", trace.WithAttributes(label.String("marker", aggregationTask.Marker())))
+		enqueuer.Enqueue(enqueueCtx, aggregationTask, func(err error) {
+			defer cancel()
+			defer tracing.EndWithError(span, err)
 			if err != nil {
-				log.Printf("failed to enqueue aggregation task: %s", err)
+				logger.Errorf("failed to enqueue aggregation task: %s", err)
+				// If the task queue may have accepted the task anyway, keep
+				// its pending marker for the next run to reconcile, rather
+				// than risk scheduling the task twice
+				if enqueueMayHaveSucceeded(enqueueCtx, err) {
+					logger.Warn("keeping pending aggregation task marker, as the task may have been enqueued")
+					return
+				}
+				// The task wasn't enqueued, so roll back its pending marker
+				if err := taskMarkerBucket.DeletePendingMarker(aggregationTask.Marker()); err != nil {
+					logger.Errorf("failed to delete pending aggregation task marker: %s", err)
+				}
+				// Tasks that failed because we are shutting down, or because
+				// the task queue seems to be down, are worth retrying on the
+				// next run, and don't count as failed attempts.
+				if ctx.Err() != nil {
+					return
+				}
+				retries.failed(aggregationTask, aggregationID, previous, err, taskMarkerBucket, logger)
 				return
 			}
+			retries.forget(aggregationTask.Marker(), previous, logger)
+			// The task was enqueued, so it counts as started even if its
+			// marker has yet to be promoted
+			aggregationsStarted.WithLabelValues(aggregationIDLabel(aggregationID)).Inc()
 
-			// Write a marker to cloud storage to ensure we don't schedule
-			// redundant tasks
-			if err := ownValidationBucket.WriteTaskMarker(aggregationTask.Marker()); err != nil {
-				log.Printf("failed to write aggregation task marker: %s", err)
+			// Promote the pending marker to a task marker to ensure we don't
+			// schedule redundant tasks
+			if err := taskMarkerBucket.PromoteMarker(aggregationTask); err != nil {
+				logger.Errorf("failed to promote aggregation task marker, will retry: %s", err)
+				failedMarkers.add(aggregationTask)
 			}
-
-			aggregationsStarted.Inc()
 		})
 	}
 
-	log.Printf("skipped %d aggregation tasks that already existed. Scheduled %d new aggregation tasks.",
-		skippedDueToMarker, scheduled)
+	log.Printf("skipped %d aggregation tasks that already existed, %d that previously failed, %d waiting to be retried, %d with too many batches. Scheduled %d new aggregation tasks.",
+		skippedDueToMarker, skippedDueToFailure, skippedDueToBackoff, skippedDueToSize, scheduled)
+	summary.aggregationTasksScheduled += scheduled
+	summary.aggregationTasksExisting += skippedDueToMarker
+	summary.aggregationTasksPreviouslyFailed += skippedDueToFailure
+	summary.aggregationTasksTooLarge += skippedDueToSize
+	summary.aggregationTasksBackingOff += skippedDueToBackoff
 
 	return nil
 }
 
+// workerPool calls functions on at most a fixed number of goroutines at a
+// time, and remembers the first error any of them returns
+type workerPool struct {
+	semaphore chan struct{}
+	waitGroup sync.WaitGroup
+	mutex     sync.Mutex
+	err       error
+}
+
+// newWorkerPool returns a workerPool that runs up to size functions at a time,
+// or one if size is less than one
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &workerPool{semaphore: make(chan struct{}, size)}
+}
+
+// run blocks until fewer than the pool's size of functions are running, then
+// calls f on a new goroutine, so functions start in the order they are passed
+// to run. If a function has already returned an error, run returns false
+// without calling f.
+func (p *workerPool) run(f func() error) bool {
+	p.semaphore <- struct{}{}
+	if p.firstError() != nil {
+		<-p.semaphore
+		return false
+	}
+
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+		// The error must be recorded before the semaphore is released, so
+		// that with a pool of size one, no function runs after one fails
+		defer func() { <-p.semaphore }()
+		if err := f(); err != nil {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			if p.err == nil {
+				p.err = err
+			}
+		}
+	}()
+	return true
+}
+
+func (p *workerPool) firstError() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.err
+}
+
+// wait blocks until all the functions passed to run have returned, and
+// returns the first error any of them returned
+func (p *workerPool) wait() error {
+	p.waitGroup.Wait()
+	return p.firstError()
+}
+
+// enqueueIntakeTasks schedules intake tasks for those of the provided batches
+// that are no older than ageLimit, judging by batchTime, and don't already have
+// task markers or jobs. An ageLimit of zero disables the age check.
 func enqueueIntakeTasks(
+	ctx context.Context,
 	clock utils.Clock,
+	isFirst bool,
+	taskSchemaVersion int,
+	taskFieldNaming task.FieldNaming,
 	readyBatches batchpath.List,
 	ageLimit time.Duration,
+	batchTime func(*batchpath.BatchPath) time.Time,
 	taskMarkers map[string]struct{},
+	failedTasks map[string]struct{},
+	retries *enqueueRetries,
 	existingJobs map[string]batchv1.Job,
-	ownValidationBucket bucket.TaskMarkerWriter,
+	taskMarkerBucket bucket.TaskStateWriter,
+	failedMarkers *failedMarkerWrites,
 	enqueuer task.Enqueuer,
+	concurrency int,
+	summary *runSummary,
 ) error {
 	skippedDueToAge := 0
 	skippedDueToMarker := 0
+	skippedDueToFailure := 0
+	skippedDueToBackoff := 0
 	scheduled := 0
+	// Decisions about which tasks to schedule are made here, oldest batch
+	// first, but writing markers and enqueuing happen in the pool
+	pool := newWorkerPool(concurrency)
 	for _, batch := range readyBatches {
-		age := clock.Now().Sub(batch.Time)
-		if age > ageLimit {
+		batch := batch
+		if ctx.Err() != nil {
+			log.Warnf("not scheduling any more intake tasks: %s", ctx.Err())
+			break
+		}
+
+		age := clock.Now().Sub(batchTime(batch))
+		if ageLimit != 0 && age > ageLimit {
 			skippedDueToAge++
 			continue
 		}
@@ -532,48 +4126,189 @@ func enqueueIntakeTasks(
 			AggregationID: batch.AggregationID,
 			BatchID:       batch.ID,
 			Date:          task.Timestamp(batch.Time),
+			Version:       taskSchemaVersion,
+			IsFirst:       isFirst,
+			FieldNaming:   taskFieldNaming,
+		}
+
+		taskName := intakeJobNameForBatchPath(batch)
+		if err := validateJobName(taskName); err != nil {
+			return err
 		}
+		logger := log.WithFields(log.Fields{
+			"aggregation_id": batch.AggregationID,
+			"batch_id":       batch.ID,
+			"marker":         intakeTask.Marker(),
+			"task_name":      taskName,
+		})
 
 		if _, ok := taskMarkers[intakeTask.Marker()]; ok {
+			logger.Debug("skipping intake task with existing task marker")
 			skippedDueToMarker++
 			continue
 		}
 
-		taskName := intakeJobNameForBatchPath(batch)
-		if _, ok := existingJobs[taskName]; ok {
+		if _, ok := failedTasks[intakeTask.Marker()]; ok {
+			logger.Warn("skipping intake task with failed task record")
+			skippedDueToFailure++
+			continue
+		}
+
+		previous, due, err := retries.previousAttempts(intakeTask.Marker())
+		if err != nil {
+			logger.Errorf("skipping intake task whose earlier failed attempts can't be read: %s", err)
+			skippedDueToFailure++
+			continue
+		}
+		if !due {
+			logger.Infof("skipping intake task that failed to enqueue %d times until %s", previous.Attempts, retries.retryAfter(previous))
+			skippedDueToBackoff++
+			continue
+		}
+
+		job, ok := existingJobs[taskName]
+		if !ok {
+			job, ok = existingJobs[legacyIntakeJobNameForBatchPath(batch)]
+		}
+		if ok && jobCollides(job, map[string]string{
+			"--aggregation-id": batch.AggregationID,
+			"--batch-id":       batch.ID,
+		}) {
+			logger.Warn("existing job with this intake task's name was created for a different batch")
+			jobNameCollisions.Inc()
+		} else if ok {
+			logger.Debug("skipping intake task with existing job")
 			skippedDueToMarker++
 			// If we made it here, a Kubernetes job for this intake task
 			// existed, but we did not find a marker for the task. The job was
 			// most likely created by an older workflow-manager, so write out a
 			// marker for this task, which makes it safe to reap the job when it
 			// finishes.
-			if err := ownValidationBucket.WriteTaskMarker(intakeTask.Marker()); err != nil {
-				return err
+			if !pool.run(func() error {
+				return taskMarkerBucket.WriteTaskMarker(intakeTask)
+			}) {
+				break
 			}
 
 			continue
 		}
 
-		log.Printf("scheduling intake task for batch %s", batch)
 		scheduled++
-		enqueuer.Enqueue(intakeTask, func(err error) {
-			if err != nil {
-				log.Printf("failed to enqueue intake task: %s", err)
+		intakeBatchAge.Observe(age.Seconds())
+		if !pool.run(func() error {
+			// Write a pending marker before enqueuing, so that if we stop
+			// before learning whether the task was enqueued, the next run can
+			// tell
+			if err := taskMarkerBucket.WritePendingMarker(intakeTask); err != nil {
+				return fmt.Errorf("failed to write pending intake task marker: %w", err)
+			}
+
+			logger.Infof("scheduling intake task for batch %s", batch)
+			enqueueIntakeTask(ctx, intakeTask, logger, retries, previous, taskMarkerBucket, failedMarkers, enqueuer)
+			return nil
+		}) {
+			break
+		}
+	}
+	if err := pool.wait(); err != nil {
+		return err
+	}
+
+	log.Printf("skipped %d batches as too old, %d with existing tasks, %d with previously failed tasks, %d with tasks waiting to be retried. Scheduled %d new intake tasks.",
+		skippedDueToAge, skippedDueToMarker, skippedDueToFailure, skippedDueToBackoff, scheduled)
+	summary.intakeTasksScheduled += scheduled
+	summary.intakeBatchesTooOld += skippedDueToAge
+	summary.intakeTasksExisting += skippedDueToMarker
+	summary.intakeTasksPreviouslyFailed += skippedDueToFailure
+	summary.intakeTasksBackingOff += skippedDueToBackoff
+
+	return nil
+}
+
+// enqueueIntakeTask enqueues the intake task, whose pending marker has been
+// written, then promotes the pending marker or, if enqueuing definitely
+// failed, deletes it and writes a failed task record.
+func enqueueIntakeTask(
+	ctx context.Context,
+	intakeTask task.IntakeBatch,
+	logger *log.Entry,
+	retries *enqueueRetries,
+	previous failedAttempts,
+	taskMarkerBucket bucket.TaskStateWriter,
+	failedMarkers *failedMarkerWrites,
+	enqueuer task.Enqueuer,
+) {
+	// Shutting down only stops us from scheduling more tasks. Enqueues already
+	// started are left to finish, as abandoning one would leave us not knowing
+	// whether the task was enqueued.
+	enqueueCtx, cancel := utils.ContextWithTimeoutDetachedFrom(ctx)
+	enqueueCtx, span := tracing.Tracer().Start(enqueueCtx, "Enqueue", trace.WithAttributes(label.String("marker", intakeTask.Marker())))
+	enqueuer.Enqueue(enqueueCtx, intakeTask, func(err error) {
+		defer cancel()
+		defer tracing.EndWithError(span, err)
+		if err != nil {
+			logger.Errorf("failed to enqueue intake task: %s", err)
+			// If the task queue may have accepted the task anyway, keep its
+			// pending marker for the next run to reconcile, rather than risk
+			// scheduling the task twice
+			if enqueueMayHaveSucceeded(enqueueCtx, err) {
+				logger.Warn("keeping pending intake task marker, as the task may have been enqueued")
 				return
 			}
-			// Write a marker to cloud storage to ensure we don't schedule
-			// redundant tasks
-			if err := ownValidationBucket.WriteTaskMarker(intakeTask.Marker()); err != nil {
-				log.Printf("failed to write intake task marker: %s", err)
+			// The task wasn't enqueued, so roll back its pending marker
+			if err := taskMarkerBucket.DeletePendingMarker(intakeTask.Marker()); err != nil {
+				logger.Errorf("failed to delete pending intake task marker: %s", err)
+			}
+			// Tasks that failed because we are shutting down, or because the
+			// task queue seems to be down, are worth retrying on the next
+			// run, and don't count as failed attempts.
+			if ctx.Err() != nil {
 				return
 			}
+			retries.failed(intakeTask, intakeTask.AggregationID, previous, err, taskMarkerBucket, logger)
+			return
+		}
+		retries.forget(intakeTask.Marker(), previous, logger)
+		// The task was enqueued, so it counts as started even if its marker
+		// has yet to be promoted
+		intakesStarted.WithLabelValues(aggregationIDLabel(intakeTask.AggregationID)).Inc()
 
-			intakesStarted.Inc()
-		})
-	}
+		// Promote the pending marker to a task marker to ensure we don't
+		// schedule redundant tasks
+		if err := taskMarkerBucket.PromoteMarker(intakeTask); err != nil {
+			logger.Errorf("failed to promote intake task marker, will retry: %s", err)
+			failedMarkers.add(intakeTask)
+		}
+	})
+}
 
-	log.Printf("skipped %d batches as too old, %d with existing tasks. Scheduled %d new intake tasks.",
-		skippedDueToAge, skippedDueToMarker, scheduled)
+// enqueueMayHaveSucceeded returns whether a task whose enqueue with ctx failed
+// with err may nonetheless have been accepted by the task queue, which is the
+// case if the enqueue was canceled or timed out before the task queue
+// answered
+func enqueueMayHaveSucceeded(ctx context.Context, err error) bool {
+	return ctx.Err() != nil ||
+		errors.Is(err, context.Canceled) ||
+		task.ClassifyEnqueueError(err) == task.EnqueueErrorTimeout
+}
 
-	return nil
+// pushRunMetrics records the duration of a run from started to finished and,
+// if the run succeeded, the time it finished, then pushes all metrics to the
+// push gateway, if one is configured. Metrics are added to those already in
+// the gateway rather than replacing them, so that the last success time pushed
+// by an earlier run survives runs that fail.
+func pushRunMetrics(gateway string, started, finished time.Time, succeeded bool) error {
+	runDuration.Observe(finished.Sub(started).Seconds())
+	if succeeded {
+		lastSuccess.Set(float64(finished.Unix()))
+	}
+	if gateway == "" {
+		return nil
+	}
+
+	pusher := push.New(gateway, "workflow-manager").Gatherer(prometheus.DefaultGatherer)
+	if succeeded {
+		pusher = pusher.Collector(lastSuccess)
+	}
+	return pusher.Add()
 }
@@ -1,13 +1,113 @@
+// Package monitor abstracts the metrics that workflow-manager records, so that
+// code recording metrics is the same whether or not metrics are exported. Each
+// kind of metric has an interface satisfied by the corresponding Prometheus
+// type, and a no-op implementation that is used when no push gateway is
+// configured. Like the Prometheus types, the no-op implementations are safe
+// for concurrent use.
 package monitor
 
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CounterMonitor counts events
 type CounterMonitor interface {
 	Inc()
 }
 
+// NoopCounter is a CounterMonitor whose counts go nowhere
 type NoopCounter struct {
+	mutex   sync.Mutex
 	counted int
 }
 
 func (c *NoopCounter) Inc() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.counted = c.counted + 1
 }
+
+// CounterVecMonitor is a family of CounterMonitors partitioned by label values
+type CounterVecMonitor interface {
+	// WithLabelValues returns the CounterMonitor for the provided label
+	// values, which must be provided in the same order as the labels were
+	// declared.
+	WithLabelValues(labelValues ...string) CounterMonitor
+}
+
+// NoopCounterVec is a CounterVecMonitor whose counters go nowhere. It is safe
+// for concurrent use.
+type NoopCounterVec struct {
+	mutex    sync.Mutex
+	counters map[string]*NoopCounter
+}
+
+func (v *NoopCounterVec) WithLabelValues(labelValues ...string) CounterMonitor {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.counters == nil {
+		v.counters = map[string]*NoopCounter{}
+	}
+	key := ""
+	for _, value := range labelValues {
+		key += value + "\x00"
+	}
+	counter, ok := v.counters[key]
+	if !ok {
+		counter = &NoopCounter{}
+		v.counters[key] = counter
+	}
+	return counter
+}
+
+// PrometheusCounterVec is a CounterVecMonitor backed by a Prometheus CounterVec
+type PrometheusCounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+// NewPrometheusCounterVec creates a CounterVec with the provided options and
+// labels and registers it with the default Prometheus registry.
+func NewPrometheusCounterVec(opts prometheus.CounterOpts, labels ...string) *PrometheusCounterVec {
+	return &PrometheusCounterVec{vec: promauto.NewCounterVec(opts, labels)}
+}
+
+func (v *PrometheusCounterVec) WithLabelValues(labelValues ...string) CounterMonitor {
+	return v.vec.WithLabelValues(labelValues...)
+}
+
+// HistogramMonitor observes values, such as durations, into buckets
+type HistogramMonitor interface {
+	Observe(value float64)
+}
+
+// NoopHistogram is a HistogramMonitor whose observations go nowhere
+type NoopHistogram struct {
+	mutex    sync.Mutex
+	observed int
+}
+
+func (h *NoopHistogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.observed = h.observed + 1
+}
+
+// GaugeMonitor tracks a value that can go up and down
+type GaugeMonitor interface {
+	Set(value float64)
+}
+
+// NoopGauge is a GaugeMonitor whose value goes nowhere
+type NoopGauge struct {
+	mutex sync.Mutex
+	value float64
+}
+
+func (g *NoopGauge) Set(value float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value = value
+}
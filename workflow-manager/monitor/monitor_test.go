@@ -12,3 +12,40 @@ func TestNoopCounterIncrement(t *testing.T) {
 		t.Error("Should have been counted twice")
 	}
 }
+
+func TestNoopCounterVecIncrement(t *testing.T) {
+	v := NoopCounterVec{}
+
+	v.WithLabelValues("kittens-seen").Inc()
+	v.WithLabelValues("kittens-seen").Inc()
+	v.WithLabelValues("dogs-seen").Inc()
+
+	if counted := v.WithLabelValues("kittens-seen").(*NoopCounter).counted; counted != 2 {
+		t.Errorf("kittens-seen should have been counted twice, got %d", counted)
+	}
+	if counted := v.WithLabelValues("dogs-seen").(*NoopCounter).counted; counted != 1 {
+		t.Errorf("dogs-seen should have been counted once, got %d", counted)
+	}
+}
+
+func TestNoopHistogramObserve(t *testing.T) {
+	h := NoopHistogram{}
+
+	h.Observe(1)
+	h.Observe(3600)
+
+	if h.observed != 2 {
+		t.Errorf("should have observed twice, got %d", h.observed)
+	}
+}
+
+func TestNoopGaugeSet(t *testing.T) {
+	g := NoopGauge{}
+
+	g.Set(1)
+	g.Set(1604188800)
+
+	if g.value != 1604188800 {
+		t.Errorf("should have the last value set, got %f", g.value)
+	}
+}
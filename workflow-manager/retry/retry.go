@@ -2,8 +2,9 @@ package retry
 
 import (
 	"fmt"
-	"log"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Retry defines a behavior for Retryable functions
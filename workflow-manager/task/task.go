@@ -5,42 +5,339 @@
 package task
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	leaws "github.com/letsencrypt/prio-server/workflow-manager/aws"
 	"github.com/letsencrypt/prio-server/workflow-manager/utils"
 
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
 	"cloud.google.com/go/pubsub"
+	"github.com/Shopify/sarama"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Timestamp is an alias to time.Time with a custom JSON marshaler that
-// marshals the time to UTC, with minute precision, in the format
-// "2006/01/02/15/04"
+// marshals the time to UTC in the format set by SetTimestampFormat, by default
+// with minute precision, as in "2006/01/02/15/04"
 type Timestamp time.Time
 
+// DefaultTimestampFormat is the default format of timestamps in task JSON and
+// batch paths, which facilitator/lib.rs expects
+const DefaultTimestampFormat = "2006/01/02/15/04"
+
+// timestampPrecisions maps the supported formats of timestamps in task JSON and
+// batch paths to their precision
+var timestampPrecisions = map[string]time.Duration{
+	DefaultTimestampFormat: time.Minute,
+	"2006/01/02/15":        time.Hour,
+}
+
+var (
+	// timestampFormat is the format of timestamps in task JSON and batch paths
+	timestampFormat = DefaultTimestampFormat
+	// markerTimestampFormat is the format of timestamps in task markers
+	markerTimestampFormat = markerFormat(DefaultTimestampFormat)
+	// markerTimestampRegexp matches timestamps in the format produced by
+	// Timestamp.MarkerString
+	markerTimestampRegexp = markerRegexp(markerTimestampFormat)
+)
+
+// markerFormat returns the format of timestamps in task markers corresponding
+// to the format of timestamps in task JSON and batch paths. Task markers must
+// not contain "/", so it is replaced with "-".
+func markerFormat(format string) string {
+	return strings.ReplaceAll(format, "/", "-")
+}
+
+// markerRegexp returns a regular expression matching timestamps in the
+// provided marker format, in which each digit of the reference time stands
+// for any digit
+func markerRegexp(format string) *regexp.Regexp {
+	var expression strings.Builder
+	for _, r := range format {
+		if r >= '0' && r <= '9' {
+			expression.WriteString(`\d`)
+		} else {
+			expression.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return regexp.MustCompile(expression.String())
+}
+
+// CheckTimestampFormat returns the precision of the provided format of
+// timestamps in task JSON and batch paths, or an error if the format isn't
+// supported. A format is only supported if timestamps in it, and in the
+// corresponding task marker format, both identify the same time, so that
+// tasks are deduplicated by their markers as they would be by their
+// timestamps.
+func CheckTimestampFormat(format string) (time.Duration, error) {
+	precision, ok := timestampPrecisions[format]
+	if !ok {
+		var supported []string
+		for supportedFormat := range timestampPrecisions {
+			supported = append(supported, fmt.Sprintf("%q", supportedFormat))
+		}
+		sort.Strings(supported)
+		return 0, fmt.Errorf("unsupported timestamp format %q, expected one of %s", format, strings.Join(supported, ", "))
+	}
+
+	reference := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Truncate(precision)
+	for _, layout := range []string{format, markerFormat(format)} {
+		parsed, err := time.Parse(layout, reference.Format(layout))
+		if err != nil || !parsed.Equal(reference) {
+			return 0, fmt.Errorf("timestamp format %q does not round trip", layout)
+		}
+	}
+	return precision, nil
+}
+
+// SetTimestampFormat sets the format of timestamps in task JSON and batch
+// paths, and the corresponding format of timestamps in task markers, which is
+// the same with "/" replaced with "-". It must be called before any tasks are
+// created or batch paths parsed, and is not safe for concurrent use. Changing
+// the format changes the markers of all tasks, so markers written in another
+// format don't prevent the same tasks from being scheduled again.
+func SetTimestampFormat(format string) error {
+	if _, err := CheckTimestampFormat(format); err != nil {
+		return err
+	}
+	timestampFormat = format
+	markerTimestampFormat = markerFormat(format)
+	markerTimestampRegexp = markerRegexp(markerTimestampFormat)
+	return nil
+}
+
+// TimestampFormat returns the format of timestamps in task JSON and batch paths
+func TimestampFormat() string {
+	return timestampFormat
+}
+
+// ParseTimestamp parses a timestamp in the format produced by String, as found
+// in task JSON and batch paths.
+func ParseTimestamp(s string) (Timestamp, error) {
+	parsed, err := time.Parse(timestampFormat, s)
+	if err != nil {
+		return Timestamp{}, fmt.Errorf("parsing timestamp %q: %w", s, err)
+	}
+	return Timestamp(parsed), nil
+}
+
+// ParseMarkerTimestamp parses a timestamp in the format produced by
+// MarkerString, as found in task markers.
+func ParseMarkerTimestamp(s string) (Timestamp, error) {
+	parsed, err := time.Parse(markerTimestampFormat, s)
+	if err != nil {
+		return Timestamp{}, fmt.Errorf("parsing marker timestamp %q: %w", s, err)
+	}
+	return Timestamp(parsed), nil
+}
+
 func (t Timestamp) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.String())
 }
 
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var asString string
+	if err := json.Unmarshal(data, &asString); err != nil {
+		return err
+	}
+	parsed, err := ParseTimestamp(asString)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
 func (t *Timestamp) stringWithFormat(format string) string {
 	asTime := (*time.Time)(t)
 	return asTime.Format(format)
 }
 
 func (t *Timestamp) String() string {
-	return t.stringWithFormat("2006/01/02/15/04")
+	return t.stringWithFormat(timestampFormat)
 }
 
 // Returns the representation of the timestamp as it should be incorporated into
 // a task marker
 func (t *Timestamp) MarkerString() string {
-	return t.stringWithFormat("2006-01-02-15-04")
+	return t.stringWithFormat(markerTimestampFormat)
+}
+
+// ParseMarkerTime returns the time embedded in a task marker. That is the batch
+// time for intake tasks and the end of the aggregation interval for
+// aggregation tasks. Returns an error if marker is not the marker for an intake
+// or aggregation task or contains no timestamp.
+func ParseMarkerTime(marker string) (time.Time, error) {
+	if !strings.HasPrefix(marker, "intake-") && !strings.HasPrefix(marker, "aggregate-") {
+		return time.Time{}, fmt.Errorf("unknown kind of task marker %q", marker)
+	}
+
+	// Aggregation IDs could conceivably contain something that looks like a
+	// timestamp, but batch IDs (typically UUIDs) can't, so the last timestamp
+	// in the marker is always the one we want.
+	timestamps := markerTimestampRegexp.FindAllString(marker, -1)
+	if len(timestamps) == 0 {
+		return time.Time{}, fmt.Errorf("no timestamp in task marker %q", marker)
+	}
+
+	parsed, err := ParseMarkerTimestamp(timestamps[len(timestamps)-1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("task marker %q: %w", marker, err)
+	}
+
+	return time.Time(parsed), nil
+}
+
+// TaskSchemaVersion is the version of the JSON encoding of tasks emitted by
+// this version of workflow-manager, which facilitators use to decide how to
+// parse tasks. Version 0 is the original schema, which has no version field;
+// tasks with Version 0 are encoded without one so that facilitators predating
+// versioning can still parse them. Version 2 adds batches objects to
+// aggregation tasks.
+const TaskSchemaVersion = 2
+
+// BatchesObjectSchemaVersion is the first schema version in which aggregation
+// tasks may refer to a batches object instead of listing their batches
+const BatchesObjectSchemaVersion = 2
+
+// FieldNaming is the style of the keys in the JSON encoding of a task
+type FieldNaming string
+
+const (
+	// KebabCase keys, like "aggregation-id", are what the facilitator expects
+	// and are the default
+	KebabCase FieldNaming = "kebab-case"
+	// SnakeCase keys, like "aggregation_id", are for facilitators that expect
+	// them instead
+	SnakeCase FieldNaming = "snake-case"
+)
+
+// ParseFieldNaming returns the FieldNaming named by s, or an error if there is
+// none.
+func ParseFieldNaming(s string) (FieldNaming, error) {
+	switch naming := FieldNaming(s); naming {
+	case KebabCase, SnakeCase:
+		return naming, nil
+	default:
+		return "", fmt.Errorf("unknown field naming %q, must be %q or %q", s, KebabCase, SnakeCase)
+	}
+}
+
+// marshalWithNaming returns the JSON encoding of v with its object keys
+// rewritten in the provided style. Keys are always kebab-case to begin with,
+// so only SnakeCase requires rewriting.
+func marshalWithNaming(v interface{}, naming FieldNaming) ([]byte, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil || naming != SnakeCase {
+		return encoded, err
+	}
+	return rewriteKeys(encoded, "-", "_")
+}
+
+// rewriteKeys returns the JSON document encoded with old replaced by new in
+// the keys of every object within it
+func rewriteKeys(encoded []byte, old, new string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(replaceInKeys(decoded, old, new))
+}
+
+// replaceInKeys returns v with old replaced by new in the keys of every object
+// within it
+func replaceInKeys(v interface{}, old, new string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		rewritten := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			rewritten[strings.ReplaceAll(key, old, new)] = replaceInKeys(value, old, new)
+		}
+		return rewritten
+	case []interface{}:
+		for i, value := range v {
+			v[i] = replaceInKeys(value, old, new)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// Decode returns the task of the provided type, "intake", "aggregate" or
+// "selftest", whose JSON encoding is encoded and whose attributes are
+// attributes. It reverses marshaling a task and getting its attributes, so
+// that a task recorded that way can be enqueued again. Either FieldNaming is
+// accepted.
+func Decode(taskType string, encoded []byte, attributes map[string]string) (Task, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &keys); err != nil {
+		return nil, fmt.Errorf("decoding %s task: %w", taskType, err)
+	}
+	// Every task has an aggregation ID, so its key tells the naming apart
+	naming := KebabCase
+	if _, ok := keys["aggregation_id"]; ok {
+		naming = SnakeCase
+		var err error
+		if encoded, err = rewriteKeys(encoded, "_", "-"); err != nil {
+			return nil, fmt.Errorf("decoding %s task: %w", taskType, err)
+		}
+	}
+	isFirst := attributes["is_first"] == "true"
+
+	switch taskType {
+	case "intake":
+		var intakeBatch IntakeBatch
+		if err := json.Unmarshal(encoded, &intakeBatch); err != nil {
+			return nil, fmt.Errorf("decoding intake task: %w", err)
+		}
+		intakeBatch.IsFirst = isFirst
+		intakeBatch.FieldNaming = naming
+		return intakeBatch, nil
+	case "aggregate":
+		var aggregation Aggregation
+		if err := json.Unmarshal(encoded, &aggregation); err != nil {
+			return nil, fmt.Errorf("decoding aggregation task: %w", err)
+		}
+		aggregation.IsFirst = isFirst
+		aggregation.FieldNaming = naming
+		return aggregation, nil
+	case "selftest":
+		var selfTest SelfTest
+		if err := json.Unmarshal(encoded, &selfTest); err != nil {
+			return nil, fmt.Errorf("decoding selftest task: %w", err)
+		}
+		return selfTest, nil
+	default:
+		return nil, fmt.Errorf("unknown task type %q", taskType)
+	}
 }
 
 // Task is a task that can be enqueued into an Enqueuer
@@ -48,6 +345,10 @@ type Task interface {
 	// Marker returns the name that should be used when writing out a marker for
 	// this task
 	Marker() string
+	// Attributes returns metadata about the task that task queues which
+	// support it attach to the message alongside the task's JSON encoding, so
+	// that consumers can filter or route messages without decoding them
+	Attributes() map[string]string
 }
 
 // Aggregation represents an aggregation task
@@ -62,6 +363,36 @@ type Aggregation struct {
 	// Batches is the list of batch ID date pairs of the batches aggregated by
 	// this task
 	Batches []Batch `json:"batches"`
+	// BatchesObject is the key, in the own validation bucket, of an object
+	// holding the JSON encoding of the aggregation's batches, if they were too
+	// many to fit into the task queue's messages. Batches is then empty and
+	// left out of the task's JSON encoding, so that facilitators that don't
+	// know about batches objects fail to parse the task rather than aggregate
+	// no batches.
+	BatchesObject string `json:"batches-object,omitempty"`
+	// Version is the schema version of the task's JSON encoding. See
+	// TaskSchemaVersion.
+	Version int `json:"version,omitempty"`
+	// IsFirst is whether the task is for the "first" set of servers, aka PHA
+	// servers. It is only conveyed in the task's attributes.
+	IsFirst bool `json:"-"`
+	// FieldNaming is the style of the keys in the task's JSON encoding. If
+	// empty, KebabCase is used.
+	FieldNaming FieldNaming `json:"-"`
+}
+
+func (a Aggregation) MarshalJSON() ([]byte, error) {
+	// aggregation has the same fields as Aggregation but not this method, so
+	// that marshaling it doesn't recurse
+	type aggregation Aggregation
+	if a.BatchesObject != "" {
+		// The shallower Batches hides the embedded one
+		return marshalWithNaming(struct {
+			aggregation
+			Batches []Batch `json:"batches,omitempty"`
+		}{aggregation: aggregation(a)}, a.FieldNaming)
+	}
+	return marshalWithNaming(aggregation(a), a.FieldNaming)
 }
 
 func (a Aggregation) Marker() string {
@@ -73,6 +404,14 @@ func (a Aggregation) Marker() string {
 	)
 }
 
+func (a Aggregation) Attributes() map[string]string {
+	return map[string]string{
+		"task_type":      "aggregate",
+		"aggregation_id": a.AggregationID,
+		"is_first":       strconv.FormatBool(a.IsFirst),
+	}
+}
+
 // Batch represents a batch included in an aggregation task
 type Batch struct {
 	// ID is the batch ID. Typically a UUID.
@@ -88,30 +427,556 @@ type IntakeBatch struct {
 	BatchID string `json:"batch-id"`
 	// Date is the timestamp on the batch
 	Date Timestamp `json:"date"`
+	// Version is the schema version of the task's JSON encoding. See
+	// TaskSchemaVersion.
+	Version int `json:"version,omitempty"`
+	// IsFirst is whether the task is for the "first" set of servers, aka PHA
+	// servers. It is only conveyed in the task's attributes.
+	IsFirst bool `json:"-"`
+	// FieldNaming is the style of the keys in the task's JSON encoding. If
+	// empty, KebabCase is used.
+	FieldNaming FieldNaming `json:"-"`
+}
+
+func (i IntakeBatch) MarshalJSON() ([]byte, error) {
+	// intakeBatch has the same fields as IntakeBatch but not this method, so
+	// that marshaling it doesn't recurse
+	type intakeBatch IntakeBatch
+	return marshalWithNaming(intakeBatch(i), i.FieldNaming)
 }
 
 func (i IntakeBatch) Marker() string {
 	return fmt.Sprintf("intake-%s-%s-%s", i.AggregationID, i.Date.MarkerString(), i.BatchID)
 }
 
+func (i IntakeBatch) Attributes() map[string]string {
+	return map[string]string{
+		"task_type":      "intake",
+		"aggregation_id": i.AggregationID,
+		"is_first":       strconv.FormatBool(i.IsFirst),
+	}
+}
+
+// SelfTest is a sentinel task that `workflow-manager selftest` uses to check
+// that task markers can be written and read back, and that task queues accept
+// messages. It describes no work: it carries no aggregation or batch ID, and
+// its task_type attribute is "selftest", so consumers can recognize and drop
+// it.
+type SelfTest struct {
+	// ID identifies the selftest run that created the task
+	ID string `json:"selftest-id"`
+}
+
+func (s SelfTest) Marker() string {
+	return "selftest-" + s.ID
+}
+
+func (s SelfTest) Attributes() map[string]string {
+	return map[string]string{"task_type": "selftest"}
+}
+
+// Default maximum sizes, in bytes, of the JSON encoding of a task in a single
+// message to each task queue, as documented by the respective cloud providers.
+const (
+	DefaultGCPPubSubMaxMessageSize = 10000000
+	DefaultAWSSNSMaxMessageSize    = 256 * 1024
+	DefaultGCPCloudTasksMaxSize    = 1000000
+	DefaultKafkaMaxMessageSize     = 1000000
+)
+
 // Enqueuer allows enqueuing tasks.
 type Enqueuer interface {
 	// Enqueue enqueues a task to be executed later. The provided completion
 	// function will be invoked once the task is either successfully enqueued or
-	// some unretryable error has occurred. A call to Stop() will not return
-	// until completion functions passed to any and all calls to Enqueue() have
-	// returned.
-	Enqueue(task Task, completion func(error))
+	// some unretryable error has occurred, including ctx being canceled or
+	// exceeding its deadline. A call to Stop() will not return until completion
+	// functions passed to any and all calls to Enqueue() have returned.
+	Enqueue(ctx context.Context, task Task, completion func(error))
 	// Stop blocks until all tasks passed to Enqueue() have been enqueued in the
 	// underlying system, and all completion functions pased to Enqueue() have
 	// returned, and so it is safe to exit the program without losing any tasks.
 	Stop()
+	// Ping checks that the underlying queue exists and is reachable with the
+	// enqueuer's credentials, without enqueuing anything.
+	Ping(ctx context.Context) error
+}
+
+// EnqueuerConfig configures the Enqueuer constructed by NewEnqueuer. Only the
+// fields used by the requested kind of task queue need be set.
+type EnqueuerConfig struct {
+	// Topic is the topic, queue or stream to which tasks are enqueued. It is
+	// required by every kind but "memory".
+	Topic  string
+	DryRun bool
+
+	// GCPProjectID is the project containing the PubSub topic or Cloud Tasks
+	// queue. It is required by "gcp-pubsub" and "gcp-cloudtasks".
+	GCPProjectID             string
+	GCPPubSubPublishSettings pubsub.PublishSettings
+	GCPPubSubOrdering        bool
+	GCPPubSubMaxMessageSize  int
+
+	// GCPCloudTasksLocation and GCPCloudTasksTargetURL are required by
+	// "gcp-cloudtasks".
+	GCPCloudTasksLocation       string
+	GCPCloudTasksTargetURL      string
+	GCPCloudTasksServiceAccount string
+	GCPCloudTasksDelay          time.Duration
+	GCPCloudTasksMaxTaskSize    int
+
+	// AWSSNSRegion is the region of the "aws-sns" topic. If empty, the AWS
+	// SDK's default region resolution applies.
+	AWSSNSRegion         string
+	AWSSNSIdentity       string
+	AWSSNSMaxMessageSize int
+
+	// KafkaBrokers is required by "kafka".
+	KafkaBrokers        []string
+	KafkaMaxMessageSize int
+
+	// RedisAddr is required by "redis".
+	RedisAddr string
+	Redis     RedisStreamsConfig
+
+	// BatchesWriter, if not nil, writes the batches of aggregation tasks whose
+	// JSON encoding exceeds the task queue's maximum size, so that they are
+	// enqueued with a BatchesObject instead of failing.
+	BatchesWriter BatchesWriter
+}
+
+// BatchesWriter writes the JSON encoding of an aggregation's batches to an
+// object the facilitator can read, and returns the object's key
+type BatchesWriter interface {
+	WriteAggregationBatches(marker string, batches []byte) (string, error)
+}
+
+// ConfigError is returned by ValidateEnqueuerConfig for a config that the kind
+// of task queue can't use, so that callers can report the problem in terms of
+// wherever the fields were set from.
+type ConfigError struct {
+	Kind string
+	// Fields are the names of the EnqueuerConfig fields at fault, e.g.
+	// "GCPProjectID" or "Redis.MaxLen"
+	Fields []string
+	// Problem describes what is wrong with the fields, or is empty if they
+	// are required but unset.
+	Problem string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Problem == "" {
+		return fmt.Sprintf("%s required for task queue kind %s", strings.Join(e.Fields, ", "), e.Kind)
+	}
+	return fmt.Sprintf("%s %s", strings.Join(e.Fields, ", "), e.Problem)
+}
+
+// ValidateEnqueuerConfig checks that config has the fields that the kind of
+// task queue requires, without contacting the task queue. Problems with the
+// fields are reported with a *ConfigError.
+func ValidateEnqueuerConfig(kind string, config EnqueuerConfig) error {
+	var missing []string
+	switch kind {
+	case "gcp-pubsub":
+		if config.GCPProjectID == "" {
+			missing = append(missing, "GCPProjectID")
+		}
+	case "gcp-cloudtasks":
+		if config.GCPProjectID == "" {
+			missing = append(missing, "GCPProjectID")
+		}
+		if config.GCPCloudTasksLocation == "" {
+			missing = append(missing, "GCPCloudTasksLocation")
+		}
+		if config.GCPCloudTasksTargetURL == "" {
+			missing = append(missing, "GCPCloudTasksTargetURL")
+		}
+		if config.GCPCloudTasksDelay < 0 {
+			return &ConfigError{Kind: kind, Fields: []string{"GCPCloudTasksDelay"}, Problem: "must not be negative"}
+		}
+	case "aws-sns":
+	case "kafka":
+		if len(config.KafkaBrokers) == 0 {
+			missing = append(missing, "KafkaBrokers")
+		}
+		for _, broker := range config.KafkaBrokers {
+			if broker == "" {
+				return &ConfigError{Kind: kind, Fields: []string{"KafkaBrokers"}, Problem: "must not contain empty addresses"}
+			}
+		}
+	case "redis":
+		if config.RedisAddr == "" {
+			missing = append(missing, "RedisAddr")
+		}
+		if config.Redis.MaxLen < 0 {
+			return &ConfigError{Kind: kind, Fields: []string{"Redis.MaxLen"}, Problem: "must not be negative"}
+		}
+	case "memory":
+		return nil
+	default:
+		return fmt.Errorf("unknown task queue kind %q", kind)
+	}
+
+	if config.Topic == "" {
+		missing = append([]string{"Topic"}, missing...)
+	}
+	if len(missing) > 0 {
+		return &ConfigError{Kind: kind, Fields: missing}
+	}
+	return nil
+}
+
+// NewEnqueuer validates config with ValidateEnqueuerConfig, then constructs an
+// Enqueuer for the kind of task queue, which is one of "gcp-pubsub",
+// "gcp-cloudtasks", "aws-sns", "kafka", "redis" or "memory". To implement a new
+// kind of task queue, add its fields to EnqueuerConfig, check them in
+// ValidateEnqueuerConfig and construct it here.
+func NewEnqueuer(kind string, config EnqueuerConfig) (Enqueuer, error) {
+	if err := ValidateEnqueuerConfig(kind, config); err != nil {
+		return nil, err
+	}
+
+	var enqueuer Enqueuer
+	var err error
+	switch kind {
+	case "gcp-pubsub":
+		enqueuer, err = NewGCPPubSubEnqueuer(
+			config.GCPProjectID,
+			config.Topic,
+			config.GCPPubSubPublishSettings,
+			config.GCPPubSubOrdering,
+			config.GCPPubSubMaxMessageSize,
+			config.DryRun,
+		)
+	case "gcp-cloudtasks":
+		enqueuer, err = NewGCPCloudTasksEnqueuer(
+			config.GCPProjectID,
+			config.GCPCloudTasksLocation,
+			config.Topic,
+			config.GCPCloudTasksTargetURL,
+			config.GCPCloudTasksServiceAccount,
+			config.GCPCloudTasksDelay,
+			config.GCPCloudTasksMaxTaskSize,
+			config.DryRun,
+		)
+	case "aws-sns":
+		enqueuer, err = NewAWSSNSEnqueuer(
+			config.AWSSNSRegion,
+			config.AWSSNSIdentity,
+			config.Topic,
+			config.AWSSNSMaxMessageSize,
+			config.DryRun,
+		)
+	case "kafka":
+		enqueuer, err = NewKafkaEnqueuer(config.KafkaBrokers, config.Topic, config.KafkaMaxMessageSize, config.DryRun)
+	case "redis":
+		enqueuer = NewRedisStreamsEnqueuer(config.RedisAddr, config.Topic, config.Redis, config.DryRun)
+	default:
+		// Tasks are only logged, which is useful for local development
+		enqueuer = NewMemoryEnqueuer()
+	}
+	if err != nil {
+		// Don't return a typed nil pointer, which wouldn't compare equal to nil
+		return nil, err
+	}
+	if config.BatchesWriter != nil {
+		enqueuer = &batchesObjectEnqueuer{
+			Enqueuer: enqueuer,
+			maxSize:  maxTaskSize(kind, config),
+			writer:   config.BatchesWriter,
+		}
+	}
+	return enqueuer, nil
+}
+
+// maxTaskSize returns the maximum size in bytes of the JSON encoding of a task
+// enqueued to the kind of task queue, or 0 if it is not limited
+func maxTaskSize(kind string, config EnqueuerConfig) int {
+	switch kind {
+	case "gcp-pubsub":
+		return config.GCPPubSubMaxMessageSize
+	case "gcp-cloudtasks":
+		return config.GCPCloudTasksMaxTaskSize
+	case "aws-sns":
+		return config.AWSSNSMaxMessageSize
+	case "kafka":
+		return config.KafkaMaxMessageSize
+	default:
+		return 0
+	}
+}
+
+// batchesObjectEnqueuer is an Enqueuer that moves the batches of aggregation
+// tasks too large for the wrapped Enqueuer into objects written by writer, so
+// that each aggregation is still enqueued as a single task
+type batchesObjectEnqueuer struct {
+	Enqueuer
+	maxSize int
+	writer  BatchesWriter
+}
+
+func (e *batchesObjectEnqueuer) Enqueue(ctx context.Context, task Task, completion func(error)) {
+	if aggregation, ok := task.(Aggregation); ok {
+		var err error
+		if task, err = withBatchesObject(aggregation, e.maxSize, e.writer); err != nil {
+			completion(err)
+			return
+		}
+	}
+	e.Enqueuer.Enqueue(ctx, task, completion)
+}
+
+// withBatchesObject returns the aggregation unchanged if its JSON encoding fits
+// into maxSize bytes, or if maxSize is 0. Otherwise, it writes the batches with
+// writer and returns the aggregation with BatchesObject set instead, unless the
+// aggregation's schema version predates batches objects, in which case the
+// error wraps ErrTaskTooLarge.
+func withBatchesObject(aggregation Aggregation, maxSize int, writer BatchesWriter) (Aggregation, error) {
+	jsonTask, err := json.Marshal(aggregation)
+	if err != nil {
+		return Aggregation{}, fmt.Errorf("marshaling task to JSON: %w", err)
+	}
+	if maxSize == 0 || len(jsonTask) <= maxSize {
+		return aggregation, nil
+	}
+	if aggregation.Version < BatchesObjectSchemaVersion {
+		return Aggregation{}, fmt.Errorf(
+			"%w, and its schema version %d predates batches objects (version %d)",
+			ErrTaskTooLarge, aggregation.Version, BatchesObjectSchemaVersion,
+		)
+	}
+
+	batches, err := json.Marshal(aggregation.Batches)
+	if err != nil {
+		return Aggregation{}, fmt.Errorf("marshaling batches to JSON: %w", err)
+	}
+	key, err := writer.WriteAggregationBatches(aggregation.Marker(), batches)
+	if err != nil {
+		return Aggregation{}, fmt.Errorf("writing batches of task %s: %w", aggregation.Marker(), err)
+	}
+
+	aggregation.Batches = []Batch{}
+	aggregation.BatchesObject = key
+	return aggregation, nil
+}
+
+// Classes of enqueue failures returned by ClassifyEnqueueError
+const (
+	EnqueueErrorMessageTooLarge = "message-too-large"
+	EnqueueErrorThrottled       = "throttled"
+	EnqueueErrorAuth            = "auth"
+	EnqueueErrorTimeout         = "timeout"
+	EnqueueErrorOther           = "other"
+)
+
+// ErrTaskTooLarge is wrapped by the errors returned by enqueuers for tasks
+// whose encoding exceeds the task queue's maximum message size
+var ErrTaskTooLarge = errors.New("task too large for task queue")
+
+// awsThrottlingCodes and awsAuthCodes are the AWS error codes that
+// ClassifyEnqueueError counts as throttling and authentication or
+// authorization failures
+var (
+	awsThrottlingCodes = map[string]bool{
+		"Throttling":                             true,
+		"ThrottlingException":                    true,
+		"ThrottledException":                     true,
+		sns.ErrCodeThrottledException:            true,
+		sns.ErrCodeKMSThrottlingException:        true,
+		"TooManyRequestsException":               true,
+		"RequestLimitExceeded":                   true,
+		"RequestThrottled":                       true,
+		"ProvisionedThroughputExceededException": true,
+	}
+	awsAuthCodes = map[string]bool{
+		sns.ErrCodeAuthorizationErrorException: true,
+		"AccessDenied":                         true,
+		"AccessDeniedException":                true,
+		"InvalidClientTokenId":                 true,
+		"UnrecognizedClientException":          true,
+		"ExpiredToken":                         true,
+		"ExpiredTokenException":                true,
+		"SignatureDoesNotMatch":                true,
+		"IncompleteSignature":                  true,
+		"MissingAuthenticationToken":           true,
+		"NoCredentialProviders":                true,
+	}
+)
+
+// ClassifyEnqueueError buckets an error with which an enqueue failed into one
+// of the EnqueueError* classes, recognizing the errors of the AWS, GCP, Kafka
+// and Redis clients used by the enqueuers, even if wrapped
+func ClassifyEnqueueError(err error) string {
+	if errors.Is(err, ErrTaskTooLarge) || errors.Is(err, pubsub.ErrOversizedMessage) {
+		return EnqueueErrorMessageTooLarge
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return EnqueueErrorTimeout
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		if awsThrottlingCodes[awsErr.Code()] {
+			return EnqueueErrorThrottled
+		}
+		if awsAuthCodes[awsErr.Code()] {
+			return EnqueueErrorAuth
+		}
+		if awsErr.Code() == sns.ErrCodeInvalidParameterException && strings.Contains(awsErr.Message(), "too long") {
+			return EnqueueErrorMessageTooLarge
+		}
+		var requestFailure awserr.RequestFailure
+		if errors.As(err, &requestFailure) {
+			switch requestFailure.StatusCode() {
+			case 413:
+				return EnqueueErrorMessageTooLarge
+			case 429:
+				return EnqueueErrorThrottled
+			case 401, 403:
+				return EnqueueErrorAuth
+			}
+		}
+		return EnqueueErrorOther
+	}
+
+	// The gRPC status package in use doesn't unwrap errors, so look for the
+	// status ourselves
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		grpcStatus := grpcErr.GRPCStatus()
+		switch grpcStatus.Code() {
+		case codes.ResourceExhausted:
+			return EnqueueErrorThrottled
+		case codes.PermissionDenied, codes.Unauthenticated:
+			return EnqueueErrorAuth
+		case codes.DeadlineExceeded:
+			return EnqueueErrorTimeout
+		case codes.InvalidArgument:
+			message := strings.ToLower(grpcStatus.Message())
+			if strings.Contains(message, "too large") || strings.Contains(message, "exceeds the limit") {
+				return EnqueueErrorMessageTooLarge
+			}
+		}
+		return EnqueueErrorOther
+	}
+
+	// SendMessages returns the errors of each message that failed, which all
+	// have the same cause in practice
+	var producerErrors sarama.ProducerErrors
+	if errors.As(err, &producerErrors) && len(producerErrors) > 0 {
+		err = producerErrors[0].Err
+	}
+	var kafkaErr sarama.KError
+	if errors.As(err, &kafkaErr) {
+		switch kafkaErr {
+		case sarama.ErrMessageSizeTooLarge, sarama.ErrInvalidMessageSize:
+			return EnqueueErrorMessageTooLarge
+		case sarama.ErrTopicAuthorizationFailed, sarama.ErrClusterAuthorizationFailed, sarama.ErrSASLAuthenticationFailed:
+			return EnqueueErrorAuth
+		case sarama.ErrRequestTimedOut:
+			return EnqueueErrorTimeout
+		}
+		return EnqueueErrorOther
+	}
+
+	// Redis only reports errors as strings, prefixed with the error kind
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		message := redisErr.Error()
+		if strings.HasPrefix(message, "NOAUTH") || strings.HasPrefix(message, "WRONGPASS") || strings.HasPrefix(message, "NOPERM") {
+			return EnqueueErrorAuth
+		}
+	}
+
+	return EnqueueErrorOther
+}
+
+// Valid names of the topics, or queues or streams, of each kind of task queue
+var (
+	// PubSub topic and subscription IDs also must not start with "goog"
+	pubSubTopicPattern     = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9\-_.~+%]{2,254}$`)
+	cloudTasksQueuePattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,100}$`)
+	// FIFO SNS topic names also end in ".fifo", which counts towards the
+	// length limit
+	snsTopicPattern   = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+	kafkaTopicPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,249}$`)
+)
+
+// PrefixTopic returns the topic of a task queue of the provided kind with
+// prefix prepended to its name, after checking that the result is a valid
+// name for that kind of task queue. The topics of "aws-sns" task queues are
+// ARNs, and the prefix is prepended to the topic name at their end. If prefix
+// is empty, topic is returned unchanged and unchecked.
+func PrefixTopic(kind, prefix, topic string) (string, error) {
+	if prefix == "" || kind == "memory" {
+		return topic, nil
+	}
+
+	var valid bool
+	prefixed := prefix + topic
+	switch kind {
+	case "gcp-pubsub":
+		valid = pubSubTopicPattern.MatchString(prefixed) && !strings.HasPrefix(prefixed, "goog")
+	case "gcp-cloudtasks":
+		valid = cloudTasksQueuePattern.MatchString(prefixed)
+	case "aws-sns":
+		topicARN, err := arn.Parse(topic)
+		if err != nil || topicARN.Service != "sns" {
+			return "", fmt.Errorf("%q is not an SNS topic ARN", topic)
+		}
+		topicARN.Resource = prefix + topicARN.Resource
+		prefixed = topicARN.String()
+		name := strings.TrimSuffix(topicARN.Resource, ".fifo")
+		valid = snsTopicPattern.MatchString(name) && len(topicARN.Resource) <= 256
+	case "kafka":
+		valid = kafkaTopicPattern.MatchString(prefixed)
+	case "redis":
+		valid = true
+	default:
+		return "", fmt.Errorf("unknown task queue kind %q", kind)
+	}
+	if !valid {
+		return "", fmt.Errorf("%q is not a valid topic name for task queue kind %s", prefixed, kind)
+	}
+	return prefixed, nil
+}
+
+// PubSubSubscriptionConfig configures the subscriptions created by
+// CreatePubSubTopic
+type PubSubSubscriptionConfig struct {
+	// AckDeadline is how long a facilitator has to acknowledge a message
+	// before PubSub redelivers it
+	AckDeadline time.Duration
+	// RetentionDuration is how long PubSub retains unacknowledged messages. If
+	// zero, PubSub's default of 7 days is used.
+	RetentionDuration time.Duration
+	// DeadLetterTopicID is the ID of a topic in the same project to which
+	// PubSub forwards messages that could not be delivered after
+	// MaxDeliveryAttempts. If empty, messages are never dead-lettered.
+	DeadLetterTopicID string
+	// MaxDeliveryAttempts is the number of delivery attempts after which a
+	// message is dead-lettered. If zero, PubSub's default of 5 is used.
+	MaxDeliveryAttempts int
+	// EnableMessageOrdering makes PubSub deliver messages with the same
+	// ordering key in the order they were published. It can't be changed on
+	// an existing subscription.
+	EnableMessageOrdering bool
+}
+
+// DefaultPubSubSubscriptionConfig is the subscription configuration used
+// unless otherwise specified
+var DefaultPubSubSubscriptionConfig = PubSubSubscriptionConfig{
+	AckDeadline: 10 * time.Minute,
 }
 
 // CreatePubSubTopic creates a PubSub topic with the provided ID, as well as a
-// subscription with the same ID that can later be used by a facilitator.
+// subscription with the same ID and the provided configuration that can later
+// be used by a facilitator. If the configuration has a dead letter topic, it is
+// created along with a subscription of the same ID from which dead-lettered
+// messages can be inspected. Topics and subscriptions that already exist are
+// not an error, so it is safe to call CreatePubSubTopic repeatedly, and the
+// settings of existing subscriptions are updated to match the configuration.
 // Returns error on failure.
-func CreatePubSubTopic(project string, topicID string) error {
+func CreatePubSubTopic(project string, topicID string, subscriptionConfig PubSubSubscriptionConfig) error {
 	ctx, cancel := utils.ContextWithTimeout()
 	defer cancel()
 
@@ -119,38 +984,155 @@ func CreatePubSubTopic(project string, topicID string) error {
 	if err != nil {
 		return fmt.Errorf("pubsub.newClient: %w", err)
 	}
+	defer client.Close()
+
+	return createPubSubTopic(ctx, client, topicID, subscriptionConfig)
+}
 
+func createPubSubTopic(
+	ctx context.Context,
+	client *pubsub.Client,
+	topicID string,
+	subscriptionConfig PubSubSubscriptionConfig,
+) error {
+	var deadLetterPolicy *pubsub.DeadLetterPolicy
+	if subscriptionConfig.DeadLetterTopicID != "" {
+		if err := createTopicAndSubscription(ctx, client, subscriptionConfig.DeadLetterTopicID, pubsub.SubscriptionConfig{
+			ExpirationPolicy: time.Duration(0), // never expire
+		}); err != nil {
+			return fmt.Errorf("creating dead letter topic: %w", err)
+		}
+
+		deadLetterPolicy = &pubsub.DeadLetterPolicy{
+			DeadLetterTopic:     client.Topic(subscriptionConfig.DeadLetterTopicID).String(),
+			MaxDeliveryAttempts: subscriptionConfig.MaxDeliveryAttempts,
+		}
+	}
+
+	return createTopicAndSubscription(ctx, client, topicID, pubsub.SubscriptionConfig{
+		AckDeadline:           subscriptionConfig.AckDeadline,
+		RetentionDuration:     subscriptionConfig.RetentionDuration,
+		ExpirationPolicy:      time.Duration(0), // never expire
+		DeadLetterPolicy:      deadLetterPolicy,
+		EnableMessageOrdering: subscriptionConfig.EnableMessageOrdering,
+	})
+}
+
+// createTopicAndSubscription creates a topic and a subscription to it, both
+// with the provided ID, unless they already exist, in which case the
+// subscription is reconciled with subscriptionConfig
+func createTopicAndSubscription(
+	ctx context.Context,
+	client *pubsub.Client,
+	topicID string,
+	subscriptionConfig pubsub.SubscriptionConfig,
+) error {
 	topic, err := client.CreateTopic(ctx, topicID)
-	if err != nil {
+	if status.Code(err) == codes.AlreadyExists {
+		log.Printf("PubSub topic %s already exists", topicID)
+		topic = client.Topic(topicID)
+	} else if err != nil {
 		return fmt.Errorf("pubsub.CreateTopic: %w", err)
 	}
 
-	tenMinutes, _ := time.ParseDuration("10m")
+	subscriptionConfig.Topic = topic
+	_, err = client.CreateSubscription(ctx, topicID, subscriptionConfig)
+	if status.Code(err) == codes.AlreadyExists {
+		log.Printf("PubSub subscription %s already exists", topicID)
+		return reconcileSubscription(ctx, client.Subscription(topicID), subscriptionConfig)
+	} else if err != nil {
+		return fmt.Errorf("pubsub.CreateSubscription: %w", err)
+	}
 
-	subscriptionConfig := pubsub.SubscriptionConfig{
-		Topic:            topic,
-		AckDeadline:      tenMinutes,
-		ExpirationPolicy: time.Duration(0), // never expire
+	return nil
+}
+
+// reconcileSubscription updates the settings of an existing subscription that
+// differ from those in desired. Settings that are zero in desired are left
+// alone, as are the expiration policy and message ordering.
+func reconcileSubscription(ctx context.Context, subscription *pubsub.Subscription, desired pubsub.SubscriptionConfig) error {
+	existing, err := subscription.Config(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub.Config: %w", err)
 	}
-	if _, err := client.CreateSubscription(ctx, topicID, subscriptionConfig); err != nil {
-		return fmt.Errorf("pubsub.CreateSubscription: %w", err)
+	if existing.Topic.String() != desired.Topic.String() {
+		return fmt.Errorf("PubSub subscription %s is for topic %s, not %s", subscription, existing.Topic, desired.Topic)
+	}
+	if existing.EnableMessageOrdering != desired.EnableMessageOrdering {
+		log.Warnf("message ordering of PubSub subscription %s is %t and can only be changed by recreating the subscription",
+			subscription, existing.EnableMessageOrdering)
 	}
 
+	var update pubsub.SubscriptionConfigToUpdate
+	updated := false
+	if desired.AckDeadline != 0 && existing.AckDeadline != desired.AckDeadline {
+		log.Printf("changing ack deadline of PubSub subscription %s from %s to %s",
+			subscription, existing.AckDeadline, desired.AckDeadline)
+		update.AckDeadline = desired.AckDeadline
+		updated = true
+	}
+	if desired.RetentionDuration != 0 && existing.RetentionDuration != desired.RetentionDuration {
+		log.Printf("changing retention duration of PubSub subscription %s from %s to %s",
+			subscription, existing.RetentionDuration, desired.RetentionDuration)
+		update.RetentionDuration = desired.RetentionDuration
+		updated = true
+	}
+	if deadLetterPolicyDrifted(existing.DeadLetterPolicy, desired.DeadLetterPolicy) {
+		log.Printf("changing dead letter policy of PubSub subscription %s from %+v to %+v",
+			subscription, existing.DeadLetterPolicy, desired.DeadLetterPolicy)
+		// The zero value removes dead lettering
+		update.DeadLetterPolicy = &pubsub.DeadLetterPolicy{}
+		if desired.DeadLetterPolicy != nil {
+			update.DeadLetterPolicy = desired.DeadLetterPolicy
+		}
+		updated = true
+	}
+	if !updated {
+		return nil
+	}
+
+	if _, err := subscription.Update(ctx, update); err != nil {
+		return fmt.Errorf("pubsub.Update: %w", err)
+	}
 	return nil
 }
 
-// GCPPubSubEnqueuer implements Enqueuer using GCP PubSub
+// deadLetterPolicyDrifted returns true if the existing dead letter policy of a
+// subscription differs from the desired one. A desired maximum number of
+// delivery attempts of zero matches any number.
+func deadLetterPolicyDrifted(existing, desired *pubsub.DeadLetterPolicy) bool {
+	if existing == nil || desired == nil {
+		return (existing == nil) != (desired == nil)
+	}
+	return existing.DeadLetterTopic != desired.DeadLetterTopic ||
+		(desired.MaxDeliveryAttempts != 0 && existing.MaxDeliveryAttempts != desired.MaxDeliveryAttempts)
+}
+
+// GCPPubSubEnqueuer implements Enqueuer using GCP PubSub. If message ordering
+// is enabled on the topic, each message's ordering key is the task's
+// aggregation ID, so that subscriptions with ordering enabled deliver each
+// aggregation ID's tasks in the order they were enqueued.
 type GCPPubSubEnqueuer struct {
-	topic     *pubsub.Topic
-	waitGroup sync.WaitGroup
-	dryRun    bool
+	topic          *pubsub.Topic
+	maxMessageSize int
+	waitGroup      sync.WaitGroup
+	dryRun         bool
 }
 
 // NewGCPPubSubEnqueuer creates a task enqueuer for a given project and topic
-// in GCP PubSub. If dryRun is true, no tasks will actually be enqueued. Clients
-// should re-use a single instance as much as possible to enable batching of
-// publish requests.
-func NewGCPPubSubEnqueuer(project string, topicID string, dryRun bool) (*GCPPubSubEnqueuer, error) {
+// in GCP PubSub, which batches publish requests according to publishSettings.
+// If ordering is true, messages are published with ordering keys. Tasks whose
+// JSON encoding exceeds maxMessageSize bytes fail to enqueue. If dryRun is
+// true, no tasks will actually be enqueued. Clients should re-use a single
+// instance as much as possible to enable batching of publish requests.
+func NewGCPPubSubEnqueuer(
+	project string,
+	topicID string,
+	publishSettings pubsub.PublishSettings,
+	ordering bool,
+	maxMessageSize int,
+	dryRun bool,
+) (*GCPPubSubEnqueuer, error) {
 	ctx, cancel := utils.ContextWithTimeout()
 	defer cancel()
 
@@ -159,70 +1141,138 @@ func NewGCPPubSubEnqueuer(project string, topicID string, dryRun bool) (*GCPPubS
 		return nil, fmt.Errorf("pubsub.NewClient: %w", err)
 	}
 
+	topic := client.Topic(topicID)
+	topic.PublishSettings = publishSettings
+	topic.EnableMessageOrdering = ordering
+
+	return newGCPPubSubEnqueuerForTopic(topic, maxMessageSize, dryRun), nil
+}
+
+func newGCPPubSubEnqueuerForTopic(topic *pubsub.Topic, maxMessageSize int, dryRun bool) *GCPPubSubEnqueuer {
 	return &GCPPubSubEnqueuer{
-		topic:  client.Topic(topicID),
-		dryRun: dryRun,
-	}, nil
+		topic:          topic,
+		maxMessageSize: maxMessageSize,
+		dryRun:         dryRun,
+	}
 }
 
-func (e *GCPPubSubEnqueuer) Enqueue(task Task, completion func(error)) {
-	e.waitGroup.Add(1)
-	go func(task Task) {
-		defer e.waitGroup.Done()
-		jsonTask, err := json.Marshal(task)
-		if err != nil {
-			completion(fmt.Errorf("marshaling task to JSON: %w", err))
-			return
-		}
+func (e *GCPPubSubEnqueuer) Enqueue(ctx context.Context, task Task, completion func(error)) {
+	jsonTask, err := encodeTask(task, e.maxMessageSize)
+	if err != nil {
+		completion(err)
+		return
+	}
 
-		if e.dryRun {
-			log.Printf("dry run, not enqueuing task")
-			completion(nil)
-			return
-		}
+	if e.dryRun {
+		log.Printf("dry run, not enqueuing task")
+		completion(nil)
+		return
+	}
 
-		// Publish() returns immediately, giving us a handle to the result that we
-		// can block on to see if publishing succeeded. The PubSub client
-		// automatically retries for us, so we just keep the handle so the caller
-		// can do whatever they need to after successful publication and we can
-		// block in Stop() until all tasks have been enqueued
-		ctx, cancel := utils.ContextWithTimeout()
+	// Publish() returns immediately, giving us a handle to the result that we
+	// can block on to see if publishing succeeded. Publishing from this
+	// goroutine lets the PubSub client bundle messages from successive calls to
+	// Enqueue() into a single publish request. The PubSub client automatically
+	// retries for us, so we just keep the handle so the caller can do whatever
+	// they need to after successful publication and we can block in Stop()
+	// until all tasks have been enqueued.
+	ctx, cancel := utils.ContextWithTimeoutFrom(ctx)
+	var orderingKey string
+	if e.topic.EnableMessageOrdering {
+		orderingKey = aggregationID(task)
+	}
+	res := e.topic.Publish(ctx, &pubsub.Message{
+		Data:        jsonTask,
+		Attributes:  task.Attributes(),
+		OrderingKey: orderingKey,
+	})
+
+	e.waitGroup.Add(1)
+	go func() {
+		defer e.waitGroup.Done()
 		defer cancel()
-		res := e.topic.Publish(ctx, &pubsub.Message{Data: jsonTask})
 		if _, err := res.Get(ctx); err != nil {
-			completion(fmt.Errorf("Failed to publish task %+v: %w", task, err))
+			// After a failure to publish a message with an ordering key, the
+			// PubSub client refuses to publish any more messages with that key
+			// until told to resume. The failed task is handled by the caller,
+			// so carry on with the ones after it.
+			if orderingKey != "" {
+				e.topic.ResumePublish(orderingKey)
+			}
+			completion(fmt.Errorf("Failed to publish task %s: %w", task.Marker(), err))
+			return
 		}
 
 		completion(nil)
-	}(task)
+	}()
 }
 
 func (e *GCPPubSubEnqueuer) Stop() {
 	e.waitGroup.Wait()
+	e.topic.Stop()
 }
 
-// AWSSNSEnqueuer implements Enqueuer using AWS SNS
+func (e *GCPPubSubEnqueuer) Ping(ctx context.Context) error {
+	ctx, cancel := utils.ContextWithTimeoutFrom(ctx)
+	defer cancel()
+
+	exists, err := e.topic.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub.Exists: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("PubSub topic %s does not exist", e.topic)
+	}
+
+	return nil
+}
+
+// AWSSNSEnqueuer implements Enqueuer using AWS SNS. If the topic is a FIFO
+// topic, messages are deduplicated by task marker and grouped by aggregation
+// ID, so that duplicate publishes of a task within SNS' deduplication window
+// are collapsed.
 type AWSSNSEnqueuer struct {
-	service   *sns.SNS
-	topicARN  string
-	waitGroup sync.WaitGroup
-	dryRun    bool
+	service        snsiface.SNSAPI
+	topicARN       string
+	maxMessageSize int
+	waitGroup      sync.WaitGroup
+	dryRun         bool
+	// retryBaseDelay and retryMaxDelay bound the backoff between attempts
+	// to publish a message
+	retryBaseDelay, retryMaxDelay time.Duration
+	rndLock                       sync.Mutex
+	rnd                           *rand.Rand
 }
 
-func NewAWSSNSEnqueuer(region, identity, topicARN string, dryRun bool) (*AWSSNSEnqueuer, error) {
-	session, config, err := leaws.ClientConfig(region, identity)
+// Bounds of the backoff between attempts to publish a message to SNS
+const (
+	snsRetryBaseDelay = 100 * time.Millisecond
+	snsRetryMaxDelay  = 5 * time.Second
+)
+
+// NewAWSSNSEnqueuer creates a task enqueuer for the SNS topic with the
+// provided ARN. Tasks whose JSON encoding exceeds maxMessageSize bytes fail to
+// enqueue. If dryRun is true, no tasks will actually be enqueued.
+func NewAWSSNSEnqueuer(region, identity, topicARN string, maxMessageSize int, dryRun bool) (*AWSSNSEnqueuer, error) {
+	session, config, err := leaws.ClientConfig(region, identity, "")
 	if err != nil {
 		return nil, err
 	}
 
+	// Publishes are retried by Enqueue, with jitter and until the operation
+	// timeout, so the client's own retries would only multiply the attempts
 	return &AWSSNSEnqueuer{
-		service:  sns.New(session, config),
-		topicARN: topicARN,
-		dryRun:   dryRun,
+		service:        sns.New(session, config.WithMaxRetries(0)),
+		topicARN:       topicARN,
+		maxMessageSize: maxMessageSize,
+		dryRun:         dryRun,
+		retryBaseDelay: snsRetryBaseDelay,
+		retryMaxDelay:  snsRetryMaxDelay,
+		rnd:            rand.New(rand.NewSource(time.Now().UnixNano())),
 	}, nil
 }
 
-func (e *AWSSNSEnqueuer) Enqueue(task Task, completion func(error)) {
+func (e *AWSSNSEnqueuer) Enqueue(ctx context.Context, task Task, completion func(error)) {
 	// sns.Publish() blocks until the message has been saved by SNS, so no need
 	// to asynchronously handle completion. However we still want to maintain
 	// the guarantee that Stop() will block until all pending calls to Enqueue()
@@ -230,9 +1280,9 @@ func (e *AWSSNSEnqueuer) Enqueue(task Task, completion func(error)) {
 	e.waitGroup.Add(1)
 	defer e.waitGroup.Done()
 
-	jsonTask, err := json.Marshal(task)
+	jsonTask, err := encodeTask(task, e.maxMessageSize)
 	if err != nil {
-		completion(fmt.Errorf("marshaling task to JSON: %w", err))
+		completion(err)
 		return
 	}
 
@@ -241,19 +1291,576 @@ func (e *AWSSNSEnqueuer) Enqueue(task Task, completion func(error)) {
 		completion(nil)
 		return
 	}
-	// There's nothing in the PublishOutput we care about, so we discard it.
-	_, err = e.service.Publish(&sns.PublishInput{
+	ctx, cancel := utils.ContextWithTimeoutFrom(ctx)
+	defer cancel()
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(e.topicARN),
+		Message:           aws.String(string(jsonTask)),
+		MessageAttributes: snsMessageAttributes(task),
+	}
+	if strings.HasSuffix(e.topicARN, ".fifo") {
+		input.MessageDeduplicationId = aws.String(snsDeduplicationID(task))
+		input.MessageGroupId = aws.String(aggregationID(task))
+	}
+
+	if err := e.publish(ctx, input); err != nil {
+		completion(fmt.Errorf("failed to publish task %s: %w", task.Marker(), err))
+		return
+	}
+
+	completion(nil)
+}
+
+// publish publishes a message to the topic. Failures that may succeed on retry
+// are retried with exponential backoff and jitter until ctx is done, after
+// which the last error is returned.
+func (e *AWSSNSEnqueuer) publish(ctx context.Context, input *sns.PublishInput) error {
+	for attempt := 0; ; attempt++ {
+		// There's nothing in the PublishOutput we care about, so we discard it.
+		_, err := e.service.PublishWithContext(ctx, input)
+		if err == nil || !isRetryableSNSError(err) {
+			return err
+		}
+
+		delay := e.retryDelay(attempt)
+		log.Printf("retrying publish to SNS topic %s in %s: %s", e.topicARN, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDelay returns how long to wait after the provided number of earlier
+// failed retries before retrying again: a random duration up to the base delay
+// doubled for each retry, capped at the maximum delay
+func (e *AWSSNSEnqueuer) retryDelay(retries int) time.Duration {
+	ceiling := e.retryMaxDelay
+	if retries < 32 && e.retryBaseDelay<<uint(retries) < ceiling {
+		ceiling = e.retryBaseDelay << uint(retries)
+	}
+	e.rndLock.Lock()
+	defer e.rndLock.Unlock()
+	return time.Duration(e.rnd.Int63n(int64(ceiling) + 1))
+}
+
+// isRetryableSNSError returns whether a failed publish to SNS may succeed if
+// retried, because it was throttled, failed inside SNS or never reached it
+func isRetryableSNSError(err error) bool {
+	if ClassifyEnqueueError(err) == EnqueueErrorThrottled || request.IsErrorRetryable(err) {
+		return true
+	}
+	var requestFailure awserr.RequestFailure
+	return errors.As(err, &requestFailure) && requestFailure.StatusCode() >= 500
+}
+
+func (e *AWSSNSEnqueuer) Stop() {
+	e.waitGroup.Wait()
+}
+
+func (e *AWSSNSEnqueuer) Ping(ctx context.Context) error {
+	ctx, cancel := utils.ContextWithTimeoutFrom(ctx)
+	defer cancel()
+
+	if _, err := e.service.GetTopicAttributesWithContext(ctx, &sns.GetTopicAttributesInput{
 		TopicArn: aws.String(e.topicARN),
-		Message:  aws.String(string(jsonTask)),
-	})
+	}); err != nil {
+		return fmt.Errorf("sns.GetTopicAttributes for topic %s: %w", e.topicARN, err)
+	}
+
+	return nil
+}
+
+// GCPCloudTasksEnqueuer implements Enqueuer using Google Cloud Tasks. Tasks
+// are delivered as HTTP POST requests with the task JSON as the body, and
+// delivery of each task can be deferred until some delay after the time of
+// the batch or aggregation it concerns. The Cloud Tasks task name is derived
+// from the task marker, so Cloud Tasks rejects duplicate tasks for up to an
+// hour after the original was delivered.
+type GCPCloudTasksEnqueuer struct {
+	client              *cloudtasks.Client
+	queuePath           string
+	targetURL           string
+	serviceAccountEmail string
+	delay               time.Duration
+	maxTaskSize         int
+	waitGroup           sync.WaitGroup
+	dryRun              bool
+}
+
+// NewGCPCloudTasksEnqueuer creates a task enqueuer for the Cloud Tasks queue
+// with the provided project, location and queue ID. Tasks will be delivered to
+// targetURL, authenticated with an OIDC token for serviceAccountEmail, if it is
+// not empty. Delivery of each task is deferred until delay after the task's
+// timestamp, which is the batch time for intake tasks and the end of the
+// aggregation interval for aggregation tasks. Tasks whose JSON encoding exceeds
+// maxTaskSize bytes fail to enqueue. If dryRun is true, no tasks will actually
+// be enqueued.
+func NewGCPCloudTasksEnqueuer(
+	project, location, queueID, targetURL, serviceAccountEmail string,
+	delay time.Duration,
+	maxTaskSize int,
+	dryRun bool,
+) (*GCPCloudTasksEnqueuer, error) {
+	ctx, cancel := utils.ContextWithTimeout()
+	defer cancel()
+
+	client, err := cloudtasks.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cloudtasks.NewClient: %w", err)
+	}
+
+	return &GCPCloudTasksEnqueuer{
+		client:              client,
+		queuePath:           fmt.Sprintf("projects/%s/locations/%s/queues/%s", project, location, queueID),
+		targetURL:           targetURL,
+		serviceAccountEmail: serviceAccountEmail,
+		delay:               delay,
+		maxTaskSize:         maxTaskSize,
+		dryRun:              dryRun,
+	}, nil
+}
+
+func (e *GCPCloudTasksEnqueuer) Enqueue(ctx context.Context, task Task, completion func(error)) {
+	// CreateTask() blocks until the task has been saved by Cloud Tasks, so as
+	// with AWSSNSEnqueuer, we use the waitgroup only to maintain the guarantee
+	// that Stop() blocks until all pending calls to Enqueue() complete.
+	e.waitGroup.Add(1)
+	defer e.waitGroup.Done()
+
+	jsonTask, err := encodeTask(task, e.maxTaskSize)
 	if err != nil {
-		completion(fmt.Errorf("failed to publish task %+v: %w", task, err))
+		completion(err)
+		return
+	}
+
+	if scheduleTime := taskTime(task).Add(e.delay); scheduleTime.After(time.Now()) {
+		log.Printf("deferring delivery of task %s until %s", task.Marker(), scheduleTime)
+	}
+
+	if e.dryRun {
+		log.Printf("dry run, not enqueuing task")
+		completion(nil)
+		return
+	}
+
+	ctx, cancel := utils.ContextWithTimeoutFrom(ctx)
+	defer cancel()
+	if err := e.createTask(ctx, task, jsonTask); err != nil {
+		completion(err)
 		return
 	}
 
 	completion(nil)
 }
 
-func (e *AWSSNSEnqueuer) Stop() {
+// createTask creates the Cloud Tasks task for the task with the provided JSON
+// encoding
+func (e *GCPCloudTasksEnqueuer) createTask(ctx context.Context, task Task, jsonTask []byte) error {
+	httpRequest := &taskspb.HttpRequest{
+		HttpMethod: taskspb.HttpMethod_POST,
+		Url:        e.targetURL,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       jsonTask,
+	}
+	if e.serviceAccountEmail != "" {
+		httpRequest.AuthorizationHeader = &taskspb.HttpRequest_OidcToken{
+			OidcToken: &taskspb.OidcToken{ServiceAccountEmail: e.serviceAccountEmail},
+		}
+	}
+
+	marker := task.Marker()
+	request := &taskspb.CreateTaskRequest{
+		Parent: e.queuePath,
+		Task: &taskspb.Task{
+			// Cloud Tasks task names may only contain letters, numbers,
+			// hyphens and underscores, so we use a hash of the marker.
+			Name: fmt.Sprintf("%s/tasks/%x", e.queuePath, sha256.Sum256([]byte(marker))),
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: httpRequest,
+			},
+		},
+	}
+
+	if scheduleTime := taskTime(task).Add(e.delay); scheduleTime.After(time.Now()) {
+		request.Task.ScheduleTime = timestamppb.New(scheduleTime)
+	}
+
+	if _, err := e.client.CreateTask(ctx, request); err != nil {
+		// A task with this name was already created, so this one is a
+		// duplicate and needn't be delivered again.
+		if status.Code(err) == codes.AlreadyExists {
+			log.Printf("task %s already exists in Cloud Tasks queue", marker)
+			return nil
+		}
+		return fmt.Errorf("failed to create task %s: %w", marker, err)
+	}
+
+	return nil
+}
+
+func (e *GCPCloudTasksEnqueuer) Stop() {
 	e.waitGroup.Wait()
+	if err := e.client.Close(); err != nil {
+		log.Printf("failed to close Cloud Tasks client: %s", err)
+	}
+}
+
+func (e *GCPCloudTasksEnqueuer) Ping(ctx context.Context) error {
+	ctx, cancel := utils.ContextWithTimeoutFrom(ctx)
+	defer cancel()
+
+	if _, err := e.client.GetQueue(ctx, &taskspb.GetQueueRequest{Name: e.queuePath}); err != nil {
+		return fmt.Errorf("cloudtasks.GetQueue for queue %s: %w", e.queuePath, err)
+	}
+
+	return nil
+}
+
+// KafkaEnqueuer implements Enqueuer using Apache Kafka. Each task is produced
+// to the topic with its aggregation ID as the message key, so that all of an
+// aggregation's tasks land on the same partition, in the order they were
+// enqueued.
+type KafkaEnqueuer struct {
+	client         sarama.Client
+	producer       sarama.SyncProducer
+	topic          string
+	maxMessageSize int
+	waitGroup      sync.WaitGroup
+	dryRun         bool
+}
+
+// NewKafkaEnqueuer creates a task enqueuer for the Kafka topic, connecting to
+// the cluster through the provided brokers ("host:port"). Tasks whose JSON
+// encoding exceeds maxMessageSize bytes fail to enqueue. If dryRun is true, no
+// tasks will actually be enqueued.
+func NewKafkaEnqueuer(brokers []string, topic string, maxMessageSize int, dryRun bool) (*KafkaEnqueuer, error) {
+	config := sarama.NewConfig()
+	config.ClientID = "workflow-manager"
+	// Wait for all in-sync replicas to have the message before considering a
+	// task enqueued, and allow only one request in flight per broker so that
+	// retries can't reorder a partition's messages.
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	// sarama rejects a maximum of 0, which to us means no limit, so its
+	// default applies then
+	if maxMessageSize > 0 {
+		config.Producer.MaxMessageBytes = maxMessageSize
+	}
+	config.Net.MaxOpenRequests = 1
+
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, fmt.Errorf("sarama.NewClient: %w", err)
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("sarama.NewSyncProducerFromClient: %w", err)
+	}
+
+	return newKafkaEnqueuerForProducer(client, producer, topic, maxMessageSize, dryRun), nil
+}
+
+func newKafkaEnqueuerForProducer(
+	client sarama.Client,
+	producer sarama.SyncProducer,
+	topic string,
+	maxMessageSize int,
+	dryRun bool,
+) *KafkaEnqueuer {
+	return &KafkaEnqueuer{
+		client:         client,
+		producer:       producer,
+		topic:          topic,
+		maxMessageSize: maxMessageSize,
+		dryRun:         dryRun,
+	}
+}
+
+func (e *KafkaEnqueuer) Enqueue(ctx context.Context, task Task, completion func(error)) {
+	// SendMessages() blocks until every message has been acknowledged, so as
+	// with AWSSNSEnqueuer, we use the waitgroup only to maintain the guarantee
+	// that Stop() blocks until all pending calls to Enqueue() complete.
+	e.waitGroup.Add(1)
+	defer e.waitGroup.Done()
+
+	jsonTask, err := encodeTask(task, e.maxMessageSize)
+	if err != nil {
+		completion(err)
+		return
+	}
+
+	if e.dryRun {
+		log.Printf("dry run, not enqueuing task")
+		completion(nil)
+		return
+	}
+
+	if err := ctx.Err(); err != nil {
+		completion(fmt.Errorf("failed to produce task %s: %w", task.Marker(), err))
+		return
+	}
+
+	message := &sarama.ProducerMessage{
+		Topic: e.topic,
+		Key:   sarama.StringEncoder(aggregationID(task)),
+		Value: sarama.ByteEncoder(jsonTask),
+	}
+
+	if _, _, err := e.producer.SendMessage(message); err != nil {
+		completion(fmt.Errorf("failed to produce task %s: %w", task.Marker(), err))
+		return
+	}
+
+	completion(nil)
+}
+
+func (e *KafkaEnqueuer) Stop() {
+	e.waitGroup.Wait()
+	// Closing the producer flushes any buffered messages
+	if err := e.producer.Close(); err != nil {
+		log.Printf("failed to close Kafka producer: %s", err)
+	}
+	if err := e.client.Close(); err != nil {
+		log.Printf("failed to close Kafka client: %s", err)
+	}
+}
+
+// Ping checks that the topic exists by refreshing its metadata from the
+// brokers. The Kafka client does not support contexts, so ctx is ignored in
+// favor of the client's own timeouts.
+func (e *KafkaEnqueuer) Ping(ctx context.Context) error {
+	if err := e.client.RefreshMetadata(e.topic); err != nil {
+		return fmt.Errorf("sarama.RefreshMetadata for topic %s: %w", e.topic, err)
+	}
+
+	partitions, err := e.client.Partitions(e.topic)
+	if err != nil {
+		return fmt.Errorf("sarama.Partitions for topic %s: %w", e.topic, err)
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("Kafka topic %s has no partitions", e.topic)
+	}
+
+	return nil
+}
+
+// RedisStreamsConfig configures how RedisStreamsEnqueuer connects to Redis and
+// bounds the size of the stream. The zero value connects without
+// authentication or TLS and never trims the stream.
+type RedisStreamsConfig struct {
+	// Username and Password authenticate the connection. If Username is
+	// empty, Password authenticates the default user.
+	Username, Password string
+	// TLS makes the connection use TLS
+	TLS bool
+	// MaxLen, if not 0, is the approximate number of entries beyond which
+	// Redis trims the oldest entries of the stream when tasks are added to it
+	MaxLen int64
+}
+
+// RedisStreamsEnqueuer implements Enqueuer using Redis Streams. Each task is
+// added to the stream as an entry whose "task" field holds the task's JSON
+// encoding, alongside a field for each of the task's attributes, so that
+// facilitators reading the stream through consumer groups can filter tasks by
+// aggregation ID without decoding them.
+type RedisStreamsEnqueuer struct {
+	client    *redis.Client
+	stream    string
+	maxLen    int64
+	waitGroup sync.WaitGroup
+	dryRun    bool
+}
+
+// NewRedisStreamsEnqueuer creates a task enqueuer for the Redis stream, on the
+// Redis server at addr ("host:port"). The stream is created when the first task
+// is added to it. If dryRun is true, no tasks will actually be enqueued.
+func NewRedisStreamsEnqueuer(addr, stream string, config RedisStreamsConfig, dryRun bool) *RedisStreamsEnqueuer {
+	options := &redis.Options{
+		Addr:     addr,
+		Username: config.Username,
+		Password: config.Password,
+	}
+	if config.TLS {
+		options.TLSConfig = &tls.Config{}
+	}
+
+	return &RedisStreamsEnqueuer{
+		client: redis.NewClient(options),
+		stream: stream,
+		maxLen: config.MaxLen,
+		dryRun: dryRun,
+	}
+}
+
+func (e *RedisStreamsEnqueuer) Enqueue(ctx context.Context, task Task, completion func(error)) {
+	// XADD returns once the entry has been added, so as with KafkaEnqueuer, we
+	// use the waitgroup only to maintain the guarantee that Stop() blocks
+	// until all pending calls to Enqueue() complete.
+	e.waitGroup.Add(1)
+	defer e.waitGroup.Done()
+
+	// Redis values may be up to 512 MB, so the task's size isn't limited
+	jsonTask, err := encodeTask(task, 0)
+	if err != nil {
+		completion(err)
+		return
+	}
+
+	if e.dryRun {
+		log.Printf("dry run, not enqueuing task")
+		completion(nil)
+		return
+	}
+
+	if err := e.client.XAdd(ctx, &redis.XAddArgs{
+		Stream:       e.stream,
+		MaxLenApprox: e.maxLen,
+		Values:       redisStreamValues(task, jsonTask),
+	}).Err(); err != nil {
+		completion(fmt.Errorf("failed to add task %s to Redis stream: %w", task.Marker(), err))
+		return
+	}
+
+	completion(nil)
+}
+
+func (e *RedisStreamsEnqueuer) Stop() {
+	e.waitGroup.Wait()
+	if err := e.client.Close(); err != nil {
+		log.Printf("failed to close Redis client: %s", err)
+	}
+}
+
+// Ping checks that the Redis server is reachable and accepts the enqueuer's
+// credentials. The stream itself need not exist yet.
+func (e *RedisStreamsEnqueuer) Ping(ctx context.Context) error {
+	if err := e.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("redis.Ping: %w", err)
+	}
+	return nil
+}
+
+// redisStreamValues returns the fields of the stream entry for the task: one
+// for each of the task's attributes, in a deterministic order, followed by
+// "task" with the task's JSON encoding
+func redisStreamValues(task Task, json []byte) []interface{} {
+	attributes := task.Attributes()
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make([]interface{}, 0, 2*len(names)+2)
+	for _, name := range names {
+		values = append(values, name, attributes[name])
+	}
+	return append(values, "task", string(json))
+}
+
+// MemoryEnqueuer implements Enqueuer by recording tasks in memory, so that
+// tests and local development can observe what was enqueued. It is safe for
+// concurrent use.
+type MemoryEnqueuer struct {
+	lock  sync.Mutex
+	tasks []Task
+}
+
+// NewMemoryEnqueuer creates an empty MemoryEnqueuer
+func NewMemoryEnqueuer() *MemoryEnqueuer {
+	return &MemoryEnqueuer{}
+}
+
+func (e *MemoryEnqueuer) Enqueue(ctx context.Context, task Task, completion func(error)) {
+	if err := ctx.Err(); err != nil {
+		completion(fmt.Errorf("failed to enqueue task %s: %w", task.Marker(), err))
+		return
+	}
+
+	log.Printf("enqueuing task %s in memory", task.Marker())
+	e.lock.Lock()
+	e.tasks = append(e.tasks, task)
+	e.lock.Unlock()
+	completion(nil)
+}
+
+func (e *MemoryEnqueuer) Stop() {}
+
+func (e *MemoryEnqueuer) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Tasks returns the tasks enqueued so far, in the order they were enqueued
+func (e *MemoryEnqueuer) Tasks() []Task {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]Task(nil), e.tasks...)
+}
+
+// snsDeduplicationID returns the deduplication ID for the task when published
+// to a FIFO SNS topic, which is the task's marker, or a hash of it if the
+// marker is longer than the 128 characters SNS allows.
+func snsDeduplicationID(task Task) string {
+	marker := task.Marker()
+	if len(marker) <= 128 {
+		return marker
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(marker)))
+}
+
+// snsMessageAttributes returns the task's attributes as SNS message attributes
+func snsMessageAttributes(task Task) map[string]*sns.MessageAttributeValue {
+	attributes := map[string]*sns.MessageAttributeValue{}
+	for name, value := range task.Attributes() {
+		attributes[name] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	return attributes
+}
+
+// aggregationID returns the aggregation ID of the task
+func aggregationID(task Task) string {
+	switch t := task.(type) {
+	case IntakeBatch:
+		return t.AggregationID
+	case Aggregation:
+		return t.AggregationID
+	case SelfTest:
+		// SNS FIFO topics require a message group ID
+		return "selftest"
+	default:
+		return ""
+	}
+}
+
+// taskTime returns the timestamp of the batch or aggregation that the task
+// concerns
+func taskTime(task Task) time.Time {
+	switch t := task.(type) {
+	case IntakeBatch:
+		return time.Time(t.Date)
+	case Aggregation:
+		return time.Time(t.AggregationEnd)
+	default:
+		return time.Time{}
+	}
+}
+
+// encodeTask returns the JSON encoding of the task, or an error wrapping
+// ErrTaskTooLarge if the encoding is larger than maxSize bytes. If maxSize is 0,
+// the task's size is not limited.
+func encodeTask(task Task, maxSize int) ([]byte, error) {
+	jsonTask, err := json.Marshal(task)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling task to JSON: %w", err)
+	}
+	if maxSize > 0 && len(jsonTask) > maxSize {
+		return nil, fmt.Errorf("task %s is %d bytes, exceeding the maximum of %d: %w", task.Marker(), len(jsonTask), maxSize, ErrTaskTooLarge)
+	}
+	return jsonTask, nil
 }
@@ -0,0 +1,1807 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/utils"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/Shopify/sarama"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakePubSubClient returns a PubSub client connected to a fake PubSub server
+// on which the topic "existing-topic" exists
+func fakePubSubClient(t *testing.T) *pubsub.Client {
+	t.Helper()
+	_, client := fakePubSubServerAndClient(t)
+	return client
+}
+
+// fakePubSubServerAndClient returns a fake PubSub server on which the topic
+// "existing-topic" exists, and a PubSub client connected to it
+func fakePubSubServerAndClient(t *testing.T) (*pstest.Server, *pubsub.Client) {
+	t.Helper()
+	server := pstest.NewServer()
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := grpc.Dial(server.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("failed to dial fake PubSub server: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := pubsub.NewClient(context.Background(), "project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("failed to create PubSub client: %s", err)
+	}
+
+	if _, err := client.CreateTopic(context.Background(), "existing-topic"); err != nil {
+		t.Fatalf("failed to create topic: %s", err)
+	}
+
+	return server, client
+}
+
+func TestGCPPubSubEnqueuerCompletion(t *testing.T) {
+	var testCases = []struct {
+		name          string
+		topic         string
+		expectFailure bool
+	}{
+		{
+			name:          "publish-succeeds",
+			topic:         "existing-topic",
+			expectFailure: false,
+		},
+		{
+			name:          "publish-fails",
+			topic:         "nonexistent-topic",
+			expectFailure: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			client := fakePubSubClient(t)
+			enqueuer := newGCPPubSubEnqueuerForTopic(client.Topic(testCase.topic), DefaultGCPPubSubMaxMessageSize, false)
+
+			var lock sync.Mutex
+			var completions []error
+			enqueuer.Enqueue(context.Background(), IntakeBatch{AggregationID: "kittens-seen"}, func(err error) {
+				lock.Lock()
+				defer lock.Unlock()
+				completions = append(completions, err)
+			})
+			enqueuer.Stop()
+
+			if len(completions) != 1 {
+				t.Fatalf("expected completion to be called once, got %d calls: %v", len(completions), completions)
+			}
+			if testCase.expectFailure && completions[0] == nil {
+				t.Errorf("expected publish failure, got success")
+			}
+			if !testCase.expectFailure && completions[0] != nil {
+				t.Errorf("unexpected publish failure: %s", completions[0])
+			}
+		})
+	}
+}
+
+func TestGCPPubSubEnqueuerOrdering(t *testing.T) {
+	for _, ordering := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ordering-%t", ordering), func(t *testing.T) {
+			server, client := fakePubSubServerAndClient(t)
+			topic := client.Topic("existing-topic")
+			topic.EnableMessageOrdering = ordering
+			enqueuer := newGCPPubSubEnqueuerForTopic(topic, DefaultGCPPubSubMaxMessageSize, false)
+
+			for _, batchID := range []string{"b8a5579a", "0f0f0f0f"} {
+				enqueuer.Enqueue(context.Background(), IntakeBatch{AggregationID: "kittens-seen", BatchID: batchID}, func(err error) {
+					if err != nil {
+						t.Errorf("unexpected publish failure: %s", err)
+					}
+				})
+			}
+			enqueuer.Stop()
+
+			expectedOrderingKey := ""
+			if ordering {
+				expectedOrderingKey = "kittens-seen"
+			}
+			messages := server.Messages()
+			if len(messages) != 2 {
+				t.Fatalf("expected 2 messages, got %d", len(messages))
+			}
+			expectedAttributes := map[string]string{
+				"task_type":      "intake",
+				"aggregation_id": "kittens-seen",
+				"is_first":       "false",
+			}
+			for _, message := range messages {
+				if message.OrderingKey != expectedOrderingKey {
+					t.Errorf("expected ordering key %q, got %q", expectedOrderingKey, message.OrderingKey)
+				}
+				if !reflect.DeepEqual(message.Attributes, expectedAttributes) {
+					t.Errorf("expected attributes %v, got %v", expectedAttributes, message.Attributes)
+				}
+			}
+		})
+	}
+}
+
+func TestGCPPubSubEnqueuerPing(t *testing.T) {
+	client := fakePubSubClient(t)
+
+	if err := newGCPPubSubEnqueuerForTopic(client.Topic("existing-topic"), DefaultGCPPubSubMaxMessageSize, false).Ping(context.Background()); err != nil {
+		t.Errorf("unexpected error pinging existing topic: %s", err)
+	}
+	if err := newGCPPubSubEnqueuerForTopic(client.Topic("nonexistent-topic"), DefaultGCPPubSubMaxMessageSize, false).Ping(context.Background()); err == nil {
+		t.Errorf("expected error pinging nonexistent topic")
+	}
+}
+
+func TestCreatePubSubTopic(t *testing.T) {
+	ctx := context.Background()
+	client := fakePubSubClient(t)
+
+	subscriptionConfig := PubSubSubscriptionConfig{
+		AckDeadline:           5 * time.Minute,
+		RetentionDuration:     24 * time.Hour,
+		DeadLetterTopicID:     "dead-letter",
+		MaxDeliveryAttempts:   10,
+		EnableMessageOrdering: true,
+	}
+	// The intake and aggregation topics share the dead letter topic
+	for _, topicID := range []string{"intake", "aggregate"} {
+		if err := createPubSubTopic(ctx, client, topicID, subscriptionConfig); err != nil {
+			t.Fatalf("unexpected error creating topic %s: %s", topicID, err)
+		}
+
+		config, err := client.Subscription(topicID).Config(ctx)
+		if err != nil {
+			t.Fatalf("failed to get subscription %s: %s", topicID, err)
+		}
+		if config.AckDeadline != subscriptionConfig.AckDeadline {
+			t.Errorf("expected ack deadline %s, got %s", subscriptionConfig.AckDeadline, config.AckDeadline)
+		}
+		if config.RetentionDuration != subscriptionConfig.RetentionDuration {
+			t.Errorf("expected retention duration %s, got %s", subscriptionConfig.RetentionDuration, config.RetentionDuration)
+		}
+		expectedPolicy := pubsub.DeadLetterPolicy{
+			DeadLetterTopic:     "projects/project/topics/dead-letter",
+			MaxDeliveryAttempts: 10,
+		}
+		if config.DeadLetterPolicy == nil || *config.DeadLetterPolicy != expectedPolicy {
+			t.Errorf("expected dead letter policy %+v, got %+v", expectedPolicy, config.DeadLetterPolicy)
+		}
+		if !config.EnableMessageOrdering {
+			t.Errorf("expected message ordering to be enabled")
+		}
+	}
+
+	if exists, err := client.Subscription("dead-letter").Exists(ctx); err != nil || !exists {
+		t.Errorf("expected dead letter subscription to exist (error %v)", err)
+	}
+
+	if err := createPubSubTopic(ctx, client, "no-dead-letter", DefaultPubSubSubscriptionConfig); err != nil {
+		t.Fatalf("unexpected error creating topic: %s", err)
+	}
+	config, err := client.Subscription("no-dead-letter").Config(ctx)
+	if err != nil {
+		t.Fatalf("failed to get subscription: %s", err)
+	}
+	if config.DeadLetterPolicy != nil {
+		t.Errorf("unexpected dead letter policy %+v", config.DeadLetterPolicy)
+	}
+}
+
+func TestCreatePubSubTopicAgain(t *testing.T) {
+	ctx := context.Background()
+	client := fakePubSubClient(t)
+
+	subscriptionConfig := PubSubSubscriptionConfig{
+		AckDeadline:         5 * time.Minute,
+		RetentionDuration:   24 * time.Hour,
+		DeadLetterTopicID:   "dead-letter",
+		MaxDeliveryAttempts: 10,
+	}
+	if err := createPubSubTopic(ctx, client, "intake", subscriptionConfig); err != nil {
+		t.Fatalf("unexpected error creating topic: %s", err)
+	}
+	if err := createPubSubTopic(ctx, client, "intake", subscriptionConfig); err != nil {
+		t.Fatalf("unexpected error creating existing topic: %s", err)
+	}
+
+	// Creating the topic again with different settings updates the
+	// subscription
+	subscriptionConfig.AckDeadline = 10 * time.Minute
+	subscriptionConfig.RetentionDuration = 48 * time.Hour
+	if err := createPubSubTopic(ctx, client, "intake", subscriptionConfig); err != nil {
+		t.Fatalf("unexpected error creating existing topic with new settings: %s", err)
+	}
+	config, err := client.Subscription("intake").Config(ctx)
+	if err != nil {
+		t.Fatalf("failed to get subscription: %s", err)
+	}
+	if config.AckDeadline != subscriptionConfig.AckDeadline {
+		t.Errorf("expected ack deadline %s, got %s", subscriptionConfig.AckDeadline, config.AckDeadline)
+	}
+	if config.RetentionDuration != subscriptionConfig.RetentionDuration {
+		t.Errorf("expected retention duration %s, got %s", subscriptionConfig.RetentionDuration, config.RetentionDuration)
+	}
+
+	// A subscription with the topic's ID on some other topic can't be fixed
+	if _, err := client.CreateSubscription(ctx, "aggregate", pubsub.SubscriptionConfig{Topic: client.Topic("existing-topic")}); err != nil {
+		t.Fatalf("failed to create subscription: %s", err)
+	}
+	if err := createPubSubTopic(ctx, client, "aggregate", DefaultPubSubSubscriptionConfig); err == nil {
+		t.Errorf("expected error creating topic whose subscription is for another topic")
+	}
+}
+
+func TestPrefixTopic(t *testing.T) {
+	var testCases = []struct {
+		name          string
+		kind          string
+		prefix        string
+		topic         string
+		expectedTopic string
+		expectedError string
+	}{
+		{name: "no-prefix", kind: "gcp-pubsub", topic: "intake", expectedTopic: "intake"},
+		{name: "memory", kind: "memory", prefix: "narnia/", topic: "intake", expectedTopic: "intake"},
+		{name: "gcp-pubsub", kind: "gcp-pubsub", prefix: "narnia-", topic: "intake", expectedTopic: "narnia-intake"},
+		{
+			name:          "gcp-pubsub-illegal-character",
+			kind:          "gcp-pubsub",
+			prefix:        "narnia/",
+			topic:         "intake",
+			expectedError: `"narnia/intake" is not a valid topic name for task queue kind gcp-pubsub`,
+		},
+		{
+			name:          "gcp-pubsub-leading-digit",
+			kind:          "gcp-pubsub",
+			prefix:        "1-",
+			topic:         "intake",
+			expectedError: "not a valid topic name",
+		},
+		{
+			name:          "gcp-pubsub-goog",
+			kind:          "gcp-pubsub",
+			prefix:        "goog-",
+			topic:         "intake",
+			expectedError: "not a valid topic name",
+		},
+		{
+			name:          "gcp-pubsub-too-long",
+			kind:          "gcp-pubsub",
+			prefix:        strings.Repeat("n", 250),
+			topic:         "intake",
+			expectedError: "not a valid topic name",
+		},
+		{name: "gcp-cloudtasks", kind: "gcp-cloudtasks", prefix: "narnia-", topic: "intake", expectedTopic: "narnia-intake"},
+		{
+			name:          "gcp-cloudtasks-underscore",
+			kind:          "gcp-cloudtasks",
+			prefix:        "narnia_",
+			topic:         "intake",
+			expectedError: "not a valid topic name",
+		},
+		{
+			name:          "aws-sns",
+			kind:          "aws-sns",
+			prefix:        "narnia-",
+			topic:         "arn:aws:sns:us-west-2:123456789012:intake",
+			expectedTopic: "arn:aws:sns:us-west-2:123456789012:narnia-intake",
+		},
+		{
+			name:          "aws-sns-fifo",
+			kind:          "aws-sns",
+			prefix:        "narnia-",
+			topic:         "arn:aws:sns:us-west-2:123456789012:intake.fifo",
+			expectedTopic: "arn:aws:sns:us-west-2:123456789012:narnia-intake.fifo",
+		},
+		{
+			name:          "aws-sns-illegal-character",
+			kind:          "aws-sns",
+			prefix:        "narnia.",
+			topic:         "arn:aws:sns:us-west-2:123456789012:intake",
+			expectedError: "not a valid topic name",
+		},
+		{
+			name:          "aws-sns-not-arn",
+			kind:          "aws-sns",
+			prefix:        "narnia-",
+			topic:         "intake",
+			expectedError: `"intake" is not an SNS topic ARN`,
+		},
+		{name: "kafka", kind: "kafka", prefix: "narnia.", topic: "intake", expectedTopic: "narnia.intake"},
+		{
+			name:          "kafka-illegal-character",
+			kind:          "kafka",
+			prefix:        "narnia:",
+			topic:         "intake",
+			expectedError: "not a valid topic name",
+		},
+		{name: "redis", kind: "redis", prefix: "narnia:", topic: "intake", expectedTopic: "narnia:intake"},
+		{
+			name:          "unknown-kind",
+			kind:          "carrier-pigeon",
+			prefix:        "narnia-",
+			topic:         "intake",
+			expectedError: `unknown task queue kind "carrier-pigeon"`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			topic, err := PrefixTopic(testCase.kind, testCase.prefix, testCase.topic)
+			if testCase.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+					t.Fatalf("expected error containing %q, got %v", testCase.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if topic != testCase.expectedTopic {
+				t.Errorf("expected topic %q, got %q", testCase.expectedTopic, topic)
+			}
+		})
+	}
+}
+
+func TestTaskAttributes(t *testing.T) {
+	var testCases = []struct {
+		name               string
+		task               Task
+		expectedAttributes map[string]string
+	}{
+		{
+			name: "intake",
+			task: IntakeBatch{AggregationID: "kittens-seen", BatchID: "b8a5579a", IsFirst: true},
+			expectedAttributes: map[string]string{
+				"task_type":      "intake",
+				"aggregation_id": "kittens-seen",
+				"is_first":       "true",
+			},
+		},
+		{
+			name: "aggregate",
+			task: Aggregation{AggregationID: "kittens-seen", BatchesObject: "aggregation-batches/aggregate-kittens-seen.json"},
+			expectedAttributes: map[string]string{
+				"task_type":      "aggregate",
+				"aggregation_id": "kittens-seen",
+				"is_first":       "false",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if attributes := testCase.task.Attributes(); !reflect.DeepEqual(attributes, testCase.expectedAttributes) {
+				t.Errorf("expected attributes %v, got %v", testCase.expectedAttributes, attributes)
+			}
+
+			snsAttributes := snsMessageAttributes(testCase.task)
+			if len(snsAttributes) != len(testCase.expectedAttributes) {
+				t.Errorf("expected %d SNS message attributes, got %v", len(testCase.expectedAttributes), snsAttributes)
+			}
+			for name, value := range testCase.expectedAttributes {
+				if attribute, ok := snsAttributes[name]; !ok || *attribute.DataType != "String" || *attribute.StringValue != value {
+					t.Errorf("expected SNS message attribute %s to be string %q, got %v", name, value, attribute)
+				}
+			}
+
+			// The attributes are not part of the task's JSON encoding
+			encoded, err := json.Marshal(testCase.task)
+			if err != nil {
+				t.Fatalf("failed to encode task: %s", err)
+			}
+			if strings.Contains(string(encoded), "first") {
+				t.Errorf("unexpected is_first in JSON encoding %s", encoded)
+			}
+		})
+	}
+}
+
+func TestTaskSchemaVersion(t *testing.T) {
+	batchTime := Timestamp(time.Date(2020, 10, 31, 20, 29, 0, 0, time.UTC))
+
+	var testCases = []struct {
+		name            string
+		task            Task
+		decoded         Task
+		expectedVersion string
+	}{
+		{
+			name: "intake-current",
+			task: IntakeBatch{
+				AggregationID: "kittens-seen",
+				BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+				Date:          batchTime,
+				Version:       TaskSchemaVersion,
+			},
+			decoded:         &IntakeBatch{},
+			expectedVersion: fmt.Sprintf(`"version":%d`, TaskSchemaVersion),
+		},
+		{
+			name: "intake-v0",
+			task: IntakeBatch{
+				AggregationID: "kittens-seen",
+				BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+				Date:          batchTime,
+			},
+			decoded: &IntakeBatch{},
+		},
+		{
+			name: "aggregate-current",
+			task: Aggregation{
+				AggregationID:    "kittens-seen",
+				AggregationStart: batchTime,
+				AggregationEnd:   batchTime,
+				Batches:          []Batch{{ID: "b8a5579a-f984-460a-a42d-2813cbf57771", Time: batchTime}},
+				Version:          TaskSchemaVersion,
+			},
+			decoded:         &Aggregation{},
+			expectedVersion: fmt.Sprintf(`"version":%d`, TaskSchemaVersion),
+		},
+		{
+			name: "aggregate-v0",
+			task: Aggregation{
+				AggregationID:    "kittens-seen",
+				AggregationStart: batchTime,
+				AggregationEnd:   batchTime,
+				Batches:          []Batch{{ID: "b8a5579a-f984-460a-a42d-2813cbf57771", Time: batchTime}},
+			},
+			decoded: &Aggregation{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			encoded, err := json.Marshal(testCase.task)
+			if err != nil {
+				t.Fatalf("failed to encode task: %s", err)
+			}
+			if testCase.expectedVersion != "" && !strings.Contains(string(encoded), testCase.expectedVersion) {
+				t.Errorf("expected %s in JSON encoding %s", testCase.expectedVersion, encoded)
+			}
+			if testCase.expectedVersion == "" && strings.Contains(string(encoded), "version") {
+				t.Errorf("unexpected version in JSON encoding %s", encoded)
+			}
+
+			if err := json.Unmarshal(encoded, testCase.decoded); err != nil {
+				t.Fatalf("failed to decode task %s: %s", encoded, err)
+			}
+			if decoded := reflect.ValueOf(testCase.decoded).Elem().Interface(); !reflect.DeepEqual(decoded, testCase.task) {
+				t.Errorf("expected decoded task %+v, got %+v", testCase.task, decoded)
+			}
+		})
+	}
+}
+
+func TestAggregationJSONRoundTrip(t *testing.T) {
+	aggregation := Aggregation{
+		AggregationID:    "kittens-seen",
+		AggregationStart: Timestamp(time.Date(2020, 10, 31, 16, 0, 0, 0, time.UTC)),
+		AggregationEnd:   Timestamp(time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)),
+		Batches: []Batch{
+			{ID: "0f0f0f0f-f984-460a-a42d-2813cbf57771", Time: Timestamp(time.Date(2020, 10, 31, 16, 0, 0, 0, time.UTC))},
+			{ID: "b8a5579a-f984-460a-a42d-2813cbf57771", Time: Timestamp(time.Date(2020, 10, 31, 20, 29, 0, 0, time.UTC))},
+		},
+		Version: TaskSchemaVersion,
+	}
+
+	encoded, err := json.Marshal(aggregation)
+	if err != nil {
+		t.Fatalf("failed to encode task: %s", err)
+	}
+	var decoded Aggregation
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("failed to decode task %s: %s", encoded, err)
+	}
+
+	if !time.Time(decoded.AggregationStart).Equal(time.Time(aggregation.AggregationStart)) {
+		t.Errorf("expected aggregation start %s, got %s", &aggregation.AggregationStart, &decoded.AggregationStart)
+	}
+	if !time.Time(decoded.AggregationEnd).Equal(time.Time(aggregation.AggregationEnd)) {
+		t.Errorf("expected aggregation end %s, got %s", &aggregation.AggregationEnd, &decoded.AggregationEnd)
+	}
+	if len(decoded.Batches) != len(aggregation.Batches) {
+		t.Fatalf("expected %d batches, got %d", len(aggregation.Batches), len(decoded.Batches))
+	}
+	for i, batch := range decoded.Batches {
+		if !time.Time(batch.Time).Equal(time.Time(aggregation.Batches[i].Time)) {
+			t.Errorf("expected batch %s time %s, got %s", batch.ID, &aggregation.Batches[i].Time, &batch.Time)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"aggregation-start": "2020-10-31-16-00"}`,
+		`{"aggregation-start": 1604160000}`,
+		`{"batches": [{"id": "0f0f0f0f", "time": "2020/10/31"}]}`,
+	} {
+		if err := json.Unmarshal([]byte(invalid), &Aggregation{}); err == nil {
+			t.Errorf("expected error decoding %s", invalid)
+		}
+	}
+}
+
+func TestTaskFieldNaming(t *testing.T) {
+	batchTime := Timestamp(time.Date(2020, 10, 31, 20, 29, 0, 0, time.UTC))
+	intake := IntakeBatch{
+		AggregationID: "kittens-seen",
+		BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+		Date:          batchTime,
+		Version:       TaskSchemaVersion,
+	}
+	aggregation := Aggregation{
+		AggregationID:    "kittens-seen",
+		AggregationStart: batchTime,
+		AggregationEnd:   batchTime,
+		BatchesObject:    "aggregation-batches/aggregate-kittens-seen.json",
+		Version:          TaskSchemaVersion,
+	}
+
+	var testCases = []struct {
+		name         string
+		naming       FieldNaming
+		task         Task
+		expectedJSON string
+	}{
+		{
+			name: "intake-default",
+			task: intake,
+			expectedJSON: fmt.Sprintf(
+				`{"aggregation-id":"kittens-seen","batch-id":"b8a5579a-f984-460a-a42d-2813cbf57771","date":"2020/10/31/20/29","version":%d}`,
+				TaskSchemaVersion,
+			),
+		},
+		{
+			name:   "intake-kebab-case",
+			naming: KebabCase,
+			task:   intake,
+			expectedJSON: fmt.Sprintf(
+				`{"aggregation-id":"kittens-seen","batch-id":"b8a5579a-f984-460a-a42d-2813cbf57771","date":"2020/10/31/20/29","version":%d}`,
+				TaskSchemaVersion,
+			),
+		},
+		{
+			name:   "intake-snake-case",
+			naming: SnakeCase,
+			task:   intake,
+			expectedJSON: fmt.Sprintf(
+				`{"aggregation_id":"kittens-seen","batch_id":"b8a5579a-f984-460a-a42d-2813cbf57771","date":"2020/10/31/20/29","version":%d}`,
+				TaskSchemaVersion,
+			),
+		},
+		{
+			name:   "aggregate-kebab-case",
+			naming: KebabCase,
+			task:   aggregation,
+			expectedJSON: fmt.Sprintf(
+				`{"aggregation-id":"kittens-seen","aggregation-start":"2020/10/31/20/29","aggregation-end":"2020/10/31/20/29","batches-object":"aggregation-batches/aggregate-kittens-seen.json","version":%d}`,
+				TaskSchemaVersion,
+			),
+		},
+		{
+			name:   "aggregate-snake-case",
+			naming: SnakeCase,
+			task:   aggregation,
+			expectedJSON: fmt.Sprintf(
+				`{"aggregation_end":"2020/10/31/20/29","aggregation_id":"kittens-seen","aggregation_start":"2020/10/31/20/29","batches_object":"aggregation-batches/aggregate-kittens-seen.json","version":%d}`,
+				TaskSchemaVersion,
+			),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			task := testCase.task
+			switch typed := task.(type) {
+			case IntakeBatch:
+				typed.FieldNaming = testCase.naming
+				task = typed
+			case Aggregation:
+				typed.FieldNaming = testCase.naming
+				task = typed
+			}
+
+			jsonTask, err := encodeTask(task, 0)
+			if err != nil {
+				t.Fatalf("failed to encode task: %s", err)
+			}
+			if encoded := string(jsonTask); encoded != testCase.expectedJSON {
+				t.Errorf("expected JSON encoding %s, got %s", testCase.expectedJSON, encoded)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	batchTime := Timestamp(time.Date(2020, 10, 31, 20, 29, 0, 0, time.UTC))
+	intake := IntakeBatch{
+		AggregationID: "kittens-seen",
+		BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+		Date:          batchTime,
+		Version:       TaskSchemaVersion,
+		IsFirst:       true,
+	}
+	aggregation := Aggregation{
+		AggregationID:    "kittens-seen",
+		AggregationStart: batchTime,
+		AggregationEnd:   batchTime,
+		Batches:          []Batch{{ID: "b8a5579a-f984-460a-a42d-2813cbf57771", Time: batchTime}},
+		Version:          TaskSchemaVersion,
+	}
+
+	var testCases = []struct {
+		name     string
+		taskType string
+		task     Task
+	}{
+		{name: "intake-kebab-case", taskType: "intake", task: withFieldNaming(intake, KebabCase)},
+		{name: "intake-snake-case", taskType: "intake", task: withFieldNaming(intake, SnakeCase)},
+		{name: "aggregate-kebab-case", taskType: "aggregate", task: withFieldNaming(aggregation, KebabCase)},
+		{name: "aggregate-snake-case", taskType: "aggregate", task: withFieldNaming(aggregation, SnakeCase)},
+		{name: "selftest", taskType: "selftest", task: SelfTest{ID: "20201101T040100Z-0a0a0a0a"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			encoded, err := json.Marshal(testCase.task)
+			if err != nil {
+				t.Fatalf("failed to encode task: %s", err)
+			}
+			decoded, err := Decode(testCase.taskType, encoded, testCase.task.Attributes())
+			if err != nil {
+				t.Fatalf("failed to decode task %s: %s", encoded, err)
+			}
+			if !reflect.DeepEqual(decoded, testCase.task) {
+				t.Errorf("expected task %+v, got %+v", testCase.task, decoded)
+			}
+		})
+	}
+
+	if _, err := Decode("reap", []byte(`{"aggregation-id":"kittens-seen"}`), nil); err == nil {
+		t.Errorf("expected error decoding unknown task type")
+	}
+	if _, err := Decode("intake", []byte(`"intake-kittens-seen"`), nil); err == nil {
+		t.Errorf("expected error decoding task that isn't an object")
+	}
+}
+
+// withFieldNaming returns the task with the provided field naming
+func withFieldNaming(task Task, naming FieldNaming) Task {
+	switch typed := task.(type) {
+	case IntakeBatch:
+		typed.FieldNaming = naming
+		return typed
+	case Aggregation:
+		typed.FieldNaming = naming
+		return typed
+	default:
+		return task
+	}
+}
+
+func TestParseFieldNaming(t *testing.T) {
+	for _, naming := range []FieldNaming{KebabCase, SnakeCase} {
+		if parsed, err := ParseFieldNaming(string(naming)); err != nil || parsed != naming {
+			t.Errorf("expected %q to parse, got %q, %v", naming, parsed, err)
+		}
+	}
+	if _, err := ParseFieldNaming("camelCase"); err == nil {
+		t.Errorf("expected error parsing unknown field naming")
+	}
+}
+
+func TestSNSDeduplicationID(t *testing.T) {
+	shortTask := IntakeBatch{
+		AggregationID: "kittens-seen",
+		BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+	}
+	if id := snsDeduplicationID(shortTask); id != shortTask.Marker() {
+		t.Errorf("expected deduplication ID %q, got %q", shortTask.Marker(), id)
+	}
+
+	longTask := IntakeBatch{
+		AggregationID: strings.Repeat("kittens-seen", 20),
+		BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+	}
+	id := snsDeduplicationID(longTask)
+	if len(id) > 128 {
+		t.Errorf("deduplication ID %q is too long", id)
+	}
+	if id != snsDeduplicationID(longTask) {
+		t.Errorf("deduplication ID is not deterministic")
+	}
+}
+
+// flakySNS is an SNS client whose publishes fail with the error that fail
+// returns for the number of the attempt, starting from 0, if any
+type flakySNS struct {
+	snsiface.SNSAPI
+	fail     func(attempt int) error
+	attempts int
+}
+
+func (s *flakySNS) PublishWithContext(ctx context.Context, input *sns.PublishInput, options ...request.Option) (*sns.PublishOutput, error) {
+	attempt := s.attempts
+	s.attempts++
+	if err := s.fail(attempt); err != nil {
+		return nil, err
+	}
+	return &sns.PublishOutput{}, nil
+}
+
+func TestAWSSNSEnqueuerRetries(t *testing.T) {
+	defer func(previous time.Duration) { utils.OperationTimeout = previous }(utils.OperationTimeout)
+	utils.OperationTimeout = 200 * time.Millisecond
+
+	throttled := awserr.NewRequestFailure(awserr.New(sns.ErrCodeThrottledException, "Rate exceeded", nil), 400, "request-id")
+	var testCases = []struct {
+		name             string
+		fail             func(attempt int) error
+		expectError      bool
+		expectedAttempts int
+	}{
+		{
+			name: "throttled-twice",
+			fail: func(attempt int) error {
+				if attempt < 2 {
+					return throttled
+				}
+				return nil
+			},
+			expectedAttempts: 3,
+		},
+		{
+			name: "server-error",
+			fail: func(attempt int) error {
+				if attempt < 1 {
+					return awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, "request-id")
+				}
+				return nil
+			},
+			expectedAttempts: 2,
+		},
+		{
+			name: "not-retryable",
+			fail: func(int) error {
+				return awserr.NewRequestFailure(awserr.New(sns.ErrCodeAuthorizationErrorException, "", nil), 403, "request-id")
+			},
+			expectError:      true,
+			expectedAttempts: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			service := &flakySNS{fail: testCase.fail}
+			enqueuer := &AWSSNSEnqueuer{
+				service:        service,
+				topicARN:       "arn:aws:sns:us-west-2:123456789012:intake-tasks",
+				retryBaseDelay: time.Millisecond,
+				retryMaxDelay:  10 * time.Millisecond,
+				rnd:            rand.New(rand.NewSource(1)),
+			}
+			var enqueueErr error
+			enqueuer.Enqueue(context.Background(), IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch"}, func(err error) { enqueueErr = err })
+			enqueuer.Stop()
+
+			if testCase.expectError && enqueueErr == nil {
+				t.Errorf("expected error")
+			}
+			if !testCase.expectError && enqueueErr != nil {
+				t.Errorf("unexpected error: %s", enqueueErr)
+			}
+			if service.attempts != testCase.expectedAttempts {
+				t.Errorf("expected %d attempts to publish, got %d", testCase.expectedAttempts, service.attempts)
+			}
+		})
+	}
+
+	// Retries stop once the operation timeout has passed
+	service := &flakySNS{fail: func(int) error { return throttled }}
+	enqueuer := &AWSSNSEnqueuer{
+		service:        service,
+		topicARN:       "arn:aws:sns:us-west-2:123456789012:intake-tasks",
+		retryBaseDelay: time.Millisecond,
+		retryMaxDelay:  10 * time.Millisecond,
+		rnd:            rand.New(rand.NewSource(1)),
+	}
+	start := time.Now()
+	var enqueueErr error
+	enqueuer.Enqueue(context.Background(), IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch"}, func(err error) { enqueueErr = err })
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected retries to stop after the operation timeout, took %s", elapsed)
+	}
+	if ClassifyEnqueueError(enqueueErr) != EnqueueErrorThrottled {
+		t.Errorf("expected the last throttling error, got %v", enqueueErr)
+	}
+	if service.attempts < 2 {
+		t.Errorf("expected publish to be retried, got %d attempts", service.attempts)
+	}
+}
+
+func TestSNSRetryDelay(t *testing.T) {
+	enqueuer := &AWSSNSEnqueuer{
+		retryBaseDelay: 100 * time.Millisecond,
+		retryMaxDelay:  5 * time.Second,
+		rnd:            rand.New(rand.NewSource(1)),
+	}
+	for retries := 0; retries < 100; retries++ {
+		ceiling := 5 * time.Second
+		if retries < 6 {
+			ceiling = (100 * time.Millisecond) << uint(retries)
+		}
+		if delay := enqueuer.retryDelay(retries); delay < 0 || delay > ceiling {
+			t.Errorf("delay %s after %d retries is not within [0, %s]", delay, retries, ceiling)
+		}
+	}
+}
+
+func TestTaskTime(t *testing.T) {
+	batchTime := time.Date(2020, 10, 31, 20, 29, 0, 0, time.UTC)
+	aggregationEnd := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	if got := taskTime(IntakeBatch{Date: Timestamp(batchTime)}); !got.Equal(batchTime) {
+		t.Errorf("expected intake task time %s, got %s", batchTime, got)
+	}
+	if got := taskTime(Aggregation{AggregationEnd: Timestamp(aggregationEnd)}); !got.Equal(aggregationEnd) {
+		t.Errorf("expected aggregation task time %s, got %s", aggregationEnd, got)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		parse       func(string) (Timestamp, error)
+		format      func(Timestamp) string
+		input       string
+		expectError bool
+	}{
+		{
+			name:   "string",
+			parse:  ParseTimestamp,
+			format: func(t Timestamp) string { return t.String() },
+			input:  "2020/10/31/20/29",
+		},
+		{
+			name:   "marker-string",
+			parse:  ParseMarkerTimestamp,
+			format: func(t Timestamp) string { return t.MarkerString() },
+			input:  "2020-10-31-20-29",
+		},
+		{
+			name:        "string-in-marker-format",
+			parse:       ParseTimestamp,
+			input:       "2020-10-31-20-29",
+			expectError: true,
+		},
+		{
+			name:        "marker-string-in-string-format",
+			parse:       ParseMarkerTimestamp,
+			input:       "2020/10/31/20/29",
+			expectError: true,
+		},
+		{
+			name:        "missing-minutes",
+			parse:       ParseTimestamp,
+			input:       "2020/10/31/20",
+			expectError: true,
+		},
+	}
+
+	expected := time.Date(2020, 10, 31, 20, 29, 0, 0, time.UTC)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			parsed, err := testCase.parse(testCase.input)
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected error parsing %q, got %s", testCase.input, time.Time(parsed))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !time.Time(parsed).Equal(expected) {
+				t.Errorf("expected %s, got %s", expected, time.Time(parsed))
+			}
+			if formatted := testCase.format(parsed); formatted != testCase.input {
+				t.Errorf("expected %q to round trip, got %q", testCase.input, formatted)
+			}
+		})
+	}
+}
+
+func TestCheckTimestampFormat(t *testing.T) {
+	var testCases = []struct {
+		format            string
+		expectedPrecision time.Duration
+		expectError       bool
+	}{
+		{format: DefaultTimestampFormat, expectedPrecision: time.Minute},
+		{format: "2006/01/02/15", expectedPrecision: time.Hour},
+		{format: "2006-01-02-15-04", expectError: true},
+		{format: "2006/01/02", expectError: true},
+		{format: time.RFC3339, expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.format, func(t *testing.T) {
+			precision, err := CheckTimestampFormat(testCase.format)
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected error, got precision %s", precision)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if precision != testCase.expectedPrecision {
+				t.Errorf("expected precision %s, got %s", testCase.expectedPrecision, precision)
+			}
+		})
+	}
+}
+
+func TestSetTimestampFormat(t *testing.T) {
+	defer SetTimestampFormat(DefaultTimestampFormat)
+
+	if err := SetTimestampFormat("2006/01/02"); err == nil {
+		t.Fatalf("expected error setting unsupported format")
+	}
+	if TimestampFormat() != DefaultTimestampFormat {
+		t.Fatalf("expected unsupported format to leave format at %q, got %q", DefaultTimestampFormat, TimestampFormat())
+	}
+
+	if err := SetTimestampFormat("2006/01/02/15"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	batchTime := time.Date(2020, 10, 31, 20, 0, 0, 0, time.UTC)
+	intake := IntakeBatch{
+		AggregationID: "kittens-seen",
+		BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+		Date:          Timestamp(batchTime),
+	}
+
+	encoded, err := json.Marshal(intake)
+	if err != nil {
+		t.Fatalf("unexpected error encoding task: %s", err)
+	}
+	if !strings.Contains(string(encoded), `"2020/10/31/20"`) {
+		t.Errorf("expected timestamp with hour precision in %s", encoded)
+	}
+	var decoded IntakeBatch
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("unexpected error decoding task: %s", err)
+	}
+	if !time.Time(decoded.Date).Equal(batchTime) {
+		t.Errorf("expected decoded time %s, got %s", batchTime, time.Time(decoded.Date))
+	}
+
+	// Markers use the same format, so tasks are deduplicated by their
+	// markers as they are by their timestamps
+	marker := intake.Marker()
+	if expected := "intake-kittens-seen-2020-10-31-20-b8a5579a-f984-460a-a42d-2813cbf57771"; marker != expected {
+		t.Errorf("expected marker %q, got %q", expected, marker)
+	}
+	markerTime, err := ParseMarkerTime(marker)
+	if err != nil {
+		t.Fatalf("unexpected error parsing marker time: %s", err)
+	}
+	if !markerTime.Equal(batchTime) {
+		t.Errorf("expected marker time %s, got %s", batchTime, markerTime)
+	}
+}
+
+func TestParseMarkerTime(t *testing.T) {
+	batchTime := time.Date(2020, 10, 31, 20, 29, 0, 0, time.UTC)
+	aggregationStart := time.Date(2020, 10, 31, 16, 0, 0, 0, time.UTC)
+	aggregationEnd := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	var testCases = []struct {
+		name        string
+		marker      string
+		expected    time.Time
+		expectError bool
+	}{
+		{
+			name: "intake",
+			marker: IntakeBatch{
+				AggregationID: "kittens-seen",
+				BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+				Date:          Timestamp(batchTime),
+			}.Marker(),
+			expected: batchTime,
+		},
+		{
+			name: "intake-timestamp-in-aggregation-id",
+			marker: IntakeBatch{
+				AggregationID: "kittens-seen-1999-01-01-00-00",
+				BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+				Date:          Timestamp(batchTime),
+			}.Marker(),
+			expected: batchTime,
+		},
+		{
+			name: "aggregate",
+			marker: Aggregation{
+				AggregationID:    "kittens-seen",
+				AggregationStart: Timestamp(aggregationStart),
+				AggregationEnd:   Timestamp(aggregationEnd),
+			}.Marker(),
+			expected: aggregationEnd,
+		},
+		{
+			name:        "unknown-kind",
+			marker:      "sum-kittens-seen-2020-10-31-20-29",
+			expectError: true,
+		},
+		{
+			name:        "no-timestamp",
+			marker:      "intake-kittens-seen-b8a5579a-f984-460a-a42d-2813cbf57771",
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			parsed, err := ParseMarkerTime(testCase.marker)
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected error parsing %q, got %s", testCase.marker, parsed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !parsed.Equal(testCase.expected) {
+				t.Errorf("expected %s, got %s", testCase.expected, parsed)
+			}
+		})
+	}
+}
+
+func TestEncodeTask(t *testing.T) {
+	aggregation := Aggregation{
+		AggregationID: "kittens-seen",
+		Batches:       []Batch{{ID: "b8a5579a-f984-460a-a42d-2813cbf57771"}},
+	}
+	aggregationJSON, err := json.Marshal(aggregation)
+	if err != nil {
+		t.Fatalf("failed to marshal aggregation: %s", err)
+	}
+
+	var testCases = []struct {
+		name        string
+		task        Task
+		maxSize     int
+		expectError bool
+	}{
+		{
+			name:    "unlimited",
+			task:    aggregation,
+			maxSize: 0,
+		},
+		{
+			name:    "aggregation-fits",
+			task:    aggregation,
+			maxSize: len(aggregationJSON),
+		},
+		{
+			name:        "aggregation-too-large",
+			task:        aggregation,
+			maxSize:     len(aggregationJSON) - 1,
+			expectError: true,
+		},
+		{
+			name:        "intake-too-large",
+			task:        IntakeBatch{AggregationID: "kittens-seen", BatchID: "b8a5579a-f984-460a-a42d-2813cbf57771"},
+			maxSize:     10,
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			jsonTask, err := encodeTask(testCase.task, testCase.maxSize)
+			if testCase.expectError {
+				if !errors.Is(err, ErrTaskTooLarge) {
+					t.Errorf("expected ErrTaskTooLarge, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if testCase.maxSize != 0 && len(jsonTask) > testCase.maxSize {
+				t.Errorf("encoded task is %d bytes, exceeding %d", len(jsonTask), testCase.maxSize)
+			}
+		})
+	}
+}
+
+// fakeBatchesWriter records the batches written by WriteAggregationBatches
+type fakeBatchesWriter struct {
+	written map[string][]byte
+	err     error
+}
+
+func (w *fakeBatchesWriter) WriteAggregationBatches(marker string, batches []byte) (string, error) {
+	if w.err != nil {
+		return "", w.err
+	}
+	key := "aggregation-batches/" + marker + ".json"
+	w.written[key] = batches
+	return key, nil
+}
+
+func TestWithBatchesObject(t *testing.T) {
+	aggregationEnd := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	batches := make([]Batch, 100)
+	for i := range batches {
+		batches[i] = Batch{ID: fmt.Sprintf("b8a5579a-f984-460a-a42d-%012d", i), Time: Timestamp(aggregationEnd)}
+	}
+	aggregation := Aggregation{
+		AggregationID:    "kittens-seen",
+		AggregationStart: Timestamp(aggregationEnd.Add(-8 * time.Hour)),
+		AggregationEnd:   Timestamp(aggregationEnd),
+		Batches:          batches,
+		Version:          TaskSchemaVersion,
+	}
+	aggregationJSON, err := json.Marshal(aggregation)
+	if err != nil {
+		t.Fatalf("failed to marshal aggregation: %s", err)
+	}
+
+	var testCases = []struct {
+		name                  string
+		maxSize               int
+		version               int
+		writerErr             error
+		expectedBatchesObject string
+		expectError           bool
+	}{
+		{
+			name:    "unlimited",
+			maxSize: 0,
+		},
+		{
+			name:    "fits",
+			maxSize: len(aggregationJSON),
+		},
+		{
+			name:                  "too-large",
+			maxSize:               len(aggregationJSON) / 3,
+			expectedBatchesObject: "aggregation-batches/aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00.json",
+		},
+		{
+			name:        "write-fails",
+			maxSize:     len(aggregationJSON) / 3,
+			writerErr:   errors.New("bucket unavailable"),
+			expectError: true,
+		},
+		{
+			name:        "schema-version-without-batches-objects",
+			maxSize:     len(aggregationJSON) / 3,
+			version:     BatchesObjectSchemaVersion - 1,
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			aggregation := aggregation
+			if testCase.version != 0 {
+				aggregation.Version = testCase.version
+			}
+			writer := &fakeBatchesWriter{written: map[string][]byte{}, err: testCase.writerErr}
+			result, err := withBatchesObject(aggregation, testCase.maxSize, writer)
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected error, got %+v", result)
+				}
+				if testCase.version != 0 && (!errors.Is(err, ErrTaskTooLarge) || len(writer.written) != 0) {
+					t.Errorf("expected ErrTaskTooLarge without writing batches, got %v and %d written", err, len(writer.written))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if result.Marker() != aggregation.Marker() {
+				t.Errorf("expected marker %s, got %s", aggregation.Marker(), result.Marker())
+			}
+			if result.BatchesObject != testCase.expectedBatchesObject {
+				t.Errorf("expected batches object %q, got %q", testCase.expectedBatchesObject, result.BatchesObject)
+			}
+
+			if testCase.expectedBatchesObject == "" {
+				if len(result.Batches) != len(batches) || len(writer.written) != 0 {
+					t.Errorf("expected %d batches in the task and none written, got %d and %d", len(batches), len(result.Batches), len(writer.written))
+				}
+				return
+			}
+
+			if len(result.Batches) != 0 {
+				t.Errorf("expected no batches in the task, got %d", len(result.Batches))
+			}
+			var written []json.RawMessage
+			if err := json.Unmarshal(writer.written[testCase.expectedBatchesObject], &written); err != nil {
+				t.Fatalf("failed to unmarshal written batches: %s", err)
+			}
+			if len(written) != len(batches) {
+				t.Errorf("expected %d batches written, got %d", len(batches), len(written))
+			}
+			encoded, err := encodeTask(result, testCase.maxSize)
+			if err != nil {
+				t.Errorf("task with batches object does not fit: %s", err)
+			}
+			if strings.Contains(string(encoded), `"batches":`) {
+				t.Errorf("expected task with batches object to omit batches, got %s", encoded)
+			}
+		})
+	}
+}
+
+// fakeKafkaClient returns a Kafka client connected to a mock broker that leads
+// the single partition of the topic "existing-topic"
+func fakeKafkaClient(t *testing.T) sarama.Client {
+	t.Helper()
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("existing-topic", 0, broker.BrokerID()),
+	})
+
+	config := sarama.NewConfig()
+	config.Metadata.Retry.Max = 0
+	client, err := sarama.NewClient([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatalf("failed to create Kafka client: %s", err)
+	}
+
+	return client
+}
+
+// fakeSyncProducer records the messages sent to it, failing if err is set
+type fakeSyncProducer struct {
+	messages []*sarama.ProducerMessage
+	err      error
+	closed   bool
+}
+
+func (p *fakeSyncProducer) SendMessage(message *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, p.SendMessages([]*sarama.ProducerMessage{message})
+}
+
+func (p *fakeSyncProducer) SendMessages(messages []*sarama.ProducerMessage) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *fakeSyncProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestNewKafkaEnqueuerMaxMessageSize(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("existing-topic", 0, broker.BrokerID()),
+	})
+
+	// A maximum of 0 means no limit, which sarama's config would reject
+	for _, maxMessageSize := range []int{0, DefaultKafkaMaxMessageSize} {
+		enqueuer, err := NewKafkaEnqueuer([]string{broker.Addr()}, "existing-topic", maxMessageSize, false)
+		if err != nil {
+			t.Fatalf("unexpected error with maximum message size %d: %s", maxMessageSize, err)
+		}
+		enqueuer.Stop()
+	}
+}
+
+func TestKafkaEnqueuerEnqueue(t *testing.T) {
+	intakeTask := IntakeBatch{AggregationID: "kittens-seen", BatchID: "b8a5579a"}
+
+	var testCases = []struct {
+		name          string
+		producerErr   error
+		dryRun        bool
+		expectFailure bool
+		expectMessage bool
+	}{
+		{name: "produce-succeeds", expectMessage: true},
+		{name: "produce-fails", producerErr: fmt.Errorf("broker unavailable"), expectFailure: true},
+		{name: "dry-run", dryRun: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			producer := &fakeSyncProducer{err: testCase.producerErr}
+			enqueuer := newKafkaEnqueuerForProducer(fakeKafkaClient(t), producer, "existing-topic", DefaultKafkaMaxMessageSize, testCase.dryRun)
+
+			var completions []error
+			enqueuer.Enqueue(context.Background(), intakeTask, func(err error) {
+				completions = append(completions, err)
+			})
+			enqueuer.Stop()
+
+			if !producer.closed {
+				t.Errorf("producer not closed by Stop()")
+			}
+			if len(completions) != 1 {
+				t.Fatalf("expected completion to be called once, got %d calls: %v", len(completions), completions)
+			}
+			if testCase.expectFailure && completions[0] == nil {
+				t.Errorf("expected produce failure, got success")
+			}
+			if !testCase.expectFailure && completions[0] != nil {
+				t.Errorf("unexpected produce failure: %s", completions[0])
+			}
+
+			if !testCase.expectMessage {
+				if len(producer.messages) != 0 {
+					t.Errorf("unexpected messages produced: %v", producer.messages)
+				}
+				return
+			}
+			if len(producer.messages) != 1 {
+				t.Fatalf("expected one message, got %v", producer.messages)
+			}
+			message := producer.messages[0]
+			if message.Topic != "existing-topic" {
+				t.Errorf("expected topic existing-topic, got %s", message.Topic)
+			}
+			if key, _ := message.Key.Encode(); string(key) != "kittens-seen" {
+				t.Errorf("expected key kittens-seen, got %q", key)
+			}
+			expectedValue, _ := json.Marshal(intakeTask)
+			if value, _ := message.Value.Encode(); string(value) != string(expectedValue) {
+				t.Errorf("expected value %s, got %s", expectedValue, value)
+			}
+		})
+	}
+}
+
+func TestKafkaEnqueuerPing(t *testing.T) {
+	client := fakeKafkaClient(t)
+	defer client.Close()
+
+	if err := newKafkaEnqueuerForProducer(client, &fakeSyncProducer{}, "existing-topic", DefaultKafkaMaxMessageSize, false).Ping(context.Background()); err != nil {
+		t.Errorf("unexpected error pinging existing topic: %s", err)
+	}
+	if err := newKafkaEnqueuerForProducer(client, &fakeSyncProducer{}, "nonexistent-topic", DefaultKafkaMaxMessageSize, false).Ping(context.Background()); err == nil {
+		t.Errorf("expected error pinging nonexistent topic")
+	}
+}
+
+func TestRedisStreamsEnqueuerEnqueue(t *testing.T) {
+	intakeTask := IntakeBatch{AggregationID: "kittens-seen", BatchID: "b8a5579a", IsFirst: true}
+	expectedJSON, _ := json.Marshal(intakeTask)
+
+	var testCases = []struct {
+		name            string
+		config          RedisStreamsConfig
+		dryRun          bool
+		tasks           int
+		expectFailure   bool
+		expectedEntries int
+	}{
+		{name: "add-succeeds", tasks: 1, expectedEntries: 1},
+		{name: "authenticated", config: RedisStreamsConfig{Password: "hunter2"}, tasks: 1, expectedEntries: 1},
+		{name: "wrong-password", config: RedisStreamsConfig{Password: "hunter3"}, tasks: 1, expectFailure: true},
+		{name: "trimmed", config: RedisStreamsConfig{MaxLen: 2}, tasks: 5, expectedEntries: 2},
+		{name: "dry-run", dryRun: true, tasks: 1},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			if err != nil {
+				t.Fatalf("failed to start Redis server: %s", err)
+			}
+			defer server.Close()
+			if testCase.config.Password != "" {
+				server.RequireAuth("hunter2")
+			}
+
+			enqueuer := NewRedisStreamsEnqueuer(server.Addr(), "intake-tasks", testCase.config, testCase.dryRun)
+			var completions []error
+			for i := 0; i < testCase.tasks; i++ {
+				enqueuer.Enqueue(context.Background(), intakeTask, func(err error) {
+					completions = append(completions, err)
+				})
+			}
+			enqueuer.Stop()
+
+			if len(completions) != testCase.tasks {
+				t.Fatalf("expected completion to be called %d times, got %d calls: %v", testCase.tasks, len(completions), completions)
+			}
+			for _, completion := range completions {
+				if testCase.expectFailure && completion == nil {
+					t.Errorf("expected failure adding task, got success")
+				}
+				if !testCase.expectFailure && completion != nil {
+					t.Errorf("unexpected failure adding task: %s", completion)
+				}
+			}
+
+			entries, _ := server.Stream("intake-tasks")
+			if len(entries) != testCase.expectedEntries {
+				t.Fatalf("expected %d stream entries, got %v", testCase.expectedEntries, entries)
+			}
+			expectedValues := []string{
+				"aggregation_id", "kittens-seen",
+				"is_first", "true",
+				"task_type", "intake",
+				"task", string(expectedJSON),
+			}
+			for _, entry := range entries {
+				if !reflect.DeepEqual(entry.Values, expectedValues) {
+					t.Errorf("expected stream entry values %q, got %q", expectedValues, entry.Values)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisStreamsEnqueuerPing(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start Redis server: %s", err)
+	}
+	server.RequireUserAuth("facilitator", "hunter2")
+
+	enqueuer := NewRedisStreamsEnqueuer(server.Addr(), "intake-tasks", RedisStreamsConfig{Username: "facilitator", Password: "hunter2"}, false)
+	defer enqueuer.Stop()
+	if err := enqueuer.Ping(context.Background()); err != nil {
+		t.Errorf("unexpected error pinging Redis: %s", err)
+	}
+
+	wrongPasswordEnqueuer := NewRedisStreamsEnqueuer(server.Addr(), "intake-tasks", RedisStreamsConfig{Username: "facilitator", Password: "hunter3"}, false)
+	defer wrongPasswordEnqueuer.Stop()
+	if err := wrongPasswordEnqueuer.Ping(context.Background()); err == nil {
+		t.Errorf("expected error pinging Redis with the wrong password")
+	}
+
+	server.Close()
+	if err := enqueuer.Ping(context.Background()); err == nil {
+		t.Errorf("expected error pinging stopped Redis server")
+	}
+}
+
+func TestMemoryEnqueuer(t *testing.T) {
+	enqueuer := NewMemoryEnqueuer()
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			enqueuer.Enqueue(context.Background(), IntakeBatch{BatchID: fmt.Sprint(i)}, func(err error) {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			})
+		}(i)
+	}
+	waitGroup.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var canceledErr error
+	enqueuer.Enqueue(ctx, IntakeBatch{BatchID: "canceled"}, func(err error) { canceledErr = err })
+	if canceledErr == nil {
+		t.Errorf("expected error enqueuing with canceled context")
+	}
+	enqueuer.Stop()
+
+	tasks := enqueuer.Tasks()
+	if len(tasks) != 10 {
+		t.Fatalf("expected 10 tasks, got %v", tasks)
+	}
+	batchIDs := map[string]bool{}
+	for _, task := range tasks {
+		batchIDs[task.(IntakeBatch).BatchID] = true
+	}
+	if len(batchIDs) != 10 || batchIDs["canceled"] {
+		t.Errorf("unexpected tasks %v", tasks)
+	}
+}
+
+func TestClassifyEnqueueError(t *testing.T) {
+	_, tooLargeErr := encodeTask(IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch"}, 10)
+
+	var testCases = []struct {
+		name          string
+		err           error
+		expectedClass string
+	}{
+		{
+			name:          "encoded-task-too-large",
+			err:           tooLargeErr,
+			expectedClass: EnqueueErrorMessageTooLarge,
+		},
+		{
+			name:          "pubsub-oversized-message",
+			err:           fmt.Errorf("Failed to publish task: %w", pubsub.ErrOversizedMessage),
+			expectedClass: EnqueueErrorMessageTooLarge,
+		},
+		{
+			name:          "grpc-payload-too-large",
+			err:           fmt.Errorf("Failed to publish task: %w", status.Error(codes.InvalidArgument, "Request payload size exceeds the limit: 10485760 bytes.")),
+			expectedClass: EnqueueErrorMessageTooLarge,
+		},
+		{
+			name:          "grpc-invalid-argument",
+			err:           status.Error(codes.InvalidArgument, "Invalid resource name"),
+			expectedClass: EnqueueErrorOther,
+		},
+		{
+			name:          "grpc-resource-exhausted",
+			err:           fmt.Errorf("Failed to publish task: %w", status.Error(codes.ResourceExhausted, "quota exceeded")),
+			expectedClass: EnqueueErrorThrottled,
+		},
+		{
+			name:          "grpc-permission-denied",
+			err:           fmt.Errorf("failed to create task: %w", status.Error(codes.PermissionDenied, "")),
+			expectedClass: EnqueueErrorAuth,
+		},
+		{
+			name:          "grpc-unauthenticated",
+			err:           status.Error(codes.Unauthenticated, ""),
+			expectedClass: EnqueueErrorAuth,
+		},
+		{
+			name:          "grpc-deadline-exceeded",
+			err:           status.Error(codes.DeadlineExceeded, ""),
+			expectedClass: EnqueueErrorTimeout,
+		},
+		{
+			name:          "grpc-unavailable",
+			err:           status.Error(codes.Unavailable, ""),
+			expectedClass: EnqueueErrorOther,
+		},
+		{
+			name:          "aws-throttled",
+			err:           fmt.Errorf("failed to publish task: %w", awserr.New("Throttled", "Rate exceeded", nil)),
+			expectedClass: EnqueueErrorThrottled,
+		},
+		{
+			name:          "aws-throttling-exception",
+			err:           awserr.NewRequestFailure(awserr.New("ThrottlingException", "", nil), 400, "request-id"),
+			expectedClass: EnqueueErrorThrottled,
+		},
+		{
+			name:          "aws-too-many-requests",
+			err:           awserr.NewRequestFailure(awserr.New("SomethingElse", "", nil), 429, "request-id"),
+			expectedClass: EnqueueErrorThrottled,
+		},
+		{
+			name:          "aws-authorization-error",
+			err:           fmt.Errorf("failed to publish task: %w", awserr.New("AuthorizationError", "not authorized to perform SNS:Publish", nil)),
+			expectedClass: EnqueueErrorAuth,
+		},
+		{
+			name:          "aws-expired-token",
+			err:           awserr.NewRequestFailure(awserr.New("ExpiredToken", "", nil), 400, "request-id"),
+			expectedClass: EnqueueErrorAuth,
+		},
+		{
+			name:          "aws-forbidden",
+			err:           awserr.NewRequestFailure(awserr.New("SomethingElse", "", nil), 403, "request-id"),
+			expectedClass: EnqueueErrorAuth,
+		},
+		{
+			name:          "aws-message-too-long",
+			err:           awserr.NewRequestFailure(awserr.New("InvalidParameter", "Invalid parameter: Message too long", nil), 400, "request-id"),
+			expectedClass: EnqueueErrorMessageTooLarge,
+		},
+		{
+			name:          "aws-invalid-parameter",
+			err:           awserr.NewRequestFailure(awserr.New("InvalidParameter", "Invalid parameter: TopicArn", nil), 400, "request-id"),
+			expectedClass: EnqueueErrorOther,
+		},
+		{
+			name:          "aws-internal-error",
+			err:           awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, "request-id"),
+			expectedClass: EnqueueErrorOther,
+		},
+		{
+			name:          "kafka-message-too-large",
+			err:           fmt.Errorf("failed to produce task: %w", sarama.ProducerErrors{&sarama.ProducerError{Err: sarama.ErrMessageSizeTooLarge}}),
+			expectedClass: EnqueueErrorMessageTooLarge,
+		},
+		{
+			name:          "kafka-topic-authorization-failed",
+			err:           fmt.Errorf("failed to produce task: %w", sarama.ProducerErrors{&sarama.ProducerError{Err: sarama.ErrTopicAuthorizationFailed}}),
+			expectedClass: EnqueueErrorAuth,
+		},
+		{
+			name:          "kafka-other",
+			err:           fmt.Errorf("failed to produce task: %w", sarama.ErrNotLeaderForPartition),
+			expectedClass: EnqueueErrorOther,
+		},
+		{
+			name:          "context-deadline-exceeded",
+			err:           fmt.Errorf("failed to add task: %w", context.DeadlineExceeded),
+			expectedClass: EnqueueErrorTimeout,
+		},
+		{
+			name:          "unrecognized",
+			err:           fmt.Errorf("connection refused"),
+			expectedClass: EnqueueErrorOther,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if class := ClassifyEnqueueError(testCase.err); class != testCase.expectedClass {
+				t.Errorf("expected class %q for %q, got %q", testCase.expectedClass, testCase.err, class)
+			}
+		})
+	}
+}
+
+func TestClassifyRedisEnqueueError(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start Redis server: %s", err)
+	}
+	defer server.Close()
+	server.RequireUserAuth("facilitator", "hunter2")
+
+	enqueuer := NewRedisStreamsEnqueuer(server.Addr(), "intake-tasks", RedisStreamsConfig{Username: "facilitator", Password: "hunter3"}, false)
+	defer enqueuer.Stop()
+	var enqueueErr error
+	enqueuer.Enqueue(context.Background(), IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch"}, func(err error) { enqueueErr = err })
+	if enqueueErr == nil {
+		t.Fatalf("expected error enqueuing with the wrong password")
+	}
+	if class := ClassifyEnqueueError(enqueueErr); class != EnqueueErrorAuth {
+		t.Errorf("expected class %q for %q, got %q", EnqueueErrorAuth, enqueueErr, class)
+	}
+}
+
+func TestNewEnqueuer(t *testing.T) {
+	var testCases = []struct {
+		name          string
+		kind          string
+		config        EnqueuerConfig
+		expectedError string
+		expectedType  Enqueuer
+	}{
+		{name: "memory", kind: "memory", expectedType: &MemoryEnqueuer{}},
+		{
+			name:         "redis",
+			kind:         "redis",
+			config:       EnqueuerConfig{Topic: "intake-tasks", RedisAddr: "localhost:6379"},
+			expectedType: &RedisStreamsEnqueuer{},
+		},
+		{
+			name:         "aws-sns",
+			kind:         "aws-sns",
+			config:       EnqueuerConfig{Topic: "arn:aws:sns:us-west-2:123456789012:intake-tasks", AWSSNSRegion: "us-west-2"},
+			expectedType: &AWSSNSEnqueuer{},
+		},
+		{name: "unknown-kind", kind: "carrier-pigeon", expectedError: `unknown task queue kind "carrier-pigeon"`},
+		{
+			name:          "no-topic",
+			kind:          "redis",
+			config:        EnqueuerConfig{RedisAddr: "localhost:6379"},
+			expectedError: "Topic required for task queue kind redis",
+		},
+		{
+			name:          "gcp-pubsub-no-project",
+			kind:          "gcp-pubsub",
+			config:        EnqueuerConfig{Topic: "intake-tasks"},
+			expectedError: "GCPProjectID required for task queue kind gcp-pubsub",
+		},
+		{
+			name:          "gcp-cloudtasks-no-location-or-url",
+			kind:          "gcp-cloudtasks",
+			config:        EnqueuerConfig{Topic: "intake-tasks", GCPProjectID: "prio"},
+			expectedError: "GCPCloudTasksLocation, GCPCloudTasksTargetURL required for task queue kind gcp-cloudtasks",
+		},
+		{
+			name: "gcp-cloudtasks-negative-delay",
+			kind: "gcp-cloudtasks",
+			config: EnqueuerConfig{
+				Topic:                  "intake-tasks",
+				GCPProjectID:           "prio",
+				GCPCloudTasksLocation:  "us-west2",
+				GCPCloudTasksTargetURL: "https://facilitator.example.com",
+				GCPCloudTasksDelay:     -time.Minute,
+			},
+			expectedError: "GCPCloudTasksDelay must not be negative",
+		},
+		{
+			name:          "aws-sns-no-topic",
+			kind:          "aws-sns",
+			config:        EnqueuerConfig{},
+			expectedError: "Topic required for task queue kind aws-sns",
+		},
+		{
+			name:          "kafka-no-brokers",
+			kind:          "kafka",
+			config:        EnqueuerConfig{Topic: "intake-tasks"},
+			expectedError: "KafkaBrokers required for task queue kind kafka",
+		},
+		{
+			name:          "kafka-empty-broker",
+			kind:          "kafka",
+			config:        EnqueuerConfig{Topic: "intake-tasks", KafkaBrokers: []string{"localhost:9092", ""}},
+			expectedError: "KafkaBrokers must not contain empty addresses",
+		},
+		{
+			name:          "redis-no-addr",
+			kind:          "redis",
+			config:        EnqueuerConfig{Topic: "intake-tasks"},
+			expectedError: "RedisAddr required for task queue kind redis",
+		},
+		{
+			name:          "redis-negative-max-len",
+			kind:          "redis",
+			config:        EnqueuerConfig{Topic: "intake-tasks", RedisAddr: "localhost:6379", Redis: RedisStreamsConfig{MaxLen: -1}},
+			expectedError: "Redis.MaxLen must not be negative",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			enqueuer, err := NewEnqueuer(testCase.kind, testCase.config)
+			if testCase.expectedError != "" {
+				if err == nil || err.Error() != testCase.expectedError {
+					t.Errorf("expected error %q, got %v", testCase.expectedError, err)
+				}
+				if enqueuer != nil {
+					t.Errorf("expected no enqueuer alongside error, got %T", enqueuer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer enqueuer.Stop()
+			if reflect.TypeOf(enqueuer) != reflect.TypeOf(testCase.expectedType) {
+				t.Errorf("expected %T, got %T", testCase.expectedType, enqueuer)
+			}
+		})
+	}
+}
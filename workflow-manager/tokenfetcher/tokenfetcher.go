@@ -3,10 +3,10 @@ package tokenfetcher
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	log "github.com/sirupsen/logrus"
 )
 
 type TokenFetcher struct {
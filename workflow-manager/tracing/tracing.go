@@ -0,0 +1,74 @@
+// Package tracing contains utilities related to OpenTelemetry tracing
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/utils"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"google.golang.org/grpc/credentials"
+)
+
+const instrumentationName = "github.com/letsencrypt/prio-server/workflow-manager"
+
+// Init configures the global tracer provider to export spans over OTLP to the
+// collector at endpoint. If endpoint is empty, the global tracer provider is
+// left as the default no-op provider. The returned function flushes any
+// buffered spans and shuts down the exporter, and should be called before the
+// program exits.
+func Init(endpoint string, insecure bool) (func(), error) {
+	if endpoint == "" {
+		return func() {}, nil
+	}
+
+	options := []otlp.ExporterOption{otlp.WithAddress(endpoint)}
+	if insecure {
+		options = append(options, otlp.WithInsecure())
+	} else {
+		options = append(options, otlp.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")))
+	}
+
+	exporter, err := otlp.NewExporter(options...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+
+	processor := sdktrace.NewBatchSpanProcessor(exporter)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithResource(resource.New(semconv.ServiceNameKey.String("workflow-manager"))),
+		sdktrace.WithSpanProcessor(processor),
+	)
+	global.SetTracerProvider(provider)
+
+	return func() {
+		processor.Shutdown()
+		ctx, cancel := utils.ContextWithTimeout()
+		defer cancel()
+		if err := exporter.Shutdown(ctx); err != nil {
+			log.Printf("failed to shut down OTLP exporter: %s", err)
+		}
+	}, nil
+}
+
+// Tracer returns the Tracer that workflow-manager should use to create spans
+func Tracer() trace.Tracer {
+	return global.Tracer(instrumentationName)
+}
+
+// EndWithError records err, if it is not nil, on span and then ends it
+func EndWithError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(context.Background(), err, trace.WithErrorStatus(codes.Error))
+	}
+	span.End()
+}
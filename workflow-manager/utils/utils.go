@@ -14,8 +14,55 @@ func Index(isFirst bool) int {
 	return 1
 }
 
+// DefaultOperationTimeout is the default value of OperationTimeout
+const DefaultOperationTimeout = 30 * time.Second
+
+// OperationTimeout is how long a single network operation, such as publishing
+// a task or listing a page of a bucket, may take before it times out. It
+// should only be changed at startup, before any operation begins.
+var OperationTimeout = DefaultOperationTimeout
+
+// ContextWithTimeout returns a context that will time out after
+// OperationTimeout.
 func ContextWithTimeout() (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), 30*time.Second)
+	return ContextWithTimeoutFrom(context.Background())
+}
+
+// ContextWithTimeoutFrom returns a context derived from parent that will time
+// out after OperationTimeout, or when parent is canceled, whichever comes
+// first.
+func ContextWithTimeoutFrom(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, OperationTimeout)
+}
+
+// ContextWithTimeoutDetachedFrom returns a context that carries parent's
+// values, such as its tracing span, and will time out after OperationTimeout,
+// but isn't canceled when parent is. It is for operations that must be
+// allowed to finish once started, even if the process is shutting down.
+func ContextWithTimeoutDetachedFrom(parent context.Context) (context.Context, context.CancelFunc) {
+	return ContextWithTimeoutFrom(detachedContext{parent: parent})
+}
+
+// detachedContext carries the values of parent, but none of its deadline or
+// cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
 }
 
 // Clock allows mocking of time for testing purposes
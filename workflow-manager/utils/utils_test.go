@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestContextWithTimeout(t *testing.T) {
+	defer func(previous time.Duration) { OperationTimeout = previous }(OperationTimeout)
+
+	var testCases = []struct {
+		name             string
+		operationTimeout time.Duration
+		newContext       func() (context.Context, context.CancelFunc)
+		expectedTimeout  time.Duration
+	}{
+		{
+			name:             "default",
+			operationTimeout: DefaultOperationTimeout,
+			newContext:       ContextWithTimeout,
+			expectedTimeout:  DefaultOperationTimeout,
+		},
+		{
+			name:             "configured",
+			operationTimeout: 5 * time.Minute,
+			newContext:       ContextWithTimeout,
+			expectedTimeout:  5 * time.Minute,
+		},
+		{
+			name:             "from-parent",
+			operationTimeout: 5 * time.Minute,
+			newContext: func() (context.Context, context.CancelFunc) {
+				return ContextWithTimeoutFrom(context.Background())
+			},
+			expectedTimeout: 5 * time.Minute,
+		},
+		{
+			name:             "parent-deadline-sooner",
+			operationTimeout: 5 * time.Minute,
+			newContext: func() (context.Context, context.CancelFunc) {
+				parent, cancel := context.WithTimeout(context.Background(), time.Minute)
+				ctx, _ := ContextWithTimeoutFrom(parent)
+				return ctx, cancel
+			},
+			expectedTimeout: time.Minute,
+		},
+		{
+			name:             "detached-from-parent",
+			operationTimeout: 5 * time.Minute,
+			newContext: func() (context.Context, context.CancelFunc) {
+				parent, cancel := context.WithTimeout(context.Background(), time.Minute)
+				ctx, _ := ContextWithTimeoutDetachedFrom(parent)
+				return ctx, cancel
+			},
+			expectedTimeout: 5 * time.Minute,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			OperationTimeout = testCase.operationTimeout
+
+			start := time.Now()
+			ctx, cancel := testCase.newContext()
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				t.Fatalf("expected context to have a deadline")
+			}
+			// Allow for the time taken to create the context
+			if timeout := deadline.Sub(start); timeout < testCase.expectedTimeout || timeout > testCase.expectedTimeout+time.Second {
+				t.Errorf("expected deadline %s from now, got %s", testCase.expectedTimeout, timeout)
+			}
+		})
+	}
+}
+
+func TestContextWithTimeoutDetachedFrom(t *testing.T) {
+	type key struct{}
+	parent, cancelParent := context.WithCancel(context.WithValue(context.Background(), key{}, "kittens"))
+	ctx, cancel := ContextWithTimeoutDetachedFrom(parent)
+	defer cancel()
+
+	cancelParent()
+	if err := ctx.Err(); err != nil {
+		t.Errorf("expected context to survive cancellation of its parent, got %s", err)
+	}
+	if value := ctx.Value(key{}); value != "kittens" {
+		t.Errorf("expected value %q from parent, got %v", "kittens", value)
+	}
+
+	cancel()
+	if err := ctx.Err(); err != context.Canceled {
+		t.Errorf("expected context to be canceled, got %v", err)
+	}
+}